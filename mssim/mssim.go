@@ -4,19 +4,34 @@ package mssim
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 )
 
 const RCSuccess uint32 = 0
 
+// maxBufferSize limits the size of a TPM command or of hash data in a frame, it is the maximum command size of swtpm2
+const maxBufferSize = 4096
+
 type Command uint32
 
 const (
-	TpmSignalPowerOn  Command = 1
-	TpmSignalPowerOff Command = 2
-	TpmSendCommand    Command = 8
-	TpmSignalNVOn     Command = 11
-	TpmSessionEnd     Command = 20
+	TpmSignalPowerOn     Command = 1
+	TpmSignalPowerOff    Command = 2
+	TpmSignalPhysPresOn  Command = 3
+	TpmSignalPhysPresOff Command = 4
+	TpmSignalHashStart   Command = 5
+	TpmSignalHashData    Command = 6
+	TpmSignalHashEnd     Command = 7
+	TpmSendCommand       Command = 8
+	TpmSignalCancelOn    Command = 9
+	TpmSignalCancelOff   Command = 10
+	TpmSignalNVOn        Command = 11
+	TpmSignalNVOff       Command = 12
+	TpmRemoteHandshake   Command = 15
+	TpmSignalReset       Command = 17
+	TpmSessionEnd        Command = 20
+	TpmStop              Command = 21
 )
 
 // Command represents a single MSSIM command
@@ -24,34 +39,56 @@ type Request struct {
 	Command         Command
 	Locality        uint8
 	InternalCommand []byte
+	// HashData is the data of TPM_SIGNAL_HASH_DATA
+	HashData []byte
 }
 
 // ParseRequest reads and unmarshalls MSSIM command
 func ParseRequest(r io.Reader) (*Request, error) {
 	var command Command
-	var locality uint8
-	var commandSize uint32
-
 	if err := binary.Read(r, binary.BigEndian, &command); err != nil {
 		return nil, err
 	}
-	if err := binary.Read(r, binary.BigEndian, &locality); err != nil {
-		return nil, err
+
+	request := &Request{Command: command}
+	switch command {
+	case TpmSendCommand:
+		if err := binary.Read(r, binary.BigEndian, &request.Locality); err != nil {
+			return nil, err
+		}
+		internalCommand, err := readBuffer(r)
+		if err != nil {
+			return nil, err
+		}
+		request.InternalCommand = internalCommand
+	case TpmSignalHashData:
+		hashData, err := readBuffer(r)
+		if err != nil {
+			return nil, err
+		}
+		request.HashData = hashData
+	case TpmSignalHashStart, TpmSignalHashEnd, TpmSessionEnd:
+		// no payload
+	default:
+		return nil, fmt.Errorf("unsupported command: %d", command)
 	}
-	if err := binary.Read(r, binary.BigEndian, &commandSize); err != nil {
+	return request, nil
+}
+
+// readBuffer reads a buffer prefixed with its uint32 size, the size is checked before the buffer is allocated
+func readBuffer(r io.Reader) ([]byte, error) {
+	var size uint32
+	if err := binary.Read(r, binary.BigEndian, &size); err != nil {
 		return nil, err
 	}
-
-	internalCommand := make([]byte, commandSize)
-	if _, err := io.ReadFull(r, internalCommand); err != nil {
+	if size > maxBufferSize {
+		return nil, fmt.Errorf("buffer size %d exceeds %d", size, maxBufferSize)
+	}
+	buf := make([]byte, size)
+	if _, err := io.ReadFull(r, buf); err != nil {
 		return nil, err
 	}
-
-	return &Request{
-		Command:         command,
-		Locality:        locality,
-		InternalCommand: internalCommand,
-	}, nil
+	return buf, nil
 }
 
 // CreateResponse creates a MSSIM response frame for specified result code and response body
@@ -3,6 +3,7 @@ package mssim_test
 import (
 	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"net"
 	"sync"
@@ -22,10 +23,38 @@ type mockedCommands struct {
 	readPublic func(handle tpmutil.Handle) (*swtpm2.ReadPublicResponse, error)
 }
 
+func (m *mockedCommands) BeginCommand(cmd *swtpm2.CommandContext) error {
+	return nil
+}
+
+func (m *mockedCommands) EndCommand(cmd *swtpm2.CommandContext, responseParameters []byte) ([]swtpm2.AuthResponse, error) {
+	return nil, nil
+}
+
 func (m *mockedCommands) ReadPublic(handle tpmutil.Handle) (*swtpm2.ReadPublicResponse, error) {
 	return m.readPublic(handle)
 }
 
+type mockedPlatform struct {
+	signals []string
+}
+
+func (m *mockedPlatform) PowerOn()  { m.signals = append(m.signals, "power on") }
+func (m *mockedPlatform) PowerOff() { m.signals = append(m.signals, "power off") }
+func (m *mockedPlatform) Init()     { m.signals = append(m.signals, "init") }
+
+func (m *mockedPlatform) SetNVAvailable(available bool) {
+	m.signals = append(m.signals, fmt.Sprintf("nv %v", available))
+}
+
+func (m *mockedPlatform) SetPhysicalPresence(asserted bool) {
+	m.signals = append(m.signals, fmt.Sprintf("pp %v", asserted))
+}
+
+func (m *mockedPlatform) SetCancel(canceled bool) {
+	m.signals = append(m.signals, fmt.Sprintf("cancel %v", canceled))
+}
+
 func TestMSSIM(t *testing.T) {
 	port, err := transport.GetFreePort()
 	require.NoError(t, err)
@@ -70,6 +99,8 @@ func TestMSSIM(t *testing.T) {
 		},
 	}
 
+	platform := &mockedPlatform{}
+
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -81,10 +112,10 @@ func TestMSSIM(t *testing.T) {
 	go func() {
 		defer wg.Done()
 
-		dummyProcessor := func(c net.Conn) error {
-			return mssim.DummyPlatformProcessor(c, nil)
+		platformProcessor := func(c net.Conn) error {
+			return mssim.PlatformProcessor(c, platform, nil)
 		}
-		loop := transport.NewConnectionProcessingLoop(dummyProcessor)
+		loop := transport.NewConnectionProcessingLoop(platformProcessor)
 		platformServeTCPError = transport.ServeTCP(ctx, platformPort, func(c net.Conn) {
 			loop(c)
 		}, nil)
@@ -125,9 +156,101 @@ func TestMSSIM(t *testing.T) {
 	require.NotNil(t, request)
 
 	require.Equal(t, mssim.TpmSendCommand, request.Command)
+	require.Equal(t, []string{"power off", "power on", "nv true"}, platform.signals)
 
 	require.Equal(t, usedHandle, actualHandle)
 	require.Equal(t, expectedResponse.Public, public)
 	require.Equal(t, expectedResponse.Name, name)
 	require.Equal(t, expectedResponse.QualifiedName, qualifiedName)
 }
+
+func TestPlatformProcessor(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	platform := &mockedPlatform{}
+	errs := make(chan error)
+	go func() {
+		defer server.Close()
+		for {
+			err := mssim.PlatformProcessor(server, platform, nil)
+			if err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+
+	signal := func(command mssim.Command) {
+		require.NoError(t, binary.Write(client, binary.BigEndian, command))
+		var rc uint32
+		require.NoError(t, binary.Read(client, binary.BigEndian, &rc))
+		require.Equal(t, mssim.RCSuccess, rc)
+	}
+
+	for _, command := range []mssim.Command{
+		mssim.TpmSignalPowerOn,
+		mssim.TpmSignalNVOff,
+		mssim.TpmSignalNVOn,
+		mssim.TpmSignalPhysPresOn,
+		mssim.TpmSignalPhysPresOff,
+		mssim.TpmSignalCancelOn,
+		mssim.TpmSignalCancelOff,
+		mssim.TpmSignalReset,
+		mssim.TpmSignalPowerOff,
+	} {
+		signal(command)
+	}
+	require.Equal(t, []string{
+		"power on",
+		"nv false",
+		"nv true",
+		"pp true",
+		"pp false",
+		"cancel true",
+		"cancel false",
+		"init",
+		"power off",
+	}, platform.signals)
+
+	// the handshake reports the server version and the end point information
+	require.NoError(t, binary.Write(client, binary.BigEndian, []uint32{uint32(mssim.TpmRemoteHandshake), 1}))
+	handshake := make([]uint32, 3)
+	require.NoError(t, binary.Read(client, binary.BigEndian, handshake))
+	require.Equal(t, []uint32{1, 0x09, mssim.RCSuccess}, handshake)
+
+	require.NoError(t, binary.Write(client, binary.BigEndian, mssim.TpmStop))
+	require.ErrorIs(t, <-errs, mssim.ErrStop)
+}
+
+func TestParseRequest(t *testing.T) {
+	var buf bytes.Buffer
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, mssim.TpmSendCommand))
+	buf.Write([]byte{3, 0, 0, 0, 2, 0xAA, 0xBB})
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, mssim.TpmSignalHashStart))
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, mssim.TpmSignalHashData))
+	buf.Write([]byte{0, 0, 0, 3, 0x01, 0x02, 0x03})
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, mssim.TpmSignalHashEnd))
+
+	expected := []*mssim.Request{
+		{Command: mssim.TpmSendCommand, Locality: 3, InternalCommand: []byte{0xAA, 0xBB}},
+		{Command: mssim.TpmSignalHashStart},
+		{Command: mssim.TpmSignalHashData, HashData: []byte{0x01, 0x02, 0x03}},
+		{Command: mssim.TpmSignalHashEnd},
+	}
+	for _, e := range expected {
+		request, err := mssim.ParseRequest(&buf)
+		require.NoError(t, err)
+		require.Equal(t, e, request)
+	}
+
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, mssim.TpmSignalPowerOn))
+	_, err := mssim.ParseRequest(&buf)
+	require.Error(t, err)
+	// the size of a buffer is limited before it is read
+	buf.Reset()
+	require.NoError(t, binary.Write(&buf, binary.BigEndian, mssim.TpmSignalHashData))
+	buf.Write([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	_, err = mssim.ParseRequest(&buf)
+	require.Error(t, err)
+}
@@ -2,26 +2,97 @@ package mssim
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
-	"net"
+	"io"
 
 	"github.com/rihter007/logruswrap"
 )
 
-var successCode uint32
+// Versions reported by TPM_REMOTE_HANDSHAKE
+const (
+	serverVersion uint32 = 1
+	// tpmPlatformAvailable and tpmSupportsPP are bits of the TPM end point information
+	tpmPlatformAvailable uint32 = 0x01
+	tpmSupportsPP        uint32 = 0x08
+)
+
+// ErrSessionEnd is returned when the client closes the session with TPM_SESSION_END
+var ErrSessionEnd = errors.New("session ended by the client")
 
-// DummyPlatformProcessor reads platform command and responds with success status code
-func DummyPlatformProcessor(c net.Conn, l logruswrap.PrintfLogger) error {
+// ErrStop is returned when the client requests to stop the simulator with TPM_STOP
+var ErrStop = errors.New("simulator stopped by the client")
+
+// Platform is a device that is controlled via the platform channel
+type Platform interface {
+	// PowerOn is invoked on TPM_SIGNAL_POWER_ON, it is followed by _TPM_Init
+	PowerOn()
+	// PowerOff is invoked on TPM_SIGNAL_POWER_OFF
+	PowerOff()
+	// Init is invoked on TPM_SIGNAL_RESET, it performs _TPM_Init without a power cycle
+	Init()
+	// SetNVAvailable is invoked on TPM_SIGNAL_NV_ON and TPM_SIGNAL_NV_OFF
+	SetNVAvailable(available bool)
+	// SetPhysicalPresence is invoked on TPM_SIGNAL_PHYS_PRES_ON and TPM_SIGNAL_PHYS_PRES_OFF
+	SetPhysicalPresence(asserted bool)
+	// SetCancel is invoked on TPM_SIGNAL_CANCEL_ON and TPM_SIGNAL_CANCEL_OFF
+	SetCancel(canceled bool)
+}
+
+// PlatformProcessor reads a single platform command, applies it to the platform and responds with a status code
+// ErrSessionEnd and ErrStop are returned when the connection should not be used anymore
+func PlatformProcessor(rw io.ReadWriter, platform Platform, l logruswrap.PrintfLogger) error {
 	var command Command
-	if err := binary.Read(c, binary.BigEndian, &command); err != nil {
+	if err := binary.Read(rw, binary.BigEndian, &command); err != nil {
 		return fmt.Errorf("failed to read command, err: %v", err)
 	}
 
 	log := logruswrap.WrapPrintfLogger(l)
-	log.Infof("obtained command: %d", command)
+	log.Infof("obtained platform command: %d", command)
+
+	switch command {
+	case TpmSignalPowerOn:
+		platform.PowerOn()
+	case TpmSignalPowerOff:
+		platform.PowerOff()
+	case TpmSignalReset:
+		platform.Init()
+	case TpmSignalNVOn, TpmSignalNVOff:
+		platform.SetNVAvailable(command == TpmSignalNVOn)
+	case TpmSignalPhysPresOn, TpmSignalPhysPresOff:
+		platform.SetPhysicalPresence(command == TpmSignalPhysPresOn)
+	case TpmSignalCancelOn, TpmSignalCancelOff:
+		platform.SetCancel(command == TpmSignalCancelOn)
+	case TpmRemoteHandshake:
+		if err := remoteHandshake(rw); err != nil {
+			return err
+		}
+	case TpmSessionEnd:
+		// the client closes the connection without waiting for a response
+		return ErrSessionEnd
+	case TpmStop:
+		return ErrStop
+	default:
+		return fmt.Errorf("unsupported platform command: %d", command)
+	}
 
-	if err := binary.Write(c, binary.BigEndian, successCode); err != nil {
+	if err := binary.Write(rw, binary.BigEndian, RCSuccess); err != nil {
 		return fmt.Errorf("failed to write response code, err: %v", err)
 	}
 	return nil
 }
+
+// remoteHandshake reads the client version and reports the server version and capabilities
+func remoteHandshake(rw io.ReadWriter) error {
+	var clientVersion uint32
+	if err := binary.Read(rw, binary.BigEndian, &clientVersion); err != nil {
+		return fmt.Errorf("failed to read client version, err: %v", err)
+	}
+	if clientVersion == 0 {
+		return fmt.Errorf("unsupported client version: %d", clientVersion)
+	}
+	if err := binary.Write(rw, binary.BigEndian, []uint32{serverVersion, tpmPlatformAvailable | tpmSupportsPP}); err != nil {
+		return fmt.Errorf("failed to write server version, err: %v", err)
+	}
+	return nil
+}
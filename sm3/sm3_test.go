@@ -0,0 +1,37 @@
+package sm3_test
+
+import (
+	"bytes"
+	"encoding/hex"
+	"testing"
+
+	"github.com/rihter007/go-swtpm/sm3"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSum(t *testing.T) {
+	for _, tc := range []struct {
+		input    []byte
+		expected string
+	}{
+		{
+			input:    []byte("abc"),
+			expected: "66c7f0f462eeedd9d1f2d46bdc10e4e24167c4875cf2f7a2297da02b8f4ba8e0",
+		},
+		{
+			input:    bytes.Repeat([]byte("abcd"), 16),
+			expected: "debe9ff92275b8a138604889c18e5a4d6fdb70e5387e5765293dcba39c0c5732",
+		},
+	} {
+		sum := sm3.Sum(tc.input)
+		require.Equal(t, tc.expected, hex.EncodeToString(sum[:]))
+
+		// the same input written in chunks
+		h := sm3.New()
+		for _, b := range tc.input {
+			_, err := h.Write([]byte{b})
+			require.NoError(t, err)
+		}
+		require.Equal(t, tc.expected, hex.EncodeToString(h.Sum(nil)))
+	}
+}
@@ -0,0 +1,309 @@
+package swtpm
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+
+	"github.com/rihter007/logruswrap"
+)
+
+// capabilities are the control channel commands supported by Control
+const capabilities = CapInit | CapShutdown | CapGetTPMEstablished | CapSetLocality | CapHashing | CapCancelTPMCmd |
+	CapStoreVolatile | CapResetTPMEstablished | CapGetStateBlob | CapSetStateBlob | CapStop | CapGetConfig |
+	CapSetDataFD | CapSetBufferSize
+
+// maxHashData is the maximal size of data of a single CMD_HASH_DATA
+const maxHashData = 4096
+
+// controlBufferSize fits every control message except the data of CMD_SET_STATEBLOB
+const controlBufferSize = 4 + 4 + maxHashData
+
+// maxStateBlobSize is the maximal size of a state blob accepted by CMD_SET_STATEBLOB
+const maxStateBlobSize = 1 << 20
+
+// maxLocality is the highest locality that can be set by CMD_SET_LOCALITY
+const maxLocality = 4
+
+// Limits of the buffer size of the data channel
+const (
+	minBufferSize uint32 = 2048
+	maxBufferSize uint32 = 4096
+)
+
+// Control keeps the state shared by the control channel and the data channels of a device
+type Control struct {
+	device     Device
+	handleData func(c net.Conn)
+
+	mu         sync.Mutex
+	running    bool
+	locality   uint8
+	bufferSize uint32
+}
+
+// NewControl creates the control of a running device,
+// handleData serves the data channels passed by CMD_SET_DATAFD
+func NewControl(device Device, handleData func(c net.Conn)) *Control {
+	return &Control{
+		device:     device,
+		handleData: handleData,
+		running:    true,
+		bufferSize: maxBufferSize,
+	}
+}
+
+// ProcessControl reads a single control message, applies it to the device and responds with its result,
+// ErrShutdown is returned after the response to CMD_SHUTDOWN
+func (c *Control) ProcessControl(rw io.ReadWriter, l logruswrap.PrintfLogger) error {
+	buf := make([]byte, controlBufferSize)
+	n, files, err := readMessage(rw, buf)
+	if err != nil {
+		return fmt.Errorf("failed to read control message, err: %v", err)
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	// clients send a message with a single write, the fields that did not fit the first read follow it
+	r := io.MultiReader(bytes.NewReader(buf[:n]), rw)
+	var command Command
+	if err := binary.Read(r, binary.BigEndian, &command); err != nil {
+		return fmt.Errorf("failed to read command, err: %v", err)
+	}
+
+	log := logruswrap.WrapPrintfLogger(l)
+	log.Infof("obtained control command: %d", command)
+
+	c.mu.Lock()
+	resp, err := c.execute(command, r, files)
+	c.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if _, err := rw.Write(resp); err != nil {
+		return fmt.Errorf("failed to write response, err: %v", err)
+	}
+	if command == CmdShutdown {
+		return ErrShutdown
+	}
+	return nil
+}
+
+// execute processes a control command and builds its response
+func (c *Control) execute(command Command, r io.Reader, files []*os.File) ([]byte, error) {
+	switch command {
+	case CmdGetCapability:
+		return response(capabilities)
+	case CmdInit:
+		var initFlags uint32
+		if err := binary.Read(r, binary.BigEndian, &initFlags); err != nil {
+			return nil, fmt.Errorf("failed to read init flags, err: %v", err)
+		}
+		return response(c.init(initFlags))
+	case CmdShutdown, CmdStop:
+		if c.running {
+			c.device.PowerOff()
+			c.running = false
+		}
+		return response(ResultSuccess)
+	case CmdGetTPMEstablished:
+		if !c.running {
+			return response(ResultFail, uint8(0), [3]byte{})
+		}
+		var bit uint8
+		if c.device.TPMEstablished() {
+			bit = 1
+		}
+		return response(ResultSuccess, bit, [3]byte{})
+	case CmdSetLocality:
+		var locality uint8
+		if err := binary.Read(r, binary.BigEndian, &locality); err != nil {
+			return nil, fmt.Errorf("failed to read locality, err: %v", err)
+		}
+		if locality > maxLocality {
+			return response(ResultBadLocality)
+		}
+		c.locality = locality
+		return response(ResultSuccess)
+	case CmdHashStart, CmdHashEnd:
+		if !c.running {
+			return response(ResultFail)
+		}
+		if command == CmdHashStart {
+			c.device.HashStart()
+		} else {
+			c.device.HashEnd()
+		}
+		return response(ResultSuccess)
+	case CmdHashData:
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			return nil, fmt.Errorf("failed to read hash data length, err: %v", err)
+		}
+		if length > maxHashData {
+			return response(ResultBadParameter)
+		}
+		data := make([]byte, length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, fmt.Errorf("failed to read hash data, err: %v", err)
+		}
+		if !c.running {
+			return response(ResultFail)
+		}
+		c.device.HashData(data)
+		return response(ResultSuccess)
+	case CmdCancelTPMCmd:
+		// commands are executed synchronously, there is no command in progress when a control message is processed
+		return response(ResultSuccess)
+	case CmdStoreVolatile:
+		if !c.running || c.device.StoreVolatile() != nil {
+			return response(ResultFail)
+		}
+		return response(ResultSuccess)
+	case CmdResetTPMEstablished:
+		var locality uint8
+		if err := binary.Read(r, binary.BigEndian, &locality); err != nil {
+			return nil, fmt.Errorf("failed to read locality, err: %v", err)
+		}
+		if !c.running {
+			return response(ResultFail)
+		}
+		if locality > maxLocality || c.device.ResetTPMEstablished(locality) != nil {
+			return response(ResultBadLocality)
+		}
+		return response(ResultSuccess)
+	case CmdGetStateBlob:
+		return c.getStateBlob(r)
+	case CmdSetStateBlob:
+		return c.setStateBlob(r)
+	case CmdGetConfig:
+		// the state is never encrypted
+		return response(ResultSuccess, uint32(0))
+	case CmdSetDataFD:
+		return response(c.setDataFD(files))
+	case CmdSetBufferSize:
+		var bufferSize uint32
+		if err := binary.Read(r, binary.BigEndian, &bufferSize); err != nil {
+			return nil, fmt.Errorf("failed to read buffer size, err: %v", err)
+		}
+		return response(c.setBufferSize(bufferSize), c.bufferSize, minBufferSize, maxBufferSize)
+	default:
+		return response(ResultFail)
+	}
+}
+
+// init performs CMD_INIT, a running TPM is powered off first
+func (c *Control) init(initFlags uint32) uint32 {
+	if c.running {
+		c.device.PowerOff()
+		c.running = false
+	}
+	if initFlags&initFlagDeleteVolatile != 0 {
+		if err := c.device.DeleteVolatile(); err != nil {
+			return ResultFail
+		}
+	}
+	c.device.PowerOn()
+	c.running = true
+	return ResultSuccess
+}
+
+// getStateBlob performs CMD_GET_STATEBLOB, the blob starting from the requested offset is sent at once
+func (c *Control) getStateBlob(r io.Reader) ([]byte, error) {
+	var request struct {
+		StateFlags uint32
+		BlobType   BlobType
+		Offset     uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &request); err != nil {
+		return nil, fmt.Errorf("failed to read state blob request, err: %v", err)
+	}
+	blob, err := c.device.StateBlob(request.BlobType)
+	if err != nil {
+		return response(ResultFail, uint32(0), uint32(0), uint32(0))
+	}
+	if request.Offset > uint32(len(blob)) {
+		return response(ResultBadParameter, uint32(0), uint32(0), uint32(0))
+	}
+	data := blob[request.Offset:]
+	return response(ResultSuccess, uint32(0), uint32(len(blob)), uint32(len(data)), data)
+}
+
+// setStateBlob performs CMD_SET_STATEBLOB, the state of a running TPM cannot be replaced
+func (c *Control) setStateBlob(r io.Reader) ([]byte, error) {
+	var request struct {
+		StateFlags uint32
+		BlobType   BlobType
+		Length     uint32
+	}
+	if err := binary.Read(r, binary.BigEndian, &request); err != nil {
+		return nil, fmt.Errorf("failed to read state blob header, err: %v", err)
+	}
+	if request.Length > maxStateBlobSize {
+		return nil, fmt.Errorf("state blob of %d bytes is too large", request.Length)
+	}
+	blob := make([]byte, request.Length)
+	if _, err := io.ReadFull(r, blob); err != nil {
+		return nil, fmt.Errorf("failed to read state blob, err: %v", err)
+	}
+
+	switch {
+	case c.running:
+		return response(ResultInvalidPostInit)
+	case request.StateFlags&stateFlagEncrypted != 0:
+		return response(ResultBadParameter)
+	case c.device.SetStateBlob(request.BlobType, blob) != nil:
+		return response(ResultFail)
+	}
+	return response(ResultSuccess)
+}
+
+// setDataFD performs CMD_SET_DATAFD, the passed socket becomes a data channel
+func (c *Control) setDataFD(files []*os.File) uint32 {
+	if len(files) != 1 || c.handleData == nil {
+		return ResultFail
+	}
+	conn, err := net.FileConn(files[0])
+	if err != nil {
+		return ResultFail
+	}
+	go c.handleData(conn)
+	return ResultSuccess
+}
+
+// setBufferSize performs CMD_SET_BUFFERSIZE, zero size only queries the current buffer size
+func (c *Control) setBufferSize(bufferSize uint32) uint32 {
+	if bufferSize == 0 {
+		return ResultSuccess
+	}
+	if c.running {
+		return ResultBadParameter
+	}
+	switch {
+	case bufferSize < minBufferSize:
+		bufferSize = minBufferSize
+	case bufferSize > maxBufferSize:
+		bufferSize = maxBufferSize
+	}
+	c.bufferSize = bufferSize
+	return ResultSuccess
+}
+
+// response encodes the fields of a response
+func response(fields ...interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, field := range fields {
+		if err := binary.Write(&buf, binary.BigEndian, field); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,64 @@
+package swtpm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// commandHeaderSize is the size of TPM command header: tag, commandSize and commandCode
+const commandHeaderSize = 10
+
+// ProcessData reads a single TPM command from a data channel and responds with the result of process,
+// commands are executed at the locality set by CMD_SET_LOCALITY
+func (c *Control) ProcessData(rw io.ReadWriter, process func(command []byte, locality uint8) ([]byte, error)) error {
+	header := make([]byte, commandHeaderSize)
+	if _, err := io.ReadFull(rw, header); err != nil {
+		return fmt.Errorf("failed to read command header, err: %v", err)
+	}
+	size := binary.BigEndian.Uint32(header[2:])
+	if size < commandHeaderSize {
+		return fmt.Errorf("incorrect command size: %d", size)
+	}
+
+	c.mu.Lock()
+	running, locality, bufferSize := c.running, c.locality, c.bufferSize
+	c.mu.Unlock()
+
+	var resp []byte
+	var err error
+	switch {
+	case size > bufferSize:
+		if _, err := io.CopyN(ioutil.Discard, rw, int64(size-commandHeaderSize)); err != nil {
+			return fmt.Errorf("failed to read command, err: %v", err)
+		}
+		resp, err = errorResponse(tpm2.RCCommandSize)
+	default:
+		command := make([]byte, size)
+		copy(command, header)
+		if _, err := io.ReadFull(rw, command[commandHeaderSize:]); err != nil {
+			return fmt.Errorf("failed to read command, err: %v", err)
+		}
+		if running {
+			resp, err = process(command, locality)
+		} else {
+			// a stopped TPM is in failure mode until CMD_INIT
+			resp, err = errorResponse(tpm2.RCFailure)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = rw.Write(resp)
+	return err
+}
+
+// errorResponse creates a response without parameters
+func errorResponse(rc tpm2.RCFmt0) ([]byte, error) {
+	return tpmutil.Pack(tpm2.TagNoSessions, uint32(commandHeaderSize), uint32(rc))
+}
@@ -0,0 +1,15 @@
+//go:build windows
+// +build windows
+
+package swtpm
+
+import (
+	"io"
+	"os"
+)
+
+// readMessage reads a single control message, passing of file descriptors is not supported
+func readMessage(r io.Reader, buf []byte) (int, []*os.File, error) {
+	n, err := r.Read(buf)
+	return n, nil, err
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+// +build !windows
+
+package swtpm
+
+import (
+	"io"
+	"net"
+	"os"
+	"syscall"
+)
+
+// readMessage reads a single control message, file descriptors passed along with the message are returned as files
+func readMessage(r io.Reader, buf []byte) (int, []*os.File, error) {
+	conn, ok := r.(*net.UnixConn)
+	if !ok {
+		n, err := r.Read(buf)
+		return n, nil, err
+	}
+
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return 0, nil, err
+	}
+	if n == 0 {
+		return 0, nil, io.EOF
+	}
+
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, nil, err
+	}
+	var files []*os.File
+	for i := range messages {
+		fds, err := syscall.ParseUnixRights(&messages[i])
+		if err != nil {
+			continue
+		}
+		for _, fd := range fds {
+			files = append(files, os.NewFile(uintptr(fd), "data channel"))
+		}
+	}
+	return n, files, nil
+}
@@ -0,0 +1,74 @@
+//go:build !windows
+// +build !windows
+
+package swtpm_test
+
+import (
+	"encoding/binary"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/rihter007/go-swtpm/swtpm"
+	"github.com/stretchr/testify/require"
+)
+
+// socketPair creates a pair of connected unix domain sockets
+func socketPair(t *testing.T) (*net.UnixConn, *os.File) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	f := os.NewFile(uintptr(fds[0]), "local")
+	defer f.Close()
+	conn, err := net.FileConn(f)
+	require.NoError(t, err)
+	t.Cleanup(func() {
+		_ = conn.Close()
+	})
+	remote := os.NewFile(uintptr(fds[1]), "remote")
+	t.Cleanup(func() {
+		_ = remote.Close()
+	})
+	return conn.(*net.UnixConn), remote
+}
+
+func TestControlSetDataFD(t *testing.T) {
+	dataChannels := make(chan net.Conn, 1)
+	control := swtpm.NewControl(&mockedDevice{}, func(c net.Conn) {
+		dataChannels <- c
+	})
+
+	ctrlClient, ctrlServerFile := socketPair(t)
+	ctrlServer, err := net.FileConn(ctrlServerFile)
+	require.NoError(t, err)
+	defer ctrlServer.Close()
+	go func() {
+		_ = control.ProcessControl(ctrlServer, nil)
+	}()
+
+	dataClient, dataServerFile := socketPair(t)
+	command := make([]byte, 4)
+	binary.BigEndian.PutUint32(command, uint32(swtpm.CmdSetDataFD))
+	_, _, err = ctrlClient.WriteMsgUnix(command, syscall.UnixRights(int(dataServerFile.Fd())), nil)
+	require.NoError(t, err)
+	var result uint32
+	require.NoError(t, binary.Read(ctrlClient, binary.BigEndian, &result))
+	require.Equal(t, swtpm.ResultSuccess, result)
+
+	var dataServer net.Conn
+	select {
+	case dataServer = <-dataChannels:
+	case <-time.After(time.Second):
+	}
+	require.NotNil(t, dataServer)
+	defer dataServer.Close()
+
+	// the passed socket is connected to the data channel of the client
+	_, err = dataClient.Write([]byte("data"))
+	require.NoError(t, err)
+	received := make([]byte, 4)
+	_, err = dataServer.Read(received)
+	require.NoError(t, err)
+	require.Equal(t, []byte("data"), received)
+}
@@ -0,0 +1,98 @@
+// Package swtpm contains functionality for processing the control channel protocol of swtpm
+package swtpm
+
+import "errors"
+
+// Command is a code of a control channel command, the codes follow PTM ioctls of swtpm
+type Command uint32
+
+const (
+	CmdGetCapability       Command = 1
+	CmdInit                Command = 2
+	CmdShutdown            Command = 3
+	CmdGetTPMEstablished   Command = 4
+	CmdSetLocality         Command = 5
+	CmdHashStart           Command = 6
+	CmdHashData            Command = 7
+	CmdHashEnd             Command = 8
+	CmdCancelTPMCmd        Command = 9
+	CmdStoreVolatile       Command = 10
+	CmdResetTPMEstablished Command = 11
+	CmdGetStateBlob        Command = 12
+	CmdSetStateBlob        Command = 13
+	CmdStop                Command = 14
+	CmdGetConfig           Command = 15
+	CmdSetDataFD           Command = 16
+	CmdSetBufferSize       Command = 17
+)
+
+// Capability is a bitmask of supported control channel commands reported by CMD_GET_CAPABILITY
+type Capability uint64
+
+const (
+	CapInit                Capability = 0x0001
+	CapShutdown            Capability = 0x0002
+	CapGetTPMEstablished   Capability = 0x0004
+	CapSetLocality         Capability = 0x0008
+	CapHashing             Capability = 0x0010
+	CapCancelTPMCmd        Capability = 0x0020
+	CapStoreVolatile       Capability = 0x0040
+	CapResetTPMEstablished Capability = 0x0080
+	CapGetStateBlob        Capability = 0x0100
+	CapSetStateBlob        Capability = 0x0200
+	CapStop                Capability = 0x0400
+	CapGetConfig           Capability = 0x0800
+	CapSetDataFD           Capability = 0x1000
+	CapSetBufferSize       Capability = 0x2000
+)
+
+// Result codes of control channel commands, the codes follow TPM 1.2 return codes used by swtpm
+const (
+	ResultSuccess         uint32 = 0
+	ResultBadParameter    uint32 = 0x03
+	ResultFail            uint32 = 0x09
+	ResultInvalidPostInit uint32 = 0x26
+	ResultBadLocality     uint32 = 0x3D
+)
+
+// BlobType identifies a part of the TPM state transferred by CMD_GET_STATEBLOB and CMD_SET_STATEBLOB
+type BlobType uint32
+
+const (
+	BlobPermanent BlobType = 1
+	BlobVolatile  BlobType = 2
+	BlobSaveState BlobType = 3
+)
+
+// Flags of CMD_INIT and CMD_SET_STATEBLOB
+const (
+	initFlagDeleteVolatile uint32 = 0x01
+	stateFlagEncrypted     uint32 = 0x02
+)
+
+// ErrShutdown is returned when the client terminates the emulator with CMD_SHUTDOWN
+var ErrShutdown = errors.New("emulator shut down by the client")
+
+// Device is a TPM controlled via the control channel
+type Device interface {
+	// PowerOn is invoked on CMD_INIT, it is followed by _TPM_Init
+	PowerOn()
+	// PowerOff is invoked on CMD_STOP, CMD_SHUTDOWN and CMD_INIT of a running TPM
+	PowerOff()
+	// HashStart, HashData and HashEnd are invoked on CMD_HASH_START, CMD_HASH_DATA and CMD_HASH_END
+	HashStart()
+	HashData(data []byte)
+	HashEnd()
+	// TPMEstablished returns the TPM established flag that is set by a dynamic root of trust
+	TPMEstablished() bool
+	// ResetTPMEstablished clears the TPM established flag on behalf of a given locality
+	ResetTPMEstablished(locality uint8) error
+	// StoreVolatile saves the volatile state, it is restored by the next CMD_INIT
+	StoreVolatile() error
+	// DeleteVolatile removes the volatile state saved by StoreVolatile
+	DeleteVolatile() error
+	// StateBlob returns a part of the TPM state
+	StateBlob(blobType BlobType) ([]byte, error)
+	// SetStateBlob replaces a part of the TPM state, it takes effect on the next CMD_INIT
+	SetStateBlob(blobType BlobType, blob []byte) error
+}
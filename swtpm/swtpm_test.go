@@ -0,0 +1,206 @@
+package swtpm_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/rihter007/go-swtpm/swtpm"
+	"github.com/stretchr/testify/require"
+)
+
+type mockedDevice struct {
+	signals     []string
+	established bool
+	blobs       map[swtpm.BlobType][]byte
+}
+
+func (m *mockedDevice) PowerOn()             { m.signals = append(m.signals, "power on") }
+func (m *mockedDevice) PowerOff()            { m.signals = append(m.signals, "power off") }
+func (m *mockedDevice) HashStart()           { m.signals = append(m.signals, "hash start") }
+func (m *mockedDevice) HashData(data []byte) { m.signals = append(m.signals, "hash "+string(data)) }
+func (m *mockedDevice) HashEnd()             { m.signals = append(m.signals, "hash end") }
+func (m *mockedDevice) TPMEstablished() bool { return m.established }
+
+func (m *mockedDevice) ResetTPMEstablished(locality uint8) error {
+	if locality < 3 {
+		return errors.New("bad locality")
+	}
+	m.established = false
+	return nil
+}
+
+func (m *mockedDevice) StoreVolatile() error {
+	m.signals = append(m.signals, "store volatile")
+	return nil
+}
+
+func (m *mockedDevice) DeleteVolatile() error {
+	m.signals = append(m.signals, "delete volatile")
+	return nil
+}
+
+func (m *mockedDevice) StateBlob(blobType swtpm.BlobType) ([]byte, error) {
+	blob, ok := m.blobs[blobType]
+	if !ok {
+		return nil, fmt.Errorf("no blob %d", blobType)
+	}
+	return blob, nil
+}
+
+func (m *mockedDevice) SetStateBlob(blobType swtpm.BlobType, blob []byte) error {
+	m.blobs[blobType] = blob
+	return nil
+}
+
+// controlClient sends control messages to a control channel that is processed in background
+type controlClient struct {
+	t    *testing.T
+	conn net.Conn
+	errs chan error
+}
+
+func newControlClient(t *testing.T, control *swtpm.Control) *controlClient {
+	server, client := net.Pipe()
+	errs := make(chan error, 1)
+	go func() {
+		defer server.Close()
+		for {
+			if err := control.ProcessControl(server, nil); err != nil {
+				errs <- err
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return &controlClient{t: t, conn: client, errs: errs}
+}
+
+// call sends a command with input fields and reads response fields
+func (c *controlClient) call(command swtpm.Command, input []interface{}, output ...interface{}) {
+	message, err := tpmutil.Pack(append([]interface{}{command}, input...)...)
+	require.NoError(c.t, err)
+	_, err = c.conn.Write(message)
+	require.NoError(c.t, err)
+	for _, o := range output {
+		require.NoError(c.t, binary.Read(c.conn, binary.BigEndian, o))
+	}
+}
+
+// result sends a command that responds with a result code only
+func (c *controlClient) result(command swtpm.Command, input ...interface{}) uint32 {
+	var result uint32
+	c.call(command, input, &result)
+	return result
+}
+
+// runCommand sends a TPM command to a data channel and returns the response code
+func runCommand(t *testing.T, control *swtpm.Control, command []byte) (tpmutil.ResponseCode, uint8) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	var locality uint8
+	go func() {
+		defer server.Close()
+		_ = control.ProcessData(server, func(command []byte, l uint8) ([]byte, error) {
+			locality = l
+			return tpmutil.Pack(tpm2.TagNoSessions, uint32(10), uint32(0))
+		})
+	}()
+
+	_, err := client.Write(command)
+	require.NoError(t, err)
+	resp := make([]byte, 10)
+	_, err = io.ReadFull(client, resp)
+	require.NoError(t, err)
+	return tpmutil.ResponseCode(binary.BigEndian.Uint32(resp[6:])), locality
+}
+
+func TestControl(t *testing.T) {
+	device := &mockedDevice{blobs: map[swtpm.BlobType][]byte{swtpm.BlobPermanent: []byte("permanent")}}
+	control := swtpm.NewControl(device, nil)
+	client := newControlClient(t, control)
+
+	var capabilities swtpm.Capability
+	client.call(swtpm.CmdGetCapability, nil, &capabilities)
+	require.NotZero(t, capabilities&swtpm.CapInit)
+	require.NotZero(t, capabilities&swtpm.CapSetLocality)
+	require.NotZero(t, capabilities&swtpm.CapHashing)
+
+	// a TPM command is executed at the locality set by the control channel,
+	// the locality is padded by the clients that send the whole request structure
+	startup := []byte{0x80, 0x01, 0x00, 0x00, 0x00, 0x0C, 0x00, 0x00, 0x01, 0x44, 0x00, 0x00}
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdSetLocality, uint8(3), [3]byte{}))
+	rc, locality := runCommand(t, control, startup)
+	require.Equal(t, tpmutil.RCSuccess, rc)
+	require.Equal(t, uint8(3), locality)
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdSetLocality, uint8(0)))
+	require.Equal(t, swtpm.ResultBadLocality, client.result(swtpm.CmdSetLocality, uint8(5)))
+	_, locality = runCommand(t, control, startup)
+	require.Equal(t, uint8(0), locality)
+
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdHashStart))
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdHashData, tpmutil.U32Bytes("CRTM")))
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdHashEnd))
+	require.Equal(t, []string{"hash start", "hash CRTM", "hash end"}, device.signals)
+
+	device.established = true
+	var result uint32
+	var established [4]byte
+	client.call(swtpm.CmdGetTPMEstablished, nil, &result, &established)
+	require.Equal(t, swtpm.ResultSuccess, result)
+	require.Equal(t, [4]byte{1, 0, 0, 0}, established)
+	require.Equal(t, swtpm.ResultBadLocality, client.result(swtpm.CmdResetTPMEstablished, uint8(0)))
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdResetTPMEstablished, uint8(3)))
+	require.False(t, device.established)
+
+	// the state is replaced and the buffer size is changed only when the TPM is stopped
+	require.Equal(t, swtpm.ResultInvalidPostInit, client.result(swtpm.CmdSetStateBlob,
+		uint32(0), swtpm.BlobVolatile, tpmutil.U32Bytes("volatile")))
+	var bufferSize, minSize, maxSize uint32
+	client.call(swtpm.CmdSetBufferSize, []interface{}{uint32(3000)}, &result, &bufferSize, &minSize, &maxSize)
+	require.Equal(t, swtpm.ResultBadParameter, result)
+	require.Equal(t, uint32(4096), bufferSize)
+
+	device.signals = nil
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdStop))
+	rc, _ = runCommand(t, control, startup)
+	require.Equal(t, tpmutil.ResponseCode(tpm2.RCFailure), rc)
+
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdSetStateBlob,
+		uint32(0), swtpm.BlobVolatile, tpmutil.U32Bytes("volatile")))
+	require.Equal(t, []byte("volatile"), device.blobs[swtpm.BlobVolatile])
+	client.call(swtpm.CmdSetBufferSize, []interface{}{uint32(3000)}, &result, &bufferSize, &minSize, &maxSize)
+	require.Equal(t, swtpm.ResultSuccess, result)
+	require.Equal(t, []uint32{3000, 2048, 4096}, []uint32{bufferSize, minSize, maxSize})
+
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdInit, uint32(1)))
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdStoreVolatile))
+	require.Equal(t, []string{"power off", "delete volatile", "power on", "store volatile"}, device.signals)
+	rc, _ = runCommand(t, control, startup)
+	require.Equal(t, tpmutil.RCSuccess, rc)
+	large := make([]byte, 3001)
+	copy(large, []byte{0x80, 0x01, 0x00, 0x00, 0x0B, 0xB9, 0x00, 0x00, 0x01, 0x44})
+	rc, _ = runCommand(t, control, large)
+	require.Equal(t, tpmutil.ResponseCode(tpm2.RCCommandSize), rc)
+
+	var stateFlags, totalLength uint32
+	var data tpmutil.U32Bytes
+	client.call(swtpm.CmdGetStateBlob, []interface{}{uint32(0), swtpm.BlobPermanent, uint32(4)},
+		&result, &stateFlags, &totalLength)
+	require.NoError(t, tpmutil.UnpackBuf(client.conn, &data))
+	require.Equal(t, swtpm.ResultSuccess, result)
+	require.Equal(t, uint32(len("permanent")), totalLength)
+	require.Equal(t, tpmutil.U32Bytes("anent"), data)
+
+	require.Equal(t, swtpm.ResultFail, client.result(swtpm.Command(0xFF)))
+	require.Equal(t, swtpm.ResultSuccess, client.result(swtpm.CmdShutdown))
+	require.ErrorIs(t, <-client.errs, swtpm.ErrShutdown)
+}
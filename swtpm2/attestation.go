@@ -0,0 +1,254 @@
+package swtpm2
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/binary"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// tpmGenerated is TPM_GENERATED_VALUE that starts every structure signed by TPM
+const tpmGenerated uint32 = 0xFF544347
+
+// tagAttestNV is TPM_ST_ATTEST_NV that is missing in go-tpm
+const tagAttestNV tpmutil.Tag = 0x8014
+
+// maxQualifyingDataSize is the maximal size of TPM2B_DATA, sizeof(TPMT_HA) of SHA-512
+const maxQualifyingDataSize = 66
+
+// tagVerified is TPM_ST_VERIFIED, the tag of tickets produced by VerifySignature
+const tagVerified tpmutil.Tag = 0x8022
+
+// obfuscateLabel is used to derive the value that hides resetCount, restartCount and firmwareVersion
+// from the verifiers of keys outside the endorsement and platform hierarchies
+const obfuscateLabel = "OBFUSCATE"
+
+// signingKey returns a key that signs attestation structures and its signing scheme, the scheme of the key
+// takes precedence and inScheme with index schemeIndex may only repeat it. The object is nil for TPM_RH_NULL
+func (t *TPM2) signingKey(signHandle tpmutil.Handle, inScheme *tpm2.SigScheme, schemeIndex int) (*object, *tpm2.SigScheme, error) {
+	if signHandle == tpm2.HandleNull {
+		return nil, nil, nil
+	}
+	obj, ok := t.objects[signHandle]
+	if !ok {
+		return nil, nil, handleError(tpm2.RCHandle, 1)
+	}
+	if obj.public.Attributes&tpm2.FlagSign == 0 || obj.privateKey == nil {
+		return nil, nil, handleError(tpm2.RCKey, 1)
+	}
+
+	var keyScheme *tpm2.SigScheme
+	switch {
+	case obj.public.RSAParameters != nil:
+		keyScheme = obj.public.RSAParameters.Sign
+	case obj.public.ECCParameters != nil:
+		keyScheme = obj.public.ECCParameters.Sign
+	}
+	scheme := inScheme
+	if keyScheme != nil && keyScheme.Alg != tpm2.AlgNull {
+		if inScheme != nil && *inScheme != *keyScheme {
+			return nil, nil, parameterError(tpm2.RCScheme, schemeIndex)
+		}
+		scheme = keyScheme
+	}
+	if scheme == nil {
+		return nil, nil, parameterError(tpm2.RCScheme, schemeIndex)
+	}
+
+	switch obj.privateKey.(type) {
+	case *rsa.PrivateKey:
+		if scheme.Alg != tpm2.AlgRSASSA && scheme.Alg != tpm2.AlgRSAPSS {
+			return nil, nil, parameterError(tpm2.RCScheme, schemeIndex)
+		}
+	case *ecdsa.PrivateKey:
+		if scheme.Alg != tpm2.AlgECDSA {
+			return nil, nil, parameterError(tpm2.RCScheme, schemeIndex)
+		}
+	}
+	if _, err := scheme.Hash.Hash(); err != nil {
+		return nil, nil, parameterError(tpm2.RCScheme, schemeIndex)
+	}
+	return obj, scheme, nil
+}
+
+// attest builds TPMS_ATTEST with the attested information of a given type and signs it with the signing key,
+// the structure is not signed when there is no key
+func (t *TPM2) attest(signKey *object, scheme *tpm2.SigScheme, attestType tpmutil.Tag,
+	qualifyingData []byte, attested []byte) ([]byte, tpm2.Signature, error) {
+
+	clockInfo := t.clockInfo()
+	firmware := uint64(firmwareVersion) << 32
+	var qualifiedSigner []byte
+	if signKey != nil {
+		qualifiedSigner = signKey.qualifiedName
+		if signKey.hierarchy != tpm2.HandleEndorsement && signKey.hierarchy != tpm2.HandlePlatform {
+			obfuscation, err := tpm2.KDFa(signKey.public.NameAlg, t.hierarchies[tpm2.HandleOwner].proof,
+				obfuscateLabel, signKey.name, nil, 128)
+			if err != nil {
+				return nil, tpm2.Signature{}, err
+			}
+			firmware += binary.BigEndian.Uint64(obfuscation)
+			clockInfo.ResetCount += binary.BigEndian.Uint32(obfuscation[8:])
+			clockInfo.RestartCount += binary.BigEndian.Uint32(obfuscation[12:])
+		}
+	}
+
+	attest, err := tpmutil.Pack(tpmGenerated, attestType, tpmutil.U16Bytes(qualifiedSigner),
+		tpmutil.U16Bytes(qualifyingData), clockInfo, firmware, tpmutil.RawBytes(attested))
+	if err != nil {
+		return nil, tpm2.Signature{}, err
+	}
+	if signKey == nil {
+		return attest, tpm2.Signature{Alg: tpm2.AlgNull}, nil
+	}
+	signature, err := sign(signKey, scheme, attest)
+	if err != nil {
+		return nil, tpm2.Signature{}, err
+	}
+	return attest, signature, nil
+}
+
+// sign signs the digest of a message with an asymmetric key using a validated scheme
+func sign(key *object, scheme *tpm2.SigScheme, message []byte) (tpm2.Signature, error) {
+	hash, err := scheme.Hash.Hash()
+	if err != nil {
+		return tpm2.Signature{}, err
+	}
+	h := hash.New()
+	h.Write(message)
+	digest := h.Sum(nil)
+
+	signature := tpm2.Signature{Alg: scheme.Alg}
+	switch priv := key.privateKey.(type) {
+	case *rsa.PrivateKey:
+		var sig []byte
+		if scheme.Alg == tpm2.AlgRSAPSS {
+			sig, err = rsa.SignPSS(rand.Reader, priv, hash, digest, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthEqualsHash})
+		} else {
+			sig, err = rsa.SignPKCS1v15(rand.Reader, priv, hash, digest)
+		}
+		if err != nil {
+			return tpm2.Signature{}, err
+		}
+		signature.RSA = &tpm2.SignatureRSA{HashAlg: scheme.Hash, Signature: sig}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		if err != nil {
+			return tpm2.Signature{}, err
+		}
+		signature.ECC = &tpm2.SignatureECC{HashAlg: scheme.Hash, R: r, S: s}
+	default:
+		return tpm2.Signature{}, handleError(tpm2.RCKey, 1)
+	}
+	return signature, nil
+}
+
+// signatureHash returns the hash algorithm of a signature that is a parameter with a given index
+func signatureHash(signature *tpm2.Signature, index int) (crypto.Hash, error) {
+	var hashAlg tpm2.Algorithm
+	switch {
+	case signature.RSA != nil:
+		hashAlg = signature.RSA.HashAlg
+	case signature.ECC != nil:
+		hashAlg = signature.ECC.HashAlg
+	default:
+		return 0, parameterError(tpm2.RCScheme, index)
+	}
+	hash, err := hashAlg.Hash()
+	if err != nil {
+		return 0, parameterError(tpm2.RCScheme, index)
+	}
+	return hash, nil
+}
+
+// verifySignature checks a signature of a message that is a parameter with a given index using the public key
+// of an object, the digest of the message is computed with the hash algorithm of the signature
+func verifySignature(key *object, message []byte, signature *tpm2.Signature, index int) error {
+	hash, err := signatureHash(signature, index)
+	if err != nil {
+		return err
+	}
+	h := hash.New()
+	h.Write(message)
+	return verifyDigest(key, h.Sum(nil), signature, index)
+}
+
+// verifyDigest checks a signature of a digest that is a parameter with a given index using the public key of an object
+func verifyDigest(key *object, digest []byte, signature *tpm2.Signature, index int) error {
+	hash, err := signatureHash(signature, index)
+	if err != nil {
+		return err
+	}
+	publicKey, err := key.public.Key()
+	if err != nil {
+		return err
+	}
+	switch pub := publicKey.(type) {
+	case *rsa.PublicKey:
+		switch signature.Alg {
+		case tpm2.AlgRSASSA:
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, signature.RSA.Signature)
+		case tpm2.AlgRSAPSS:
+			err = rsa.VerifyPSS(pub, hash, digest, signature.RSA.Signature, &rsa.PSSOptions{SaltLength: rsa.PSSSaltLengthAuto})
+		default:
+			return parameterError(tpm2.RCScheme, index)
+		}
+		if err != nil {
+			return parameterError(tpm2.RCSignature, index)
+		}
+	case *ecdsa.PublicKey:
+		if signature.Alg != tpm2.AlgECDSA {
+			return parameterError(tpm2.RCScheme, index)
+		}
+		if !ecdsa.Verify(pub, digest, signature.ECC.R, signature.ECC.S) {
+			return parameterError(tpm2.RCSignature, index)
+		}
+	default:
+		return parameterError(tpm2.RCScheme, index)
+	}
+	return nil
+}
+
+// verifiedTicketDigest computes the digest of TPMT_TK_VERIFIED: HMAC(proof, TPM_ST_VERIFIED || digest || keyName)
+func (t *TPM2) verifiedTicketDigest(hierarchyHandle tpmutil.Handle, digest, keyName []byte) ([]byte, bool) {
+	h, ok := t.hierarchies[hierarchyHandle]
+	if !ok || h.proof == nil {
+		return nil, false
+	}
+	data, err := tpmutil.Pack(tagVerified, tpmutil.U16Bytes(digest), tpmutil.U16Bytes(keyName))
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(hashFunctions[tpm2.AlgSHA256], h.proof)
+	mac.Write(data)
+	return mac.Sum(nil), true
+}
+
+// VerifySignature processes VerifySignature command, the ticket proves that the key signed the digest.
+// Keys of the null hierarchy produce null tickets
+func (t *TPM2) VerifySignature(keyHandle tpmutil.Handle, digest []byte, signature *tpm2.Signature) (tpm2.Ticket, error) {
+	key, ok := t.objects[keyHandle]
+	if !ok {
+		return tpm2.Ticket{}, handleError(tpm2.RCHandle, 1)
+	}
+	if key.public.Attributes&tpm2.FlagSign == 0 {
+		return tpm2.Ticket{}, handleError(tpm2.RCAttributes, 1)
+	}
+	if err := verifyDigest(key, digest, signature, 2); err != nil {
+		return tpm2.Ticket{}, err
+	}
+
+	ticket := tpm2.Ticket{Type: tagVerified, Hierarchy: tpm2.HandleNull}
+	if key.hierarchy == tpm2.HandleNull {
+		return ticket, nil
+	}
+	if ticket.Digest, ok = t.verifiedTicketDigest(key.hierarchy, digest, key.name); ok {
+		ticket.Hierarchy = key.hierarchy
+	}
+	return ticket, nil
+}
@@ -0,0 +1,115 @@
+package swtpm2
+
+import (
+	"bytes"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// maxSessions is the maximum number of sessions in the authorization area of a command
+const maxSessions = 3
+
+// CommandContext describes a command that is being processed
+type CommandContext struct {
+	Header CommandHeader
+	// Handles are all handles from the handle area of the command
+	Handles []tpmutil.Handle
+	// AuthHandles are the leading handles of the handle area that require authorization
+	AuthHandles []tpmutil.Handle
+	// Sessions is the authorization area of the command
+	Sessions []tpm2.AuthCommand
+	// Parameters is the parameter area of the command
+	Parameters []byte
+	// Locality is the locality at which the command is received
+	Locality uint8
+}
+
+// AuthResponse represents TPMS_AUTH_RESPONSE structure
+type AuthResponse struct {
+	Nonce      tpmutil.U16Bytes
+	Attributes tpm2.SessionAttributes
+	Auth       tpmutil.U16Bytes
+}
+
+// ParseCommandContext splits the command buffer into handle, authorization and parameter areas
+func ParseCommandContext(ch CommandHeader, b []byte) (*CommandContext, error) {
+	if ch.Tag != tpm2.TagSessions && ch.Tag != tpm2.TagNoSessions {
+		return nil, errBadTag
+	}
+	info, ok := commandTable[ch.Cmd]
+	if !ok {
+		return nil, tpm2.Error{Code: tpm2.RCCommandCode}
+	}
+
+	cmd := &CommandContext{
+		Header:  ch,
+		Handles: make([]tpmutil.Handle, info.handles),
+	}
+	buf := bytes.NewBuffer(b)
+	for i := range cmd.Handles {
+		if err := tpmutil.UnpackBuf(buf, &cmd.Handles[i]); err != nil {
+			return nil, handleError(tpm2.RCInsufficient, i+1)
+		}
+	}
+	cmd.AuthHandles = cmd.Handles[:info.authHandles]
+
+	if ch.Tag == tpm2.TagSessions {
+		sessions, err := parseAuthorizationArea(buf)
+		if err != nil {
+			return nil, err
+		}
+		cmd.Sessions = sessions
+	}
+	if len(cmd.Sessions) < len(cmd.AuthHandles) {
+		return nil, tpm2.Error{Code: tpm2.RCAuthMissing}
+	}
+	cmd.Parameters = buf.Bytes()
+	return cmd, nil
+}
+
+// parseAuthorizationArea reads authorizationSize followed by a list of TPMS_AUTH_COMMAND structures
+func parseAuthorizationArea(buf *bytes.Buffer) ([]tpm2.AuthCommand, error) {
+	var authorizationSize uint32
+	if err := tpmutil.UnpackBuf(buf, &authorizationSize); err != nil || authorizationSize > uint32(buf.Len()) {
+		return nil, tpm2.Error{Code: tpm2.RCAuthSize}
+	}
+
+	area := bytes.NewBuffer(buf.Next(int(authorizationSize)))
+	var sessions []tpm2.AuthCommand
+	for area.Len() > 0 {
+		if len(sessions) == maxSessions {
+			return nil, tpm2.Error{Code: tpm2.RCAuthSize}
+		}
+		var session tpm2.AuthCommand
+		if err := tpmutil.UnpackBuf(area, &session); err != nil {
+			return nil, tpm2.Error{Code: tpm2.RCAuthSize}
+		}
+		sessions = append(sessions, session)
+	}
+	if len(sessions) == 0 {
+		return nil, tpm2.Error{Code: tpm2.RCAuthSize}
+	}
+	return sessions, nil
+}
+
+// packResponse assembles handle, parameter and authorization areas of a response
+func packResponse(tag tpmutil.Tag, handles, parameters []byte, sessions []AuthResponse) ([]byte, error) {
+	if tag != tpm2.TagSessions {
+		return bytes.Join([][]byte{handles, parameters}, nil), nil
+	}
+
+	parameterSize, err := tpmutil.Pack(uint32(len(parameters)))
+	if err != nil {
+		return nil, err
+	}
+	chunks := [][]byte{handles, parameterSize, parameters}
+	for _, session := range sessions {
+		b, err := tpmutil.Pack(session)
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, b)
+	}
+	return bytes.Join(chunks, nil), nil
+}
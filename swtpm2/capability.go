@@ -0,0 +1,435 @@
+package swtpm2
+
+import (
+	"encoding/binary"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// maxCapBuffer is the size of TPMU_CAPABILITIES buffer, maxCapData is left for the list after capability and count
+const (
+	maxCapBuffer = 1024
+	maxCapData   = maxCapBuffer - 4 - 4
+)
+
+// Maximal number of values in a single GetCapability response
+const (
+	maxCapAlgs        = maxCapData / 6
+	maxCapHandles     = maxCapData / 4
+	maxCapCC          = maxCapData / 4
+	maxTPMProperties  = maxCapData / 8
+	maxPCRProperties  = maxCapData / (4 + 1 + maxSizeOfPCRSelect)
+	maxECCCurves      = maxCapData / 2
+	maxTaggedPolicies = maxCapData / (4 + 2 + 64)
+)
+
+// Fixed properties of the emulated device
+const (
+	specFamily      = "2.0"
+	specLevel       = 0
+	specRevision    = 159
+	specDayOfYear   = 312
+	specYear        = 2019
+	manufacturer    = "SWTP"
+	vendorString    = "go-swtpm"
+	firmwareVersion = 0x00010000
+	maxCommandSize  = 4096
+	maxResponseSize = 4096
+	maxDigestSize   = 64
+	maxNVBufferSize = 1024
+	maxNVIndexSize  = 2048
+	inputBufferSize = 1024
+)
+
+// Handle types, the most significant octet of a handle
+const (
+	handleTypePCR           = 0x00
+	handleTypeNVIndex       = 0x01
+	handleTypeHMACSession   = 0x02
+	handleTypePolicySession = 0x03
+	// GetCapability lists the loaded sessions of both types under the type of HMAC sessions
+	// and the saved sessions under the type of policy sessions
+	handleTypeLoadedSession = handleTypeHMACSession
+	handleTypeSavedSession  = handleTypePolicySession
+	handleTypePermanent     = 0x40
+	handleTypeTransient     = 0x80
+	handleTypePersistent    = 0x81
+	handleTypeShift         = 24
+)
+
+// Bits of TPMA_ALGORITHM
+const (
+	algAsymmetric tpm2.AlgorithmAttributes = 1 << 0
+	algSymmetric  tpm2.AlgorithmAttributes = 1 << 1
+	algHash       tpm2.AlgorithmAttributes = 1 << 2
+	algObject     tpm2.AlgorithmAttributes = 1 << 3
+	algSigning    tpm2.AlgorithmAttributes = 1 << 8
+	algEncrypting tpm2.AlgorithmAttributes = 1 << 9
+	algMethod     tpm2.AlgorithmAttributes = 1 << 10
+)
+
+// algorithms lists the implemented algorithms in ascending order
+var algorithms = []tpm2.AlgorithmDescription{
+	{ID: tpm2.AlgRSA, Attributes: algAsymmetric | algObject},
+	{ID: tpm2.AlgSHA1, Attributes: algHash},
+	{ID: tpm2.AlgHMAC, Attributes: algHash | algSigning},
+	{ID: tpm2.AlgAES, Attributes: algSymmetric},
+	{ID: tpm2.AlgKeyedHash, Attributes: algHash | algObject | algSigning | algEncrypting},
+	{ID: tpm2.AlgXOR, Attributes: algSymmetric | algHash},
+	{ID: tpm2.AlgSHA256, Attributes: algHash},
+	{ID: tpm2.AlgSHA384, Attributes: algHash},
+	{ID: tpm2.AlgSHA512, Attributes: algHash},
+	{ID: tpm2.AlgNull},
+	{ID: algSM3, Attributes: algHash},
+	{ID: tpm2.AlgRSASSA, Attributes: algAsymmetric | algSigning},
+	{ID: tpm2.AlgRSAES, Attributes: algAsymmetric | algEncrypting},
+	{ID: tpm2.AlgRSAPSS, Attributes: algAsymmetric | algSigning},
+	{ID: tpm2.AlgOAEP, Attributes: algAsymmetric | algEncrypting},
+	{ID: tpm2.AlgECDSA, Attributes: algAsymmetric | algSigning | algMethod},
+	{ID: tpm2.AlgECDH, Attributes: algAsymmetric | algMethod},
+	{ID: tpm2.AlgECC, Attributes: algAsymmetric | algObject},
+	{ID: tpm2.AlgSymCipher, Attributes: algObject},
+	{ID: tpm2.AlgCTR, Attributes: algSymmetric | algEncrypting},
+	{ID: tpm2.AlgOFB, Attributes: algSymmetric | algEncrypting},
+	{ID: tpm2.AlgCBC, Attributes: algSymmetric | algEncrypting},
+	{ID: tpm2.AlgCFB, Attributes: algSymmetric | algEncrypting},
+	{ID: tpm2.AlgECB, Attributes: algSymmetric | algEncrypting},
+}
+
+// eccCurves lists the implemented curves in ascending order
+var eccCurves = []tpm2.EllipticCurve{
+	tpm2.CurveNISTP224,
+	tpm2.CurveNISTP256,
+	tpm2.CurveNISTP384,
+	tpm2.CurveNISTP521,
+}
+
+// permanentHandles lists the implemented permanent handles in ascending order
+var permanentHandles = []tpmutil.Handle{
+	tpm2.HandleOwner,
+	tpm2.HandleNull,
+	tpm2.HandlePasswordSession,
+	tpm2.HandleLockout,
+	tpm2.HandleEndorsement,
+	tpm2.HandlePlatform,
+}
+
+// capabilityPage returns the end of a page of `total` sorted values that starts with the value `first`
+// and whether more values follow the page, the page contains at most `count` values but no more than `limit` values
+func capabilityPage(first, total int, count uint32, limit int) (int, bool) {
+	if count > uint32(limit) {
+		count = uint32(limit)
+	}
+	last := first + int(count)
+	if last >= total {
+		return total, false
+	}
+	return last, true
+}
+
+// propertyString converts up to 4 characters of a string to a property value
+func propertyString(s string) uint32 {
+	var b [4]byte
+	copy(b[:], s)
+	return binary.BigEndian.Uint32(b[:])
+}
+
+// GetCapabilityAlgs processes GetCapability(TPM_CAP_ALGS) command
+func (t *TPM2) GetCapabilityAlgs(count, property uint32) ([]tpm2.AlgorithmDescription, bool, error) {
+	first := sort.Search(len(algorithms), func(i int) bool {
+		return uint32(algorithms[i].ID) >= property
+	})
+	last, moreData := capabilityPage(first, len(algorithms), count, maxCapAlgs)
+	return algorithms[first:last], moreData, nil
+}
+
+// GetCapabilityHandles processes GetCapability(TPM_CAP_HANDLES) command
+func (t *TPM2) GetCapabilityHandles(count, property uint32) ([]tpmutil.Handle, bool, error) {
+	var handles []tpmutil.Handle
+	switch property >> handleTypeShift {
+	case handleTypePCR:
+		for pcr := 0; pcr < t.pcrCount; pcr++ {
+			handles = append(handles, tpmutil.Handle(pcr))
+		}
+	case handleTypeLoadedSession:
+		return t.loadedSessionHandles(count, property)
+	case handleTypeSavedSession:
+		// session contexts cannot be saved
+	case handleTypePermanent:
+		handles = permanentHandles
+	case handleTypeNVIndex:
+		for handle := range t.nvIndices {
+			handles = append(handles, handle)
+		}
+		sortHandles(handles)
+	case handleTypeTransient, handleTypePersistent:
+		for handle := range t.objects {
+			if uint32(handle)>>handleTypeShift == property>>handleTypeShift {
+				handles = append(handles, handle)
+			}
+		}
+		sortHandles(handles)
+	default:
+		return nil, false, parameterError(tpm2.RCHandle, 2)
+	}
+
+	first := sort.Search(len(handles), func(i int) bool {
+		return uint32(handles[i]) >= property
+	})
+	last, moreData := capabilityPage(first, len(handles), count, maxCapHandles)
+	return handles[first:last], moreData, nil
+}
+
+// loadedSessionHandles lists loaded HMAC and policy sessions in the order of their slots starting from the slot
+// in the lower bits of the property
+func (t *TPM2) loadedSessionHandles(count, property uint32) ([]tpmutil.Handle, bool, error) {
+	var handles []tpmutil.Handle
+	for handle := range t.sessions {
+		handles = append(handles, handle)
+	}
+	slot := func(i int) uint32 {
+		return uint32(handles[i]) & (1<<handleTypeShift - 1)
+	}
+	sort.Slice(handles, func(i, j int) bool {
+		return slot(i) < slot(j)
+	})
+	first := sort.Search(len(handles), func(i int) bool {
+		return slot(i) >= property&(1<<handleTypeShift-1)
+	})
+	last, moreData := capabilityPage(first, len(handles), count, maxCapHandles)
+	return handles[first:last], moreData, nil
+}
+
+// sortHandles sorts handles in ascending order
+func sortHandles(handles []tpmutil.Handle) {
+	sort.Slice(handles, func(i, j int) bool {
+		return handles[i] < handles[j]
+	})
+}
+
+// GetCapabilityCommands processes GetCapability(TPM_CAP_COMMANDS) command
+func (t *TPM2) GetCapabilityCommands(count, property uint32) ([]CommandAttributes, bool, error) {
+	codes := sortedCommands(func(tpmutil.Command) bool { return true })
+	first := sort.Search(len(codes), func(i int) bool {
+		return uint32(codes[i]) >= property
+	})
+	last, moreData := capabilityPage(first, len(codes), count, maxCapCC)
+
+	attributes := make([]CommandAttributes, 0, last-first)
+	for _, cc := range codes[first:last] {
+		attributes = append(attributes, commandTable[cc].attributes(cc))
+	}
+	return attributes, moreData, nil
+}
+
+// GetCapabilityPPCommands processes GetCapability(TPM_CAP_PP_COMMANDS) command
+func (t *TPM2) GetCapabilityPPCommands(count, property uint32) ([]tpmutil.Command, bool, error) {
+	codes := sortedCommands(func(cc tpmutil.Command) bool { return t.ppCommands[cc] })
+	first := sort.Search(len(codes), func(i int) bool {
+		return uint32(codes[i]) >= property
+	})
+	last, moreData := capabilityPage(first, len(codes), count, maxCapCC)
+	return codes[first:last], moreData, nil
+}
+
+// GetCapabilityAuditCommands processes GetCapability(TPM_CAP_AUDIT_COMMANDS) command
+func (t *TPM2) GetCapabilityAuditCommands(count, property uint32) ([]tpmutil.Command, bool, error) {
+	codes := sortedCommands(func(cc tpmutil.Command) bool { return t.auditCommands[cc] })
+	first := sort.Search(len(codes), func(i int) bool {
+		return uint32(codes[i]) >= property
+	})
+	last, moreData := capabilityPage(first, len(codes), count, maxCapCC)
+	return codes[first:last], moreData, nil
+}
+
+// GetCapabilityTPMProperties processes GetCapability(TPM_CAP_TPM_PROPERTIES) command
+func (t *TPM2) GetCapabilityTPMProperties(count, property uint32) ([]tpm2.TaggedProperty, bool, error) {
+	properties := t.tpmProperties()
+	first := sort.Search(len(properties), func(i int) bool {
+		return uint32(properties[i].Tag) >= property
+	})
+	last, moreData := capabilityPage(first, len(properties), count, maxTPMProperties)
+	return properties[first:last], moreData, nil
+}
+
+// GetCapabilityPCRProperties processes GetCapability(TPM_CAP_PCR_PROPERTIES) command
+func (t *TPM2) GetCapabilityPCRProperties(count, property uint32) ([]TaggedPCRSelect, bool, error) {
+	properties := pcrProperties(t.pcrCount)
+	first := sort.Search(len(properties), func(i int) bool {
+		return uint32(properties[i].Tag) >= property
+	})
+	last, moreData := capabilityPage(first, len(properties), count, maxPCRProperties)
+	return properties[first:last], moreData, nil
+}
+
+// GetCapabilityECCCurves processes GetCapability(TPM_CAP_ECC_CURVES) command
+func (t *TPM2) GetCapabilityECCCurves(count, property uint32) ([]tpm2.EllipticCurve, bool, error) {
+	first := sort.Search(len(eccCurves), func(i int) bool {
+		return uint32(eccCurves[i]) >= property
+	})
+	last, moreData := capabilityPage(first, len(eccCurves), count, maxECCCurves)
+	return eccCurves[first:last], moreData, nil
+}
+
+// GetCapabilityAuthPolicies processes GetCapability(TPM_CAP_AUTH_POLICIES) command
+func (t *TPM2) GetCapabilityAuthPolicies(count, property uint32) ([]TaggedPolicy, bool, error) {
+	var policies []TaggedPolicy
+	for _, handle := range permanentHandles {
+		policy, ok := t.authPolicy(handle)
+		if ok {
+			policies = append(policies, TaggedPolicy{Handle: handle, PolicyHash: policy})
+		}
+	}
+
+	first := sort.Search(len(policies), func(i int) bool {
+		return uint32(policies[i].Handle) >= property
+	})
+	last, moreData := capabilityPage(first, len(policies), count, maxTaggedPolicies)
+	return policies[first:last], moreData, nil
+}
+
+// authPolicy returns the authorization policy of a permanent entity
+func (t *TPM2) authPolicy(handle tpmutil.Handle) (tpm2.HashValue, bool) {
+	h, ok := t.hierarchies[handle]
+	if !ok || handle == tpm2.HandleNull {
+		return tpm2.HashValue{}, false
+	}
+	return h.authPolicy, true
+}
+
+// tpmProperties returns fixed and variable properties of the TPM in ascending order of tags
+func (t *TPM2) tpmProperties() []tpm2.TaggedProperty {
+	var loaded, persistent int
+	for handle := range t.objects {
+		switch uint32(handle) >> handleTypeShift {
+		case handleTypeTransient:
+			loaded++
+		case handleTypePersistent:
+			persistent++
+		}
+	}
+	var counters int
+	for _, nv := range t.nvIndices {
+		if nv.nvType() == nvTypeCounter {
+			counters++
+		}
+	}
+	t.updateLockout()
+
+	return []tpm2.TaggedProperty{
+		{Tag: tpm2.FamilyIndicator, Value: propertyString(specFamily)},
+		{Tag: tpm2.SpecLevel, Value: specLevel},
+		{Tag: tpm2.SpecRevision, Value: specRevision},
+		{Tag: tpm2.SpecDayOfYear, Value: specDayOfYear},
+		{Tag: tpm2.SpecYear, Value: specYear},
+		{Tag: tpm2.Manufacturer, Value: propertyString(manufacturer)},
+		{Tag: tpm2.VendorString1, Value: propertyString(vendorString)},
+		{Tag: tpm2.VendorString2, Value: propertyString(vendorString[4:])},
+		{Tag: tpm2.VendorString3},
+		{Tag: tpm2.VendorString4},
+		{Tag: tpm2.VendorTPMType},
+		{Tag: tpm2.FirmwareVersion1, Value: firmwareVersion},
+		{Tag: tpm2.FirmwareVersion2},
+		{Tag: tpm2.InputMaxBufferSize, Value: inputBufferSize},
+		{Tag: tpm2.TransientObjectsMin, Value: maxLoadedObjects},
+		{Tag: tpm2.PersistentObjectsMin, Value: maxPersistentObjects},
+		{Tag: tpm2.LoadedObjectsMin, Value: maxLoadedSessions},
+		{Tag: tpm2.ActiveSessionsMax, Value: maxLoadedSessions},
+		{Tag: tpm2.PCRCount, Value: uint32(t.pcrCount)},
+		{Tag: tpm2.PCRSelectMin, Value: uint32(PCRSelectSize(t.pcrCount))},
+		{Tag: tpm2.ContextGapMax, Value: maxContextGap},
+		{Tag: tpm2.NVCountersMax},
+		{Tag: tpm2.NVIndexMax, Value: maxNVIndexSize},
+		{Tag: tpm2.MemoryMethod},
+		{Tag: tpm2.ClockUpdate, Value: clockUpdate},
+		{Tag: tpm2.ContextHash, Value: uint32(tpm2.AlgSHA256)},
+		{Tag: tpm2.ContextSym, Value: uint32(tpm2.AlgAES)},
+		{Tag: tpm2.ContextSymSize, Value: 128},
+		{Tag: tpm2.OrderlyCount, Value: maxOrderlyCount},
+		{Tag: tpm2.CommandMaxSize, Value: maxCommandSize},
+		{Tag: tpm2.ResponseMaxSize, Value: maxResponseSize},
+		{Tag: tpm2.DigestMaxSize, Value: maxDigestSize},
+		{Tag: tpm2.ObjectContextMaxSize, Value: maxResponseSize},
+		{Tag: tpm2.SessionContextMaxSize, Value: maxResponseSize},
+		{Tag: tpm2.PSFamilyIndicator, Value: 1},
+		{Tag: tpm2.PSSpecLevel},
+		{Tag: tpm2.PSSpecRevision},
+		{Tag: tpm2.PSSpecDayOfYear},
+		{Tag: tpm2.PSSpecYear},
+		{Tag: tpm2.SplitSigningMax},
+		{Tag: tpm2.TotalCommands, Value: uint32(len(commandTable))},
+		{Tag: tpm2.LibraryCommands, Value: uint32(len(commandTable))},
+		{Tag: tpm2.VendorCommands},
+		{Tag: tpm2.NVMaxBufferSize, Value: maxNVBufferSize},
+		{Tag: tpm2.TPMModes},
+		{Tag: tpm2.CapabilityMaxBufferSize, Value: maxCapBuffer},
+
+		{Tag: tpm2.TPMAPermanent, Value: t.permanentAttributes()},
+		{Tag: tpm2.TPMAStartupClear, Value: t.startupClearAttributes()},
+		{Tag: tpm2.HRNVIndex, Value: uint32(len(t.nvIndices))},
+		{Tag: tpm2.HRLoaded, Value: uint32(len(t.sessions))},
+		{Tag: tpm2.HRLoadedAvail, Value: uint32(maxLoadedSessions - len(t.sessions))},
+		{Tag: tpm2.HRActive, Value: uint32(len(t.sessions))},
+		{Tag: tpm2.HRActiveAvail, Value: uint32(maxLoadedSessions - len(t.sessions))},
+		{Tag: tpm2.HRTransientAvail, Value: uint32(maxLoadedObjects - loaded)},
+		{Tag: tpm2.CurrentPersistent, Value: uint32(persistent)},
+		{Tag: tpm2.AvailPersistent, Value: uint32(maxPersistentObjects - persistent)},
+		{Tag: tpm2.NVCounters, Value: uint32(counters)},
+		{Tag: tpm2.NVCountersAvail, Value: uint32(maxNVIndices - len(t.nvIndices))},
+		{Tag: tpm2.AlgorithmSet},
+		{Tag: tpm2.LoadedCurves, Value: uint32(len(eccCurves))},
+		{Tag: tpm2.LockoutCounter, Value: t.da.failedTries},
+		{Tag: tpm2.MaxAuthFail, Value: t.da.maxTries},
+		{Tag: tpm2.LockoutInterval, Value: t.da.recoveryTime},
+		{Tag: tpm2.LockoutRecovery, Value: t.da.lockoutRecovery},
+		{Tag: tpm2.NVWriteRecovery},
+		{Tag: tpm2.AuditCounter0},
+		{Tag: tpm2.AuditCounter1},
+	}
+}
+
+// inLockout bit of TPMA_PERMANENT
+const permanentInLockout = 1 << 9
+
+// permanentAttributes builds TPMA_PERMANENT value, only the lockout is reported
+func (t *TPM2) permanentAttributes() uint32 {
+	if t.da.inLockout() {
+		return permanentInLockout
+	}
+	return 0
+}
+
+// Bits of TPMA_STARTUP_CLEAR
+const (
+	startupClearPHEnable   = 1 << 0
+	startupClearSHEnable   = 1 << 1
+	startupClearEHEnable   = 1 << 2
+	startupClearPHEnableNV = 1 << 3
+	startupClearOrderly    = 1 << 31
+)
+
+// startupClearAttributes builds TPMA_STARTUP_CLEAR value
+func (t *TPM2) startupClearAttributes() uint32 {
+	// all hierarchies are always enabled
+	attributes := uint32(startupClearPHEnable | startupClearSHEnable | startupClearEHEnable | startupClearPHEnableNV)
+	if t.orderlyStartup {
+		attributes |= startupClearOrderly
+	}
+	return attributes
+}
+
+// sortedCommands returns implemented command codes that satisfy a filter in ascending order
+func sortedCommands(filter func(cc tpmutil.Command) bool) []tpmutil.Command {
+	var codes []tpmutil.Command
+	for cc := range commandTable {
+		if filter(cc) {
+			codes = append(codes, cc)
+		}
+	}
+	sort.Slice(codes, func(i, j int) bool {
+		return codes[i] < codes[j]
+	})
+	return codes
+}
@@ -0,0 +1,53 @@
+package swtpm2
+
+import (
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// clockUpdate is the interval in milliseconds between updates of Clock in NV memory
+const clockUpdate = 1000
+
+// clockValue returns Clock, the number of milliseconds the TPM has been running since it was manufactured
+func (t *TPM2) clockValue() uint64 {
+	return t.clock + uint64(time.Since(t.clockStart)/time.Millisecond)
+}
+
+// setClock sets Clock to a given value that keeps advancing in real time
+func (t *TPM2) setClock(clock uint64) {
+	t.clock = clock
+	t.clockStart = time.Now()
+}
+
+// timeValue returns Time, the number of milliseconds since _TPM_Init
+func (t *TPM2) timeValue() uint64 {
+	return uint64(time.Since(t.timeStart) / time.Millisecond)
+}
+
+// clockInfo returns TPMS_CLOCK_INFO. Clock of the emulator never goes back, so it is always safe
+func (t *TPM2) clockInfo() tpm2.ClockInfo {
+	return tpm2.ClockInfo{
+		Clock:        t.clockValue(),
+		ResetCount:   t.resetCount,
+		RestartCount: t.restartCount,
+		Safe:         1,
+	}
+}
+
+// nvClock returns the value of Clock that is kept in NV memory. It is rounded up to the next update,
+// so Clock restored after a restart of the device is not behind the values reported before the state was saved
+func (t *TPM2) nvClock() uint64 {
+	return (t.clockValue()/clockUpdate + 1) * clockUpdate
+}
+
+// clockStartup updates resetCount and restartCount: TPM Reset increments resetCount and clears restartCount,
+// TPM Restart and TPM Resume increment restartCount
+func (t *TPM2) clockStartup(reset bool) {
+	if reset {
+		t.resetCount++
+		t.restartCount = 0
+		return
+	}
+	t.restartCount++
+}
@@ -0,0 +1,133 @@
+package swtpm2
+
+import (
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// handleSize is the size of a marshalled handle
+const handleSize = 4
+
+// Command codes that are missing in go-tpm
+const (
+	cmdPCRAllocate             tpmutil.Command = 0x0000012B
+	cmdNVGlobalWriteLock       tpmutil.Command = 0x00000132
+	cmdNVSetBits               tpmutil.Command = 0x00000135
+	cmdNVExtend                tpmutil.Command = 0x00000136
+	cmdNVChangeAuth            tpmutil.Command = 0x0000013B
+	cmdPolicyNV                tpmutil.Command = 0x00000149
+	cmdDuplicate               tpmutil.Command = 0x0000014B
+	cmdObjectChangeAuth        tpmutil.Command = 0x00000150
+	cmdPolicyCpHash            tpmutil.Command = 0x00000163
+	cmdPolicyAuthorize         tpmutil.Command = 0x0000016A
+	cmdPolicyAuthValue         tpmutil.Command = 0x0000016B
+	cmdPolicyCounterTimer      tpmutil.Command = 0x0000016D
+	cmdPolicyLocality          tpmutil.Command = 0x0000016F
+	cmdPolicyNameHash          tpmutil.Command = 0x00000170
+	cmdPolicyTicket            tpmutil.Command = 0x00000172
+	cmdVerifySignature         tpmutil.Command = 0x00000177
+	cmdPolicyRestart           tpmutil.Command = 0x00000180
+	cmdNVCertify               tpmutil.Command = 0x00000184
+	cmdPolicyPhysicalPresence  tpmutil.Command = 0x00000187
+	cmdPolicyDuplicationSelect tpmutil.Command = 0x00000188
+	cmdPolicyNvWritten         tpmutil.Command = 0x0000018F
+	cmdPolicyTemplate          tpmutil.Command = 0x00000190
+	cmdPolicyAuthorizeNV       tpmutil.Command = 0x00000192
+)
+
+// commandInfo describes the layout of a command and its response
+type commandInfo struct {
+	// handles is the number of handles in the handle area of the command
+	handles int
+	// authHandles is the number of leading handles that require authorization
+	authHandles int
+	// responseHandle is set when the response contains a handle
+	responseHandle bool
+	// nvAccess tells whether the command reads or writes an NV index authorized with its own authorization
+	nvAccess nvAccess
+	// adminRole is set when an object that is the first authorized handle is authorized in the ADMIN role,
+	// other objects are authorized in the USER role
+	adminRole bool
+	// decrypt and encrypt are set when the first parameter of the command or of the response is a sized buffer
+	// that a session may encrypt
+	decrypt bool
+	encrypt bool
+}
+
+// commandTable contains layouts of all supported commands
+var commandTable = map[tpmutil.Command]commandInfo{
+	tpm2.CmdStartup:          {},
+	tpm2.CmdShutdown:         {},
+	tpm2.CmdReadPublic:       {handles: 1, encrypt: true},
+	tpm2.CmdReadPublicNV:     {handles: 1, encrypt: true},
+	tpm2.CmdGetCapability:    {},
+	tpm2.CmdStartAuthSession: {handles: 2, responseHandle: true, decrypt: true, encrypt: true},
+	tpm2.CmdCreatePrimary:    {handles: 1, authHandles: 1, responseHandle: true, decrypt: true, encrypt: true},
+	tpm2.CmdCreate:           {handles: 1, authHandles: 1, decrypt: true, encrypt: true},
+	tpm2.CmdLoad:             {handles: 1, authHandles: 1, responseHandle: true, decrypt: true, encrypt: true},
+	tpm2.CmdLoadExternal:     {responseHandle: true, decrypt: true, encrypt: true},
+	cmdObjectChangeAuth:      {handles: 2, authHandles: 1, adminRole: true, decrypt: true, encrypt: true},
+	tpm2.CmdFlushContext:     {},
+	tpm2.CmdEvictControl:     {handles: 2, authHandles: 1},
+	tpm2.CmdPCRExtend:        {handles: 1, authHandles: 1},
+	tpm2.CmdPCREvent:         {handles: 1, authHandles: 1, decrypt: true},
+	tpm2.CmdPCRRead:          {},
+	tpm2.CmdPCRReset:         {handles: 1, authHandles: 1},
+	cmdPCRAllocate:           {handles: 1, authHandles: 1},
+
+	tpm2.CmdDefineSpace:            {handles: 1, authHandles: 1, decrypt: true},
+	tpm2.CmdUndefineSpace:          {handles: 2, authHandles: 1},
+	tpm2.CmdNVUndefineSpaceSpecial: {handles: 2, authHandles: 2},
+	tpm2.CmdWriteNV:                {handles: 2, authHandles: 1, nvAccess: nvAccessWrite, decrypt: true},
+	tpm2.CmdReadNV:                 {handles: 2, authHandles: 1, nvAccess: nvAccessRead, encrypt: true},
+	tpm2.CmdIncrementNVCounter:     {handles: 2, authHandles: 1, nvAccess: nvAccessWrite},
+	cmdNVSetBits:                   {handles: 2, authHandles: 1, nvAccess: nvAccessWrite},
+	cmdNVExtend:                    {handles: 2, authHandles: 1, nvAccess: nvAccessWrite, decrypt: true},
+	tpm2.CmdWriteLockNV:            {handles: 2, authHandles: 1, nvAccess: nvAccessWrite},
+	tpm2.CmdReadLockNV:             {handles: 2, authHandles: 1, nvAccess: nvAccessRead},
+	cmdNVGlobalWriteLock:           {handles: 1, authHandles: 1},
+	cmdNVChangeAuth:                {handles: 1, authHandles: 1, decrypt: true},
+	cmdNVCertify:                   {handles: 3, authHandles: 2, nvAccess: nvAccessRead, decrypt: true, encrypt: true},
+	cmdVerifySignature:             {handles: 1, decrypt: true},
+
+	tpm2.CmdPolicySigned:       {handles: 2, decrypt: true, encrypt: true},
+	tpm2.CmdPolicySecret:       {handles: 2, authHandles: 1, nvAccess: nvAccessRead, decrypt: true, encrypt: true}, // the authValue of an index is used like for reading
+	cmdPolicyTicket:            {handles: 1, decrypt: true},
+	tpm2.CmdPolicyPCR:          {handles: 1, decrypt: true},
+	tpm2.CmdPolicyOr:           {handles: 1},
+	tpm2.CmdPolicyGetDigest:    {handles: 1, encrypt: true},
+	cmdPolicyRestart:           {handles: 1},
+	cmdPolicyAuthorize:         {handles: 1, decrypt: true},
+	cmdPolicyAuthorizeNV:       {handles: 3, authHandles: 1, nvAccess: nvAccessRead},
+	cmdPolicyNV:                {handles: 3, authHandles: 1, nvAccess: nvAccessRead, decrypt: true},
+	cmdPolicyCounterTimer:      {handles: 1, decrypt: true},
+	cmdPolicyNvWritten:         {handles: 1},
+	tpm2.CmdPolicyCommandCode:  {handles: 1},
+	cmdPolicyCpHash:            {handles: 1, decrypt: true},
+	cmdPolicyNameHash:          {handles: 1, decrypt: true},
+	cmdPolicyDuplicationSelect: {handles: 1, decrypt: true},
+	cmdPolicyTemplate:          {handles: 1, decrypt: true},
+	cmdPolicyAuthValue:         {handles: 1},
+	tpm2.CmdPolicyPassword:     {handles: 1},
+	cmdPolicyLocality:          {handles: 1},
+	cmdPolicyPhysicalPresence:  {handles: 1},
+
+	tpm2.CmdDictionaryAttackLockReset:  {handles: 1, authHandles: 1},
+	tpm2.CmdDictionaryAttackParameters: {handles: 1, authHandles: 1},
+}
+
+// Bits of TPMA_CC
+const (
+	ccCommandIndexMask = 0x0000FFFF
+	ccHandlesShift     = 25
+	ccRHandle          = 1 << 28
+)
+
+// attributes builds TPMA_CC value of a command
+func (ci commandInfo) attributes(cc tpmutil.Command) CommandAttributes {
+	attributes := CommandAttributes(uint32(cc)&ccCommandIndexMask) | CommandAttributes(ci.handles)<<ccHandlesShift
+	if ci.responseHandle {
+		attributes |= ccRHandle
+	}
+	return attributes
+}
@@ -2,6 +2,7 @@
 package swtpm2
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
@@ -10,16 +11,90 @@ import (
 	"github.com/google/go-tpm/tpmutil"
 )
 
-var RCFail = tpmutil.RCSuccess + 1
-
 // Commands represents an interface to all supported TPM2 commands
 type Commands interface {
+	// BeginCommand is invoked before the execution of every command, it validates the authorization area
+	// and decrypts the first parameter in place
+	BeginCommand(cmd *CommandContext) error
+	// EndCommand is invoked after successful execution of a command, it builds the response authorization area
+	// and encrypts the first response parameter in place
+	EndCommand(cmd *CommandContext, responseParameters []byte) ([]AuthResponse, error)
+
+	Startup(startupType tpm2.StartupType, locality uint8) error
+	Shutdown(shutdownType tpm2.StartupType) error
+
 	ReadPublic(handle tpmutil.Handle) (*ReadPublicResponse, error)
-	ReadPublicNV(index tpmutil.Handle) (*tpm2.NVPublic, error)
+	ReadPublicNV(index tpmutil.Handle) (*ReadPublicNVResponse, error)
 	// GetCapability division
+	// Every method returns at most `count` values starting from `property` and whether more values are available
+	GetCapabilityAlgs(count, property uint32) ([]tpm2.AlgorithmDescription, bool, error)
+	GetCapabilityHandles(count, property uint32) ([]tpmutil.Handle, bool, error)
+	GetCapabilityCommands(count, property uint32) ([]CommandAttributes, bool, error)
+	GetCapabilityPPCommands(count, property uint32) ([]tpmutil.Command, bool, error)
+	GetCapabilityAuditCommands(count, property uint32) ([]tpmutil.Command, bool, error)
 	GetCapabilityPCRs(count, property uint32) ([]tpm2.PCRSelection, error)
+	GetCapabilityTPMProperties(count, property uint32) ([]tpm2.TaggedProperty, bool, error)
+	GetCapabilityPCRProperties(count, property uint32) ([]TaggedPCRSelect, bool, error)
+	GetCapabilityECCCurves(count, property uint32) ([]tpm2.EllipticCurve, bool, error)
+	GetCapabilityAuthPolicies(count, property uint32) ([]TaggedPolicy, bool, error)
+
+	CreatePrimary(primaryHandle tpmutil.Handle, inSensitive SensitiveCreate, inPublic tpm2.Public, outsideInfo []byte, creationPCR []tpm2.PCRSelection) (*CreatePrimaryResponse, error)
+	Create(parentHandle tpmutil.Handle, inSensitive SensitiveCreate, inPublic tpm2.Public, outsideInfo []byte, creationPCR []tpm2.PCRSelection) (*CreateResponse, error)
+	Load(parentHandle tpmutil.Handle, inPrivate []byte, inPublic tpm2.Public) (tpmutil.Handle, []byte, error)
+	LoadExternal(inPrivate *tpm2.Private, inPublic tpm2.Public, hierarchy tpmutil.Handle) (tpmutil.Handle, []byte, error)
+	ObjectChangeAuth(objectHandle, parentHandle tpmutil.Handle, newAuth []byte) ([]byte, error)
+	FlushContext(flushHandle tpmutil.Handle) error
+	EvictControl(auth, objectHandle, persistentHandle tpmutil.Handle) error
+
+	PCRExtend(pcrHandle tpmutil.Handle, digests []tpm2.HashValue) error
+	PCREvent(pcrHandle tpmutil.Handle, eventData []byte) ([]tpm2.HashValue, error)
+	PCRRead(pcrSelection []tpm2.PCRSelection) (*PCRReadResponse, error)
+	PCRReset(pcrHandle tpmutil.Handle) error
+	PCRAllocate(authHandle tpmutil.Handle, pcrAllocation []tpm2.PCRSelection) (*PCRAllocateResponse, error)
+
+	NVDefineSpace(authHandle tpmutil.Handle, auth []byte, publicInfo tpm2.NVPublic) error
+	NVUndefineSpace(authHandle, nvIndex tpmutil.Handle) error
+	NVUndefineSpaceSpecial(nvIndex, platform tpmutil.Handle) error
+	NVWrite(authHandle, nvIndex tpmutil.Handle, data []byte, offset uint16) error
+	NVRead(authHandle, nvIndex tpmutil.Handle, size, offset uint16) ([]byte, error)
+	NVIncrement(authHandle, nvIndex tpmutil.Handle) error
+	NVSetBits(authHandle, nvIndex tpmutil.Handle, bits uint64) error
+	NVExtend(authHandle, nvIndex tpmutil.Handle, data []byte) error
+	NVWriteLock(authHandle, nvIndex tpmutil.Handle) error
+	NVReadLock(authHandle, nvIndex tpmutil.Handle) error
+	NVGlobalWriteLock(authHandle tpmutil.Handle) error
+	NVChangeAuth(nvIndex tpmutil.Handle, newAuth []byte) error
+	NVCertify(signHandle, authHandle, nvIndex tpmutil.Handle, qualifyingData []byte, inScheme *tpm2.SigScheme, size, offset uint16) (*NVCertifyResponse, error)
+
+	StartAuthSession(tpmKey, bindKey tpmutil.Handle, nonceCaller, encryptedSalt []byte, sessionType tpm2.SessionType,
+		symmetric tpm2.SymScheme, authHash tpm2.Algorithm) (tpmutil.Handle, []byte, error)
+
+	VerifySignature(keyHandle tpmutil.Handle, digest []byte, signature *tpm2.Signature) (tpm2.Ticket, error)
+
+	PolicySigned(authObject, policySession tpmutil.Handle, nonceTPM, cpHashA, policyRef []byte, expiration int32, auth *tpm2.Signature) (*PolicyAuthResponse, error)
+	PolicySecret(authHandle, policySession tpmutil.Handle, nonceTPM, cpHashA, policyRef []byte, expiration int32) (*PolicyAuthResponse, error)
+	PolicyTicket(policySession tpmutil.Handle, timeout, cpHashA, policyRef, authName []byte, ticket tpm2.Ticket) error
+	PolicyPCR(policySession tpmutil.Handle, pcrDigest []byte, pcrs []tpm2.PCRSelection, encodedPCRs []byte) error
+	PolicyOR(policySession tpmutil.Handle, pHashList [][]byte) error
+	PolicyGetDigest(policySession tpmutil.Handle) ([]byte, error)
+	PolicyRestart(sessionHandle tpmutil.Handle) error
+	PolicyAuthorize(policySession tpmutil.Handle, approvedPolicy, policyRef, keySign []byte, checkTicket tpm2.Ticket) error
+	PolicyAuthorizeNV(authHandle, nvIndex, policySession tpmutil.Handle) error
+	PolicyNV(authHandle, nvIndex, policySession tpmutil.Handle, operandB []byte, offset, operation uint16) error
+	PolicyCounterTimer(policySession tpmutil.Handle, operandB []byte, offset, operation uint16) error
+	PolicyNvWritten(policySession tpmutil.Handle, writtenSet bool) error
+	PolicyCommandCode(policySession tpmutil.Handle, code tpmutil.Command) error
+	PolicyCpHash(policySession tpmutil.Handle, cpHashA []byte) error
+	PolicyNameHash(policySession tpmutil.Handle, nameHash []byte) error
+	PolicyDuplicationSelect(policySession tpmutil.Handle, objectName, newParentName []byte, includeObject bool) error
+	PolicyTemplate(policySession tpmutil.Handle, templateHash []byte) error
+	PolicyAuthValue(policySession tpmutil.Handle) error
+	PolicyPassword(policySession tpmutil.Handle) error
+	PolicyLocality(policySession tpmutil.Handle, locality byte) error
+	PolicyPhysicalPresence(policySession tpmutil.Handle) error
 
-	StartAuthSession(tpmKey, bindKey tpmutil.Handle, nonceCaller, secret []byte, se tpm2.SessionType, sym, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error)
+	DictionaryAttackLockReset(lockHandle tpmutil.Handle) error
+	DictionaryAttackParameters(lockHandle tpmutil.Handle, newMaxTries, newRecoveryTime, lockoutRecovery uint32) error
 }
 
 // NewLoopProcessCommand processes a sequence of commands until an error is obtained
@@ -40,16 +115,53 @@ func NewLoopProcessCommand(commands Commands) func(rw io.ReadWriter) {
 // ProcessCommand tries to decode command and invoke an appropriate method of `Commands` interface
 // Returns an error if further commands processing is impossible
 func ProcessCommand(r io.Reader, commands Commands) ([]byte, error) {
+	return ProcessCommandAtLocality(r, 0, commands)
+}
+
+// ProcessCommandAtLocality processes a command received at a given locality
+func ProcessCommandAtLocality(r io.Reader, locality uint8, commands Commands) ([]byte, error) {
 	ch, commandBuffer, err := ParseCommandHeader(r)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read input command, err: %v", err)
 	}
 
-	b, err := executeCommand(ch, commandBuffer, commands)
+	cmd, err := ParseCommandContext(ch, commandBuffer)
+	if err != nil {
+		return PackWithResponseHeader(tpm2.TagNoSessions, ResponseCode(err), nil)
+	}
+	cmd.Locality = locality
+
+	b, err := processCommand(cmd, commands)
 	if err != nil {
-		return PackWithResponseHeader(tpm2.TagNoSessions, RCFail, nil)
+		return PackWithResponseHeader(tpm2.TagNoSessions, ResponseCode(err), nil)
 	}
-	return PackWithResponseHeader(tpm2.TagNoSessions, tpmutil.RCSuccess, b)
+	return PackWithResponseHeader(ch.Tag, tpmutil.RCSuccess, b)
+}
+
+// processCommand executes a parsed command and builds the response body
+func processCommand(cmd *CommandContext, commands Commands) ([]byte, error) {
+	if err := commands.BeginCommand(cmd); err != nil {
+		return nil, err
+	}
+
+	b, err := executeCommand(cmd, commands)
+	if err != nil {
+		return nil, err
+	}
+
+	var responseHandles []byte
+	if commandTable[cmd.Header.Cmd].responseHandle {
+		if len(b) < handleSize {
+			return nil, fmt.Errorf("response of command %d does not contain a handle", cmd.Header.Cmd)
+		}
+		responseHandles, b = b[:handleSize], b[handleSize:]
+	}
+
+	sessions, err := commands.EndCommand(cmd, b)
+	if err != nil {
+		return nil, err
+	}
+	return packResponse(cmd.Header.Tag, responseHandles, b, sessions)
 }
 
 // ParseCommandHeader tries to obtain a command from the input byte stream
@@ -84,91 +196,680 @@ func ParseCommandHeader(r io.Reader) (CommandHeader, []byte, error) {
 	return ch, commandBuffer, err
 }
 
-func executeCommand(ch CommandHeader, b []byte, commands Commands) ([]byte, error) {
-	switch ch.Cmd {
-	case tpm2.CmdReadPublic:
-		var handle tpmutil.Handle
-		_, err := tpmutil.Unpack(b, &handle)
+// unpackParameters unmarshals command parameters one by one,
+// TPM_RC_INSUFFICIENT is reported with the index of the parameter that could not be read
+func unpackParameters(b []byte, parameters ...interface{}) (int, error) {
+	var read int
+	for i, p := range parameters {
+		n, err := tpmutil.Unpack(b[read:], p)
 		if err != nil {
+			return read, parameterError(tpm2.RCInsufficient, i+1)
+		}
+		read += n
+	}
+	return read, nil
+}
+
+func executeCommand(cmd *CommandContext, commands Commands) ([]byte, error) {
+	switch cmd.Header.Cmd {
+	case tpm2.CmdStartup:
+		var startupType tpm2.StartupType
+		if _, err := unpackParameters(cmd.Parameters, &startupType); err != nil {
 			return nil, err
 		}
-		resp, err := commands.ReadPublic(handle)
+		return nil, commands.Startup(startupType, cmd.Locality)
+	case tpm2.CmdShutdown:
+		var shutdownType tpm2.StartupType
+		if _, err := unpackParameters(cmd.Parameters, &shutdownType); err != nil {
+			return nil, err
+		}
+		return nil, commands.Shutdown(shutdownType)
+	case tpm2.CmdReadPublic:
+		resp, err := commands.ReadPublic(cmd.Handles[0])
 		if err != nil {
 			return nil, err
 		}
 		return resp.Encode()
 	case tpm2.CmdReadPublicNV:
-		var index tpmutil.Handle
-		_, err := tpmutil.Unpack(b, &index)
+		resp, err := commands.ReadPublicNV(cmd.Handles[0])
+		if err != nil {
+			return nil, err
+		}
+		return resp.Encode()
+	case tpm2.CmdGetCapability:
+		return executeGetCapability(cmd.Parameters, commands)
+	case tpm2.CmdCreatePrimary:
+		inSensitive, inPublic, outsideInfo, creationPCR, err := unpackCreateParameters(cmd.Parameters)
 		if err != nil {
 			return nil, err
 		}
-		resp, err := commands.ReadPublicNV(index)
+		resp, err := commands.CreatePrimary(cmd.Handles[0], inSensitive, inPublic, outsideInfo, creationPCR)
 		if err != nil {
 			return nil, err
 		}
-		raw, err := tpmutil.Pack(*resp)
+		return resp.Encode()
+	case tpm2.CmdCreate:
+		inSensitive, inPublic, outsideInfo, creationPCR, err := unpackCreateParameters(cmd.Parameters)
 		if err != nil {
 			return nil, err
 		}
-		return tpmutil.Pack(tpmutil.U16Bytes(raw))
-	case tpm2.CmdGetCapability:
-		var capa tpm2.Capability
-		var count uint32
-		var property uint32
-
-		_, err := tpmutil.Unpack(b, &capa, &property, &count)
+		resp, err := commands.Create(cmd.Handles[0], inSensitive, inPublic, outsideInfo, creationPCR)
 		if err != nil {
 			return nil, err
 		}
+		return resp.Encode()
+	case tpm2.CmdLoad:
+		var inPrivate tpmutil.U16Bytes
+		var inPublic tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &inPrivate, &inPublic); err != nil {
+			return nil, err
+		}
+		public, err := tpm2.DecodePublic(inPublic)
+		if err != nil {
+			return nil, parameterError(tpm2.RCSize, 2)
+		}
 
-		switch capa {
-		case tpm2.CapabilityPCRs:
-			pcrs, err := commands.GetCapabilityPCRs(count, property)
-			if err != nil {
-				return nil, err
-			}
-			pcrSelection, err := EncodePCRSelection(pcrs...)
-			if err != nil {
-				return nil, err
-			}
-
-			header, err := tpmutil.Pack(false, tpm2.CapabilityPCRs)
-			if err != nil {
-				return nil, err
+		handle, name, err := commands.Load(cmd.Handles[0], inPrivate, public)
+		if err != nil {
+			return nil, err
+		}
+		return tpmutil.Pack(handle, tpmutil.U16Bytes(name))
+	case tpm2.CmdLoadExternal:
+		var inPrivate, inPublic tpmutil.U16Bytes
+		var hierarchy tpmutil.Handle
+		if _, err := unpackParameters(cmd.Parameters, &inPrivate, &inPublic, &hierarchy); err != nil {
+			return nil, err
+		}
+		// inPrivate is optional, an empty buffer loads the public area only
+		var sensitive *tpm2.Private
+		if len(inPrivate) > 0 {
+			sensitive = new(tpm2.Private)
+			if read, err := tpmutil.Unpack(inPrivate, sensitive); err != nil || read != len(inPrivate) {
+				return nil, parameterError(tpm2.RCSize, 1)
 			}
-
-			result := header
-			result = append(result, pcrSelection...)
-			return result, nil
-		default:
-			return nil, fmt.Errorf("capability %d is not supported", capa)
+		}
+		public, err := tpm2.DecodePublic(inPublic)
+		if err != nil {
+			return nil, parameterError(tpm2.RCSize, 2)
 		}
 
+		handle, name, err := commands.LoadExternal(sensitive, public, hierarchy)
+		if err != nil {
+			return nil, err
+		}
+		return tpmutil.Pack(handle, tpmutil.U16Bytes(name))
+	case cmdObjectChangeAuth:
+		var newAuth tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &newAuth); err != nil {
+			return nil, err
+		}
+		outPrivate, err := commands.ObjectChangeAuth(cmd.Handles[0], cmd.Handles[1], newAuth)
+		if err != nil {
+			return nil, err
+		}
+		return tpmutil.Pack(tpmutil.U16Bytes(outPrivate))
+	case tpm2.CmdFlushContext:
+		var flushHandle tpmutil.Handle
+		if _, err := unpackParameters(cmd.Parameters, &flushHandle); err != nil {
+			return nil, err
+		}
+		return nil, commands.FlushContext(flushHandle)
+	case tpm2.CmdEvictControl:
+		var persistentHandle tpmutil.Handle
+		if _, err := unpackParameters(cmd.Parameters, &persistentHandle); err != nil {
+			return nil, err
+		}
+		return nil, commands.EvictControl(cmd.Handles[0], cmd.Handles[1], persistentHandle)
+	case tpm2.CmdPCRExtend:
+		digests, err := unpackDigestValues(cmd.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		return nil, commands.PCRExtend(cmd.Handles[0], digests)
+	case tpm2.CmdPCREvent:
+		var eventData tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &eventData); err != nil {
+			return nil, err
+		}
+		if len(eventData) > maxEventSize {
+			return nil, parameterError(tpm2.RCSize, 1)
+		}
+		digests, err := commands.PCREvent(cmd.Handles[0], eventData)
+		if err != nil {
+			return nil, err
+		}
+		return EncodeDigestValues(digests)
+	case tpm2.CmdPCRRead:
+		pcrSelection, sizeOfSelect, err := DecodePCRSelectionWithSize(bytes.NewBuffer(cmd.Parameters))
+		if err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 1)
+		}
+		resp, err := commands.PCRRead(pcrSelection)
+		if err != nil {
+			return nil, err
+		}
+		// pcrSelectionOut has the same layout as pcrSelectionIn
+		resp.SizeOfSelect = sizeOfSelect
+		return resp.Encode()
+	case tpm2.CmdPCRReset:
+		return nil, commands.PCRReset(cmd.Handles[0])
+	case cmdPCRAllocate:
+		pcrAllocation, err := DecodePCRSelection(bytes.NewBuffer(cmd.Parameters))
+		if err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 1)
+		}
+		resp, err := commands.PCRAllocate(cmd.Handles[0], pcrAllocation)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Encode()
+	case tpm2.CmdDefineSpace:
+		var auth, publicInfo tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &auth, &publicInfo); err != nil {
+			return nil, err
+		}
+		var public tpm2.NVPublic
+		if n, err := tpmutil.Unpack(publicInfo, &public); err != nil || n != len(publicInfo) {
+			return nil, parameterError(tpm2.RCSize, defineSpacePublicInfoIndex)
+		}
+		return nil, commands.NVDefineSpace(cmd.Handles[0], auth, public)
+	case tpm2.CmdUndefineSpace:
+		return nil, commands.NVUndefineSpace(cmd.Handles[0], cmd.Handles[1])
+	case tpm2.CmdNVUndefineSpaceSpecial:
+		return nil, commands.NVUndefineSpaceSpecial(cmd.Handles[0], cmd.Handles[1])
+	case tpm2.CmdWriteNV:
+		var data tpmutil.U16Bytes
+		var offset uint16
+		if _, err := unpackParameters(cmd.Parameters, &data, &offset); err != nil {
+			return nil, err
+		}
+		if len(data) > maxNVBufferSize {
+			return nil, parameterError(tpm2.RCSize, 1)
+		}
+		return nil, commands.NVWrite(cmd.Handles[0], cmd.Handles[1], data, offset)
+	case tpm2.CmdReadNV:
+		var size, offset uint16
+		if _, err := unpackParameters(cmd.Parameters, &size, &offset); err != nil {
+			return nil, err
+		}
+		data, err := commands.NVRead(cmd.Handles[0], cmd.Handles[1], size, offset)
+		if err != nil {
+			return nil, err
+		}
+		return tpmutil.Pack(tpmutil.U16Bytes(data))
+	case tpm2.CmdIncrementNVCounter:
+		return nil, commands.NVIncrement(cmd.Handles[0], cmd.Handles[1])
+	case cmdNVSetBits:
+		var bits uint64
+		if _, err := unpackParameters(cmd.Parameters, &bits); err != nil {
+			return nil, err
+		}
+		return nil, commands.NVSetBits(cmd.Handles[0], cmd.Handles[1], bits)
+	case cmdNVExtend:
+		var data tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &data); err != nil {
+			return nil, err
+		}
+		if len(data) > maxNVBufferSize {
+			return nil, parameterError(tpm2.RCSize, 1)
+		}
+		return nil, commands.NVExtend(cmd.Handles[0], cmd.Handles[1], data)
+	case tpm2.CmdWriteLockNV:
+		return nil, commands.NVWriteLock(cmd.Handles[0], cmd.Handles[1])
+	case tpm2.CmdReadLockNV:
+		return nil, commands.NVReadLock(cmd.Handles[0], cmd.Handles[1])
+	case cmdNVGlobalWriteLock:
+		return nil, commands.NVGlobalWriteLock(cmd.Handles[0])
+	case cmdNVChangeAuth:
+		var newAuth tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &newAuth); err != nil {
+			return nil, err
+		}
+		return nil, commands.NVChangeAuth(cmd.Handles[0], newAuth)
+	case cmdNVCertify:
+		var qualifyingData tpmutil.U16Bytes
+		n, err := unpackParameters(cmd.Parameters, &qualifyingData)
+		if err != nil {
+			return nil, err
+		}
+		if len(qualifyingData) > maxQualifyingDataSize {
+			return nil, parameterError(tpm2.RCSize, 1)
+		}
+		buf := bytes.NewBuffer(cmd.Parameters[n:])
+		inScheme, err := decodeSigScheme(buf, 2)
+		if err != nil {
+			return nil, err
+		}
+		var size, offset uint16
+		if _, err := unpackParameters(buf.Bytes(), &size, &offset); err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 3)
+		}
+		resp, err := commands.NVCertify(cmd.Handles[0], cmd.Handles[1], cmd.Handles[2], qualifyingData, inScheme, size, offset)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Encode()
 	case tpm2.CmdStartAuthSession:
-		var tpmKey tpmutil.Handle
-		var bindKey tpmutil.Handle
+		var nonceCaller, encryptedSalt tpmutil.U16Bytes
+		var sessionType tpm2.SessionType
+		n, err := unpackParameters(cmd.Parameters, &nonceCaller, &encryptedSalt, &sessionType)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(cmd.Parameters[n:])
+		symmetric, err := decodeSymDef(buf, 4)
+		if err != nil {
+			return nil, err
+		}
+		var authHash tpm2.Algorithm
+		if err := tpmutil.UnpackBuf(buf, &authHash); err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 5)
+		}
 
-		read, err := tpmutil.Unpack(b, &tpmKey, &bindKey)
+		handle, nonce, err := commands.StartAuthSession(cmd.Handles[0], cmd.Handles[1], nonceCaller, encryptedSalt,
+			sessionType, symmetric, authHash)
 		if err != nil {
 			return nil, err
 		}
 
-		var nonceCaller tpmutil.U16Bytes
-		var secret tpmutil.U16Bytes
-		var se tpm2.SessionType
-		var sym tpm2.Algorithm
-		var hashAlg tpm2.Algorithm
-		if _, err = tpmutil.Unpack(b[read:], &nonceCaller, &secret, &se, &sym, &hashAlg); err != nil {
+		return tpmutil.Pack(handle, tpmutil.U16Bytes(nonce))
+	case cmdVerifySignature:
+		var digest tpmutil.U16Bytes
+		n, err := unpackParameters(cmd.Parameters, &digest)
+		if err != nil {
+			return nil, err
+		}
+		signature, err := tpm2.DecodeSignature(bytes.NewBuffer(cmd.Parameters[n:]))
+		if err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 2)
+		}
+		validation, err := commands.VerifySignature(cmd.Handles[0], digest, signature)
+		if err != nil {
 			return nil, err
 		}
+		return tpmutil.Pack(validation)
+	case tpm2.CmdPolicySigned:
+		var nonceTPM, cpHashA, policyRef tpmutil.U16Bytes
+		var expiration int32
+		n, err := unpackParameters(cmd.Parameters, &nonceTPM, &cpHashA, &policyRef, &expiration)
+		if err != nil {
+			return nil, err
+		}
+		auth, err := tpm2.DecodeSignature(bytes.NewBuffer(cmd.Parameters[n:]))
+		if err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 5)
+		}
+		resp, err := commands.PolicySigned(cmd.Handles[0], cmd.Handles[1], nonceTPM, cpHashA, policyRef, expiration, auth)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Encode()
+	case tpm2.CmdPolicySecret:
+		var nonceTPM, cpHashA, policyRef tpmutil.U16Bytes
+		var expiration int32
+		if _, err := unpackParameters(cmd.Parameters, &nonceTPM, &cpHashA, &policyRef, &expiration); err != nil {
+			return nil, err
+		}
+		resp, err := commands.PolicySecret(cmd.Handles[0], cmd.Handles[1], nonceTPM, cpHashA, policyRef, expiration)
+		if err != nil {
+			return nil, err
+		}
+		return resp.Encode()
+	case cmdPolicyTicket:
+		var timeout, cpHashA, policyRef, authName tpmutil.U16Bytes
+		var ticket tpm2.Ticket
+		if _, err := unpackParameters(cmd.Parameters, &timeout, &cpHashA, &policyRef, &authName, &ticket); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyTicket(cmd.Handles[0], timeout, cpHashA, policyRef, authName, ticket)
+	case tpm2.CmdPolicyPCR:
+		var pcrDigest tpmutil.U16Bytes
+		n, err := unpackParameters(cmd.Parameters, &pcrDigest)
+		if err != nil {
+			return nil, err
+		}
+		buf := bytes.NewBuffer(cmd.Parameters[n:])
+		pcrs, _, err := DecodePCRSelectionWithSize(buf)
+		if err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, 2)
+		}
+		// the policy is extended with the selection as sent, sizeofSelect included
+		encodedPCRs := cmd.Parameters[n : len(cmd.Parameters)-buf.Len()]
+		return nil, commands.PolicyPCR(cmd.Handles[0], pcrDigest, pcrs, encodedPCRs)
+	case tpm2.CmdPolicyOr:
+		pHashList, err := unpackDigestList(cmd.Parameters)
+		if err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyOR(cmd.Handles[0], pHashList)
+	case tpm2.CmdPolicyGetDigest:
+		policyDigest, err := commands.PolicyGetDigest(cmd.Handles[0])
+		if err != nil {
+			return nil, err
+		}
+		return tpmutil.Pack(tpmutil.U16Bytes(policyDigest))
+	case cmdPolicyRestart:
+		return nil, commands.PolicyRestart(cmd.Handles[0])
+	case cmdPolicyAuthorize:
+		var approvedPolicy, policyRef, keySign tpmutil.U16Bytes
+		var checkTicket tpm2.Ticket
+		if _, err := unpackParameters(cmd.Parameters, &approvedPolicy, &policyRef, &keySign, &checkTicket); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyAuthorize(cmd.Handles[0], approvedPolicy, policyRef, keySign, checkTicket)
+	case cmdPolicyAuthorizeNV:
+		return nil, commands.PolicyAuthorizeNV(cmd.Handles[0], cmd.Handles[1], cmd.Handles[2])
+	case cmdPolicyNV:
+		var operandB tpmutil.U16Bytes
+		var offset, operation uint16
+		if _, err := unpackParameters(cmd.Parameters, &operandB, &offset, &operation); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyNV(cmd.Handles[0], cmd.Handles[1], cmd.Handles[2], operandB, offset, operation)
+	case cmdPolicyCounterTimer:
+		var operandB tpmutil.U16Bytes
+		var offset, operation uint16
+		if _, err := unpackParameters(cmd.Parameters, &operandB, &offset, &operation); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyCounterTimer(cmd.Handles[0], operandB, offset, operation)
+	case cmdPolicyNvWritten:
+		var writtenSet byte
+		if _, err := unpackParameters(cmd.Parameters, &writtenSet); err != nil {
+			return nil, err
+		}
+		if writtenSet > 1 {
+			return nil, parameterError(tpm2.RCValue, 1)
+		}
+		return nil, commands.PolicyNvWritten(cmd.Handles[0], writtenSet == 1)
+	case tpm2.CmdPolicyCommandCode:
+		var code tpmutil.Command
+		if _, err := unpackParameters(cmd.Parameters, &code); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyCommandCode(cmd.Handles[0], code)
+	case cmdPolicyCpHash:
+		var cpHashA tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &cpHashA); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyCpHash(cmd.Handles[0], cpHashA)
+	case cmdPolicyNameHash:
+		var nameHash tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &nameHash); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyNameHash(cmd.Handles[0], nameHash)
+	case cmdPolicyDuplicationSelect:
+		var objectName, newParentName tpmutil.U16Bytes
+		var includeObject byte
+		if _, err := unpackParameters(cmd.Parameters, &objectName, &newParentName, &includeObject); err != nil {
+			return nil, err
+		}
+		if includeObject > 1 {
+			return nil, parameterError(tpm2.RCValue, 3)
+		}
+		return nil, commands.PolicyDuplicationSelect(cmd.Handles[0], objectName, newParentName, includeObject == 1)
+	case cmdPolicyTemplate:
+		var templateHash tpmutil.U16Bytes
+		if _, err := unpackParameters(cmd.Parameters, &templateHash); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyTemplate(cmd.Handles[0], templateHash)
+	case cmdPolicyAuthValue:
+		return nil, commands.PolicyAuthValue(cmd.Handles[0])
+	case tpm2.CmdPolicyPassword:
+		return nil, commands.PolicyPassword(cmd.Handles[0])
+	case cmdPolicyLocality:
+		var locality byte
+		if _, err := unpackParameters(cmd.Parameters, &locality); err != nil {
+			return nil, err
+		}
+		return nil, commands.PolicyLocality(cmd.Handles[0], locality)
+	case cmdPolicyPhysicalPresence:
+		return nil, commands.PolicyPhysicalPresence(cmd.Handles[0])
+	case tpm2.CmdDictionaryAttackLockReset:
+		return nil, commands.DictionaryAttackLockReset(cmd.Handles[0])
+	case tpm2.CmdDictionaryAttackParameters:
+		var newMaxTries, newRecoveryTime, lockoutRecovery uint32
+		if _, err := unpackParameters(cmd.Parameters, &newMaxTries, &newRecoveryTime, &lockoutRecovery); err != nil {
+			return nil, err
+		}
+		return nil, commands.DictionaryAttackParameters(cmd.Handles[0], newMaxTries, newRecoveryTime, lockoutRecovery)
+	}
+	return nil, tpm2.Error{Code: tpm2.RCCommandCode}
+}
+
+// decodeSigScheme decodes TPMT_SIG_SCHEME that is a parameter with a given index, TPM_ALG_NULL is decoded as nil
+func decodeSigScheme(buf *bytes.Buffer, index int) (*tpm2.SigScheme, error) {
+	var scheme tpm2.SigScheme
+	if err := tpmutil.UnpackBuf(buf, &scheme.Alg); err != nil {
+		return nil, parameterError(tpm2.RCInsufficient, index)
+	}
+	if scheme.Alg == tpm2.AlgNull {
+		return nil, nil
+	}
+	if err := tpmutil.UnpackBuf(buf, &scheme.Hash); err != nil {
+		return nil, parameterError(tpm2.RCInsufficient, index)
+	}
+	if scheme.Alg.UsesCount() {
+		if err := tpmutil.UnpackBuf(buf, &scheme.Count); err != nil {
+			return nil, parameterError(tpm2.RCInsufficient, index)
+		}
+	}
+	return &scheme, nil
+}
+
+// decodeSymDef decodes TPMT_SYM_DEF that is a parameter with a given index: keyBits is absent for TPM_ALG_NULL
+// and mode is absent for TPM_ALG_NULL and TPM_ALG_XOR
+func decodeSymDef(buf *bytes.Buffer, index int) (tpm2.SymScheme, error) {
+	var sym tpm2.SymScheme
+	if err := tpmutil.UnpackBuf(buf, &sym.Alg); err != nil {
+		return sym, parameterError(tpm2.RCInsufficient, index)
+	}
+	if sym.Alg == tpm2.AlgNull {
+		return sym, nil
+	}
+	if err := tpmutil.UnpackBuf(buf, &sym.KeyBits); err != nil {
+		return sym, parameterError(tpm2.RCInsufficient, index)
+	}
+	if sym.Alg != tpm2.AlgXOR {
+		if err := tpmutil.UnpackBuf(buf, &sym.Mode); err != nil {
+			return sym, parameterError(tpm2.RCInsufficient, index)
+		}
+	}
+	return sym, nil
+}
+
+// executeGetCapability invokes the `Commands` method of the requested capability and encodes TPMS_CAPABILITY_DATA
+func executeGetCapability(parameters []byte, commands Commands) ([]byte, error) {
+	var capa tpm2.Capability
+	var count uint32
+	var property uint32
 
-		handle, nonce, err := commands.StartAuthSession(tpmKey, bindKey, nonceCaller, secret, se, sym, hashAlg)
+	_, err := unpackParameters(parameters, &capa, &property, &count)
+	if err != nil {
+		return nil, err
+	}
+
+	var moreData bool
+	var data []byte
+	switch capa {
+	case tpm2.CapabilityAlgs:
+		var algs []tpm2.AlgorithmDescription
+		algs, moreData, err = commands.GetCapabilityAlgs(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tpmutil.Pack(uint32(len(algs)), algs)
+	case tpm2.CapabilityHandles:
+		var handles []tpmutil.Handle
+		handles, moreData, err = commands.GetCapabilityHandles(count, property)
+		if err != nil {
+			return nil, err
+		}
+		// []tpmutil.Handle has a special meaning for tpmutil.Pack, so pack handles as plain values
+		values := make([]uint32, len(handles))
+		for i, handle := range handles {
+			values[i] = uint32(handle)
+		}
+		data, err = tpmutil.Pack(uint32(len(values)), values)
+	case tpm2.CapabilityCommands:
+		var attributes []CommandAttributes
+		attributes, moreData, err = commands.GetCapabilityCommands(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tpmutil.Pack(uint32(len(attributes)), attributes)
+	case tpm2.CapabilityPPCommands, tpm2.CapabilityAuditCommands:
+		var commandCodes []tpmutil.Command
+		if capa == tpm2.CapabilityPPCommands {
+			commandCodes, moreData, err = commands.GetCapabilityPPCommands(count, property)
+		} else {
+			commandCodes, moreData, err = commands.GetCapabilityAuditCommands(count, property)
+		}
 		if err != nil {
 			return nil, err
 		}
+		data, err = tpmutil.Pack(uint32(len(commandCodes)), commandCodes)
+	case tpm2.CapabilityPCRs:
+		var pcrs []tpm2.PCRSelection
+		pcrs, err = commands.GetCapabilityPCRs(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = EncodePCRSelection(pcrs...)
+	case tpm2.CapabilityTPMProperties:
+		var properties []tpm2.TaggedProperty
+		properties, moreData, err = commands.GetCapabilityTPMProperties(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tpmutil.Pack(uint32(len(properties)), properties)
+	case tpm2.CapabilityPCRProperties:
+		var pcrProperties []TaggedPCRSelect
+		pcrProperties, moreData, err = commands.GetCapabilityPCRProperties(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tpmutil.Pack(uint32(len(pcrProperties)))
+		for i := 0; err == nil && i < len(pcrProperties); i++ {
+			var b []byte
+			b, err = pcrProperties[i].Encode()
+			data = append(data, b...)
+		}
+	case tpm2.CapabilityECCCurves:
+		var curves []tpm2.EllipticCurve
+		curves, moreData, err = commands.GetCapabilityECCCurves(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tpmutil.Pack(uint32(len(curves)), curves)
+	case tpm2.CapabilityAuthPolicies:
+		var policies []TaggedPolicy
+		policies, moreData, err = commands.GetCapabilityAuthPolicies(count, property)
+		if err != nil {
+			return nil, err
+		}
+		data, err = tpmutil.Pack(uint32(len(policies)))
+		for i := 0; err == nil && i < len(policies); i++ {
+			var b []byte
+			b, err = policies[i].Encode()
+			data = append(data, b...)
+		}
+	default:
+		return nil, parameterError(tpm2.RCValue, 1)
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		return tpmutil.Pack(handle, tpmutil.U16Bytes(nonce))
+	header, err := tpmutil.Pack(moreData, capa)
+	if err != nil {
+		return nil, err
+	}
+	return append(header, data...), nil
+}
+
+// unpackCreateParameters unmarshals parameters of Create and CreatePrimary commands
+func unpackCreateParameters(parameters []byte) (SensitiveCreate, tpm2.Public, []byte, []tpm2.PCRSelection, error) {
+	var sensitive SensitiveCreate
+	var inSensitive tpmutil.U16Bytes
+	var inPublic tpmutil.U16Bytes
+	var outsideInfo tpmutil.U16Bytes
+	read, err := unpackParameters(parameters, &inSensitive, &inPublic, &outsideInfo)
+	if err != nil {
+		return sensitive, tpm2.Public{}, nil, nil, err
+	}
+	if _, err := tpmutil.Unpack(inSensitive, &sensitive); err != nil {
+		return sensitive, tpm2.Public{}, nil, nil, parameterError(tpm2.RCSize, 1)
+	}
+	public, err := tpm2.DecodePublic(inPublic)
+	if err != nil {
+		return sensitive, tpm2.Public{}, nil, nil, parameterError(tpm2.RCSize, 2)
+	}
+	creationPCR, err := DecodePCRSelection(bytes.NewBuffer(parameters[read:]))
+	if err != nil {
+		return sensitive, tpm2.Public{}, nil, nil, parameterError(tpm2.RCInsufficient, 4)
+	}
+	return sensitive, public, outsideInfo, creationPCR, nil
+}
+
+// unpackDigestList unmarshals TPML_DIGEST that is the first parameter of a command
+func unpackDigestList(parameters []byte) ([][]byte, error) {
+	var count uint32
+	read, err := unpackParameters(parameters, &count)
+	if err != nil {
+		return nil, err
+	}
+	if count > maxPolicyORDigests {
+		return nil, parameterError(tpm2.RCSize, 1)
+	}
+
+	digests := make([][]byte, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var digest tpmutil.U16Bytes
+		n, err := unpackParameters(parameters[read:], &digest)
+		if err != nil {
+			return nil, err
+		}
+		if len(digest) > maxDigestSize {
+			return nil, parameterError(tpm2.RCSize, 1)
+		}
+		read += n
+		digests = append(digests, digest)
+	}
+	return digests, nil
+}
+
+// unpackDigestValues unmarshals TPML_DIGEST_VALUES that is the first parameter of a command
+func unpackDigestValues(parameters []byte) ([]tpm2.HashValue, error) {
+	var count uint32
+	read, err := unpackParameters(parameters, &count)
+	if err != nil {
+		return nil, err
+	}
+	if int(count) > len(hashFunctions) {
+		return nil, parameterError(tpm2.RCSize, 1)
+	}
+
+	digests := make([]tpm2.HashValue, 0, count)
+	for i := uint32(0); i < count; i++ {
+		var hashAlg tpm2.Algorithm
+		n, err := unpackParameters(parameters[read:], &hashAlg)
+		if err != nil {
+			return nil, err
+		}
+		read += n
+		size, ok := digestSize(hashAlg)
+		if !ok {
+			return nil, parameterError(tpm2.RCHash, 1)
+		}
+		if len(parameters[read:]) < size {
+			return nil, parameterError(tpm2.RCInsufficient, 1)
+		}
+		digests = append(digests, tpm2.HashValue{Alg: hashAlg, Value: parameters[read : read+size]})
+		read += size
 	}
-	return nil, fmt.Errorf("command %d is not supported", ch.Cmd)
+	return digests, nil
 }
@@ -79,17 +79,35 @@ func connectedTransport() (*memoryTransport, *memoryTransport) {
 }
 
 type mockedCommands struct {
-	readPublic        func(handle tpmutil.Handle) (*swtpm2.ReadPublicResponse, error)
-	readPublicNV      func(index tpmutil.Handle) (*tpm2.NVPublic, error)
-	getCapabilityPCRs func(count, property uint32) ([]tpm2.PCRSelection, error)
-	startAuthSession  func(tpmKey, bindKey tpmutil.Handle, nonceCaller, secret []byte, se tpm2.SessionType, sym, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error)
+	swtpm2.Commands
+	beginCommand         func(cmd *swtpm2.CommandContext) error
+	endCommand           func(cmd *swtpm2.CommandContext, responseParameters []byte) ([]swtpm2.AuthResponse, error)
+	readPublic           func(handle tpmutil.Handle) (*swtpm2.ReadPublicResponse, error)
+	readPublicNV         func(index tpmutil.Handle) (*swtpm2.ReadPublicNVResponse, error)
+	getCapabilityPCRs    func(count, property uint32) ([]tpm2.PCRSelection, error)
+	getCapabilityHandles func(count, property uint32) ([]tpmutil.Handle, bool, error)
+	startAuthSession     func(tpmKey, bindKey tpmutil.Handle, nonceCaller, secret []byte, se tpm2.SessionType, sym tpm2.SymScheme, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error)
+}
+
+func (m *mockedCommands) BeginCommand(cmd *swtpm2.CommandContext) error {
+	if m.beginCommand == nil {
+		return nil
+	}
+	return m.beginCommand(cmd)
+}
+
+func (m *mockedCommands) EndCommand(cmd *swtpm2.CommandContext, responseParameters []byte) ([]swtpm2.AuthResponse, error) {
+	if m.endCommand == nil {
+		return nil, nil
+	}
+	return m.endCommand(cmd, responseParameters)
 }
 
 func (m *mockedCommands) ReadPublic(handle tpmutil.Handle) (*swtpm2.ReadPublicResponse, error) {
 	return m.readPublic(handle)
 }
 
-func (m *mockedCommands) ReadPublicNV(index tpmutil.Handle) (*tpm2.NVPublic, error) {
+func (m *mockedCommands) ReadPublicNV(index tpmutil.Handle) (*swtpm2.ReadPublicNVResponse, error) {
 	return m.readPublicNV(index)
 }
 
@@ -97,10 +115,14 @@ func (m *mockedCommands) GetCapabilityPCRs(count, property uint32) ([]tpm2.PCRSe
 	return m.getCapabilityPCRs(count, property)
 }
 
+func (m *mockedCommands) GetCapabilityHandles(count, property uint32) ([]tpmutil.Handle, bool, error) {
+	return m.getCapabilityHandles(count, property)
+}
+
 func (m *mockedCommands) StartAuthSession(tpmKey, bindKey tpmutil.Handle,
 	nonceCaller, secret []byte,
 	se tpm2.SessionType,
-	sym, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error) {
+	sym tpm2.SymScheme, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error) {
 
 	return m.startAuthSession(tpmKey, bindKey, nonceCaller, secret, se, sym, hashAlg)
 }
@@ -181,9 +203,9 @@ func TestReadPublicNV(t *testing.T) {
 
 	var actualHandle tpmutil.Handle
 	commands := &mockedCommands{
-		readPublicNV: func(handle tpmutil.Handle) (*tpm2.NVPublic, error) {
+		readPublicNV: func(handle tpmutil.Handle) (*swtpm2.ReadPublicNVResponse, error) {
 			actualHandle = handle
-			return &expectedNVPublic, nil
+			return &swtpm2.ReadPublicNVResponse{NVPublic: expectedNVPublic, Name: []byte("name")}, nil
 		},
 	}
 
@@ -202,14 +224,23 @@ func TestReadPublicNV(t *testing.T) {
 	}()
 
 	usedHandle := tpmutil.Handle(10)
-	public, err := tpm2.NVReadPublic(clientIO, usedHandle)
+	resp, code, err := tpmutil.RunCommand(clientIO, tpm2.TagNoSessions, tpm2.CmdReadPublicNV, usedHandle)
 
 	wg.Wait()
 	require.NoError(t, commandError)
 
 	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
 	require.Equal(t, usedHandle, actualHandle)
+
+	var nvPublic, name tpmutil.U16Bytes
+	_, err = tpmutil.Unpack(resp, &nvPublic, &name)
+	require.NoError(t, err)
+	var public tpm2.NVPublic
+	_, err = tpmutil.Unpack(nvPublic, &public)
+	require.NoError(t, err)
 	require.Equal(t, expectedNVPublic, public)
+	require.Equal(t, []byte("name"), []byte(name))
 }
 
 func TestGetCapabilityPCRs(t *testing.T) {
@@ -262,6 +293,52 @@ func TestGetCapabilityPCRs(t *testing.T) {
 	require.Equal(t, usedProperty, actualProperty)
 }
 
+func TestGetCapabilityHandles(t *testing.T) {
+	clientIO, serverIO := connectedTransport()
+
+	var actualCount uint32
+	var actualProperty uint32
+
+	expectedHandles := []tpmutil.Handle{0x81000001, 0x81000005}
+
+	commands := &mockedCommands{
+		getCapabilityHandles: func(count, property uint32) ([]tpmutil.Handle, bool, error) {
+			actualCount = count
+			actualProperty = property
+			return expectedHandles, true, nil
+		},
+	}
+
+	var commandError error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b, err := swtpm2.ProcessCommand(serverIO, commands)
+		commandError = err
+
+		_, err = serverIO.Write(b)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	usedCount := uint32(2)
+	usedProperty := uint32(tpm2.PersistentFirst)
+
+	values, moreData, err := tpm2.GetCapability(clientIO, tpm2.CapabilityHandles, usedCount, usedProperty)
+	wg.Wait()
+
+	require.NoError(t, err)
+	require.NoError(t, commandError)
+
+	require.True(t, moreData)
+	require.Equal(t, []interface{}{expectedHandles[0], expectedHandles[1]}, values)
+
+	require.Equal(t, usedCount, actualCount)
+	require.Equal(t, usedProperty, actualProperty)
+}
+
 func TestStartAuthSession(t *testing.T) {
 	clientIO, serverIO := connectedTransport()
 
@@ -270,14 +347,14 @@ func TestStartAuthSession(t *testing.T) {
 	var actualNonceCaller []byte
 	var actualSecret []byte
 	var actualSE tpm2.SessionType
-	var actualSym tpm2.Algorithm
+	var actualSym tpm2.SymScheme
 	var actualHashAlg tpm2.Algorithm
 
 	var expectedSessionHandle tpmutil.Handle = 1234
 	expectedNonce := []byte{1, 2, 3, 4, 5}
 
 	commands := &mockedCommands{
-		startAuthSession: func(tpmKey, bindKey tpmutil.Handle, nonceCaller, secret []byte, se tpm2.SessionType, sym, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error) {
+		startAuthSession: func(tpmKey, bindKey tpmutil.Handle, nonceCaller, secret []byte, se tpm2.SessionType, sym tpm2.SymScheme, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error) {
 			actualTpmKey = tpmKey
 			actualBindKey = bindKey
 			actualNonceCaller = nonceCaller
@@ -309,7 +386,8 @@ func TestStartAuthSession(t *testing.T) {
 	usedNonceCaller := []byte{100, 101, 102}
 	usedSecret := []byte{200, 201, 202}
 	usedSE := tpm2.SessionHMAC
-	usedSym := tpm2.AlgAES
+	// go-tpm encodes only the algorithm of TPMT_SYM_DEF, so the parameters of AES cannot be sent
+	usedSym := tpm2.AlgNull
 	usedHashAlg := tpm2.AlgSHA1
 
 	handle, nonce, err := tpm2.StartAuthSession(clientIO, usedTpmKey, usedBindKey, usedNonceCaller, usedSecret, usedSE, usedSym, usedHashAlg)
@@ -326,6 +404,106 @@ func TestStartAuthSession(t *testing.T) {
 	require.Equal(t, usedNonceCaller, actualNonceCaller)
 	require.Equal(t, usedSecret, actualSecret)
 	require.Equal(t, usedSE, actualSE)
-	require.Equal(t, usedSym, actualSym)
+	require.Equal(t, tpm2.SymScheme{Alg: usedSym}, actualSym)
 	require.Equal(t, usedHashAlg, actualHashAlg)
 }
+
+func TestProcessCommandSessions(t *testing.T) {
+	clientIO, serverIO := connectedTransport()
+
+	usedSession := tpm2.AuthCommand{
+		Session:    tpm2.HandlePasswordSession,
+		Attributes: tpm2.AttrContinueSession,
+		Auth:       []byte("password"),
+	}
+	expectedAuthResponse := swtpm2.AuthResponse{
+		Nonce:      []byte{1, 2, 3},
+		Attributes: tpm2.AttrContinueSession,
+		Auth:       []byte{4, 5, 6},
+	}
+
+	var actualSessions []tpm2.AuthCommand
+	var actualResponseParameters []byte
+	var actualCount uint32
+	var actualProperty uint32
+	commands := &mockedCommands{
+		beginCommand: func(cmd *swtpm2.CommandContext) error {
+			actualSessions = cmd.Sessions
+			return nil
+		},
+		endCommand: func(cmd *swtpm2.CommandContext, responseParameters []byte) ([]swtpm2.AuthResponse, error) {
+			actualResponseParameters = responseParameters
+			return []swtpm2.AuthResponse{expectedAuthResponse}, nil
+		},
+		getCapabilityPCRs: func(count, property uint32) ([]tpm2.PCRSelection, error) {
+			actualCount = count
+			actualProperty = property
+			return []tpm2.PCRSelection{{Hash: tpm2.AlgSHA256, PCRs: []int{0}}}, nil
+		},
+	}
+
+	var commandError error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b, err := swtpm2.ProcessCommand(serverIO, commands)
+		commandError = err
+
+		_, err = serverIO.Write(b)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	authArea, err := tpmutil.Pack(usedSession)
+	require.NoError(t, err)
+
+	usedCount := uint32(1)
+	usedProperty := uint32(0)
+	resp, code, err := tpmutil.RunCommand(clientIO, tpm2.TagSessions, tpm2.CmdGetCapability,
+		uint32(len(authArea)), tpmutil.RawBytes(authArea), tpm2.CapabilityPCRs, usedProperty, usedCount)
+	wg.Wait()
+
+	require.NoError(t, err)
+	require.NoError(t, commandError)
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	require.Equal(t, []tpm2.AuthCommand{usedSession}, actualSessions)
+	require.Equal(t, usedCount, actualCount)
+	require.Equal(t, usedProperty, actualProperty)
+
+	var parameterSize uint32
+	read, err := tpmutil.Unpack(resp, &parameterSize)
+	require.NoError(t, err)
+	require.Equal(t, actualResponseParameters, resp[read:read+int(parameterSize)])
+
+	var actualAuthResponse swtpm2.AuthResponse
+	_, err = tpmutil.Unpack(resp[read+int(parameterSize):], &actualAuthResponse)
+	require.NoError(t, err)
+	require.Equal(t, expectedAuthResponse, actualAuthResponse)
+}
+
+func TestUnsupportedCommand(t *testing.T) {
+	clientIO, serverIO := connectedTransport()
+
+	var commandError error
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		b, err := swtpm2.ProcessCommand(serverIO, &mockedCommands{})
+		commandError = err
+
+		_, err = serverIO.Write(b)
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	_, err := tpm2.GetRandom(clientIO, 16)
+	wg.Wait()
+
+	require.NoError(t, commandError)
+	require.Equal(t, tpm2.Error{Code: tpm2.RCCommandCode}, err)
+}
@@ -0,0 +1,67 @@
+package swtpm2
+
+import (
+	"crypto/hmac"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// tagCreation is TPM_ST_CREATION, the tag of creation tickets
+const tagCreation tpmutil.Tag = 0x8021
+
+// newCreationData describes the environment in which an object is created
+func (t *TPM2) newCreationData(nameAlg tpm2.Algorithm, creationPCR []tpm2.PCRSelection,
+	parentNameAlg tpm2.Algorithm, parentName, parentQualifiedName, outsideInfo []byte) (*CreationData, error) {
+
+	pcrSelection, pcrDigest, err := t.pcrDigest(nameAlg, creationPCR)
+	if err != nil {
+		return nil, err
+	}
+	return &CreationData{
+		PCRSelection:        pcrSelection,
+		PCRDigest:           pcrDigest,
+		Locality:            localityAttributes(t.locality),
+		ParentNameAlg:       parentNameAlg,
+		ParentName:          parentName,
+		ParentQualifiedName: parentQualifiedName,
+		OutsideInfo:         outsideInfo,
+	}, nil
+}
+
+// creationHash computes the digest of creation data with a given algorithm
+func creationHash(nameAlg tpm2.Algorithm, creationData *CreationData) ([]byte, error) {
+	hash, err := nameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	b, err := creationData.Encode()
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(b)
+	return h.Sum(nil), nil
+}
+
+// creationTicket produces TPMT_TK_CREATION: HMAC(proof, TPM_ST_CREATION || name || creationHash),
+// tickets of the null hierarchy are empty
+func (t *TPM2) creationTicket(hierarchyHandle tpmutil.Handle, nameAlg tpm2.Algorithm, name, creationHash []byte) (tpm2.Ticket, error) {
+	ticket := tpm2.Ticket{Type: tagCreation, Hierarchy: hierarchyHandle}
+	if hierarchyHandle == tpm2.HandleNull {
+		return ticket, nil
+	}
+
+	hash, err := nameAlg.Hash()
+	if err != nil {
+		return ticket, err
+	}
+	data, err := tpmutil.Pack(tagCreation, tpmutil.RawBytes(name), tpmutil.RawBytes(creationHash))
+	if err != nil {
+		return ticket, err
+	}
+	mac := hmac.New(hash.New, t.hierarchies[hierarchyHandle].proof)
+	mac.Write(data)
+	ticket.Digest = mac.Sum(nil)
+	return ticket, nil
+}
@@ -0,0 +1,85 @@
+package swtpm2
+
+import (
+	"errors"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Bits of TPM_RC that determine the format of a response code
+const (
+	rcVer1 = 0x100
+	rcFmt1 = 0x080
+	rcWarn = 0x900
+	rcP    = 0x040
+	rcS    = 0x800
+	// rcIndexShift is the position of handle, parameter or session index in format-1 codes
+	rcIndexShift = 8
+)
+
+// rcPCR is TPM_RC_PCR that is missing in go-tpm
+const rcPCR tpm2.RCFmt0 = 0x27
+
+// RCBadTag is returned for commands with a tag that is neither TPM_ST_NO_SESSIONS nor TPM_ST_SESSIONS
+const RCBadTag tpmutil.ResponseCode = 0x01E
+
+// RCFail is returned for errors that do not carry a TPM response code
+var RCFail = ResponseCode(tpm2.Error{Code: tpm2.RCFailure})
+
+// Errors of `Commands` implementations are expected to be one of the typed errors of go-tpm:
+//  - tpm2.Error for format-0 errors
+//  - tpm2.Warning for format-0 warnings
+//  - tpm2.ParameterError, tpm2.HandleError, tpm2.SessionError for format-1 errors
+//  - tpm2.VendorError for vendor specific response codes
+// Other errors are reported as TPM_RC_FAILURE.
+
+// ResponseCode converts an error to TPM_RC value
+func ResponseCode(err error) tpmutil.ResponseCode {
+	if err == nil {
+		return tpmutil.RCSuccess
+	}
+	if errors.Is(err, errBadTag) {
+		return RCBadTag
+	}
+
+	var fmt0Err tpm2.Error
+	var warnErr tpm2.Warning
+	var paramErr tpm2.ParameterError
+	var handleErr tpm2.HandleError
+	var sessionErr tpm2.SessionError
+	var vendorErr tpm2.VendorError
+	switch {
+	case errors.As(err, &fmt0Err):
+		return tpmutil.ResponseCode(rcVer1 | uint32(fmt0Err.Code))
+	case errors.As(err, &warnErr):
+		return tpmutil.ResponseCode(rcWarn | uint32(warnErr.Code))
+	case errors.As(err, &paramErr):
+		return tpmutil.ResponseCode(rcFmt1 | rcP | uint32(paramErr.Code) | uint32(paramErr.Parameter)<<rcIndexShift)
+	case errors.As(err, &handleErr):
+		return tpmutil.ResponseCode(rcFmt1 | uint32(handleErr.Code) | uint32(handleErr.Handle)<<rcIndexShift)
+	case errors.As(err, &sessionErr):
+		return tpmutil.ResponseCode(rcFmt1 | rcS | uint32(sessionErr.Code) | uint32(sessionErr.Session)<<rcIndexShift)
+	case errors.As(err, &vendorErr):
+		return tpmutil.ResponseCode(vendorErr.Code)
+	}
+	return tpmutil.ResponseCode(rcVer1 | uint32(tpm2.RCFailure))
+}
+
+// errBadTag is returned for commands with an unexpected tag
+var errBadTag = errors.New("unexpected command tag")
+
+// parameterError creates TPM_RC error for a parameter with the given 1-based index
+func parameterError(code tpm2.RCFmt1, index int) error {
+	return tpm2.ParameterError{Code: code, Parameter: tpm2.RCIndex(index)}
+}
+
+// handleError creates TPM_RC error for a handle with the given 1-based index
+func handleError(code tpm2.RCFmt1, index int) error {
+	return tpm2.HandleError{Code: code, Handle: tpm2.RCIndex(index)}
+}
+
+// sessionError creates TPM_RC error for a session with the given 1-based index
+func sessionError(code tpm2.RCFmt1, index int) error {
+	return tpm2.SessionError{Code: code, Session: tpm2.RCIndex(index)}
+}
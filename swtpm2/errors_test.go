@@ -0,0 +1,36 @@
+package swtpm2_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/rihter007/go-swtpm/swtpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResponseCode(t *testing.T) {
+	testCases := []struct {
+		err  error
+		code tpmutil.ResponseCode
+	}{
+		{nil, tpmutil.RCSuccess},
+		{tpm2.Error{Code: tpm2.RCInitialize}, 0x100},
+		{tpm2.Error{Code: tpm2.RCCommandCode}, 0x143},
+		{tpm2.Warning{Code: tpm2.RCObjectMemory}, 0x902},
+		{tpm2.Warning{Code: tpm2.RCReferenceS1}, 0x919},
+		{tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC2}, 0x2C4},
+		{tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, 0x18B},
+		{tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}, 0x98E},
+		{tpm2.VendorError{Code: 0x500}, 0x500},
+		{fmt.Errorf("wrapped: %w", tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC2}), 0x28B},
+		{errors.New("internal error"), 0x101},
+	}
+
+	for _, tc := range testCases {
+		require.Equal(t, tc.code, swtpm2.ResponseCode(tc.err), "error: %v", tc.err)
+	}
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCFailure}), swtpm2.RCFail)
+}
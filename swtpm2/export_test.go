@@ -0,0 +1,29 @@
+package swtpm2
+
+// Commands that are missing in go-tpm
+const (
+	CmdNVGlobalWriteLock       = cmdNVGlobalWriteLock
+	CmdNVSetBits               = cmdNVSetBits
+	CmdNVExtend                = cmdNVExtend
+	CmdNVChangeAuth            = cmdNVChangeAuth
+	CmdPolicyNV                = cmdPolicyNV
+	CmdObjectChangeAuth        = cmdObjectChangeAuth
+	CmdPolicyCpHash            = cmdPolicyCpHash
+	CmdPolicyAuthorize         = cmdPolicyAuthorize
+	CmdPolicyAuthValue         = cmdPolicyAuthValue
+	CmdPolicyCounterTimer      = cmdPolicyCounterTimer
+	CmdPolicyLocality          = cmdPolicyLocality
+	CmdPolicyNameHash          = cmdPolicyNameHash
+	CmdPolicyTicket            = cmdPolicyTicket
+	CmdVerifySignature         = cmdVerifySignature
+	CmdPolicyRestart           = cmdPolicyRestart
+	CmdNVCertify               = cmdNVCertify
+	CmdPolicyPhysicalPresence  = cmdPolicyPhysicalPresence
+	CmdPolicyDuplicationSelect = cmdPolicyDuplicationSelect
+	CmdPolicyNvWritten         = cmdPolicyNvWritten
+	CmdPolicyTemplate          = cmdPolicyTemplate
+	CmdPolicyAuthorizeNV       = cmdPolicyAuthorizeNV
+)
+
+// LoadObject exposes loading of objects into TPM2 for tests
+var LoadObject = (*TPM2).loadObject
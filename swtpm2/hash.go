@@ -0,0 +1,41 @@
+package swtpm2
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"hash"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/rihter007/go-swtpm/sm3"
+)
+
+// algSM3 is TPM_ALG_SM3_256 that is missing in go-tpm
+const algSM3 tpm2.Algorithm = 0x0012
+
+// hashFunctions contains all implemented hash algorithms
+var hashFunctions = map[tpm2.Algorithm]func() hash.Hash{
+	tpm2.AlgSHA1:   sha1.New,
+	tpm2.AlgSHA256: sha256.New,
+	tpm2.AlgSHA384: sha512.New384,
+	tpm2.AlgSHA512: sha512.New,
+	algSM3:         sm3.New,
+}
+
+// pcrHashAlgorithms lists hash algorithms that may be allocated to PCR banks in ascending order
+var pcrHashAlgorithms = []tpm2.Algorithm{
+	tpm2.AlgSHA1,
+	tpm2.AlgSHA256,
+	tpm2.AlgSHA384,
+	tpm2.AlgSHA512,
+	algSM3,
+}
+
+// digestSize returns the size of a digest produced by a hash algorithm
+func digestSize(hashAlg tpm2.Algorithm) (int, bool) {
+	newHash, ok := hashFunctions[hashAlg]
+	if !ok {
+		return 0, false
+	}
+	return newHash().Size(), true
+}
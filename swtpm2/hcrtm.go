@@ -0,0 +1,98 @@
+package swtpm2
+
+import (
+	"hash"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// PCRs measured by the event sequence of _TPM_Hash_Start, _TPM_Hash_Data and _TPM_Hash_End
+const (
+	// hcrtmPCR receives the measurement of H-CRTM that is done before Startup
+	hcrtmPCR = 0
+	// drtmPCR receives the measurement of a dynamic root of trust that is done after Startup
+	drtmPCR = 17
+)
+
+// hashLocality is the locality of _TPM_Hash_Start, _TPM_Hash_Data and _TPM_Hash_End indications
+const hashLocality = 4
+
+// eventSequence hashes the data of an H-CRTM or D-RTM event in every allocated PCR bank
+type eventSequence map[tpm2.Algorithm]hash.Hash
+
+// HashStart processes _TPM_Hash_Start indication, a previous event sequence is abandoned
+// and the TPM established flag is set
+func (t *TPM2) HashStart() {
+	seq := make(eventSequence)
+	for _, bank := range t.pcrBanks {
+		seq[bank.hashAlg] = hashFunctions[bank.hashAlg]()
+	}
+	t.eventSequence = seq
+	t.tpmEstablished = true
+}
+
+// HashData processes _TPM_Hash_Data indication, the data is ignored when there is no event sequence
+func (t *TPM2) HashData(data []byte) {
+	if t.eventSequence == nil {
+		return
+	}
+	for _, h := range t.eventSequence {
+		h.Write(data)
+	}
+}
+
+// HashEnd processes _TPM_Hash_End indication. Before Startup PCR 0 is reset with the locality of the indication
+// in the last octet and extended with the H-CRTM digest, PCR 0 keeps this value after Startup that cannot be TPM Resume.
+// After Startup the PCRs of a dynamic root of trust are reset to zero and PCR 17 is extended with the digest
+func (t *TPM2) HashEnd() {
+	seq := t.eventSequence
+	if seq == nil {
+		return
+	}
+	t.eventSequence = nil
+
+	pcr := hcrtmPCR
+	if t.started {
+		pcr = drtmPCR
+		for reset := 0; reset < t.pcrCount; reset++ {
+			if pcrAttributesOf(reset).resetLocality&(1<<hashLocality) == 0 {
+				continue
+			}
+			for _, bank := range t.pcrBanks {
+				if bank.allocated(reset) {
+					bank.reset(reset, 0)
+				}
+			}
+			t.pcrChanged(reset)
+		}
+	} else {
+		t.hcrtmStartup = true
+	}
+
+	for _, bank := range t.pcrBanks {
+		h, ok := seq[bank.hashAlg]
+		if !ok || !bank.allocated(pcr) {
+			continue
+		}
+		if pcr == hcrtmPCR {
+			bank.reset(pcr, 0)
+			bank.values[pcr][len(bank.values[pcr])-1] = hashLocality
+		}
+		bank.extend(pcr, h.Sum(nil))
+	}
+	t.pcrChanged(pcr)
+}
+
+// TPMEstablished returns the flag that is set by _TPM_Hash_Start and survives _TPM_Init
+func (t *TPM2) TPMEstablished() bool {
+	return t.tpmEstablished
+}
+
+// ResetTPMEstablished clears the TPM established flag, it is allowed at localities 3 and 4 only
+func (t *TPM2) ResetTPMEstablished(locality uint8) error {
+	if locality != 3 && locality != 4 {
+		return tpm2.Warning{Code: tpm2.RCLocality}
+	}
+	t.tpmEstablished = false
+	return nil
+}
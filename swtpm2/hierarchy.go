@@ -0,0 +1,74 @@
+package swtpm2
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// primarySeedSize is the size of primary seeds and proof values
+const primarySeedSize = 32
+
+// hierarchy holds the secrets and the authorization of a permanent entity
+type hierarchy struct {
+	// seed is the primary seed, lockout has no seed
+	seed []byte
+	// proof is the secret used to produce tickets of the hierarchy
+	proof      []byte
+	authValue  []byte
+	authPolicy tpm2.HashValue
+}
+
+// hierarchyLabels are used to derive seeds of the persistent hierarchies from the device seed
+var hierarchyLabels = map[tpmutil.Handle]string{
+	tpm2.HandleOwner:       "OWNER",
+	tpm2.HandleEndorsement: "ENDORSEMENT",
+	tpm2.HandlePlatform:    "PLATFORM",
+}
+
+// newHierarchies creates permanent entities of a TPM, the secrets of persistent hierarchies are derived from deviceSeed
+// while the null hierarchy gets random secrets
+func newHierarchies(deviceSeed []byte) map[tpmutil.Handle]*hierarchy {
+	hierarchies := map[tpmutil.Handle]*hierarchy{
+		tpm2.HandleLockout: {authPolicy: tpm2.HashValue{Alg: tpm2.AlgNull}},
+		tpm2.HandleNull:    newNullHierarchy(),
+	}
+	for handle, label := range hierarchyLabels {
+		hierarchies[handle] = &hierarchy{
+			seed:       deriveSecret(deviceSeed, label+" SEED"),
+			proof:      deriveSecret(deviceSeed, label+" PROOF"),
+			authPolicy: tpm2.HashValue{Alg: tpm2.AlgNull},
+		}
+	}
+	return hierarchies
+}
+
+// newNullHierarchy creates the null hierarchy with random secrets, the secrets change on every TPM Reset
+func newNullHierarchy() *hierarchy {
+	return &hierarchy{
+		seed:       randomBytes(primarySeedSize),
+		proof:      randomBytes(primarySeedSize),
+		authPolicy: tpm2.HashValue{Alg: tpm2.AlgNull},
+	}
+}
+
+// deriveSecret derives a secret of primarySeedSize bytes from a seed
+func deriveSecret(seed []byte, label string) []byte {
+	secret, err := tpm2.KDFa(tpm2.AlgSHA256, seed, label, nil, nil, 8*primarySeedSize)
+	if err != nil {
+		// KDFa fails only for unsupported hash algorithms
+		panic(fmt.Sprintf("failed to derive %s, err: %v", label, err))
+	}
+	return secret
+}
+
+// randomBytes generates a random byte array of a given size
+func randomBytes(size int) []byte {
+	b := make([]byte, size)
+	if _, err := rand.Read(b); err != nil {
+		panic(fmt.Sprintf("failed to read random bytes, err: %v", err))
+	}
+	return b
+}
@@ -0,0 +1,466 @@
+package swtpm2
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/binary"
+	"io"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+)
+
+// defaultRSAExponent is used for RSA keys with zero exponent in the template
+const defaultRSAExponent = 65537
+
+// supportedRSAKeyBits lists the sizes of RSA keys that can be generated
+var supportedRSAKeyBits = map[uint16]bool{
+	1024: true,
+	2048: true,
+	3072: true,
+}
+
+// eccGoCurves maps implemented TPM curves to golang ones
+var eccGoCurves = map[tpm2.EllipticCurve]elliptic.Curve{
+	tpm2.CurveNISTP224: elliptic.P224(),
+	tpm2.CurveNISTP256: elliptic.P256(),
+	tpm2.CurveNISTP384: elliptic.P384(),
+	tpm2.CurveNISTP521: elliptic.P521(),
+}
+
+// Parameter indices of inSensitive and inPublic in TPM2_Create and TPM2_CreatePrimary
+const (
+	inSensitiveIndex = 1
+	inPublicIndex    = 2
+)
+
+// maxSymData is the maximal size of sensitive data of a keyed hash object
+const maxSymData = 128
+
+// isStorageKey reports whether an object may be a parent of other objects
+func isStorageKey(public tpm2.Public) bool {
+	return public.Attributes&tpm2.FlagRestricted != 0 && public.Attributes&tpm2.FlagDecrypt != 0
+}
+
+// symmetricScheme returns the symmetric algorithm of an asymmetric key
+func symmetricScheme(public tpm2.Public) *tpm2.SymScheme {
+	switch {
+	case public.RSAParameters != nil:
+		return public.RSAParameters.Symmetric
+	case public.ECCParameters != nil:
+		return public.ECCParameters.Symmetric
+	}
+	return nil
+}
+
+// checkSymmetricScheme validates the symmetric algorithm that protects the children of a storage key
+func checkSymmetricScheme(sym *tpm2.SymScheme) bool {
+	if sym == nil || sym.Alg != tpm2.AlgAES || sym.Mode != tpm2.AlgCFB {
+		return false
+	}
+	return sym.KeyBits == 128 || sym.KeyBits == 192 || sym.KeyBits == 256
+}
+
+// checkTemplate validates a template of an object and its sensitive data
+func checkTemplate(public tpm2.Public, sensitive SensitiveCreate) error {
+	if _, err := public.NameAlg.Hash(); err != nil {
+		return parameterError(tpm2.RCHash, inPublicIndex)
+	}
+
+	attributes := public.Attributes
+	if attributes&tpm2.FlagFixedTPM != 0 && attributes&tpm2.FlagFixedParent == 0 {
+		return parameterError(tpm2.RCAttributes, inPublicIndex)
+	}
+	if attributes&tpm2.FlagRestricted != 0 && attributes&tpm2.FlagSign != 0 && attributes&tpm2.FlagDecrypt != 0 {
+		return parameterError(tpm2.RCAttributes, inPublicIndex)
+	}
+
+	switch public.Type {
+	case tpm2.AlgRSA:
+		params := public.RSAParameters
+		if params == nil {
+			return parameterError(tpm2.RCType, inPublicIndex)
+		}
+		if !supportedRSAKeyBits[params.KeyBits] {
+			return parameterError(tpm2.RCKeySize, inPublicIndex)
+		}
+		if params.ExponentRaw != 0 && (params.ExponentRaw < 3 || params.ExponentRaw%2 == 0) {
+			return parameterError(tpm2.RCValue, inPublicIndex)
+		}
+	case tpm2.AlgECC:
+		params := public.ECCParameters
+		if params == nil {
+			return parameterError(tpm2.RCType, inPublicIndex)
+		}
+		if _, ok := eccGoCurves[params.CurveID]; !ok {
+			return parameterError(tpm2.RCCurve, inPublicIndex)
+		}
+	case tpm2.AlgKeyedHash:
+		if public.KeyedHashParameters == nil {
+			return parameterError(tpm2.RCType, inPublicIndex)
+		}
+		if attributes&tpm2.FlagSensitiveDataOrigin != 0 && len(sensitive.Data) > 0 {
+			return parameterError(tpm2.RCAttributes, inPublicIndex)
+		}
+		if len(sensitive.Data) > maxSymData {
+			return parameterError(tpm2.RCSize, inSensitiveIndex)
+		}
+		return nil
+	default:
+		return parameterError(tpm2.RCType, inPublicIndex)
+	}
+
+	// sensitive data of asymmetric keys is always generated by TPM
+	if attributes&tpm2.FlagSensitiveDataOrigin == 0 {
+		return parameterError(tpm2.RCAttributes, inPublicIndex)
+	}
+	if len(sensitive.Data) > 0 {
+		return parameterError(tpm2.RCSize, inSensitiveIndex)
+	}
+	sym := symmetricScheme(public)
+	if isStorageKey(public) {
+		if !checkSymmetricScheme(sym) {
+			return parameterError(tpm2.RCSymmetric, inPublicIndex)
+		}
+	} else if sym != nil && sym.Alg != tpm2.AlgNull {
+		return parameterError(tpm2.RCSymmetric, inPublicIndex)
+	}
+	return nil
+}
+
+// createObject generates the sensitive area of an object for a validated template using random bytes from r
+// and places the object under the parent with the given qualified name
+func createObject(r io.Reader, template tpm2.Public, sensitive SensitiveCreate, parentQualifiedName []byte) (*object, error) {
+	hash, err := template.NameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	public := template
+	var privateKey crypto.PrivateKey
+	var data []byte
+	switch template.Type {
+	case tpm2.AlgRSA:
+		params := *template.RSAParameters
+		exponent := int(params.ExponentRaw)
+		if exponent == 0 {
+			exponent = defaultRSAExponent
+		}
+		key, err := generateRSAKey(r, int(params.KeyBits), exponent)
+		if err != nil {
+			return nil, err
+		}
+		params.ModulusRaw = leftPad(key.N.Bytes(), int(params.KeyBits)/8)
+		public.RSAParameters = &params
+		privateKey = key
+	case tpm2.AlgECC:
+		params := *template.ECCParameters
+		curve := eccGoCurves[params.CurveID]
+		key, err := generateECCKey(r, curve)
+		if err != nil {
+			return nil, err
+		}
+		size := (curve.Params().BitSize + 7) / 8
+		params.Point = tpm2.ECPoint{
+			XRaw: leftPad(key.X.Bytes(), size),
+			YRaw: leftPad(key.Y.Bytes(), size),
+		}
+		public.ECCParameters = &params
+		privateKey = key
+	case tpm2.AlgKeyedHash:
+		data = sensitive.Data
+		if template.Attributes&tpm2.FlagSensitiveDataOrigin != 0 {
+			data = make([]byte, hash.Size())
+			if _, err := io.ReadFull(r, data); err != nil {
+				return nil, err
+			}
+		}
+	default:
+		return nil, parameterError(tpm2.RCType, inPublicIndex)
+	}
+
+	// seedValue is the obfuscation value of keyed hash objects and the protection seed of storage keys
+	var seedValue []byte
+	if template.Type == tpm2.AlgKeyedHash || isStorageKey(template) {
+		seedValue = make([]byte, hash.Size())
+		if _, err := io.ReadFull(r, seedValue); err != nil {
+			return nil, err
+		}
+	}
+	if template.Type == tpm2.AlgKeyedHash {
+		params := *template.KeyedHashParameters
+		params.Unique = keyedHashUnique(hash, seedValue, data)
+		public.KeyedHashParameters = &params
+	}
+
+	obj, err := newObject(public, parentQualifiedName)
+	if err != nil {
+		return nil, err
+	}
+	obj.authValue = sensitive.UserAuth
+	obj.seedValue = seedValue
+	obj.privateKey = privateKey
+	obj.data = data
+	return obj, nil
+}
+
+// keyedHashUnique computes the unique field of a keyed hash object: H_nameAlg(seedValue || data)
+func keyedHashUnique(hash crypto.Hash, seedValue, data []byte) []byte {
+	h := hash.New()
+	h.Write(seedValue)
+	h.Write(data)
+	return h.Sum(nil)
+}
+
+// sensitiveArea builds TPMT_SENSITIVE of an object
+func (o *object) sensitiveArea() tpm2.Private {
+	sensitive := tpm2.Private{
+		Type:      o.public.Type,
+		AuthValue: o.authValue,
+		SeedValue: o.seedValue,
+	}
+	switch key := o.privateKey.(type) {
+	case *rsa.PrivateKey:
+		sensitive.Sensitive = key.Primes[0].Bytes()
+	case *ecdsa.PrivateKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		sensitive.Sensitive = leftPad(key.D.Bytes(), size)
+	default:
+		sensitive.Sensitive = o.data
+	}
+	return sensitive
+}
+
+// restoreObject combines a public area with TPMT_SENSITIVE and checks that they are bound together
+func restoreObject(public tpm2.Public, sensitive tpm2.Private, parentQualifiedName []byte) (*object, error) {
+	if public.Type != sensitive.Type {
+		return nil, parameterError(tpm2.RCType, inPublicIndex)
+	}
+	hash, err := public.NameAlg.Hash()
+	if err != nil {
+		return nil, parameterError(tpm2.RCHash, inPublicIndex)
+	}
+
+	obj, err := newObject(public, parentQualifiedName)
+	if err != nil {
+		return nil, err
+	}
+	obj.authValue = sensitive.AuthValue
+	obj.seedValue = sensitive.SeedValue
+
+	switch public.Type {
+	case tpm2.AlgRSA:
+		if public.RSAParameters == nil {
+			return nil, parameterError(tpm2.RCType, inPublicIndex)
+		}
+		key, err := restoreRSAKey(public.RSAParameters, sensitive.Sensitive)
+		if err != nil {
+			return nil, err
+		}
+		obj.privateKey = key
+	case tpm2.AlgECC:
+		if public.ECCParameters == nil {
+			return nil, parameterError(tpm2.RCType, inPublicIndex)
+		}
+		key, err := restoreECCKey(public.ECCParameters, sensitive.Sensitive)
+		if err != nil {
+			return nil, err
+		}
+		obj.privateKey = key
+	case tpm2.AlgKeyedHash:
+		if public.KeyedHashParameters == nil {
+			return nil, parameterError(tpm2.RCType, inPublicIndex)
+		}
+		unique := keyedHashUnique(hash, sensitive.SeedValue, sensitive.Sensitive)
+		if !bytes.Equal(unique, public.KeyedHashParameters.Unique) {
+			return nil, parameterError(tpm2.RCBinding, inPublicIndex)
+		}
+		obj.data = sensitive.Sensitive
+	default:
+		return nil, parameterError(tpm2.RCType, inPublicIndex)
+	}
+	return obj, nil
+}
+
+// restoreRSAKey rebuilds an RSA key from the modulus and one of its primes
+func restoreRSAKey(params *tpm2.RSAParams, prime []byte) (*rsa.PrivateKey, error) {
+	n := new(big.Int).SetBytes(params.ModulusRaw)
+	p := new(big.Int).SetBytes(prime)
+	one := big.NewInt(1)
+	if p.Cmp(one) <= 0 || p.Cmp(n) >= 0 {
+		return nil, parameterError(tpm2.RCBinding, inPublicIndex)
+	}
+	q, remainder := new(big.Int).DivMod(n, p, new(big.Int))
+	if remainder.Sign() != 0 {
+		return nil, parameterError(tpm2.RCBinding, inPublicIndex)
+	}
+
+	e := big.NewInt(int64(params.Exponent()))
+	phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+	d := new(big.Int).ModInverse(e, phi)
+	if d == nil {
+		return nil, parameterError(tpm2.RCBinding, inPublicIndex)
+	}
+
+	key := &rsa.PrivateKey{
+		PublicKey: rsa.PublicKey{N: n, E: int(params.Exponent())},
+		D:         d,
+		Primes:    []*big.Int{p, q},
+	}
+	key.Precompute()
+	return key, nil
+}
+
+// restoreECCKey rebuilds an ECC key from the private scalar and checks it matches the public point
+func restoreECCKey(params *tpm2.ECCParams, d []byte) (*ecdsa.PrivateKey, error) {
+	curve, ok := eccGoCurves[params.CurveID]
+	if !ok {
+		return nil, parameterError(tpm2.RCCurve, inPublicIndex)
+	}
+
+	key := &ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d)
+	if key.X.Cmp(new(big.Int).SetBytes(params.Point.XRaw)) != 0 || key.Y.Cmp(new(big.Int).SetBytes(params.Point.YRaw)) != 0 {
+		return nil, parameterError(tpm2.RCBinding, inPublicIndex)
+	}
+	return key, nil
+}
+
+// generateRSAKey generates an RSA key from the bytes of r,
+// unlike rsa.GenerateKey the result depends only on the bytes read
+func generateRSAKey(r io.Reader, bits, exponent int) (*rsa.PrivateKey, error) {
+	e := big.NewInt(int64(exponent))
+	one := big.NewInt(1)
+	for {
+		p, err := generatePrime(r, bits/2, e)
+		if err != nil {
+			return nil, err
+		}
+		q, err := generatePrime(r, bits/2, e)
+		if err != nil {
+			return nil, err
+		}
+		if p.Cmp(q) == 0 {
+			continue
+		}
+
+		n := new(big.Int).Mul(p, q)
+		phi := new(big.Int).Mul(new(big.Int).Sub(p, one), new(big.Int).Sub(q, one))
+		d := new(big.Int).ModInverse(e, phi)
+		if n.BitLen() != bits || d == nil {
+			continue
+		}
+
+		key := &rsa.PrivateKey{
+			PublicKey: rsa.PublicKey{N: n, E: exponent},
+			D:         d,
+			Primes:    []*big.Int{p, q},
+		}
+		key.Precompute()
+		return key, nil
+	}
+}
+
+// generatePrime reads candidates from r until a prime p of a given size with gcd(e, p-1) = 1 is found
+func generatePrime(r io.Reader, bits int, e *big.Int) (*big.Int, error) {
+	b := make([]byte, bits/8)
+	one := big.NewInt(1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		// two top bits guarantee the size of the modulus, the lowest bit makes the candidate odd
+		b[0] |= 0xC0
+		b[len(b)-1] |= 1
+
+		p := new(big.Int).SetBytes(b)
+		if !p.ProbablyPrime(20) {
+			continue
+		}
+		if new(big.Int).GCD(nil, nil, e, new(big.Int).Sub(p, one)).Cmp(one) == 0 {
+			return p, nil
+		}
+	}
+}
+
+// generateECCKey generates an ECC key from the bytes of r following FIPS 186-4 B.4.1
+func generateECCKey(r io.Reader, curve elliptic.Curve) (*ecdsa.PrivateKey, error) {
+	params := curve.Params()
+	b := make([]byte, (params.BitSize+7)/8+8)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, err
+	}
+
+	one := big.NewInt(1)
+	d := new(big.Int).SetBytes(b)
+	d.Mod(d, new(big.Int).Sub(params.N, one))
+	d.Add(d, one)
+
+	key := &ecdsa.PrivateKey{D: d}
+	key.PublicKey.Curve = curve
+	key.PublicKey.X, key.PublicKey.Y = curve.ScalarBaseMult(d.Bytes())
+	return key, nil
+}
+
+// kdfStream is the KDF-seeded random number generator of Part 1 that derives primary objects. Every read
+// of n bytes is KDFa(hashAlg, key, label, contextU, contextV, 8n) with the counter of KDFa continuing
+// from the previous read, the unused bytes of the last block are discarded
+type kdfStream struct {
+	hashAlg  tpm2.Algorithm
+	key      []byte
+	label    string
+	contextU []byte
+	contextV []byte
+	counter  uint32
+}
+
+// newKDFStream creates a KDF-seeded generator with the counter starting from 1
+func newKDFStream(hashAlg tpm2.Algorithm, key []byte, label string, contextU, contextV []byte) *kdfStream {
+	return &kdfStream{
+		hashAlg:  hashAlg,
+		key:      key,
+		label:    label,
+		contextU: contextU,
+		contextV: contextV,
+	}
+}
+
+// Read fills p with the output of one KDFa invocation of the size of p
+func (s *kdfStream) Read(p []byte) (int, error) {
+	hash, err := s.hashAlg.Hash()
+	if err != nil {
+		return 0, err
+	}
+	var out []byte
+	for len(out) < len(p) {
+		s.counter++
+		mac := hmac.New(hash.New, s.key)
+		if err := binary.Write(mac, binary.BigEndian, s.counter); err != nil {
+			return 0, err
+		}
+		mac.Write([]byte(s.label))
+		mac.Write([]byte{0})
+		mac.Write(s.contextU)
+		mac.Write(s.contextV)
+		if err := binary.Write(mac, binary.BigEndian, uint32(8*len(p))); err != nil {
+			return 0, err
+		}
+		out = mac.Sum(out)
+	}
+	return copy(p, out), nil
+}
+
+// leftPad pads a big-endian number with leading zeroes to a given size
+func leftPad(b []byte, size int) []byte {
+	if len(b) >= size {
+		return b
+	}
+	padded := make([]byte, size)
+	copy(padded[size-len(b):], b)
+	return padded
+}
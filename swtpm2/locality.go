@@ -0,0 +1,31 @@
+package swtpm2
+
+import "github.com/google/go-tpm/tpm2"
+
+// firstExtendedLocality is the lowest extended locality, localities between 5 and 31 are not defined
+const firstExtendedLocality = 32
+
+// checkLocality returns TPM_RC_LOCALITY for localities that are not defined
+func checkLocality(locality uint8) error {
+	if locality > maxLocality && locality < firstExtendedLocality {
+		return tpm2.Warning{Code: tpm2.RCLocality}
+	}
+	return nil
+}
+
+// localityAttributes converts a locality to TPMA_LOCALITY, localities 0-4 are represented by a bit
+// while an extended locality is represented by its value
+func localityAttributes(locality uint8) byte {
+	if locality <= maxLocality {
+		return 1 << locality
+	}
+	return locality
+}
+
+// localityIncluded tells whether TPMA_LOCALITY includes a locality
+func localityIncluded(attributes byte, locality uint8) bool {
+	if attributes < firstExtendedLocality {
+		return locality <= maxLocality && attributes&localityAttributes(locality) != 0
+	}
+	return attributes == localityAttributes(locality)
+}
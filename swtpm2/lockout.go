@@ -0,0 +1,145 @@
+package swtpm2
+
+import (
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Parameters of the dictionary attack protection of a new TPM
+const (
+	defaultMaxTries        = 3
+	defaultRecoveryTime    = 1000
+	defaultLockoutRecovery = 1000
+)
+
+// dictionaryAttack is the state of the dictionary attack protection
+type dictionaryAttack struct {
+	// failedTries counts authorization failures of DA protected entities, the TPM is in lockout when it reaches maxTries
+	failedTries uint32
+	maxTries    uint32
+	// recoveryTime is the number of seconds after which failedTries is decremented, zero disables the protection
+	recoveryTime uint32
+	// lockoutRecovery is the number of seconds after a failed authorization of lockoutAuth before it can be used again,
+	// with zero lockoutAuth is only available after TPM Reset
+	lockoutRecovery uint32
+	// lockoutAuthFailed is set by a failed authorization of lockoutAuth
+	lockoutAuthFailed bool
+	// selfHealStart and lockoutStart are the values of Time when the current recovery intervals started
+	selfHealStart uint64
+	lockoutStart  uint64
+}
+
+// newDictionaryAttack creates the dictionary attack protection of a new TPM
+func newDictionaryAttack() dictionaryAttack {
+	return dictionaryAttack{
+		maxTries:        defaultMaxTries,
+		recoveryTime:    defaultRecoveryTime,
+		lockoutRecovery: defaultLockoutRecovery,
+	}
+}
+
+// inLockout reports whether authorizations of DA protected entities with their authValues are refused
+func (da *dictionaryAttack) inLockout() bool {
+	return da.failedTries >= da.maxTries
+}
+
+// isDAProtected reports whether authorization failures of an entity are counted by failedTries:
+// objects and NV indices are protected unless they have noDA, lockoutAuth is protected by lockoutRecovery
+func (t *TPM2) isDAProtected(handle tpmutil.Handle) bool {
+	if obj, ok := t.objects[handle]; ok {
+		return obj.public.Attributes&tpm2.FlagNoDA == 0
+	}
+	if nv, ok := t.nvIndices[handle]; ok {
+		return !nv.has(tpm2.AttrNoDA)
+	}
+	return false
+}
+
+// updateLockout applies the recovery since the last update: failedTries is decremented once every recoveryTime seconds
+// and lockoutAuth becomes available lockoutRecovery seconds after its failed authorization
+func (t *TPM2) updateLockout() {
+	da := &t.da
+	now := t.timeValue()
+	if da.recoveryTime != 0 && da.failedTries != 0 && now > da.selfHealStart {
+		interval := uint64(da.recoveryTime) * 1000
+		recovered := (now - da.selfHealStart) / interval
+		if recovered >= uint64(da.failedTries) {
+			da.failedTries = 0
+		} else {
+			da.failedTries -= uint32(recovered)
+		}
+		da.selfHealStart += recovered * interval
+	}
+	if da.lockoutAuthFailed && da.lockoutRecovery != 0 && now >= da.lockoutStart+uint64(da.lockoutRecovery)*1000 {
+		da.lockoutAuthFailed = false
+	}
+}
+
+// checkLockout returns TPM_RC_LOCKOUT when an entity cannot be authorized with its authValue
+// because of the dictionary attack protection
+func (t *TPM2) checkLockout(handle tpmutil.Handle) error {
+	t.updateLockout()
+	switch {
+	case handle == tpm2.HandleLockout && t.da.lockoutAuthFailed,
+		handle != tpm2.HandleLockout && t.isDAProtected(handle) && t.da.inLockout():
+		return tpm2.Warning{Code: tpm2.RCLockout}
+	}
+	return nil
+}
+
+// authorizationFailed counts a failed authorization of an entity with its authValue
+func (t *TPM2) authorizationFailed(handle tpmutil.Handle) {
+	da := &t.da
+	switch {
+	case handle == tpm2.HandleLockout:
+		da.lockoutAuthFailed = true
+		da.lockoutStart = t.timeValue()
+	case t.isDAProtected(handle) && da.recoveryTime != 0 && !da.inLockout():
+		da.failedTries++
+		da.selfHealStart = t.timeValue()
+	}
+}
+
+// lockoutStartup restarts the recovery intervals at Startup. TPM Reset makes lockoutAuth available when it is only
+// recovered by TPM Reset, and a Startup that is not preceded by Shutdown counts as an authorization failure,
+// so the protection is not bypassed by a power loss. The first Startup of a new TPM is not counted
+func (t *TPM2) lockoutStartup(reset bool) {
+	da := &t.da
+	if reset && da.lockoutRecovery == 0 {
+		da.lockoutAuthFailed = false
+	}
+	firstStartup := t.resetCount == 0 && t.restartCount == 0
+	if !t.shutdown && !firstStartup && da.recoveryTime != 0 && !da.inLockout() {
+		da.failedTries++
+	}
+	now := t.timeValue()
+	da.selfHealStart = now
+	da.lockoutStart = now
+}
+
+// DictionaryAttackLockReset processes DictionaryAttackLockReset command, it leaves the lockout
+func (t *TPM2) DictionaryAttackLockReset(lockHandle tpmutil.Handle) error {
+	if lockHandle != tpm2.HandleLockout {
+		return handleError(tpm2.RCValue, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	t.da.failedTries = 0
+	return nil
+}
+
+// DictionaryAttackParameters processes DictionaryAttackParameters command, failedTries is kept
+func (t *TPM2) DictionaryAttackParameters(lockHandle tpmutil.Handle, newMaxTries, newRecoveryTime, lockoutRecovery uint32) error {
+	if lockHandle != tpm2.HandleLockout {
+		return handleError(tpm2.RCValue, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	t.updateLockout()
+	t.da.maxTries = newMaxTries
+	t.da.recoveryTime = newRecoveryTime
+	t.da.lockoutRecovery = lockoutRecovery
+	return nil
+}
@@ -0,0 +1,308 @@
+package swtpm2
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Range of handles that are used for NV indices
+const (
+	nvIndexFirst = tpmutil.Handle(handleTypeNVIndex << handleTypeShift)
+	nvIndexLast  = nvIndexFirst + 0x00FFFFFF
+)
+
+// Limits of NV memory
+const (
+	// maxNVIndices is the maximum number of defined NV indices
+	maxNVIndices = 64
+	// nvMemorySize is the total size of the data of all NV indices
+	nvMemorySize = 16384
+)
+
+// nvType is TPM_NT, the type of an NV index encoded in TPMA_NV
+type nvType uint32
+
+const (
+	nvTypeOrdinary nvType = 0x0
+	nvTypeCounter  nvType = 0x1
+	nvTypeBits     nvType = 0x2
+	nvTypeExtend   nvType = 0x4
+	nvTypePinFail  nvType = 0x8
+	nvTypePinPass  nvType = 0x9
+)
+
+// Position of TPM_NT in TPMA_NV
+const (
+	nvTypeShift = 4
+	nvTypeMask  = 0xF0
+)
+
+// nvPinSize is the size of TPMS_NV_PIN_COUNTER_PARAMETERS, the data of PIN indices
+const nvPinSize = 8
+
+// nvCounterSize is the size of the data of counter and bit field indices
+const nvCounterSize = 8
+
+// maxOrderlyCount is MAX_ORDERLY_COUNT: an orderly counter is written to NV memory every time its low-order bits
+// covered by the mask wrap, so the counter in RAM is ahead of NV memory by at most this value
+const maxOrderlyCount = 0xFF
+
+// nvAccess tells whether a command reads or writes the data of an NV index that authorizes it
+type nvAccess int
+
+const (
+	nvAccessNone nvAccess = iota
+	nvAccessRead
+	nvAccessWrite
+)
+
+// nvReadAttributes and nvWriteAttributes allow reading and writing of an NV index,
+// every index has at least one attribute of each set
+const (
+	nvReadAttributes  = tpm2.AttrPPRead | tpm2.AttrOwnerRead | tpm2.AttrAuthRead | tpm2.AttrPolicyRead
+	nvWriteAttributes = tpm2.AttrPPWrite | tpm2.AttrOwnerWrite | tpm2.AttrAuthWrite | tpm2.AttrPolicyWrite
+)
+
+// nvStateAttributes are the attributes that reflect the state of an NV index and are not set by DefineSpace
+const nvStateAttributes = tpm2.AttrWriteLocked | tpm2.AttrReadLocked | tpm2.AttrWritten
+
+// nvIndex represents a defined NV index
+type nvIndex struct {
+	// public contains the current attributes of the index including TPMA_NV_WRITTEN and the lock attributes
+	public    tpm2.NVPublic
+	authValue []byte
+	// data has the size of the index, bytes that were never written are 0xFF
+	data []byte
+	// nvCounter is the value of an orderly counter in NV memory, the counter in data is kept in RAM
+	nvCounter uint64
+}
+
+// newNVIndex creates an NV index with a given public area and the data that was never written
+func newNVIndex(public tpm2.NVPublic, authValue []byte) *nvIndex {
+	return &nvIndex{
+		public:    public,
+		authValue: authValue,
+		data:      bytes.Repeat([]byte{0xFF}, int(public.DataSize)),
+	}
+}
+
+// nvType returns TPM_NT of the index
+func (nv *nvIndex) nvType() nvType {
+	return nvTypeFromAttributes(nv.public.Attributes)
+}
+
+func nvTypeFromAttributes(attributes tpm2.NVAttr) nvType {
+	return nvType(attributes&nvTypeMask) >> nvTypeShift
+}
+
+// has tells whether all given attributes are set
+func (nv *nvIndex) has(attributes tpm2.NVAttr) bool {
+	return nv.public.Attributes&attributes == attributes
+}
+
+// name computes the Name of the index: nameAlg || H_nameAlg(TPMS_NV_PUBLIC)
+func (nv *nvIndex) name() ([]byte, error) {
+	public, err := tpmutil.Pack(nv.public)
+	if err != nil {
+		return nil, err
+	}
+	hash, err := nv.public.NameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(public)
+	return tpm2.HashValue{Alg: nv.public.NameAlg, Value: h.Sum(nil)}.Encode()
+}
+
+// pin returns pinCount and pinLimit of a PIN index
+func (nv *nvIndex) pin() (uint32, uint32) {
+	return binary.BigEndian.Uint32(nv.data), binary.BigEndian.Uint32(nv.data[4:])
+}
+
+// setPinCount updates pinCount of a PIN index
+func (nv *nvIndex) setPinCount(pinCount uint32) {
+	binary.BigEndian.PutUint32(nv.data, pinCount)
+}
+
+// counter returns the value of a counter or bit field index
+func (nv *nvIndex) counter() uint64 {
+	return binary.BigEndian.Uint64(nv.data)
+}
+
+// setCounter updates the value of a counter or bit field index
+func (nv *nvIndex) setCounter(value uint64) {
+	binary.BigEndian.PutUint64(nv.data, value)
+}
+
+// isOrderlyCounter tells whether the counter of the index is kept in RAM between writes to NV memory
+func (nv *nvIndex) isOrderlyCounter() bool {
+	return nv.nvType() == nvTypeCounter && nv.has(tpm2.AttrOrderly)
+}
+
+// isNVIndexHandle tells whether a handle belongs to the NV index range
+func isNVIndexHandle(handle tpmutil.Handle) bool {
+	return handle >= nvIndexFirst && handle <= nvIndexLast
+}
+
+// nvMemoryUsed returns the total size of the data of all NV indices
+func (t *TPM2) nvMemoryUsed() int {
+	var used int
+	for _, nv := range t.nvIndices {
+		used += len(nv.data)
+	}
+	return used
+}
+
+// checkAuthValue checks that the authValue of the index can authorize a command with a password.
+// The authValue is available for commands that read or write the index with TPMA_NV_AUTHREAD or
+// TPMA_NV_AUTHWRITE, PIN indices do not accept the authValue when pinCount reached pinLimit
+func (nv *nvIndex) checkAuthValue(cc tpmutil.Command) error {
+	var available bool
+	switch commandTable[cc].nvAccess {
+	case nvAccessRead:
+		available = nv.has(tpm2.AttrAuthRead)
+	case nvAccessWrite:
+		available = nv.has(tpm2.AttrAuthWrite)
+	}
+	if !available {
+		return tpm2.Error{Code: tpm2.RCAuthUnavailable}
+	}
+
+	switch nv.nvType() {
+	case nvTypePinPass, nvTypePinFail:
+		if !nv.has(tpm2.AttrWritten) {
+			return tpm2.Error{Code: tpm2.RCNVUninitialized}
+		}
+		if pinCount, pinLimit := nv.pin(); pinCount >= pinLimit {
+			return tpm2.Error{Code: tpm2.RCNVAuthorization}
+		}
+	}
+	return nil
+}
+
+// checkAuthPolicy checks that the authPolicy of the index can authorize a command with a policy session.
+// The policy is available for commands that read or write the index with TPMA_NV_POLICYREAD or
+// TPMA_NV_POLICYWRITE and it is the only authorization of the ADMIN role
+func (nv *nvIndex) checkAuthPolicy(cc tpmutil.Command) error {
+	available := true
+	switch commandTable[cc].nvAccess {
+	case nvAccessRead:
+		available = nv.has(tpm2.AttrPolicyRead)
+	case nvAccessWrite:
+		available = nv.has(tpm2.AttrPolicyWrite)
+	}
+	if !available {
+		return tpm2.Error{Code: tpm2.RCAuthUnavailable}
+	}
+	return nil
+}
+
+// authorized updates pinCount of a PIN index after an authorization with its authValue:
+// a PIN Pass index counts successful authorizations, a PIN Fail index counts failures
+func (nv *nvIndex) authorized(succeeded bool) {
+	switch {
+	case nv.nvType() == nvTypePinPass && succeeded, nv.nvType() == nvTypePinFail && !succeeded:
+		pinCount, _ := nv.pin()
+		nv.setPinCount(pinCount + 1)
+	}
+}
+
+// nvWriteAccessChecks checks that authHandle is allowed to write an NV index
+func nvWriteAccessChecks(authHandle tpmutil.Handle, nvHandle tpmutil.Handle, nv *nvIndex) error {
+	switch {
+	case authHandle == tpm2.HandlePlatform && nv.has(tpm2.AttrPPWrite),
+		authHandle == tpm2.HandleOwner && nv.has(tpm2.AttrOwnerWrite),
+		authHandle == nvHandle && (nv.has(tpm2.AttrAuthWrite) || nv.has(tpm2.AttrPolicyWrite)):
+	default:
+		return tpm2.Error{Code: tpm2.RCNVAuthorization}
+	}
+	if nv.has(tpm2.AttrWriteLocked) {
+		return tpm2.Error{Code: tpm2.RCNVLocked}
+	}
+	return nil
+}
+
+// nvReadAccessChecks checks that authHandle is allowed to read an NV index and that the index has data
+func nvReadAccessChecks(authHandle tpmutil.Handle, nvHandle tpmutil.Handle, nv *nvIndex) error {
+	switch {
+	case authHandle == tpm2.HandlePlatform && nv.has(tpm2.AttrPPRead),
+		authHandle == tpm2.HandleOwner && nv.has(tpm2.AttrOwnerRead),
+		authHandle == nvHandle && (nv.has(tpm2.AttrAuthRead) || nv.has(tpm2.AttrPolicyRead)):
+	default:
+		return tpm2.Error{Code: tpm2.RCNVAuthorization}
+	}
+	if nv.has(tpm2.AttrReadLocked) {
+		return tpm2.Error{Code: tpm2.RCNVLocked}
+	}
+	if !nv.has(tpm2.AttrWritten) {
+		return tpm2.Error{Code: tpm2.RCNVUninitialized}
+	}
+	return nil
+}
+
+// checkNVWrite returns TPM_RC_NV_UNAVAILABLE when the data of an NV index cannot be updated,
+// indices with TPMA_NV_ORDERLY are kept in RAM until Shutdown
+func (t *TPM2) checkNVWrite(nv *nvIndex) error {
+	if nv.has(tpm2.AttrOrderly) {
+		return nil
+	}
+	return t.checkNVAvailable()
+}
+
+// maxCounter returns the largest value of all counters that were ever defined,
+// a new counter starts from this value so it never repeats values of another counter
+func (t *TPM2) maxCounter() uint64 {
+	max := t.maxNVCounter
+	for _, nv := range t.nvIndices {
+		if nv.nvType() == nvTypeCounter && nv.has(tpm2.AttrWritten) && nv.counter() > max {
+			max = nv.counter()
+		}
+	}
+	return max
+}
+
+// deleteNVIndex removes an NV index, the value of a removed counter is remembered by maxCounter
+func (t *TPM2) deleteNVIndex(handle tpmutil.Handle) {
+	if nv := t.nvIndices[handle]; nv.nvType() == nvTypeCounter && nv.has(tpm2.AttrWritten) && nv.counter() > t.maxNVCounter {
+		t.maxNVCounter = nv.counter()
+	}
+	delete(t.nvIndices, handle)
+}
+
+// nvShutdown writes orderly counters to NV memory on Shutdown
+func (t *TPM2) nvShutdown() {
+	for _, nv := range t.nvIndices {
+		if nv.isOrderlyCounter() && nv.has(tpm2.AttrWritten) {
+			nv.nvCounter = nv.counter()
+		}
+	}
+}
+
+// nvRestoreOrderlyCounters restores orderly counters after a shutdown that was not orderly,
+// the counters continue after the high-water mark so they never repeat the values lost with RAM
+func (t *TPM2) nvRestoreOrderlyCounters() {
+	for _, nv := range t.nvIndices {
+		if nv.isOrderlyCounter() && nv.has(tpm2.AttrWritten) {
+			nv.nvCounter += maxOrderlyCount + 1
+			nv.setCounter(nv.nvCounter)
+		}
+	}
+}
+
+// nvStartup updates the attributes of NV indices on TPM Reset and TPM Restart
+func (t *TPM2) nvStartup() {
+	for _, nv := range t.nvIndices {
+		if nv.has(tpm2.AttrClearSTClear) {
+			nv.public.Attributes &^= tpm2.AttrWritten
+		}
+		// TPMA_NV_WRITEDEFINE lock of a written index is permanent
+		if !nv.has(tpm2.AttrWriteDefine | tpm2.AttrWritten) {
+			nv.public.Attributes &^= tpm2.AttrWriteLocked
+		}
+		nv.public.Attributes &^= tpm2.AttrReadLocked
+	}
+}
@@ -0,0 +1,417 @@
+package swtpm2
+
+import (
+	"errors"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Parameter indices of NV_DefineSpace
+const (
+	defineSpaceAuthIndex       = 1
+	defineSpacePublicInfoIndex = 2
+)
+
+// nvReservedAttributes are the reserved bits of TPMA_NV
+const nvReservedAttributes tpm2.NVAttr = 0x00000300 | 0x01F00000
+
+// NVDefineSpace processes NV_DefineSpace command
+func (t *TPM2) NVDefineSpace(authHandle tpmutil.Handle, auth []byte, publicInfo tpm2.NVPublic) error {
+	if authHandle != tpm2.HandleOwner && authHandle != tpm2.HandlePlatform {
+		return handleError(tpm2.RCValue, 1)
+	}
+	if err := checkNVPublic(authHandle, auth, publicInfo); err != nil {
+		return err
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	if _, ok := t.nvIndices[publicInfo.NVIndex]; ok {
+		return tpm2.Error{Code: tpm2.RCNVDefined}
+	}
+	if len(t.nvIndices) >= maxNVIndices || t.nvMemoryUsed()+int(publicInfo.DataSize) > nvMemorySize {
+		return tpm2.Error{Code: tpm2.RCNVSpace}
+	}
+	t.nvIndices[publicInfo.NVIndex] = newNVIndex(publicInfo, auth)
+	return nil
+}
+
+// checkNVPublic validates the public area of a new NV index and its authValue
+func checkNVPublic(authHandle tpmutil.Handle, auth []byte, public tpm2.NVPublic) error {
+	size, ok := digestSize(public.NameAlg)
+	if !ok {
+		return parameterError(tpm2.RCHash, defineSpacePublicInfoIndex)
+	}
+	if !isNVIndexHandle(public.NVIndex) {
+		return parameterError(tpm2.RCValue, defineSpacePublicInfoIndex)
+	}
+	if len(auth) > size {
+		return parameterError(tpm2.RCSize, defineSpaceAuthIndex)
+	}
+	if len(public.AuthPolicy) != 0 && len(public.AuthPolicy) != size {
+		return parameterError(tpm2.RCSize, defineSpacePublicInfoIndex)
+	}
+	if public.DataSize > maxNVIndexSize {
+		return parameterError(tpm2.RCSize, defineSpacePublicInfoIndex)
+	}
+
+	attributes := public.Attributes
+	if attributes&nvReservedAttributes != 0 {
+		return parameterError(tpm2.RCReservedBits, defineSpacePublicInfoIndex)
+	}
+	switch nvTypeFromAttributes(attributes) {
+	case nvTypeOrdinary:
+	case nvTypeCounter, nvTypeBits:
+		if public.DataSize != nvCounterSize {
+			return parameterError(tpm2.RCSize, defineSpacePublicInfoIndex)
+		}
+	case nvTypeExtend:
+		if int(public.DataSize) != size {
+			return parameterError(tpm2.RCSize, defineSpacePublicInfoIndex)
+		}
+	case nvTypePinFail, nvTypePinPass:
+		if public.DataSize != nvPinSize {
+			return parameterError(tpm2.RCSize, defineSpacePublicInfoIndex)
+		}
+		// pinCount of a PIN Fail index is a dictionary attack protection by itself,
+		// the owner of the authValue of a PIN index is not allowed to reset pinCount
+		if nvTypeFromAttributes(attributes) == nvTypePinFail && attributes&tpm2.AttrNoDA == 0 ||
+			attributes&(tpm2.AttrAuthWrite|tpm2.AttrGlobalLock|tpm2.AttrWriteDefine) != 0 {
+			return parameterError(tpm2.RCAttributes, defineSpacePublicInfoIndex)
+		}
+	default:
+		return parameterError(tpm2.RCAttributes, defineSpacePublicInfoIndex)
+	}
+
+	switch {
+	case attributes&nvStateAttributes != 0,
+		attributes&nvReadAttributes == 0,
+		attributes&nvWriteAttributes == 0,
+		nvTypeFromAttributes(attributes) == nvTypeCounter && attributes&tpm2.AttrClearSTClear != 0,
+		attributes&tpm2.AttrPolicyDelete != 0 && attributes&tpm2.AttrPlatformCreate == 0:
+		return parameterError(tpm2.RCAttributes, defineSpacePublicInfoIndex)
+	}
+	// indices of the platform are defined with platform authorization only
+	if (attributes&tpm2.AttrPlatformCreate != 0) != (authHandle == tpm2.HandlePlatform) {
+		return parameterError(tpm2.RCAttributes, defineSpacePublicInfoIndex)
+	}
+	return nil
+}
+
+// NVUndefineSpace processes NV_UndefineSpace command
+func (t *TPM2) NVUndefineSpace(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle) error {
+	if authHandle != tpm2.HandleOwner && authHandle != tpm2.HandlePlatform {
+		return handleError(tpm2.RCValue, 1)
+	}
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	// an index with TPMA_NV_POLICY_DELETE is removed with NV_UndefineSpaceSpecial only
+	if nv.has(tpm2.AttrPolicyDelete) {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	if nv.has(tpm2.AttrPlatformCreate) != (authHandle == tpm2.HandlePlatform) {
+		return tpm2.Error{Code: tpm2.RCNVAuthorization}
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	t.deleteNVIndex(nvIndexHandle)
+	return nil
+}
+
+// NVUndefineSpaceSpecial processes NV_UndefineSpaceSpecial command,
+// the index is authorized in the ADMIN role that requires a policy session
+func (t *TPM2) NVUndefineSpaceSpecial(nvIndexHandle tpmutil.Handle, platform tpmutil.Handle) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 1)
+	if err != nil {
+		return err
+	}
+	if platform != tpm2.HandlePlatform {
+		return handleError(tpm2.RCValue, 2)
+	}
+	if !nv.has(tpm2.AttrPolicyDelete) {
+		return handleError(tpm2.RCAttributes, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	t.deleteNVIndex(nvIndexHandle)
+	return nil
+}
+
+// NVWrite processes NV_Write command
+func (t *TPM2) NVWrite(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle, data []byte, offset uint16) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	if err := nvWriteAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		return err
+	}
+	switch nv.nvType() {
+	case nvTypeCounter, nvTypeBits, nvTypeExtend:
+		// these indices are updated by the dedicated commands
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	if int(offset)+len(data) > len(nv.data) {
+		return tpm2.Error{Code: tpm2.RCNVRange}
+	}
+	if nv.has(tpm2.AttrWriteAll) && len(data) != len(nv.data) {
+		return tpm2.Error{Code: tpm2.RCNVRange}
+	}
+	if err := t.checkNVWrite(nv); err != nil {
+		return err
+	}
+
+	copy(nv.data[offset:], data)
+	nv.public.Attributes |= tpm2.AttrWritten
+	return nil
+}
+
+// NVIncrement processes NV_Increment command. A counter that was never written starts from the largest value
+// of all counters, an orderly counter is written to NV memory when its low-order bits wrap
+func (t *TPM2) NVIncrement(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	if err := nvWriteAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		return err
+	}
+	if nv.nvType() != nvTypeCounter {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+
+	value := t.maxCounter()
+	if nv.has(tpm2.AttrWritten) {
+		value = nv.counter()
+	}
+	value++
+	writeNV := !nv.isOrderlyCounter() || !nv.has(tpm2.AttrWritten) || value&maxOrderlyCount == 0
+	if writeNV {
+		if err := t.checkNVAvailable(); err != nil {
+			return err
+		}
+		nv.nvCounter = value
+	}
+
+	nv.setCounter(value)
+	nv.public.Attributes |= tpm2.AttrWritten
+	return nil
+}
+
+// NVSetBits processes NV_SetBits command, the bits are ORed into the bit field that starts from zero
+func (t *TPM2) NVSetBits(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle, bits uint64) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	if err := nvWriteAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		return err
+	}
+	if nv.nvType() != nvTypeBits {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	if err := t.checkNVWrite(nv); err != nil {
+		return err
+	}
+
+	var value uint64
+	if nv.has(tpm2.AttrWritten) {
+		value = nv.counter()
+	}
+	nv.setCounter(value | bits)
+	nv.public.Attributes |= tpm2.AttrWritten
+	return nil
+}
+
+// NVExtend processes NV_Extend command, the index is extended like a PCR starting from zero digest
+func (t *TPM2) NVExtend(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle, data []byte) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	if err := nvWriteAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		return err
+	}
+	if nv.nvType() != nvTypeExtend {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	if err := t.checkNVWrite(nv); err != nil {
+		return err
+	}
+
+	h := hashFunctions[nv.public.NameAlg]()
+	if nv.has(tpm2.AttrWritten) {
+		h.Write(nv.data)
+	} else {
+		h.Write(make([]byte, len(nv.data)))
+	}
+	h.Write(data)
+	nv.data = h.Sum(nil)
+	nv.public.Attributes |= tpm2.AttrWritten
+	return nil
+}
+
+// NVWriteLock processes NV_WriteLock command, the lock of TPMA_NV_WRITE_STCLEAR lasts until the next TPM Reset
+// or TPM Restart and the lock of TPMA_NV_WRITEDEFINE is permanent once the index is written
+func (t *TPM2) NVWriteLock(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	if err := nvWriteAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		if errors.Is(err, tpm2.Error{Code: tpm2.RCNVLocked}) {
+			// the index is already locked
+			return nil
+		}
+		return err
+	}
+	if !nv.has(tpm2.AttrWriteDefine) && !nv.has(tpm2.AttrWriteSTClear) {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	if err := t.checkNVWrite(nv); err != nil {
+		return err
+	}
+	nv.public.Attributes |= tpm2.AttrWriteLocked
+	return nil
+}
+
+// NVReadLock processes NV_ReadLock command, the lock lasts until the next TPM Reset or TPM Restart
+func (t *TPM2) NVReadLock(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return err
+	}
+	// an index that is not written or already locked is locked anyway
+	if err := nvReadAccessChecks(authHandle, nvIndexHandle, nv); errors.Is(err, tpm2.Error{Code: tpm2.RCNVAuthorization}) {
+		return err
+	}
+	if !nv.has(tpm2.AttrReadSTClear) {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	if err := t.checkNVWrite(nv); err != nil {
+		return err
+	}
+	nv.public.Attributes |= tpm2.AttrReadLocked
+	return nil
+}
+
+// NVGlobalWriteLock processes NV_GlobalWriteLock command that locks all indices with TPMA_NV_GLOBALLOCK
+func (t *TPM2) NVGlobalWriteLock(authHandle tpmutil.Handle) error {
+	if authHandle != tpm2.HandleOwner && authHandle != tpm2.HandlePlatform {
+		return handleError(tpm2.RCValue, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	for _, nv := range t.nvIndices {
+		if nv.has(tpm2.AttrGlobalLock) {
+			nv.public.Attributes |= tpm2.AttrWriteLocked
+		}
+	}
+	return nil
+}
+
+// NVChangeAuth processes NV_ChangeAuth command,
+// the index is authorized in the ADMIN role that requires a policy session
+func (t *TPM2) NVChangeAuth(nvIndexHandle tpmutil.Handle, newAuth []byte) error {
+	nv, err := t.nvIndexAt(nvIndexHandle, 1)
+	if err != nil {
+		return err
+	}
+	if size, _ := digestSize(nv.public.NameAlg); len(newAuth) > size {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+	nv.authValue = newAuth
+	return nil
+}
+
+// NVCertify processes NV_Certify command that signs TPMS_NV_CERTIFY_INFO with the contents of the index
+func (t *TPM2) NVCertify(signHandle, authHandle, nvIndexHandle tpmutil.Handle,
+	qualifyingData []byte, inScheme *tpm2.SigScheme, size, offset uint16) (*NVCertifyResponse, error) {
+
+	signKey, scheme, err := t.signingKey(signHandle, inScheme, 2)
+	if err != nil {
+		return nil, err
+	}
+	nv, err := t.nvIndexAt(nvIndexHandle, 3)
+	if err != nil {
+		return nil, err
+	}
+	if err := nvReadAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		return nil, err
+	}
+	if size > maxNVBufferSize {
+		return nil, parameterError(tpm2.RCValue, 3)
+	}
+	if int(offset)+int(size) > len(nv.data) {
+		return nil, tpm2.Error{Code: tpm2.RCNVRange}
+	}
+
+	name, err := nv.name()
+	if err != nil {
+		return nil, err
+	}
+	certifyInfo, err := tpmutil.Pack(tpmutil.U16Bytes(name), offset, tpmutil.U16Bytes(nv.data[offset:offset+size]))
+	if err != nil {
+		return nil, err
+	}
+	attest, signature, err := t.attest(signKey, scheme, tagAttestNV, qualifyingData, certifyInfo)
+	if err != nil {
+		return nil, err
+	}
+	return &NVCertifyResponse{
+		CertifyInfo: attest,
+		Signature:   signature,
+	}, nil
+}
+
+// NVRead processes NV_Read command
+func (t *TPM2) NVRead(authHandle tpmutil.Handle, nvIndexHandle tpmutil.Handle, size, offset uint16) ([]byte, error) {
+	nv, err := t.nvIndexAt(nvIndexHandle, 2)
+	if err != nil {
+		return nil, err
+	}
+	if err := nvReadAccessChecks(authHandle, nvIndexHandle, nv); err != nil {
+		return nil, err
+	}
+	if size > maxNVBufferSize {
+		return nil, parameterError(tpm2.RCValue, 1)
+	}
+	if int(offset)+int(size) > len(nv.data) {
+		return nil, tpm2.Error{Code: tpm2.RCNVRange}
+	}
+	return append([]byte(nil), nv.data[offset:offset+size]...), nil
+}
+
+// ReadPublicNV processes NV_ReadPublic command
+func (t *TPM2) ReadPublicNV(nvIndexHandle tpmutil.Handle) (*ReadPublicNVResponse, error) {
+	nv, err := t.nvIndexAt(nvIndexHandle, 1)
+	if err != nil {
+		return nil, err
+	}
+	name, err := nv.name()
+	if err != nil {
+		return nil, err
+	}
+	return &ReadPublicNVResponse{
+		NVPublic: nv.public,
+		Name:     name,
+	}, nil
+}
+
+// nvIndexAt returns a defined NV index referenced by the handle with a given 1-based index
+func (t *TPM2) nvIndexAt(handle tpmutil.Handle, index int) (*nvIndex, error) {
+	nv, ok := t.nvIndices[handle]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, index)
+	}
+	return nv, nil
+}
@@ -0,0 +1,240 @@
+package swtpm2
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Create processes Create command
+func (t *TPM2) Create(parentHandle tpmutil.Handle,
+	inSensitive SensitiveCreate,
+	inPublic tpm2.Public,
+	outsideInfo []byte,
+	creationPCR []tpm2.PCRSelection) (*CreateResponse, error) {
+
+	parent, err := t.storageParent(parentHandle)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTemplate(inPublic, inSensitive); err != nil {
+		return nil, err
+	}
+
+	creationData, err := t.newCreationData(inPublic.NameAlg, creationPCR,
+		parent.public.NameAlg, parent.name, parent.qualifiedName, outsideInfo)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := createObject(rand.Reader, inPublic, inSensitive, parent.qualifiedName)
+	if err != nil {
+		return nil, err
+	}
+
+	private, err := wrapSensitive(parent, obj)
+	if err != nil {
+		return nil, err
+	}
+	digest, err := creationHash(obj.public.NameAlg, creationData)
+	if err != nil {
+		return nil, err
+	}
+	ticket, err := t.creationTicket(parent.hierarchy, obj.public.NameAlg, obj.name, digest)
+	if err != nil {
+		return nil, err
+	}
+	return &CreateResponse{
+		Private:        private,
+		Public:         obj.public,
+		CreationData:   *creationData,
+		CreationHash:   digest,
+		CreationTicket: ticket,
+	}, nil
+}
+
+// Load processes Load command
+func (t *TPM2) Load(parentHandle tpmutil.Handle, inPrivate []byte, inPublic tpm2.Public) (tpmutil.Handle, []byte, error) {
+	parent, err := t.storageParent(parentHandle)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	name, err := objectName(inPublic)
+	if err != nil {
+		return 0, nil, parameterError(tpm2.RCHash, inPublicIndex)
+	}
+	sensitive, err := unwrapSensitive(parent, inPrivate, name)
+	if err != nil {
+		return 0, nil, err
+	}
+	obj, err := restoreObject(inPublic, sensitive, parent.qualifiedName)
+	if err != nil {
+		return 0, nil, err
+	}
+	obj.hierarchy = parent.hierarchy
+
+	handle, err := t.addObject(obj)
+	if err != nil {
+		return 0, nil, err
+	}
+	return handle, obj.name, nil
+}
+
+// loadExternalHierarchyIndex is the parameter index of hierarchy in TPM2_LoadExternal
+const loadExternalHierarchyIndex = 3
+
+// LoadExternal processes LoadExternal command. An object with a sensitive area may only be loaded
+// into the null hierarchy, a public area alone may be loaded into any hierarchy.
+// The hierarchy is the parent of the object when its Qualified Name is computed
+func (t *TPM2) LoadExternal(inPrivate *tpm2.Private, inPublic tpm2.Public, hierarchy tpmutil.Handle) (tpmutil.Handle, []byte, error) {
+	switch hierarchy {
+	case tpm2.HandleOwner, tpm2.HandleEndorsement, tpm2.HandlePlatform, tpm2.HandleNull:
+	default:
+		return 0, nil, parameterError(tpm2.RCValue, loadExternalHierarchyIndex)
+	}
+	if inPrivate != nil {
+		if hierarchy != tpm2.HandleNull {
+			return 0, nil, parameterError(tpm2.RCHierarchy, loadExternalHierarchyIndex)
+		}
+		if inPublic.Attributes&(tpm2.FlagFixedTPM|tpm2.FlagFixedParent) != 0 {
+			return 0, nil, parameterError(tpm2.RCAttributes, inPublicIndex)
+		}
+	}
+
+	if _, err := objectName(inPublic); err != nil {
+		return 0, nil, parameterError(tpm2.RCHash, inPublicIndex)
+	}
+	parentName, err := tpmutil.Pack(hierarchy)
+	if err != nil {
+		return 0, nil, err
+	}
+	var obj *object
+	if inPrivate != nil {
+		obj, err = restoreObject(inPublic, *inPrivate, parentName)
+	} else {
+		obj, err = newObject(inPublic, parentName)
+	}
+	if err != nil {
+		return 0, nil, err
+	}
+	obj.hierarchy = hierarchy
+
+	handle, err := t.addObject(obj)
+	if err != nil {
+		return 0, nil, err
+	}
+	return handle, obj.name, nil
+}
+
+// ObjectChangeAuth processes ObjectChangeAuth command, it returns the private area of the object wrapped
+// with newAuth, the loaded object keeps its authValue
+func (t *TPM2) ObjectChangeAuth(objectHandle, parentHandle tpmutil.Handle, newAuth []byte) ([]byte, error) {
+	obj, ok := t.objects[objectHandle]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, 1)
+	}
+	parent, ok := t.objects[parentHandle]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, 2)
+	}
+	qualifiedName, err := computeQualifiedName(obj.public.NameAlg, parent.qualifiedName, obj.name)
+	if err != nil {
+		return nil, err
+	}
+	if parent.seedValue == nil || !hmac.Equal(qualifiedName, obj.qualifiedName) {
+		return nil, handleError(tpm2.RCType, 2)
+	}
+	if size, _ := digestSize(obj.public.NameAlg); len(newAuth) > size {
+		return nil, parameterError(tpm2.RCSize, 1)
+	}
+
+	changed := *obj
+	changed.authValue = newAuth
+	return wrapSensitive(parent, &changed)
+}
+
+// FlushContext processes FlushContext command
+func (t *TPM2) FlushContext(flushHandle tpmutil.Handle) error {
+	if isSessionHandle(flushHandle) {
+		if !t.flushSession(flushHandle) {
+			return parameterError(tpm2.RCHandle, 1)
+		}
+		return nil
+	}
+	if uint32(flushHandle)>>handleTypeShift != handleTypeTransient {
+		return parameterError(tpm2.RCValue, 1)
+	}
+	if _, ok := t.objects[flushHandle]; !ok {
+		return parameterError(tpm2.RCHandle, 1)
+	}
+	delete(t.objects, flushHandle)
+	return nil
+}
+
+// EvictControl processes EvictControl command: a transient object is copied to persistentHandle and a persistent
+// object is removed. The owner manages the objects of the storage and endorsement hierarchies in the lower half
+// of persistent handles, the platform manages the objects of its hierarchy in the upper half and may remove any object
+func (t *TPM2) EvictControl(auth, objectHandle, persistentHandle tpmutil.Handle) error {
+	if auth != tpm2.HandleOwner && auth != tpm2.HandlePlatform {
+		return handleError(tpm2.RCValue, 1)
+	}
+	if persistentHandle < persistentFirst || persistentHandle > persistentLast {
+		return parameterError(tpm2.RCValue, 1)
+	}
+	obj, ok := t.objects[objectHandle]
+	if !ok {
+		return handleError(tpm2.RCHandle, 2)
+	}
+	// objects of the null hierarchy, objects with stClear and public areas are not kept across TPM Reset
+	if obj.hierarchy == tpm2.HandleNull || obj.public.Attributes&tpm2.FlagStClear != 0 || obj.publicOnly() {
+		return handleError(tpm2.RCAttributes, 2)
+	}
+	evicted := uint32(objectHandle)>>handleTypeShift == handleTypePersistent
+	if evicted && objectHandle != persistentHandle {
+		return handleError(tpm2.RCHandle, 2)
+	}
+	switch {
+	case auth == tpm2.HandlePlatform && !evicted && obj.hierarchy != tpm2.HandlePlatform,
+		auth == tpm2.HandleOwner && obj.hierarchy == tpm2.HandlePlatform:
+		return handleError(tpm2.RCHierarchy, 2)
+	case !evicted && (auth == tpm2.HandlePlatform) != (persistentHandle >= platformPersistentFirst):
+		return parameterError(tpm2.RCRange, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return err
+	}
+
+	if evicted {
+		delete(t.objects, persistentHandle)
+		return nil
+	}
+	if _, ok := t.objects[persistentHandle]; ok {
+		return tpm2.Error{Code: tpm2.RCNVDefined}
+	}
+	var persistent int
+	for handle := range t.objects {
+		if handle >= persistentFirst && handle <= persistentLast {
+			persistent++
+		}
+	}
+	if persistent >= maxPersistentObjects {
+		return tpm2.Error{Code: tpm2.RCNVSpace}
+	}
+	copied := *obj
+	t.objects[persistentHandle] = &copied
+	return nil
+}
+
+// storageParent returns a loaded object that is allowed to be a parent of other objects
+func (t *TPM2) storageParent(parentHandle tpmutil.Handle) (*object, error) {
+	parent, ok := t.objects[parentHandle]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, 1)
+	}
+	if !isStorageKey(parent.public) || parent.seedValue == nil || !checkSymmetricScheme(symmetricScheme(parent.public)) {
+		return nil, handleError(tpm2.RCType, 1)
+	}
+	return parent, nil
+}
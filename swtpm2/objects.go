@@ -0,0 +1,115 @@
+package swtpm2
+
+import (
+	"crypto"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Range of handles that are used for transient objects
+const (
+	transientFirst = tpmutil.Handle(tpm2.TransientFirst)
+	transientLast  = transientFirst + 0x00FFFFFF
+)
+
+// Range of handles that are used for persistent objects, the upper half of the range belongs to the platform
+const (
+	persistentFirst         = tpmutil.Handle(tpm2.PersistentFirst)
+	platformPersistentFirst = persistentFirst + 0x00800000
+	persistentLast          = persistentFirst + 0x00FFFFFF
+)
+
+// maxLoadedObjects is the maximum amount of simultaneously loaded transient objects
+const maxLoadedObjects = 16
+
+// maxPersistentObjects is the maximum amount of persistent objects
+const maxPersistentObjects = 8
+
+// object represents a transient or persistent object known to TPM
+type object struct {
+	public        tpm2.Public
+	name          []byte
+	qualifiedName []byte
+	// authValue is the authorization value from the sensitive area of the object
+	authValue []byte
+	// privateKey is the private part of an asymmetric key
+	privateKey crypto.PrivateKey
+	// seedValue protects the children of a storage key or obfuscates the data of a keyed hash object
+	seedValue []byte
+	// data is the sensitive data of a keyed hash object
+	data []byte
+	// hierarchy is the hierarchy the object belongs to
+	hierarchy tpmutil.Handle
+}
+
+// newObject creates an object with a given public area located under the parent with specified qualified name
+func newObject(public tpm2.Public, parentQualifiedName []byte) (*object, error) {
+	name, err := objectName(public)
+	if err != nil {
+		return nil, err
+	}
+	qualifiedName, err := computeQualifiedName(public.NameAlg, parentQualifiedName, name)
+	if err != nil {
+		return nil, err
+	}
+	return &object{
+		public:        public,
+		name:          name,
+		qualifiedName: qualifiedName,
+	}, nil
+}
+
+// publicOnly reports whether an object was loaded without its sensitive area
+func (o *object) publicOnly() bool {
+	return o.privateKey == nil && o.seedValue == nil && o.data == nil
+}
+
+// objectName computes the Name of an object: nameAlg || H_nameAlg(TPMT_PUBLIC)
+func objectName(public tpm2.Public) ([]byte, error) {
+	name, err := public.Name()
+	if err != nil {
+		return nil, err
+	}
+	return name.Digest.Encode()
+}
+
+// computeQualifiedName computes the Qualified Name of an entity: nameAlg || H_nameAlg(parentQN || name)
+func computeQualifiedName(nameAlg tpm2.Algorithm, parentQualifiedName, name []byte) ([]byte, error) {
+	hash, err := nameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	h := hash.New()
+	h.Write(parentQualifiedName)
+	h.Write(name)
+	return tpm2.HashValue{Alg: nameAlg, Value: h.Sum(nil)}.Encode()
+}
+
+// isAdminRole tells whether an object that is the authorized handle with a given 1-based index of a command
+// is authorized in the ADMIN role
+func isAdminRole(cc tpmutil.Command, index int) bool {
+	return index == 1 && commandTable[cc].adminRole
+}
+
+// checkAuthValue checks that the authValue of the object can authorize a command with a password or an HMAC session:
+// the USER role requires TPMA_OBJECT_USERWITHAUTH and the ADMIN role requires TPMA_OBJECT_ADMINWITHPOLICY to be clear
+func (o *object) checkAuthValue(cc tpmutil.Command, index int) error {
+	if isAdminRole(cc, index) {
+		if o.public.Attributes&tpm2.FlagAdminWithPolicy != 0 {
+			return tpm2.Error{Code: tpm2.RCAuthUnavailable}
+		}
+	} else if o.public.Attributes&tpm2.FlagUserWithAuth == 0 {
+		return tpm2.Error{Code: tpm2.RCAuthUnavailable}
+	}
+	return nil
+}
+
+// checkAuthPolicy checks that a policy session can authorize a command for the object,
+// the policy of the ADMIN role must be restricted to the command with PolicyCommandCode
+func (o *object) checkAuthPolicy(cc tpmutil.Command, index int, s *session) error {
+	if isAdminRole(cc, index) && s.commandCode != cc {
+		return sessionError(tpm2.RCPolicyFail, index)
+	}
+	return nil
+}
@@ -0,0 +1,419 @@
+package swtpm2
+
+import (
+	"fmt"
+	"sort"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Number of implemented PCRs, PC Client Platform TPM Profile requires 24 PCRs
+const (
+	defaultPCRCount = 24
+	maxPCRCount     = 8 * maxSizeOfPCRSelect
+)
+
+// maxLocality is the highest locality that has PCR attributes
+const maxLocality = 4
+
+// maxEventSize is the maximal size of TPM2B_EVENT
+const maxEventSize = 1024
+
+// maxPCRReadDigests is the maximal number of digests returned by a single PCR_Read
+const maxPCRReadDigests = 8
+
+// pcrDigestMemory is the memory reserved for the digests of a single PCR in all banks,
+// it is not enough to allocate every implemented bank at once
+const pcrDigestMemory = 128
+
+// defaultPCRBanks are allocated when the configuration does not specify PCR banks
+var defaultPCRBanks = []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256}
+
+// pcrAttributes describes which operations are allowed on a PCR
+type pcrAttributes struct {
+	// stateSave is set when the PCR value is preserved by Shutdown(STATE)
+	stateSave bool
+	// resetLocality is a bitmask of localities that are allowed to reset the PCR
+	resetLocality uint8
+	// extendLocality is a bitmask of localities that are allowed to extend the PCR
+	extendLocality uint8
+	// noIncrement is set when changes of the PCR do not increment pcrUpdateCounter
+	noIncrement bool
+}
+
+// pcrAttributesTable follows PC Client Platform TPM Profile
+var pcrAttributesTable = [defaultPCRCount]pcrAttributes{
+	// PCR 0-15, static RTM
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	{stateSave: true, extendLocality: 0x1F},
+	// PCR 16, debug
+	{resetLocality: 0x0F, extendLocality: 0x1F, noIncrement: true},
+	// PCR 17, locality 4
+	{resetLocality: 0x10, extendLocality: 0x1C},
+	// PCR 18, locality 3
+	{resetLocality: 0x10, extendLocality: 0x1C},
+	// PCR 19, locality 2
+	{resetLocality: 0x10, extendLocality: 0x0C},
+	// PCR 20, locality 1
+	{resetLocality: 0x14, extendLocality: 0x0E},
+	// PCR 21-22, dynamic OS
+	{resetLocality: 0x14, extendLocality: 0x04, noIncrement: true},
+	{resetLocality: 0x14, extendLocality: 0x04, noIncrement: true},
+	// PCR 23, application specific
+	{resetLocality: 0x0F, extendLocality: 0x1F, noIncrement: true},
+}
+
+// extraPCRAttributes are the attributes of PCRs beyond the PC Client profile, they are treated as application specific
+var extraPCRAttributes = pcrAttributes{resetLocality: 0x0F, extendLocality: 0x1F, noIncrement: true}
+
+// pcrAttributesOf returns the attributes of a PCR
+func pcrAttributesOf(pcr int) pcrAttributes {
+	if pcr < len(pcrAttributesTable) {
+		return pcrAttributesTable[pcr]
+	}
+	return extraPCRAttributes
+}
+
+// pcrProperties lists PCRs for every TPM_PT_PCR property in ascending order of tags
+func pcrProperties(pcrCount int) []TaggedPCRSelect {
+	selects := []TaggedPCRSelect{{Tag: PCRSave}}
+	for locality := uint(0); locality <= maxLocality; locality++ {
+		extend := TaggedPCRSelect{Tag: PCRExtendL0 + PCRProperty(2*locality)}
+		reset := TaggedPCRSelect{Tag: PCRResetL0 + PCRProperty(2*locality)}
+		for pcr := 0; pcr < pcrCount; pcr++ {
+			attributes := pcrAttributesOf(pcr)
+			if attributes.extendLocality&(1<<locality) != 0 {
+				extend.PCRs = append(extend.PCRs, pcr)
+			}
+			if attributes.resetLocality&(1<<locality) != 0 {
+				reset.PCRs = append(reset.PCRs, pcr)
+			}
+		}
+		selects = append(selects, extend, reset)
+	}
+	noIncrement := TaggedPCRSelect{Tag: PCRNoIncrement}
+	drtmReset := TaggedPCRSelect{Tag: PCRDRTMReset}
+	for pcr := 0; pcr < pcrCount; pcr++ {
+		attributes := pcrAttributesOf(pcr)
+		if attributes.stateSave {
+			selects[0].PCRs = append(selects[0].PCRs, pcr)
+		}
+		if attributes.noIncrement {
+			noIncrement.PCRs = append(noIncrement.PCRs, pcr)
+		}
+		// PCRs resettable from locality 4 are reset by a dynamic root of trust
+		if attributes.resetLocality&(1<<maxLocality) != 0 {
+			drtmReset.PCRs = append(drtmReset.PCRs, pcr)
+		}
+	}
+	// no PCR may have a policy or an authorization value
+	return append(selects, noIncrement, drtmReset, TaggedPCRSelect{Tag: PCRPolicy}, TaggedPCRSelect{Tag: PCRAuth})
+}
+
+// localityAllowed reports whether a locality is present in a bitmask of localities
+func localityAllowed(mask uint8, locality uint8) bool {
+	return locality <= maxLocality && mask&(1<<locality) != 0
+}
+
+// pcrBank holds the values of PCRs of a single hash algorithm, PCRs that are not allocated have no value
+type pcrBank struct {
+	hashAlg tpm2.Algorithm
+	values  [][]byte
+}
+
+// defaultPCRAllocation selects all PCRs of the banks of given hash algorithms
+func defaultPCRAllocation(hashAlgs []tpm2.Algorithm, pcrCount int) ([]tpm2.PCRSelection, error) {
+	allocation := make([]tpm2.PCRSelection, 0, len(hashAlgs))
+	for _, hashAlg := range hashAlgs {
+		if _, ok := digestSize(hashAlg); !ok {
+			return nil, fmt.Errorf("unsupported PCR bank algorithm 0x%x", hashAlg)
+		}
+		for _, sel := range allocation {
+			if sel.Hash == hashAlg {
+				return nil, fmt.Errorf("PCR bank 0x%x is allocated twice", hashAlg)
+			}
+		}
+		sel := tpm2.PCRSelection{Hash: hashAlg}
+		for pcr := 0; pcr < pcrCount; pcr++ {
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+		allocation = append(allocation, sel)
+	}
+	return allocation, nil
+}
+
+// newPCRBanks creates PCR banks with initial values of the allocated PCRs in ascending order of hash algorithms,
+// banks without allocated PCRs are omitted
+func newPCRBanks(allocation []tpm2.PCRSelection, pcrCount int) []*pcrBank {
+	var banks []*pcrBank
+	for _, sel := range allocation {
+		if len(sel.PCRs) == 0 {
+			continue
+		}
+		bank := &pcrBank{hashAlg: sel.Hash, values: make([][]byte, pcrCount)}
+		for _, pcr := range sel.PCRs {
+			bank.reset(pcr, pcrInitialValue(pcr))
+		}
+		banks = append(banks, bank)
+	}
+	sort.Slice(banks, func(i, j int) bool {
+		return banks[i].hashAlg < banks[j].hashAlg
+	})
+	return banks
+}
+
+// allocation returns the allocated PCRs of the bank
+func (b *pcrBank) allocation() tpm2.PCRSelection {
+	sel := tpm2.PCRSelection{Hash: b.hashAlg}
+	for pcr, value := range b.values {
+		if value != nil {
+			sel.PCRs = append(sel.PCRs, pcr)
+		}
+	}
+	return sel
+}
+
+// allocated reports whether a PCR is allocated in the bank
+func (b *pcrBank) allocated(pcr int) bool {
+	return pcr >= 0 && pcr < len(b.values) && b.values[pcr] != nil
+}
+
+// pcrInitialValue returns the byte that fills a PCR on initialization,
+// PCRs that are reset by a dynamic root of trust start with all ones
+func pcrInitialValue(pcr int) byte {
+	if pcrAttributesOf(pcr).resetLocality&(1<<maxLocality) != 0 {
+		return 0xFF
+	}
+	return 0
+}
+
+// reset fills a PCR with a given byte
+func (b *pcrBank) reset(pcr int, value byte) {
+	size, _ := digestSize(b.hashAlg)
+	b.values[pcr] = make([]byte, size)
+	for i := range b.values[pcr] {
+		b.values[pcr][i] = value
+	}
+}
+
+// extend replaces a PCR value with H(value || digest)
+func (b *pcrBank) extend(pcr int, digest []byte) {
+	if !b.allocated(pcr) {
+		return
+	}
+	h := hashFunctions[b.hashAlg]()
+	h.Write(b.values[pcr])
+	h.Write(digest)
+	b.values[pcr] = h.Sum(nil)
+}
+
+// pcrBank returns an allocated PCR bank of a given hash algorithm
+func (t *TPM2) pcrBank(hashAlg tpm2.Algorithm) (*pcrBank, bool) {
+	for _, bank := range t.pcrBanks {
+		if bank.hashAlg == hashAlg {
+			return bank, true
+		}
+	}
+	return nil, false
+}
+
+// pcrChanged increments pcrUpdateCounter unless the PCR is excluded from counting
+func (t *TPM2) pcrChanged(pcr int) {
+	if !pcrAttributesOf(pcr).noIncrement {
+		t.pcrUpdateCounter++
+	}
+}
+
+// pcrIndex converts a PCR handle to a PCR index
+func (t *TPM2) pcrIndex(pcrHandle tpmutil.Handle) (int, error) {
+	if pcrHandle >= tpmutil.Handle(t.pcrCount) {
+		return 0, handleError(tpm2.RCValue, 1)
+	}
+	return int(pcrHandle), nil
+}
+
+// PCRExtend processes PCR_Extend command
+func (t *TPM2) PCRExtend(pcrHandle tpmutil.Handle, digests []tpm2.HashValue) error {
+	if pcrHandle == tpm2.HandleNull {
+		return nil
+	}
+	pcr, err := t.pcrIndex(pcrHandle)
+	if err != nil {
+		return err
+	}
+	if !localityAllowed(pcrAttributesOf(pcr).extendLocality, t.locality) {
+		return tpm2.Warning{Code: tpm2.RCLocality}
+	}
+
+	for _, digest := range digests {
+		// digests of the banks that are not allocated are ignored
+		if bank, ok := t.pcrBank(digest.Alg); ok {
+			bank.extend(pcr, digest.Value)
+		}
+	}
+	t.pcrChanged(pcr)
+	return nil
+}
+
+// PCREvent processes PCR_Event command
+func (t *TPM2) PCREvent(pcrHandle tpmutil.Handle, eventData []byte) ([]tpm2.HashValue, error) {
+	digests := make([]tpm2.HashValue, 0, len(t.pcrBanks))
+	for _, bank := range t.pcrBanks {
+		h := hashFunctions[bank.hashAlg]()
+		h.Write(eventData)
+		digests = append(digests, tpm2.HashValue{Alg: bank.hashAlg, Value: h.Sum(nil)})
+	}
+	if err := t.PCRExtend(pcrHandle, digests); err != nil {
+		return nil, err
+	}
+	return digests, nil
+}
+
+// PCRRead processes PCR_Read command
+func (t *TPM2) PCRRead(pcrSelection []tpm2.PCRSelection) (*PCRReadResponse, error) {
+	resp := &PCRReadResponse{UpdateCounter: t.pcrUpdateCounter}
+	for _, sel := range pcrSelection {
+		out := tpm2.PCRSelection{Hash: sel.Hash}
+		bank, ok := t.pcrBank(sel.Hash)
+		for _, pcr := range sel.PCRs {
+			// selected PCRs of banks that are not allocated and PCRs that do not fit the response are not returned
+			if !ok || !bank.allocated(pcr) || len(resp.Digests) >= maxPCRReadDigests {
+				continue
+			}
+			out.PCRs = append(out.PCRs, pcr)
+			resp.Digests = append(resp.Digests, bank.values[pcr])
+		}
+		resp.PCRSelection = append(resp.PCRSelection, out)
+	}
+	return resp, nil
+}
+
+// PCRReset processes PCR_Reset command
+func (t *TPM2) PCRReset(pcrHandle tpmutil.Handle) error {
+	pcr, err := t.pcrIndex(pcrHandle)
+	if err != nil {
+		return err
+	}
+	// PCR_Reset is not allowed at locality 4, the PCRs of a dynamic root of trust are reset by _TPM_Hash_Start
+	if t.locality == hashLocality || !localityAllowed(pcrAttributesOf(pcr).resetLocality, t.locality) {
+		return tpm2.Warning{Code: tpm2.RCLocality}
+	}
+
+	for _, bank := range t.pcrBanks {
+		if bank.allocated(pcr) {
+			bank.reset(pcr, 0)
+		}
+	}
+	t.pcrChanged(pcr)
+	return nil
+}
+
+// GetCapabilityPCRs processes GetCapability(TPM_CAP_PCRS) command,
+// every implemented bank is reported with its allocated PCRs
+func (t *TPM2) GetCapabilityPCRs(count, property uint32) ([]tpm2.PCRSelection, error) {
+	return t.pcrAllocation(), nil
+}
+
+// pcrAllocation lists the allocated PCRs of every implemented bank in ascending order of hash algorithms
+func (t *TPM2) pcrAllocation() []tpm2.PCRSelection {
+	allocation := make([]tpm2.PCRSelection, 0, len(pcrHashAlgorithms))
+	for _, hashAlg := range pcrHashAlgorithms {
+		sel := tpm2.PCRSelection{Hash: hashAlg}
+		if bank, ok := t.pcrBank(hashAlg); ok {
+			sel = bank.allocation()
+		}
+		allocation = append(allocation, sel)
+	}
+	return allocation
+}
+
+// PCRAllocate processes PCR_Allocate command, the new allocation takes effect after the next _TPM_Init
+func (t *TPM2) PCRAllocate(authHandle tpmutil.Handle, pcrAllocation []tpm2.PCRSelection) (*PCRAllocateResponse, error) {
+	if authHandle != tpm2.HandlePlatform {
+		return nil, handleError(tpm2.RCValue, 1)
+	}
+	if err := t.checkNVAvailable(); err != nil {
+		return nil, err
+	}
+
+	// banks that are absent in the request keep the allocation that is going to be used after _TPM_Init
+	allocation := t.pendingPCRAllocation
+	if allocation == nil {
+		allocation = t.pcrAllocation()
+	}
+	allocation = append([]tpm2.PCRSelection(nil), allocation...)
+	for _, sel := range pcrAllocation {
+		if _, ok := digestSize(sel.Hash); !ok {
+			return nil, parameterError(tpm2.RCHash, 1)
+		}
+		for _, pcr := range sel.PCRs {
+			if pcr >= t.pcrCount {
+				return nil, parameterError(tpm2.RCValue, 1)
+			}
+		}
+		for i := range allocation {
+			if allocation[i].Hash == sel.Hash {
+				allocation[i] = sel
+			}
+		}
+	}
+
+	resp := &PCRAllocateResponse{
+		MaxPCR:        uint32(t.pcrCount),
+		SizeAvailable: uint32(t.pcrCount * pcrDigestMemory),
+	}
+	var allocated bool
+	for _, sel := range allocation {
+		size, _ := digestSize(sel.Hash)
+		resp.SizeNeeded += uint32(size * len(sel.PCRs))
+		allocated = allocated || len(sel.PCRs) > 0
+	}
+	if !allocated {
+		// at least one PCR has to remain
+		return nil, tpm2.Error{Code: rcPCR}
+	}
+	if resp.SizeNeeded > resp.SizeAvailable {
+		return resp, nil
+	}
+	resp.AllocationSuccess = true
+	t.pendingPCRAllocation = allocation
+	return resp, nil
+}
+
+// pcrDigest computes the digest of the selected PCR values, PCRs that are not allocated are removed from the selection
+func (t *TPM2) pcrDigest(hashAlg tpm2.Algorithm, pcrSelection []tpm2.PCRSelection) ([]tpm2.PCRSelection, []byte, error) {
+	newHash, ok := hashFunctions[hashAlg]
+	if !ok {
+		return nil, nil, fmt.Errorf("unsupported hash algorithm 0x%x", hashAlg)
+	}
+	h := newHash()
+	filtered := make([]tpm2.PCRSelection, 0, len(pcrSelection))
+	for _, sel := range pcrSelection {
+		out := tpm2.PCRSelection{Hash: sel.Hash}
+		if bank, ok := t.pcrBank(sel.Hash); ok {
+			for _, pcr := range sel.PCRs {
+				if bank.allocated(pcr) {
+					out.PCRs = append(out.PCRs, pcr)
+					h.Write(bank.values[pcr])
+				}
+			}
+		}
+		filtered = append(filtered, out)
+	}
+	return filtered, h.Sum(nil), nil
+}
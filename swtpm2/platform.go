@@ -0,0 +1,62 @@
+package swtpm2
+
+import (
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// cancelableCommands contains commands with long operations that are interrupted by the cancel signal
+var cancelableCommands = map[tpmutil.Command]bool{
+	tpm2.CmdCreatePrimary: true,
+	tpm2.CmdCreate:        true,
+}
+
+// PowerOn processes the power-on signal of the platform, it is followed by _TPM_Init
+func (t *TPM2) PowerOn() {
+	t.Init()
+}
+
+// PowerOff processes the power-off signal of the platform, the volatile state is lost
+// while the state saved by Shutdown is preserved
+func (t *TPM2) PowerOff() {
+	t.started = false
+	t.flushTransientObjects()
+}
+
+// SetNVAvailable makes NV memory available or unavailable for commands
+func (t *TPM2) SetNVAvailable(available bool) {
+	t.nvUnavailable = !available
+}
+
+// SetPhysicalPresence asserts or deasserts physical presence
+func (t *TPM2) SetPhysicalPresence(asserted bool) {
+	t.physicalPresence = asserted
+}
+
+// SetCancel sets or clears the cancel signal
+func (t *TPM2) SetCancel(canceled bool) {
+	t.canceled = canceled
+}
+
+// checkPlatformSignals rejects commands that cannot be executed with the current state of platform signals
+func (t *TPM2) checkPlatformSignals(cmd *CommandContext) error {
+	if t.canceled && cancelableCommands[cmd.Header.Cmd] {
+		return tpm2.Warning{Code: tpm2.RCCanceled}
+	}
+	if t.ppCommands[cmd.Header.Cmd] && !t.physicalPresence {
+		for i, handle := range cmd.AuthHandles {
+			if handle == tpm2.HandlePlatform {
+				return sessionError(tpm2.RCPP, i+1)
+			}
+		}
+	}
+	return nil
+}
+
+// checkNVAvailable returns TPM_RC_NV_UNAVAILABLE when NV memory cannot be written
+func (t *TPM2) checkNVAvailable() error {
+	if t.nvUnavailable {
+		return tpm2.Warning{Code: tpm2.RCNVUnavailable}
+	}
+	return nil
+}
@@ -0,0 +1,792 @@
+package swtpm2
+
+import (
+	"crypto/hmac"
+	"encoding/binary"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Limits of TPML_DIGEST in PolicyOR
+const (
+	minPolicyORDigests = 2
+	maxPolicyORDigests = 8
+)
+
+// TPM_EO, the operations of PolicyNV and PolicyCounterTimer that compare operandA with operandB
+const (
+	eoEq uint16 = iota
+	eoNeq
+	eoSignedGT
+	eoUnsignedGT
+	eoSignedLT
+	eoUnsignedLT
+	eoSignedGE
+	eoUnsignedGE
+	eoSignedLE
+	eoUnsignedLE
+	eoBitSet
+	eoBitClear
+)
+
+// timeInfoSize is the size of TPMS_TIME_INFO compared by PolicyCounterTimer:
+// time (8) || clock (8) || resetCount (4) || restartCount (4) || safe (1)
+const timeInfoSize = 25
+
+// templateCommands are the commands checked by PolicyTemplate, their inPublic parameter follows inSensitive
+var templateCommands = map[tpmutil.Command]bool{
+	tpm2.CmdCreatePrimary: true,
+	tpm2.CmdCreate:        true,
+}
+
+// timeoutSize is the size of TPM2B_TIMEOUT produced by the emulator, the timeout is Time encoded as UINT64
+const timeoutSize = 8
+
+// policySession returns a loaded policy or trial session that is the handle with a given 1-based index
+func (t *TPM2) policySession(handle tpmutil.Handle, index int) (*session, error) {
+	if uint32(handle)>>handleTypeShift != handleTypePolicySession {
+		return nil, handleError(tpm2.RCValue, index)
+	}
+	s, ok := t.sessions[handle]
+	if !ok {
+		return nil, tpm2.Warning{Code: tpm2.RCReferenceH0 + tpm2.RCWarn(index-1)}
+	}
+	return s, nil
+}
+
+// isTrial tells whether the session only computes a policy digest and cannot authorize commands
+func (s *session) isTrial() bool {
+	return s.sessionType == tpm2.SessionTrial
+}
+
+// updatePolicy extends policyDigest: H_authHash(policyDigest || commandCode || arguments)
+func (s *session) updatePolicy(cc tpmutil.Command, arguments ...[]byte) {
+	code, _ := tpmutil.Pack(cc)
+	s.extendPolicy(append([][]byte{code}, arguments...)...)
+}
+
+// extendPolicy extends policyDigest with the data: H_authHash(policyDigest || data)
+func (s *session) extendPolicy(data ...[]byte) {
+	h := hashFunctions[s.authHash]()
+	h.Write(s.policyDigest)
+	for _, d := range data {
+		h.Write(d)
+	}
+	s.policyDigest = h.Sum(nil)
+}
+
+// updatePolicyContext extends policyDigest with the Name of the authorizing entity and policyRef
+// in two steps, binds the session to cpHashA and shortens its timeout
+func (s *session) updatePolicyContext(cc tpmutil.Command, name, policyRef, cpHashA []byte, timeout uint64) {
+	s.updatePolicy(cc, name)
+	s.extendPolicy(policyRef)
+	if len(cpHashA) != 0 {
+		s.cpHash = cpHashA
+	}
+	if timeout != 0 && (s.timeout == 0 || timeout < s.timeout) {
+		s.timeout = timeout
+	}
+}
+
+// authTimeout computes Time when an assertion expires: expiration is the number of seconds after startTime
+// of the session for an assertion bound to nonceTPM, otherwise it is the number of seconds after _TPM_Init
+func (s *session) authTimeout(expiration int32, nonceTPM []byte) uint64 {
+	if expiration == 0 {
+		return 0
+	}
+	seconds := int64(expiration)
+	if seconds < 0 {
+		seconds = -seconds
+	}
+	timeout := uint64(seconds) * 1000
+	if len(nonceTPM) != 0 {
+		timeout += s.startTime
+	}
+	return timeout
+}
+
+// checkPolicyParameters validates nonceTPM, the timeout and cpHashA of an assertion, errors refer to the parameters
+// with given indices
+func (t *TPM2) checkPolicyParameters(s *session, nonceTPM []byte, nonceIndex int, timeout uint64, timeoutIndex int,
+	cpHashA []byte, cpHashIndex int) error {
+
+	if len(nonceTPM) != 0 && !hmac.Equal(nonceTPM, s.nonceTPM) {
+		return parameterError(tpm2.RCNonce, nonceIndex)
+	}
+	if timeout != 0 && timeout < t.timeValue() {
+		return parameterError(tpm2.RCExpired, timeoutIndex)
+	}
+	if len(cpHashA) != 0 {
+		if len(cpHashA) != len(s.policyDigest) {
+			return parameterError(tpm2.RCSize, cpHashIndex)
+		}
+		if s.cpHash != nil && !hmac.Equal(cpHashA, s.cpHash) || s.nameHash != nil || s.templateHash != nil {
+			return tpm2.Error{Code: tpm2.RCCPHash}
+		}
+	}
+	return nil
+}
+
+// authTicketDigest computes the digest of TPMT_TK_AUTH:
+// HMAC(proof, tag || timeout || resetCount || restartCount || cpHashA || policyRef || authName).
+// The counters make a ticket with a timeout invalid after Startup because Time starts again
+func (t *TPM2) authTicketDigest(tag tpmutil.Tag, hierarchyHandle tpmutil.Handle, timeout uint64,
+	cpHashA, policyRef, authName []byte) ([]byte, bool) {
+
+	h, ok := t.hierarchies[hierarchyHandle]
+	if !ok || h.proof == nil {
+		return nil, false
+	}
+	var epoch []byte
+	if timeout != 0 {
+		epoch, _ = tpmutil.Pack(t.resetCount, t.restartCount)
+	}
+	data, err := tpmutil.Pack(tag, timeout, tpmutil.RawBytes(epoch), tpmutil.U16Bytes(cpHashA),
+		tpmutil.U16Bytes(policyRef), tpmutil.U16Bytes(authName))
+	if err != nil {
+		return nil, false
+	}
+	mac := hmac.New(hashFunctions[tpm2.AlgSHA256], h.proof)
+	mac.Write(data)
+	return mac.Sum(nil), true
+}
+
+// policyTicket builds the response of PolicySigned and PolicySecret: an assertion with negative expiration
+// produces a ticket, other assertions return an empty timeout and a null ticket
+func (t *TPM2) policyTicket(s *session, tag tpmutil.Tag, hierarchyHandle tpmutil.Handle, expiration int32,
+	timeout uint64, cpHashA, policyRef, authName []byte) (*PolicyAuthResponse, error) {
+
+	resp := &PolicyAuthResponse{PolicyTicket: tpm2.Ticket{Type: tag, Hierarchy: tpm2.HandleNull}}
+	if expiration >= 0 || s.isTrial() {
+		return resp, nil
+	}
+	digest, ok := t.authTicketDigest(tag, hierarchyHandle, timeout, cpHashA, policyRef, authName)
+	if !ok {
+		return resp, nil
+	}
+	resp.Timeout = make([]byte, timeoutSize)
+	binary.BigEndian.PutUint64(resp.Timeout, timeout)
+	resp.PolicyTicket = tpm2.Ticket{Type: tag, Hierarchy: hierarchyHandle, Digest: digest}
+	return resp, nil
+}
+
+// checkPCRCounter returns TPM_RC_PCR_CHANGED when PCRs were updated after PolicyPCR of a policy session
+func (t *TPM2) checkPCRCounter(s *session) error {
+	if s.pcrChecked && s.pcrUpdateCounter != t.pcrUpdateCounter {
+		return tpm2.Error{Code: tpm2.RCPCRChanged}
+	}
+	return nil
+}
+
+// PolicyPCR processes PolicyPCR command. A policy session checks pcrDigest against the current PCR values
+// and remembers pcrUpdateCounter, a trial session uses the given pcrDigest or the current PCR values.
+// encodedPCRs is TPML_PCR_SELECTION of pcrs in the form it was received
+func (t *TPM2) PolicyPCR(policySession tpmutil.Handle, pcrDigest []byte, pcrs []tpm2.PCRSelection, encodedPCRs []byte) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if size, _ := digestSize(s.authHash); len(pcrDigest) > size {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	_, digest, err := t.pcrDigest(s.authHash, pcrs)
+	if err != nil {
+		return err
+	}
+
+	if s.isTrial() {
+		if len(pcrDigest) != 0 {
+			digest = pcrDigest
+		}
+	} else {
+		if len(pcrDigest) != 0 && !hmac.Equal(pcrDigest, digest) {
+			return parameterError(tpm2.RCValue, 1)
+		}
+		if err := t.checkPCRCounter(s); err != nil {
+			return err
+		}
+		s.pcrChecked = true
+		s.pcrUpdateCounter = t.pcrUpdateCounter
+	}
+
+	s.updatePolicy(tpm2.CmdPolicyPCR, encodedPCRs, digest)
+	return nil
+}
+
+// PolicyOR processes PolicyOR command. policyDigest of a policy session must be one of the digests,
+// the new policyDigest does not depend on the branch that was satisfied
+func (t *TPM2) PolicyOR(policySession tpmutil.Handle, pHashList [][]byte) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if len(pHashList) < minPolicyORDigests || len(pHashList) > maxPolicyORDigests {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	if !s.isTrial() {
+		var found bool
+		for _, digest := range pHashList {
+			if hmac.Equal(digest, s.policyDigest) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return parameterError(tpm2.RCValue, 1)
+		}
+	}
+
+	s.policyDigest = make([]byte, len(s.policyDigest))
+	s.updatePolicy(tpm2.CmdPolicyOr, pHashList...)
+	return nil
+}
+
+// PolicyGetDigest processes PolicyGetDigest command
+func (t *TPM2) PolicyGetDigest(policySession tpmutil.Handle) ([]byte, error) {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return nil, err
+	}
+	return s.policyDigest, nil
+}
+
+// PolicyRestart processes PolicyRestart command that returns a policy session to its initial state
+func (t *TPM2) PolicyRestart(sessionHandle tpmutil.Handle) error {
+	s, err := t.policySession(sessionHandle, 1)
+	if err != nil {
+		return err
+	}
+	s.resetPolicy(t.timeValue())
+	return nil
+}
+
+// PolicySigned processes PolicySigned command. The signature of authObject covers
+// nonceTPM || expiration || cpHashA || policyRef, it is not checked by a trial session
+func (t *TPM2) PolicySigned(authObject, policySession tpmutil.Handle, nonceTPM, cpHashA, policyRef []byte,
+	expiration int32, auth *tpm2.Signature) (*PolicyAuthResponse, error) {
+
+	key, ok := t.objects[authObject]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, 1)
+	}
+	if key.public.Attributes&tpm2.FlagSign == 0 {
+		return nil, handleError(tpm2.RCKey, 1)
+	}
+	s, err := t.policySession(policySession, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(policyRef) > maxDigestSize {
+		return nil, parameterError(tpm2.RCSize, 3)
+	}
+
+	var timeout uint64
+	if !s.isTrial() {
+		timeout = s.authTimeout(expiration, nonceTPM)
+		if err := t.checkPolicyParameters(s, nonceTPM, 1, timeout, 4, cpHashA, 2); err != nil {
+			return nil, err
+		}
+		message, err := tpmutil.Pack(tpmutil.RawBytes(nonceTPM), expiration, tpmutil.RawBytes(cpHashA), tpmutil.RawBytes(policyRef))
+		if err != nil {
+			return nil, err
+		}
+		if err := verifySignature(key, message, auth, 5); err != nil {
+			return nil, err
+		}
+	}
+
+	s.updatePolicyContext(tpm2.CmdPolicySigned, key.name, policyRef, cpHashA, timeout)
+	return t.policyTicket(s, tpm2.TagAuthSigned, key.hierarchy, expiration, timeout, cpHashA, policyRef, key.name)
+}
+
+// PolicySecret processes PolicySecret command, authHandle is authorized by the authorization area of the command
+func (t *TPM2) PolicySecret(authHandle, policySession tpmutil.Handle, nonceTPM, cpHashA, policyRef []byte,
+	expiration int32) (*PolicyAuthResponse, error) {
+
+	s, err := t.policySession(policySession, 2)
+	if err != nil {
+		return nil, err
+	}
+	if len(policyRef) > maxDigestSize {
+		return nil, parameterError(tpm2.RCSize, 3)
+	}
+	timeout := s.authTimeout(expiration, nonceTPM)
+	if err := t.checkPolicyParameters(s, nonceTPM, 1, timeout, 4, cpHashA, 2); err != nil {
+		return nil, err
+	}
+	name, err := t.entityName(authHandle)
+	if err != nil {
+		return nil, err
+	}
+
+	s.updatePolicyContext(tpm2.CmdPolicySecret, name, policyRef, cpHashA, timeout)
+	if nv, ok := t.nvIndices[authHandle]; ok && nv.nvType() == nvTypePinPass {
+		// a ticket would allow to use a PIN Pass index without counting the uses
+		expiration = 0
+	}
+	return t.policyTicket(s, tpm2.TagAuthSecret, t.entityHierarchy(authHandle), expiration, timeout, cpHashA, policyRef, name)
+}
+
+// PolicyTicket processes PolicyTicket command that repeats an assertion of PolicySigned or PolicySecret
+// with the ticket produced by it
+func (t *TPM2) PolicyTicket(policySession tpmutil.Handle, timeout, cpHashA, policyRef, authName []byte, ticket tpm2.Ticket) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	var cc tpmutil.Command
+	switch ticket.Type {
+	case tpm2.TagAuthSigned:
+		cc = tpm2.CmdPolicySigned
+	case tpm2.TagAuthSecret:
+		cc = tpm2.CmdPolicySecret
+	default:
+		return parameterError(tpm2.RCTag, 5)
+	}
+	if len(timeout) != timeoutSize {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	authTimeout := binary.BigEndian.Uint64(timeout)
+	if err := t.checkPolicyParameters(s, nil, 0, authTimeout, 1, cpHashA, 2); err != nil {
+		return err
+	}
+	digest, ok := t.authTicketDigest(ticket.Type, ticket.Hierarchy, authTimeout, cpHashA, policyRef, authName)
+	if !ok || !hmac.Equal(digest, ticket.Digest) {
+		return parameterError(tpm2.RCTicket, 5)
+	}
+
+	s.updatePolicyContext(cc, authName, policyRef, cpHashA, authTimeout)
+	return nil
+}
+
+// PolicyAuthorize processes PolicyAuthorize command that replaces policyDigest approved by keySign
+// with a digest that depends only on keySign and policyRef
+func (t *TPM2) PolicyAuthorize(policySession tpmutil.Handle, approvedPolicy, policyRef, keySign []byte, checkTicket tpm2.Ticket) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if checkTicket.Type != tagVerified {
+		return parameterError(tpm2.RCTag, 4)
+	}
+	if !s.isTrial() {
+		if !hmac.Equal(approvedPolicy, s.policyDigest) {
+			return parameterError(tpm2.RCValue, 1)
+		}
+		// the key signed aHash = H_nameAlg(approvedPolicy || policyRef) where nameAlg is taken from its Name
+		var hashAlg tpm2.Algorithm
+		if _, err := tpmutil.Unpack(keySign, &hashAlg); err != nil {
+			return parameterError(tpm2.RCSize, 3)
+		}
+		size, ok := digestSize(hashAlg)
+		if !ok {
+			return parameterError(tpm2.RCHash, 3)
+		}
+		if len(keySign) != 2+size {
+			return parameterError(tpm2.RCSize, 3)
+		}
+		h := hashFunctions[hashAlg]()
+		h.Write(approvedPolicy)
+		h.Write(policyRef)
+		digest, ok := t.verifiedTicketDigest(checkTicket.Hierarchy, h.Sum(nil), keySign)
+		if !ok || !hmac.Equal(digest, checkTicket.Digest) {
+			return parameterError(tpm2.RCValue, 4)
+		}
+	}
+
+	s.policyDigest = make([]byte, len(s.policyDigest))
+	s.updatePolicyContext(cmdPolicyAuthorize, keySign, policyRef, nil, 0)
+	return nil
+}
+
+// PolicyAuthorizeNV processes PolicyAuthorizeNV command, the approved policy is TPMT_HA kept in an NV index
+func (t *TPM2) PolicyAuthorizeNV(authHandle, nvIndex, policySession tpmutil.Handle) error {
+	nv, err := t.nvIndexAt(nvIndex, 2)
+	if err != nil {
+		return err
+	}
+	s, err := t.policySession(policySession, 3)
+	if err != nil {
+		return err
+	}
+	if !s.isTrial() {
+		if err := nvReadAccessChecks(authHandle, nvIndex, nv); err != nil {
+			return err
+		}
+		// the index holds TPMT_HA, the data that follows the digest is ignored
+		var hashAlg tpm2.Algorithm
+		if _, err := tpmutil.Unpack(nv.data, &hashAlg); err != nil {
+			return handleError(tpm2.RCSize, 2)
+		}
+		if hashAlg != s.authHash {
+			return handleError(tpm2.RCHash, 2)
+		}
+		size, _ := digestSize(s.authHash)
+		if len(nv.data) < 2+size {
+			return handleError(tpm2.RCSize, 2)
+		}
+		if !hmac.Equal(nv.data[2:2+size], s.policyDigest) {
+			return handleError(tpm2.RCValue, 2)
+		}
+	}
+	name, err := nv.name()
+	if err != nil {
+		return err
+	}
+
+	s.policyDigest = make([]byte, len(s.policyDigest))
+	s.updatePolicy(cmdPolicyAuthorizeNV, name)
+	return nil
+}
+
+// compareOperands compares operandA with operandB of the same size as big-endian integers,
+// the signed operations treat them as two's complement numbers
+func compareOperands(operandA, operandB []byte, operation uint16) bool {
+	a, b := new(big.Int).SetBytes(operandA), new(big.Int).SetBytes(operandB)
+	switch operation {
+	case eoSignedGT, eoSignedLT, eoSignedGE, eoSignedLE:
+		modulus := new(big.Int).Lsh(big.NewInt(1), uint(8*len(operandB)))
+		if len(operandA) != 0 && operandA[0]&0x80 != 0 {
+			a.Sub(a, modulus)
+		}
+		if len(operandB) != 0 && operandB[0]&0x80 != 0 {
+			b.Sub(b, modulus)
+		}
+	}
+	switch cmp := a.Cmp(b); operation {
+	case eoEq:
+		return cmp == 0
+	case eoNeq:
+		return cmp != 0
+	case eoSignedGT, eoUnsignedGT:
+		return cmp > 0
+	case eoSignedLT, eoUnsignedLT:
+		return cmp < 0
+	case eoSignedGE, eoUnsignedGE:
+		return cmp >= 0
+	case eoSignedLE, eoUnsignedLE:
+		return cmp <= 0
+	case eoBitSet:
+		return new(big.Int).And(a, b).Cmp(b) == 0
+	case eoBitClear:
+		return new(big.Int).And(a, b).Sign() == 0
+	}
+	return false
+}
+
+// updatePolicyCondition extends policyDigest with args = H_authHash(operandB || offset || operation)
+// followed by the Name of the compared entity
+func (s *session) updatePolicyCondition(cc tpmutil.Command, operandB []byte, offset, operation uint16, name []byte) {
+	h := hashFunctions[s.authHash]()
+	h.Write(operandB)
+	binary.Write(h, binary.BigEndian, offset)
+	binary.Write(h, binary.BigEndian, operation)
+	s.updatePolicy(cc, h.Sum(nil), name)
+}
+
+// PolicyNV processes PolicyNV command that compares the contents of an NV index at offset with operandB
+func (t *TPM2) PolicyNV(authHandle, nvIndex, policySession tpmutil.Handle, operandB []byte, offset, operation uint16) error {
+	nv, err := t.nvIndexAt(nvIndex, 2)
+	if err != nil {
+		return err
+	}
+	s, err := t.policySession(policySession, 3)
+	if err != nil {
+		return err
+	}
+	if operation > eoBitClear {
+		return parameterError(tpm2.RCValue, 3)
+	}
+	if !s.isTrial() {
+		if err := nvReadAccessChecks(authHandle, nvIndex, nv); err != nil {
+			return err
+		}
+		if int(offset) > len(nv.data) {
+			return parameterError(tpm2.RCValue, 2)
+		}
+		if len(nv.data)-int(offset) < len(operandB) {
+			return parameterError(tpm2.RCSize, 1)
+		}
+		if !compareOperands(nv.data[offset:int(offset)+len(operandB)], operandB, operation) {
+			return tpm2.Error{Code: tpm2.RCPolicy}
+		}
+	}
+	name, err := nv.name()
+	if err != nil {
+		return err
+	}
+
+	s.updatePolicyCondition(cmdPolicyNV, operandB, offset, operation, name)
+	return nil
+}
+
+// PolicyCounterTimer processes PolicyCounterTimer command that compares TPMS_TIME_INFO at offset with operandB
+func (t *TPM2) PolicyCounterTimer(policySession tpmutil.Handle, operandB []byte, offset, operation uint16) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if operation > eoBitClear {
+		return parameterError(tpm2.RCValue, 3)
+	}
+	if !s.isTrial() {
+		if int(offset)+len(operandB) > timeInfoSize {
+			return parameterError(tpm2.RCRange, 2)
+		}
+		timeInfo, err := tpmutil.Pack(t.timeValue(), t.clockInfo())
+		if err != nil {
+			return err
+		}
+		if !compareOperands(timeInfo[offset:int(offset)+len(operandB)], operandB, operation) {
+			return tpm2.Error{Code: tpm2.RCPolicy}
+		}
+	}
+
+	s.updatePolicyCondition(cmdPolicyCounterTimer, operandB, offset, operation, nil)
+	return nil
+}
+
+// PolicyNvWritten processes PolicyNvWritten command, the session can authorize only NV indices
+// with TPMA_NV_WRITTEN equal to writtenSet
+func (t *TPM2) PolicyNvWritten(policySession tpmutil.Handle, writtenSet bool) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if s.checkNVWritten && s.nvWrittenState != writtenSet {
+		return parameterError(tpm2.RCValue, 1)
+	}
+	s.checkNVWritten = true
+	s.nvWrittenState = writtenSet
+
+	var yesNo byte
+	if writtenSet {
+		yesNo = 1
+	}
+	s.updatePolicy(cmdPolicyNvWritten, []byte{yesNo})
+	return nil
+}
+
+// checkPolicyCommand checks a command against the restrictions of a policy session that were set by
+// PolicyPhysicalPresence, PolicyCommandCode, PolicyLocality, PolicyNameHash and PolicyTemplate
+func (t *TPM2) checkPolicyCommand(cmd *CommandContext, s *session, index int) error {
+	if s.isPPRequired && !t.physicalPresence {
+		return sessionError(tpm2.RCPP, index)
+	}
+	if s.commandCode != 0 && s.commandCode != cmd.Header.Cmd {
+		return sessionError(tpm2.RCPolicyCC, index)
+	}
+	if s.commandLocality != 0 && !localityIncluded(s.commandLocality, cmd.Locality) {
+		return tpm2.Warning{Code: tpm2.RCLocality}
+	}
+	if s.nameHash != nil {
+		h := hashFunctions[s.authHash]()
+		for _, handle := range cmd.Handles {
+			name, err := t.entityName(handle)
+			if err != nil {
+				return err
+			}
+			h.Write(name)
+		}
+		if !hmac.Equal(h.Sum(nil), s.nameHash) {
+			return sessionError(tpm2.RCPolicyFail, index)
+		}
+	}
+	if s.templateHash != nil {
+		var inSensitive, inPublic tpmutil.U16Bytes
+		if !templateCommands[cmd.Header.Cmd] {
+			return sessionError(tpm2.RCPolicyFail, index)
+		}
+		if _, err := tpmutil.Unpack(cmd.Parameters, &inSensitive, &inPublic); err != nil {
+			return sessionError(tpm2.RCPolicyFail, index)
+		}
+		h := hashFunctions[s.authHash]()
+		h.Write(inPublic)
+		if !hmac.Equal(h.Sum(nil), s.templateHash) {
+			return sessionError(tpm2.RCPolicyFail, index)
+		}
+	}
+	return nil
+}
+
+// isBound tells whether the session is bound to cpHash, nameHash or templateHash, only one of them can be set
+func (s *session) isBound() bool {
+	return s.cpHash != nil || s.nameHash != nil || s.templateHash != nil
+}
+
+// PolicyCommandCode processes PolicyCommandCode command that restricts the session to a command
+func (t *TPM2) PolicyCommandCode(policySession tpmutil.Handle, code tpmutil.Command) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if s.commandCode != 0 && s.commandCode != code {
+		return parameterError(tpm2.RCValue, 1)
+	}
+	if _, ok := commandTable[code]; !ok {
+		return parameterError(tpm2.RCPolicyCC, 1)
+	}
+	s.commandCode = code
+
+	codeBytes, _ := tpmutil.Pack(code)
+	s.updatePolicy(tpm2.CmdPolicyCommandCode, codeBytes)
+	return nil
+}
+
+// PolicyCpHash processes PolicyCpHash command that binds the session to the parameters of a command
+func (t *TPM2) PolicyCpHash(policySession tpmutil.Handle, cpHashA []byte) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if s.cpHash != nil && !hmac.Equal(s.cpHash, cpHashA) || s.nameHash != nil || s.templateHash != nil {
+		return tpm2.Error{Code: tpm2.RCCPHash}
+	}
+	if len(cpHashA) != len(s.policyDigest) {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	s.cpHash = cpHashA
+
+	s.updatePolicy(cmdPolicyCpHash, cpHashA)
+	return nil
+}
+
+// PolicyNameHash processes PolicyNameHash command that binds the session to the Names of the handles of a command
+func (t *TPM2) PolicyNameHash(policySession tpmutil.Handle, nameHash []byte) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if s.isBound() {
+		return tpm2.Error{Code: tpm2.RCCPHash}
+	}
+	if len(nameHash) != len(s.policyDigest) {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	s.nameHash = nameHash
+
+	s.updatePolicy(cmdPolicyNameHash, nameHash)
+	return nil
+}
+
+// PolicyDuplicationSelect processes PolicyDuplicationSelect command that restricts the session to duplication
+// of an object to a new parent, the Name of the object is a part of the policy when includeObject is set
+func (t *TPM2) PolicyDuplicationSelect(policySession tpmutil.Handle, objectName, newParentName []byte, includeObject bool) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if s.isBound() {
+		return tpm2.Error{Code: tpm2.RCCPHash}
+	}
+	if s.commandCode != 0 && s.commandCode != cmdDuplicate {
+		return tpm2.Error{Code: tpm2.RCCommandCode}
+	}
+	h := hashFunctions[s.authHash]()
+	h.Write(objectName)
+	h.Write(newParentName)
+	s.nameHash = h.Sum(nil)
+	s.commandCode = cmdDuplicate
+
+	if includeObject {
+		s.updatePolicy(cmdPolicyDuplicationSelect, objectName, newParentName, []byte{1})
+	} else {
+		s.updatePolicy(cmdPolicyDuplicationSelect, newParentName, []byte{0})
+	}
+	return nil
+}
+
+// PolicyTemplate processes PolicyTemplate command that restricts the session to creation of objects
+// with a given public area
+func (t *TPM2) PolicyTemplate(policySession tpmutil.Handle, templateHash []byte) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if s.templateHash != nil {
+		if !hmac.Equal(s.templateHash, templateHash) {
+			return parameterError(tpm2.RCValue, 1)
+		}
+	} else if s.isBound() {
+		return tpm2.Error{Code: tpm2.RCCPHash}
+	}
+	if len(templateHash) != len(s.policyDigest) {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	s.templateHash = templateHash
+
+	s.updatePolicy(cmdPolicyTemplate, templateHash)
+	return nil
+}
+
+// PolicyAuthValue processes PolicyAuthValue command, the session proves the authValue of the entity with an HMAC
+func (t *TPM2) PolicyAuthValue(policySession tpmutil.Handle) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	s.isAuthValueNeeded = true
+	s.isPasswordNeeded = false
+
+	s.updatePolicy(cmdPolicyAuthValue)
+	return nil
+}
+
+// PolicyPassword processes PolicyPassword command, the session carries the authValue of the entity in clear text.
+// The policy is the same as the one of PolicyAuthValue
+func (t *TPM2) PolicyPassword(policySession tpmutil.Handle) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	s.isPasswordNeeded = true
+	s.isAuthValueNeeded = false
+
+	s.updatePolicy(cmdPolicyAuthValue)
+	return nil
+}
+
+// PolicyLocality processes PolicyLocality command, repeated assertions allow only the localities
+// included in all of them
+func (t *TPM2) PolicyLocality(policySession tpmutil.Handle, locality byte) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	if locality == 0 {
+		return parameterError(tpm2.RCRange, 1)
+	}
+	allowed := locality
+	if s.commandLocality != 0 {
+		if locality < firstExtendedLocality {
+			if s.commandLocality >= firstExtendedLocality {
+				return parameterError(tpm2.RCRange, 1)
+			}
+			allowed = s.commandLocality & locality
+			if allowed == 0 {
+				return parameterError(tpm2.RCRange, 1)
+			}
+		} else if s.commandLocality != locality {
+			return parameterError(tpm2.RCRange, 1)
+		}
+	}
+	s.commandLocality = allowed
+
+	s.updatePolicy(cmdPolicyLocality, []byte{locality})
+	return nil
+}
+
+// PolicyPhysicalPresence processes PolicyPhysicalPresence command, the session requires the assertion
+// of physical presence when it authorizes a command
+func (t *TPM2) PolicyPhysicalPresence(policySession tpmutil.Handle) error {
+	s, err := t.policySession(policySession, 1)
+	if err != nil {
+		return err
+	}
+	s.isPPRequired = true
+
+	s.updatePolicy(cmdPolicyPhysicalPresence)
+	return nil
+}
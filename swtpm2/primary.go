@@ -0,0 +1,72 @@
+package swtpm2
+
+import (
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// primaryObjectLabel is the label of the KDF-seeded generator that derives primary objects from a primary seed
+const primaryObjectLabel = "Primary Object Creation"
+
+// CreatePrimary processes CreatePrimary command
+// The key is derived from the seed of the hierarchy, the Name of the template and the sensitive data
+// with the KDF-seeded generator of Part 1, so the same template always produces the same key within a hierarchy.
+// ECC keys take the private scalar from the generator as in FIPS 186-4 B.4.1, but the search of RSA primes
+// is implementation specific, so RSA primary keys are deterministic yet differ from those of other TPMs
+// with the same seed
+func (t *TPM2) CreatePrimary(primaryHandle tpmutil.Handle,
+	inSensitive SensitiveCreate,
+	inPublic tpm2.Public,
+	outsideInfo []byte,
+	creationPCR []tpm2.PCRSelection) (*CreatePrimaryResponse, error) {
+
+	h, ok := t.hierarchies[primaryHandle]
+	if !ok || h.seed == nil {
+		return nil, handleError(tpm2.RCValue, 1)
+	}
+	if err := checkTemplate(inPublic, inSensitive); err != nil {
+		return nil, err
+	}
+
+	parentName, err := tpmutil.Pack(primaryHandle)
+	if err != nil {
+		return nil, err
+	}
+	// a hierarchy has no name algorithm, its Name and Qualified Name is the handle
+	creationData, err := t.newCreationData(inPublic.NameAlg, creationPCR, tpm2.AlgNull, parentName, parentName, outsideInfo)
+	if err != nil {
+		return nil, err
+	}
+	templateName, err := objectName(inPublic)
+	if err != nil {
+		return nil, err
+	}
+	stream := newKDFStream(inPublic.NameAlg, h.seed, primaryObjectLabel, templateName, inSensitive.Data)
+	obj, err := createObject(stream, inPublic, inSensitive, parentName)
+	if err != nil {
+		return nil, err
+	}
+	obj.hierarchy = primaryHandle
+
+	digest, err := creationHash(obj.public.NameAlg, creationData)
+	if err != nil {
+		return nil, err
+	}
+	ticket, err := t.creationTicket(primaryHandle, obj.public.NameAlg, obj.name, digest)
+	if err != nil {
+		return nil, err
+	}
+
+	handle, err := t.addObject(obj)
+	if err != nil {
+		return nil, err
+	}
+	return &CreatePrimaryResponse{
+		Handle:         handle,
+		Public:         obj.public,
+		CreationData:   *creationData,
+		CreationHash:   digest,
+		CreationTicket: ticket,
+		Name:           obj.name,
+	}, nil
+}
@@ -0,0 +1,117 @@
+package swtpm2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/subtle"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Labels of KDFa used for protection of the sensitive area of an object by its parent
+const (
+	storageLabel   = "STORAGE"
+	integrityLabel = "INTEGRITY"
+)
+
+// inPrivateIndex is the parameter index of inPrivate in TPM2_Load
+const inPrivateIndex = 1
+
+// wrapSensitive encrypts and integrity-protects the sensitive area of an object with the seedValue of its parent,
+// the result is the content of TPM2B_PRIVATE: integrityHMAC || encSensitive
+func wrapSensitive(parent *object, obj *object) ([]byte, error) {
+	encoded, err := tpmutil.Pack(obj.sensitiveArea())
+	if err != nil {
+		return nil, err
+	}
+	sensitive, err := tpmutil.Pack(tpmutil.U16Bytes(encoded))
+	if err != nil {
+		return nil, err
+	}
+
+	stream, err := storageStream(parent, obj.name, false)
+	if err != nil {
+		return nil, err
+	}
+	encSensitive := make([]byte, len(sensitive))
+	stream.XORKeyStream(encSensitive, sensitive)
+
+	integrity, err := integrityHMAC(parent, encSensitive, obj.name)
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(tpmutil.U16Bytes(integrity), tpmutil.RawBytes(encSensitive))
+}
+
+// unwrapSensitive checks integrity of TPM2B_PRIVATE content and decrypts the sensitive area of an object with a given name
+func unwrapSensitive(parent *object, private, name []byte) (tpm2.Private, error) {
+	var sensitive tpm2.Private
+	var integrity tpmutil.U16Bytes
+	read, err := tpmutil.Unpack(private, &integrity)
+	if err != nil {
+		return sensitive, parameterError(tpm2.RCInsufficient, inPrivateIndex)
+	}
+	encSensitive := private[read:]
+
+	expected, err := integrityHMAC(parent, encSensitive, name)
+	if err != nil {
+		return sensitive, err
+	}
+	if subtle.ConstantTimeCompare(expected, integrity) != 1 {
+		return sensitive, parameterError(tpm2.RCIntegrity, inPrivateIndex)
+	}
+
+	stream, err := storageStream(parent, name, true)
+	if err != nil {
+		return sensitive, err
+	}
+	decrypted := make([]byte, len(encSensitive))
+	stream.XORKeyStream(decrypted, encSensitive)
+
+	var encoded tpmutil.U16Bytes
+	read, err = tpmutil.Unpack(decrypted, &encoded)
+	if err != nil || read != len(decrypted) {
+		return sensitive, parameterError(tpm2.RCSize, inPrivateIndex)
+	}
+	read, err = tpmutil.Unpack(encoded, &sensitive)
+	if err != nil || read != len(encoded) {
+		return sensitive, parameterError(tpm2.RCSize, inPrivateIndex)
+	}
+	return sensitive, nil
+}
+
+// storageStream creates CFB cipher with zero IV and the key KDFa(nameAlg, seedValue, "STORAGE", name, nil, keyBits)
+func storageStream(parent *object, name []byte, decrypt bool) (cipher.Stream, error) {
+	sym := symmetricScheme(parent.public)
+	key, err := tpm2.KDFa(parent.public.NameAlg, parent.seedValue, storageLabel, name, nil, int(sym.KeyBits))
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	iv := make([]byte, block.BlockSize())
+	if decrypt {
+		return cipher.NewCFBDecrypter(block, iv), nil
+	}
+	return cipher.NewCFBEncrypter(block, iv), nil
+}
+
+// integrityHMAC computes HMAC(KDFa(nameAlg, seedValue, "INTEGRITY", nil, nil, digestBits), encSensitive || name)
+func integrityHMAC(parent *object, encSensitive, name []byte) ([]byte, error) {
+	hash, err := parent.public.NameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+	key, err := tpm2.KDFa(parent.public.NameAlg, parent.seedValue, integrityLabel, nil, nil, 8*hash.Size())
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(hash.New, key)
+	mac.Write(encSensitive)
+	mac.Write(name)
+	return mac.Sum(nil), nil
+}
@@ -0,0 +1,618 @@
+package swtpm2
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// Range of handles of HMAC sessions, policy and trial sessions use the same slots in the policy session range
+const (
+	hmacSessionFirst   = tpmutil.Handle(handleTypeHMACSession << handleTypeShift)
+	policySessionFirst = tpmutil.Handle(handleTypePolicySession << handleTypeShift)
+)
+
+// Limits of sessions, all active sessions are loaded since contexts are not saved
+const (
+	maxLoadedSessions = 3
+	// maxContextGap is the maximum difference between the context IDs of saved sessions, it never applies
+	// to loaded sessions
+	maxContextGap = 0xFFFF
+	// minNonceSize is the minimal size of nonceCaller
+	minNonceSize = 16
+)
+
+// Parameter indices of StartAuthSession
+const (
+	startAuthSessionNonceIndex     = 1
+	startAuthSessionSaltIndex      = 2
+	startAuthSessionTypeIndex      = 3
+	startAuthSessionSymmetricIndex = 4
+	startAuthSessionHashIndex      = 5
+)
+
+// Labels of KDFa and KDFe used by sessions
+const (
+	sessionKeyLabel = "ATH"
+	saltLabel       = "SECRET"
+	cfbLabel        = "CFB"
+	xorLabel        = "XOR"
+)
+
+// session is an HMAC, policy or trial session started by StartAuthSession
+type session struct {
+	sessionType tpm2.SessionType
+	authHash    tpm2.Algorithm
+	symmetric   tpm2.SymScheme
+	sessionKey  []byte
+	nonceTPM    []byte
+	// boundEntity is the Name of the bind entity followed by its authValue, it is nil for unbound sessions
+	boundEntity []byte
+	// policyDigest is the policy digest of policy and trial sessions
+	policyDigest []byte
+	// pcrChecked is set by PolicyPCR that saved pcrUpdateCounter, the PCRs must not change until the session is used
+	pcrChecked       bool
+	pcrUpdateCounter uint32
+	// startTime is Time when the policy was started, it is the base of the timeouts bound to nonceTPM
+	startTime uint64
+	// timeout is Time after which the policy session cannot authorize commands, zero means no timeout
+	timeout uint64
+	// cpHash is the command parameters hash that the session is bound to
+	cpHash []byte
+	// checkNVWritten is set by PolicyNvWritten, the session authorizes NV indices with TPMA_NV_WRITTEN
+	// equal to nvWrittenState
+	checkNVWritten bool
+	nvWrittenState bool
+	// commandCode is the command that the session is restricted to, zero allows any command
+	commandCode tpmutil.Command
+	// nameHash is the digest of the Names of the handles that the session is bound to
+	nameHash []byte
+	// templateHash is the digest of the public area of an object that the session is allowed to create
+	templateHash []byte
+	// commandLocality is TPMA_LOCALITY of the localities allowed to use the session, zero allows any locality
+	commandLocality byte
+	// isAuthValueNeeded requires an HMAC with the authValue of the entity set by PolicyAuthValue,
+	// isPasswordNeeded requires the authValue in clear text set by PolicyPassword
+	isAuthValueNeeded bool
+	isPasswordNeeded  bool
+	// isPPRequired requires the assertion of physical presence set by PolicyPhysicalPresence
+	isPPRequired bool
+}
+
+// sessionAuth is an authorization of a command by a session that is completed by EndCommand
+type sessionAuth struct {
+	session *session
+	// hmacKey is sessionKey || authValue that computes the HMAC of the response and encrypts parameters
+	hmacKey []byte
+	// authorizes is set when the session authorizes a handle, other sessions only encrypt parameters
+	authorizes bool
+}
+
+// isPolicy tells whether the session is a policy or trial session
+func (s *session) isPolicy() bool {
+	return s.sessionType == tpm2.SessionPolicy || s.sessionType == tpm2.SessionTrial
+}
+
+// resetPolicy returns the policy state of the session to the state after StartAuthSession at a given Time
+func (s *session) resetPolicy(now uint64) {
+	size, _ := digestSize(s.authHash)
+	s.policyDigest = make([]byte, size)
+	s.pcrChecked = false
+	s.startTime = now
+	s.timeout = 0
+	s.cpHash = nil
+	s.checkNVWritten = false
+	s.commandCode = 0
+	s.nameHash = nil
+	s.templateHash = nil
+	s.commandLocality = 0
+	s.isAuthValueNeeded = false
+	s.isPasswordNeeded = false
+	s.isPPRequired = false
+}
+
+// StartAuthSession processes StartAuthSession command. A salted session decrypts the salt with tpmKey,
+// a bound session uses the authValue of bindKey and the session key is derived from both with KDFa
+func (t *TPM2) StartAuthSession(tpmKey, bindKey tpmutil.Handle, nonceCaller, encryptedSalt []byte,
+	sessionType tpm2.SessionType, symmetric tpm2.SymScheme, authHash tpm2.Algorithm) (tpmutil.Handle, []byte, error) {
+
+	var bindAuth, boundEntity []byte
+	if bindKey != tpm2.HandleNull {
+		authValue, ok := t.authValue(bindKey)
+		if !ok {
+			return 0, nil, handleError(tpm2.RCHandle, 2)
+		}
+		name, err := t.entityName(bindKey)
+		if err != nil {
+			return 0, nil, err
+		}
+		bindAuth = authValue
+		boundEntity = append(append([]byte(nil), name...), authValue...)
+	}
+	size, ok := digestSize(authHash)
+	if !ok {
+		return 0, nil, parameterError(tpm2.RCHash, startAuthSessionHashIndex)
+	}
+	if len(nonceCaller) < minNonceSize || len(nonceCaller) > size {
+		return 0, nil, parameterError(tpm2.RCSize, startAuthSessionNonceIndex)
+	}
+	switch sessionType {
+	case tpm2.SessionHMAC, tpm2.SessionPolicy, tpm2.SessionTrial:
+	default:
+		return 0, nil, parameterError(tpm2.RCValue, startAuthSessionTypeIndex)
+	}
+	if !checkSessionSymmetric(symmetric) {
+		return 0, nil, parameterError(tpm2.RCSymmetric, startAuthSessionSymmetricIndex)
+	}
+	salt, err := t.decryptSalt(tpmKey, encryptedSalt)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	handle, err := t.sessionHandle(sessionType)
+	if err != nil {
+		return 0, nil, err
+	}
+	s := &session{
+		sessionType: sessionType,
+		authHash:    authHash,
+		symmetric:   symmetric,
+		nonceTPM:    randomBytes(size),
+		boundEntity: boundEntity,
+	}
+	if key := append(append([]byte(nil), bindAuth...), salt...); len(key) > 0 {
+		if s.sessionKey, err = tpm2.KDFa(authHash, key, sessionKeyLabel, s.nonceTPM, nonceCaller, 8*size); err != nil {
+			return 0, nil, err
+		}
+	}
+	s.resetPolicy(t.timeValue())
+	t.sessions[handle] = s
+	return handle, s.nonceTPM, nil
+}
+
+// checkSessionSymmetric validates TPMT_SYM_DEF of a session: parameters are encrypted with AES in CFB mode or XOR
+func checkSessionSymmetric(symmetric tpm2.SymScheme) bool {
+	switch symmetric.Alg {
+	case tpm2.AlgNull:
+		return true
+	case tpm2.AlgXOR:
+		// keyBits of XOR is the hash algorithm
+		_, ok := digestSize(tpm2.Algorithm(symmetric.KeyBits))
+		return ok
+	default:
+		return checkSymmetricScheme(&symmetric)
+	}
+}
+
+// sessionHandle returns a handle of a free session slot, the slots are shared by HMAC and policy sessions
+func (t *TPM2) sessionHandle(sessionType tpm2.SessionType) (tpmutil.Handle, error) {
+	if len(t.sessions) >= maxLoadedSessions {
+		return 0, tpm2.Warning{Code: tpm2.RCSessionMemory}
+	}
+
+	first := hmacSessionFirst
+	if sessionType != tpm2.SessionHMAC {
+		first = policySessionFirst
+	}
+	for slot := tpmutil.Handle(0); ; slot++ {
+		if t.sessions[hmacSessionFirst+slot] == nil && t.sessions[policySessionFirst+slot] == nil {
+			return first + slot, nil
+		}
+	}
+}
+
+// isSessionHandle tells whether a handle belongs to the HMAC or policy session range
+func isSessionHandle(handle tpmutil.Handle) bool {
+	handleType := uint32(handle) >> handleTypeShift
+	return handleType == handleTypeHMACSession || handleType == handleTypePolicySession
+}
+
+// decryptSalt recovers the salt of a session encrypted with tpmKey: RSA keys use OAEP with "SECRET" label
+// and ECC keys use ECDH with an ephemeral point followed by KDFe
+func (t *TPM2) decryptSalt(tpmKey tpmutil.Handle, encryptedSalt []byte) ([]byte, error) {
+	if tpmKey == tpm2.HandleNull {
+		if len(encryptedSalt) != 0 {
+			return nil, parameterError(tpm2.RCValue, startAuthSessionSaltIndex)
+		}
+		return nil, nil
+	}
+	key, ok := t.objects[tpmKey]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, 1)
+	}
+	if key.public.Attributes&tpm2.FlagDecrypt == 0 || key.privateKey == nil {
+		return nil, handleError(tpm2.RCAttributes, 1)
+	}
+	hash, err := key.public.NameAlg.Hash()
+	if err != nil {
+		return nil, err
+	}
+
+	switch priv := key.privateKey.(type) {
+	case *rsa.PrivateKey:
+		salt, err := rsa.DecryptOAEP(hash.New(), nil, priv, encryptedSalt, []byte(saltLabel+"\x00"))
+		if err != nil {
+			return nil, parameterError(tpm2.RCValue, startAuthSessionSaltIndex)
+		}
+		return salt, nil
+	case *ecdsa.PrivateKey:
+		var x, y tpmutil.U16Bytes
+		if n, err := tpmutil.Unpack(encryptedSalt, &x, &y); err != nil || n != len(encryptedSalt) {
+			return nil, parameterError(tpm2.RCSize, startAuthSessionSaltIndex)
+		}
+		qx, qy := new(big.Int).SetBytes(x), new(big.Int).SetBytes(y)
+		if !priv.Curve.IsOnCurve(qx, qy) {
+			return nil, parameterError(tpm2.RCECCPoint, startAuthSessionSaltIndex)
+		}
+		zx, _ := priv.Curve.ScalarMult(qx, qy, priv.D.Bytes())
+		byteSize := (priv.Curve.Params().BitSize + 7) / 8
+		return tpm2.KDFe(key.public.NameAlg, leftPad(zx.Bytes(), byteSize), saltLabel,
+			leftPad(x, byteSize), leftPad(priv.X.Bytes(), byteSize), 8*hash.Size())
+	}
+	return nil, handleError(tpm2.RCKey, 1)
+}
+
+// flushSession removes a session, the result tells whether the session existed
+func (t *TPM2) flushSession(handle tpmutil.Handle) bool {
+	if _, ok := t.sessions[handle]; !ok {
+		return false
+	}
+	delete(t.sessions, handle)
+	return true
+}
+
+// entityName returns the Name of an entity: objects and NV indices are named by the digests of their public areas,
+// other entities are named by their handles
+func (t *TPM2) entityName(handle tpmutil.Handle) ([]byte, error) {
+	if obj, ok := t.objects[handle]; ok {
+		return obj.name, nil
+	}
+	if nv, ok := t.nvIndices[handle]; ok {
+		return nv.name()
+	}
+	return tpmutil.Pack(handle)
+}
+
+// entityHierarchy returns the hierarchy of an entity whose proof protects the tickets produced for it
+func (t *TPM2) entityHierarchy(handle tpmutil.Handle) tpmutil.Handle {
+	if obj, ok := t.objects[handle]; ok {
+		return obj.hierarchy
+	}
+	if nv, ok := t.nvIndices[handle]; ok && nv.has(tpm2.AttrPlatformCreate) {
+		return tpm2.HandlePlatform
+	}
+	switch handle {
+	case tpm2.HandlePlatform, tpm2.HandleEndorsement, tpm2.HandleNull:
+		return handle
+	}
+	return tpm2.HandleOwner
+}
+
+// entityPolicy returns the authPolicy of an entity and its hash algorithm
+func (t *TPM2) entityPolicy(handle tpmutil.Handle) (tpm2.Algorithm, []byte) {
+	if h, ok := t.hierarchies[handle]; ok {
+		return h.authPolicy.Alg, h.authPolicy.Value
+	}
+	if obj, ok := t.objects[handle]; ok {
+		return obj.public.NameAlg, obj.public.AuthPolicy
+	}
+	if nv, ok := t.nvIndices[handle]; ok {
+		return nv.public.NameAlg, nv.public.AuthPolicy
+	}
+	return tpm2.AlgNull, nil
+}
+
+// commandParametersHash computes cpHash: H_hashAlg(commandCode || Names of the handles || parameters)
+func (t *TPM2) commandParametersHash(hashAlg tpm2.Algorithm, cmd *CommandContext) ([]byte, error) {
+	h := hashFunctions[hashAlg]()
+	cc, err := tpmutil.Pack(cmd.Header.Cmd)
+	if err != nil {
+		return nil, err
+	}
+	h.Write(cc)
+	for _, handle := range cmd.Handles {
+		name, err := t.entityName(handle)
+		if err != nil {
+			return nil, err
+		}
+		h.Write(name)
+	}
+	h.Write(cmd.Parameters)
+	return h.Sum(nil), nil
+}
+
+// responseParametersHash computes rpHash of a successful response: H_hashAlg(TPM_RC_SUCCESS || commandCode || parameters)
+func responseParametersHash(hashAlg tpm2.Algorithm, cc tpmutil.Command, parameters []byte) ([]byte, error) {
+	header, err := tpmutil.Pack(tpmutil.RCSuccess, cc)
+	if err != nil {
+		return nil, err
+	}
+	h := hashFunctions[hashAlg]()
+	h.Write(header)
+	h.Write(parameters)
+	return h.Sum(nil), nil
+}
+
+// sessionHMAC computes HMAC(key, pHash || nonceNewer || nonceOlder || sessionAttributes)
+func sessionHMAC(hashAlg tpm2.Algorithm, key, pHash, nonceNewer, nonceOlder []byte, attributes tpm2.SessionAttributes) []byte {
+	mac := hmac.New(hashFunctions[hashAlg], key)
+	mac.Write(pHash)
+	mac.Write(nonceNewer)
+	mac.Write(nonceOlder)
+	mac.Write([]byte{byte(attributes)})
+	return mac.Sum(nil)
+}
+
+// authorizeSession checks the authorization of the entity with a given 1-based index by an HMAC or policy session
+// and returns the authorization that is completed in the response
+func (t *TPM2) authorizeSession(cmd *CommandContext, index int, auth tpm2.AuthCommand) (*sessionAuth, error) {
+	s, ok := t.sessions[auth.Session]
+	if !ok {
+		return nil, tpm2.Warning{Code: tpm2.RCReferenceS0 + tpm2.RCWarn(index-1)}
+	}
+	if size, _ := digestSize(s.authHash); len(auth.Nonce) < minNonceSize || len(auth.Nonce) > size {
+		return nil, sessionError(tpm2.RCSize, index)
+	}
+	handle := cmd.AuthHandles[index-1]
+	authValue, ok := t.authValue(handle)
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, index)
+	}
+	nv := t.nvIndices[handle]
+	obj := t.objects[handle]
+
+	includeAuthValue := true
+	if s.isPolicy() {
+		if s.isTrial() {
+			return nil, sessionError(tpm2.RCAttributes, index)
+		}
+		if err := t.checkPolicyCommand(cmd, s, index); err != nil {
+			return nil, err
+		}
+		if err := t.checkPCRCounter(s); err != nil {
+			return nil, err
+		}
+		if s.timeout != 0 && s.timeout < t.timeValue() {
+			return nil, sessionError(tpm2.RCExpired, index)
+		}
+		if nv != nil {
+			if err := nv.checkAuthPolicy(cmd.Header.Cmd); err != nil {
+				return nil, err
+			}
+		}
+		if obj != nil {
+			if err := obj.checkAuthPolicy(cmd.Header.Cmd, index, s); err != nil {
+				return nil, err
+			}
+		}
+		if s.checkNVWritten && (nv == nil || nv.has(tpm2.AttrWritten) != s.nvWrittenState) {
+			return nil, sessionError(tpm2.RCPolicyFail, index)
+		}
+		policyAlg, policy := t.entityPolicy(handle)
+		if policyAlg != s.authHash || !hmac.Equal(policy, s.policyDigest) {
+			return nil, sessionError(tpm2.RCPolicyFail, index)
+		}
+		// the authValue is proven by PolicyAuthValue or PolicyPassword only
+		includeAuthValue = s.isAuthValueNeeded
+	} else {
+		if nv != nil {
+			if err := nv.checkAuthValue(cmd.Header.Cmd); err != nil {
+				return nil, err
+			}
+		}
+		if obj != nil {
+			if err := obj.checkAuthValue(cmd.Header.Cmd, index); err != nil {
+				return nil, err
+			}
+		}
+		name, err := t.entityName(handle)
+		if err != nil {
+			return nil, err
+		}
+		// the authValue of the bind entity is already a part of the session key
+		includeAuthValue = !hmac.Equal(s.boundEntity, append(append([]byte(nil), name...), authValue...))
+	}
+
+	key := append([]byte(nil), s.sessionKey...)
+	if includeAuthValue {
+		key = append(key, authValue...)
+	}
+	cpHash, err := t.commandParametersHash(s.authHash, cmd)
+	if err != nil {
+		return nil, err
+	}
+	if s.cpHash != nil && !hmac.Equal(s.cpHash, cpHash) {
+		return nil, sessionError(tpm2.RCPolicyFail, index)
+	}
+	// the dictionary attack protection applies when the authValue takes part in the authorization
+	usesAuthValue := !s.isPolicy() || s.isAuthValueNeeded || s.isPasswordNeeded
+	if usesAuthValue {
+		if err := t.checkLockout(handle); err != nil {
+			return nil, err
+		}
+	}
+	var matches bool
+	if s.isPasswordNeeded {
+		matches = hmac.Equal(authValue, auth.Auth)
+	} else {
+		expected := sessionHMAC(s.authHash, key, cpHash, auth.Nonce, s.nonceTPM, auth.Attributes)
+		// a policy session without an HMAC key proves nothing with the HMAC, so it may be empty
+		matches = hmac.Equal(expected, auth.Auth) || s.isPolicy() && len(key) == 0 && len(auth.Auth) == 0
+	}
+	if nv != nil && (includeAuthValue || s.isPasswordNeeded) {
+		nv.authorized(matches)
+	}
+	if !matches {
+		if usesAuthValue {
+			t.authorizationFailed(handle)
+		}
+		return nil, sessionError(tpm2.RCAuthFail, index)
+	}
+	return &sessionAuth{session: s, hmacKey: key, authorizes: true}, nil
+}
+
+// cipherSession checks a session with a given 1-based index that follows the authorization sessions,
+// such a session must encrypt or decrypt a parameter. Nothing is authorized, so both HMACs are keyed with sessionKey
+func (t *TPM2) cipherSession(cmd *CommandContext, index int, auth tpm2.AuthCommand) (*sessionAuth, error) {
+	if auth.Session == tpm2.HandlePasswordSession {
+		return nil, sessionError(tpm2.RCHandle, index)
+	}
+	if auth.Attributes&(tpm2.AttrDecrypt|tpm2.AttrEcrypt) == 0 {
+		return nil, sessionError(tpm2.RCAttributes, index)
+	}
+	s, ok := t.sessions[auth.Session]
+	if !ok {
+		return nil, tpm2.Warning{Code: tpm2.RCReferenceS0 + tpm2.RCWarn(index-1)}
+	}
+	if size, _ := digestSize(s.authHash); len(auth.Nonce) < minNonceSize || len(auth.Nonce) > size {
+		return nil, sessionError(tpm2.RCSize, index)
+	}
+	cpHash, err := t.commandParametersHash(s.authHash, cmd)
+	if err != nil {
+		return nil, err
+	}
+	key := append([]byte(nil), s.sessionKey...)
+	expected := sessionHMAC(s.authHash, key, cpHash, auth.Nonce, s.nonceTPM, auth.Attributes)
+	if !hmac.Equal(expected, auth.Auth) && !(s.isPolicy() && len(key) == 0 && len(auth.Auth) == 0) {
+		return nil, sessionError(tpm2.RCAuthFail, index)
+	}
+	return &sessionAuth{session: s, hmacKey: key}, nil
+}
+
+// parameterSession returns the index of the session with the decrypt or encrypt attribute, -1 means no such session.
+// Only one session may have each attribute, it cannot be a password session and the parameter must be a sized buffer
+func (t *TPM2) parameterSession(cmd *CommandContext, attribute tpm2.SessionAttributes, allowed bool) (int, error) {
+	found := -1
+	for i, session := range cmd.Sessions {
+		if session.Attributes&attribute == 0 {
+			continue
+		}
+		if !allowed || found >= 0 || t.sessionAuths[i] == nil {
+			return -1, sessionError(tpm2.RCAttributes, i+1)
+		}
+		if t.sessionAuths[i].session.symmetric.Alg == tpm2.AlgNull {
+			return -1, sessionError(tpm2.RCSymmetric, i+1)
+		}
+		found = i
+	}
+	return found, nil
+}
+
+// decryptParameter decrypts the first command parameter in place, the encrypt attribute is validated as well
+// so that a command is not executed when its response cannot be encrypted
+func (t *TPM2) decryptParameter(cmd *CommandContext) error {
+	info := commandTable[cmd.Header.Cmd]
+	if _, err := t.parameterSession(cmd, tpm2.AttrEcrypt, info.encrypt); err != nil {
+		return err
+	}
+	i, err := t.parameterSession(cmd, tpm2.AttrDecrypt, info.decrypt)
+	if err != nil || i < 0 {
+		return err
+	}
+	data, ok := sizedParameter(cmd.Parameters)
+	if !ok {
+		return parameterError(tpm2.RCSize, 1)
+	}
+	sa := t.sessionAuths[i]
+	return sa.session.parameterCipher(sa.hmacKey, cmd.Sessions[i].Nonce, sa.session.nonceTPM, data, true)
+}
+
+// encryptParameter encrypts the first response parameter in place with the new nonceTPM
+func (t *TPM2) encryptParameter(cmd *CommandContext, responseParameters []byte) error {
+	i, err := t.parameterSession(cmd, tpm2.AttrEcrypt, commandTable[cmd.Header.Cmd].encrypt)
+	if err != nil || i < 0 {
+		return err
+	}
+	data, ok := sizedParameter(responseParameters)
+	if !ok {
+		return fmt.Errorf("response of command %d does not start with a sized buffer", cmd.Header.Cmd)
+	}
+	sa := t.sessionAuths[i]
+	return sa.session.parameterCipher(sa.hmacKey, sa.session.nonceTPM, cmd.Sessions[i].Nonce, data, false)
+}
+
+// sizedParameter returns the contents of the sized buffer at the beginning of parameters
+func sizedParameter(parameters []byte) ([]byte, bool) {
+	if len(parameters) < 2 {
+		return nil, false
+	}
+	size := int(binary.BigEndian.Uint16(parameters))
+	if size > len(parameters)-2 {
+		return nil, false
+	}
+	return parameters[2 : 2+size], true
+}
+
+// parameterCipher encrypts or decrypts a parameter in place with the symmetric algorithm of the session.
+// AES in CFB mode takes the key and IV from KDFa(authHash, key, "CFB", nonceNewer, nonceOlder),
+// XOR applies the mask KDFa(hashAlg, key, "XOR", nonceNewer, nonceOlder) of the size of the parameter
+func (s *session) parameterCipher(key, nonceNewer, nonceOlder, data []byte, decrypt bool) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if s.symmetric.Alg == tpm2.AlgXOR {
+		mask, err := tpm2.KDFa(tpm2.Algorithm(s.symmetric.KeyBits), key, xorLabel, nonceNewer, nonceOlder, 8*len(data))
+		if err != nil {
+			return err
+		}
+		for i := range data {
+			data[i] ^= mask[i]
+		}
+		return nil
+	}
+
+	keySize := int(s.symmetric.KeyBits) / 8
+	bits, err := tpm2.KDFa(s.authHash, key, cfbLabel, nonceNewer, nonceOlder, 8*(keySize+aes.BlockSize))
+	if err != nil {
+		return err
+	}
+	block, err := aes.NewCipher(bits[:keySize])
+	if err != nil {
+		return err
+	}
+	iv := bits[keySize:]
+	if decrypt {
+		cipher.NewCFBDecrypter(block, iv).XORKeyStream(data, data)
+	} else {
+		cipher.NewCFBEncrypter(block, iv).XORKeyStream(data, data)
+	}
+	return nil
+}
+
+// completeSession computes the HMAC of the response with the new nonceTPM, the session is flushed unless
+// continueSession is set and a policy session that authorized a handle is reset to its initial state
+func (t *TPM2) completeSession(cmd *CommandContext, auth tpm2.AuthCommand, sa *sessionAuth, responseParameters []byte) (AuthResponse, error) {
+	s := sa.session
+	rpHash, err := responseParametersHash(s.authHash, cmd.Header.Cmd, responseParameters)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+	response := AuthResponse{
+		Nonce:      s.nonceTPM,
+		Attributes: auth.Attributes,
+	}
+	// the response of a session with PolicyPassword has no HMAC
+	if !s.isPasswordNeeded {
+		response.Auth = sessionHMAC(s.authHash, sa.hmacKey, rpHash, s.nonceTPM, auth.Nonce, auth.Attributes)
+	}
+	if auth.Attributes&tpm2.AttrContinueSession == 0 {
+		t.flushSession(auth.Session)
+	} else if s.isPolicy() && sa.authorizes {
+		s.resetPolicy(t.timeValue())
+	}
+	return response, nil
+}
+
+// rollNonce replaces nonceTPM before the response is built
+func (s *session) rollNonce() {
+	size, _ := digestSize(s.authHash)
+	s.nonceTPM = randomBytes(size)
+}
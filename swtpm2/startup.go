@@ -0,0 +1,174 @@
+package swtpm2
+
+import (
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// savedState is the volatile state preserved by Shutdown(STATE)
+type savedState struct {
+	// pcrValues contains values of PCRs with stateSave attribute, other PCRs have no value
+	pcrValues        map[tpm2.Algorithm][][]byte
+	pcrUpdateCounter uint32
+}
+
+// preservesOrderlyState contains commands that may follow Shutdown without invalidating the saved state
+var preservesOrderlyState = map[tpmutil.Command]bool{
+	tpm2.CmdStartup:       true,
+	tpm2.CmdShutdown:      true,
+	tpm2.CmdGetCapability: true,
+}
+
+// Init processes _TPM_Init indication: transient objects and sessions are lost, a pending PCR allocation takes effect
+// and the TPM waits for Startup
+func (t *TPM2) Init() {
+	t.started = false
+	t.timeStart = time.Now()
+	t.flushTransientObjects()
+	t.sessions = make(map[tpmutil.Handle]*session)
+	t.eventSequence = nil
+	t.hcrtmStartup = false
+	if t.pendingPCRAllocation != nil {
+		t.pcrBanks = newPCRBanks(t.pendingPCRAllocation, t.pcrCount)
+		t.pendingPCRAllocation = nil
+		t.pcrReconfigured = true
+	}
+}
+
+// Startup processes Startup command received at a given locality, the TPM starts at locality 0 or 3 only
+// and the startup locality is recorded in the last octet of PCR 0
+func (t *TPM2) Startup(startupType tpm2.StartupType, locality uint8) error {
+	if t.started {
+		return tpm2.Error{Code: tpm2.RCInitialize}
+	}
+	if locality != 0 && locality != 3 {
+		return tpm2.Warning{Code: tpm2.RCLocality}
+	}
+
+	switch startupType {
+	case tpm2.StartupClear:
+	case tpm2.StartupState:
+		// TPM Resume requires the state of Shutdown(STATE) and the same PCR allocation
+		if t.savedState == nil || t.pcrReconfigured {
+			return parameterError(tpm2.RCValue, 1)
+		}
+		// TPM Resume would overwrite PCR 0 measured by H-CRTM
+		if t.hcrtmStartup {
+			return tpm2.Warning{Code: tpm2.RCLocality}
+		}
+	default:
+		return parameterError(tpm2.RCValue, 1)
+	}
+
+	banks := newPCRBanks(t.pcrAllocation(), t.pcrCount)
+	for i, bank := range banks {
+		if !bank.allocated(hcrtmPCR) {
+			continue
+		}
+		if t.hcrtmStartup {
+			// PCR 0 keeps the H-CRTM measurement, the allocation has not changed since _TPM_Init
+			bank.values[hcrtmPCR] = t.pcrBanks[i].values[hcrtmPCR]
+		} else {
+			bank.values[hcrtmPCR][len(bank.values[hcrtmPCR])-1] = locality
+		}
+	}
+	t.pcrBanks = banks
+	t.pcrUpdateCounter = 0
+	if startupType != tpm2.StartupState {
+		t.nvStartup()
+	}
+	switch {
+	case startupType == tpm2.StartupState:
+		// TPM Resume
+		t.restoreState(t.savedState)
+	case t.savedState == nil:
+		// TPM Reset
+		t.hierarchies[tpm2.HandleNull] = newNullHierarchy()
+		t.resetPlatformHierarchy()
+	default:
+		// TPM Restart
+		t.resetPlatformHierarchy()
+	}
+
+	if !t.shutdown {
+		t.nvRestoreOrderlyCounters()
+	}
+	t.lockoutStartup(startupType != tpm2.StartupState && t.savedState == nil)
+	t.clockStartup(startupType != tpm2.StartupState && t.savedState == nil)
+	t.orderlyStartup = t.shutdown
+	t.shutdown = false
+	t.savedState = nil
+	t.pcrReconfigured = false
+	t.hcrtmStartup = false
+	t.started = true
+	return nil
+}
+
+// Shutdown processes Shutdown command
+func (t *TPM2) Shutdown(shutdownType tpm2.StartupType) error {
+	switch shutdownType {
+	case tpm2.StartupClear:
+		t.savedState = nil
+	case tpm2.StartupState:
+		t.savedState = t.saveState()
+	default:
+		return parameterError(tpm2.RCValue, 1)
+	}
+	t.nvShutdown()
+	t.shutdown = true
+	return nil
+}
+
+// DiscardSavedState drops the state saved by Shutdown(STATE), so the next Startup cannot be TPM Resume
+// or TPM Restart
+func (t *TPM2) DiscardSavedState() {
+	t.savedState = nil
+}
+
+// saveState captures the state that is restored by TPM Resume
+func (t *TPM2) saveState() *savedState {
+	state := &savedState{
+		pcrValues:        make(map[tpm2.Algorithm][][]byte),
+		pcrUpdateCounter: t.pcrUpdateCounter,
+	}
+	for _, bank := range t.pcrBanks {
+		values := make([][]byte, len(bank.values))
+		for pcr, value := range bank.values {
+			if value != nil && pcrAttributesOf(pcr).stateSave {
+				values[pcr] = append([]byte(nil), value...)
+			}
+		}
+		state.pcrValues[bank.hashAlg] = values
+	}
+	return state
+}
+
+// restoreState restores the state saved by Shutdown(STATE)
+func (t *TPM2) restoreState(state *savedState) {
+	for _, bank := range t.pcrBanks {
+		for pcr, value := range state.pcrValues[bank.hashAlg] {
+			if value != nil {
+				bank.values[pcr] = value
+			}
+		}
+	}
+	t.pcrUpdateCounter = state.pcrUpdateCounter
+}
+
+// resetPlatformHierarchy clears the authorization of the platform hierarchy on TPM Reset and TPM Restart
+func (t *TPM2) resetPlatformHierarchy() {
+	platform := t.hierarchies[tpm2.HandlePlatform]
+	platform.authValue = nil
+	platform.authPolicy = tpm2.HashValue{Alg: tpm2.AlgNull}
+}
+
+// flushTransientObjects removes all transient objects
+func (t *TPM2) flushTransientObjects() {
+	for handle := range t.objects {
+		if handle >= transientFirst && handle <= transientLast {
+			delete(t.objects, handle)
+		}
+	}
+}
@@ -0,0 +1,613 @@
+package swtpm2
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// The persistent state is encoded as magic || version || sections || SHA-256 of the preceding bytes,
+// every section is tag || U32Bytes(data) and the sections follow in ascending order of tags
+const (
+	stateMagic          = "SWT2"
+	stateVersion uint32 = 2
+)
+
+// Tags of the sections of the persistent state
+const (
+	stateSectionHierarchies uint16 = 1
+	stateSectionPCRs        uint16 = 2
+	stateSectionOrderly     uint16 = 3
+	stateSectionFlags       uint16 = 4
+	stateSectionNVIndices   uint16 = 5
+	stateSectionClock       uint16 = 6
+	stateSectionObjects     uint16 = 7
+	stateSectionLockout     uint16 = 8
+)
+
+// persistentHierarchies are the hierarchies which secrets and authorizations survive a restart of the device
+var persistentHierarchies = []tpmutil.Handle{tpm2.HandleOwner, tpm2.HandleEndorsement, tpm2.HandlePlatform, tpm2.HandleLockout}
+
+// ErrInvalidState is returned for a persistent state that is corrupted or has an unsupported version
+var ErrInvalidState = errors.New("invalid persistent state")
+
+// persistentState is the decoded persistent state that is applied to TPM2 at once
+type persistentState struct {
+	hierarchies     map[tpmutil.Handle]*hierarchy
+	pcrCount        int
+	pcrAllocation   []tpm2.PCRSelection
+	pcrReconfigured bool
+	shutdown        bool
+	savedState      *savedState
+	// nullHierarchy is kept by TPM Resume and TPM Restart, so it is saved together with savedState
+	nullHierarchy  *hierarchy
+	tpmEstablished bool
+	nvIndices      map[tpmutil.Handle]*nvIndex
+	maxNVCounter   uint64
+	clock          uint64
+	resetCount     uint32
+	restartCount   uint32
+	objects        map[tpmutil.Handle]*object
+	da             dictionaryAttack
+}
+
+// stateSection encodes and decodes a section of the persistent state
+type stateSection struct {
+	tag    uint16
+	encode func(t *TPM2) ([]byte, error)
+	decode func(buf *bytes.Buffer, state *persistentState) error
+}
+
+// stateSections are all sections of the persistent state in ascending order of tags, every section is required
+var stateSections = []stateSection{
+	{stateSectionHierarchies, encodeHierarchiesState, decodeHierarchiesState},
+	{stateSectionPCRs, encodePCRState, decodePCRState},
+	{stateSectionOrderly, encodeOrderlyState, decodeOrderlyState},
+	{stateSectionFlags, encodeFlagsState, decodeFlagsState},
+	{stateSectionNVIndices, encodeNVState, decodeNVState},
+	{stateSectionClock, encodeClockState, decodeClockState},
+	{stateSectionObjects, encodeObjectsState, decodeObjectsState},
+	{stateSectionLockout, encodeLockoutState, decodeLockoutState},
+}
+
+// MarshalState encodes the state of TPM2 that survives a restart of the device: the secrets and authorizations
+// of the hierarchies, the PCR allocation, the state saved by Shutdown(STATE), flags, NV indices, Clock,
+// persistent objects and the state of the dictionary attack protection
+func (t *TPM2) MarshalState() ([]byte, error) {
+	sections := make([][]byte, len(stateSections))
+	tags := make([]uint16, len(stateSections))
+	for i, section := range stateSections {
+		data, err := section.encode(t)
+		if err != nil {
+			return nil, err
+		}
+		sections[i], tags[i] = data, section.tag
+	}
+	return sealSections(stateMagic, stateVersion, tags, sections)
+}
+
+// LoadState replaces the persistent state of TPM2 with a state produced by MarshalState,
+// the volatile state is lost and the TPM waits for Startup
+func (t *TPM2) LoadState(b []byte) error {
+	state, err := unmarshalState(b)
+	if err != nil {
+		return err
+	}
+
+	for handle, h := range state.hierarchies {
+		t.hierarchies[handle] = h
+	}
+	if state.nullHierarchy != nil {
+		t.hierarchies[tpm2.HandleNull] = state.nullHierarchy
+	} else {
+		t.hierarchies[tpm2.HandleNull] = newNullHierarchy()
+	}
+	t.pcrCount = state.pcrCount
+	t.pcrBanks = newPCRBanks(state.pcrAllocation, state.pcrCount)
+	t.pendingPCRAllocation = nil
+	t.pcrReconfigured = state.pcrReconfigured
+	t.shutdown = state.shutdown
+	t.savedState = state.savedState
+	t.tpmEstablished = state.tpmEstablished
+	t.nvIndices = state.nvIndices
+	t.maxNVCounter = state.maxNVCounter
+	t.setClock(state.clock)
+	t.resetCount = state.resetCount
+	t.restartCount = state.restartCount
+	t.objects = state.objects
+	t.da = state.da
+	t.da.selfHealStart = t.timeValue()
+	t.da.lockoutStart = t.da.selfHealStart
+
+	t.started = false
+	t.sessions = make(map[tpmutil.Handle]*session)
+	t.sessionAuths = nil
+	t.eventSequence = nil
+	t.hcrtmStartup = false
+	return nil
+}
+
+// unmarshalState checks the integrity and the version of the persistent state and decodes its sections
+func unmarshalState(b []byte) (*persistentState, error) {
+	tags := make([]uint16, len(stateSections))
+	for i, section := range stateSections {
+		tags[i] = section.tag
+	}
+	sections, err := openSections(b, stateMagic, stateVersion, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &persistentState{
+		nvIndices: make(map[tpmutil.Handle]*nvIndex),
+		objects:   make(map[tpmutil.Handle]*object),
+	}
+	for i, section := range stateSections {
+		if err := decodeSection(sections[i], section.tag, func(buf *bytes.Buffer) error {
+			return section.decode(buf, state)
+		}); err != nil {
+			return nil, err
+		}
+	}
+	return state, nil
+}
+
+// sealSections encodes magic || version || sections || SHA-256 of the preceding bytes
+func sealSections(magic string, version uint32, tags []uint16, sections [][]byte) ([]byte, error) {
+	var buf bytes.Buffer
+	buf.WriteString(magic)
+	if err := packState(&buf, version); err != nil {
+		return nil, err
+	}
+	for i, data := range sections {
+		if err := packState(&buf, tags[i], tpmutil.U32Bytes(data)); err != nil {
+			return nil, err
+		}
+	}
+	digest := sha256.Sum256(buf.Bytes())
+	buf.Write(digest[:])
+	return buf.Bytes(), nil
+}
+
+// openSections checks the integrity, the format and the version of an encoded state
+// and returns the data of its sections that must have the given tags
+func openSections(b []byte, magic string, version uint32, tags []uint16) ([][]byte, error) {
+	if len(b) < len(magic)+sha256.Size {
+		return nil, fmt.Errorf("%w: %d bytes is too short", ErrInvalidState, len(b))
+	}
+	content, digest := b[:len(b)-sha256.Size], b[len(b)-sha256.Size:]
+	expected := sha256.Sum256(content)
+	if !hmac.Equal(expected[:], digest) {
+		return nil, fmt.Errorf("%w: digest mismatch", ErrInvalidState)
+	}
+	if string(content[:len(magic)]) != magic {
+		return nil, fmt.Errorf("%w: unknown format", ErrInvalidState)
+	}
+
+	buf := bytes.NewBuffer(content[len(magic):])
+	var encodedVersion uint32
+	if err := tpmutil.UnpackBuf(buf, &encodedVersion); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+	}
+	if encodedVersion != version {
+		return nil, fmt.Errorf("%w: unsupported version %d", ErrInvalidState, encodedVersion)
+	}
+	sections := make([][]byte, len(tags))
+	for i, expectedTag := range tags {
+		var tag uint16
+		var data tpmutil.U32Bytes
+		if err := tpmutil.UnpackBuf(buf, &tag, &data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidState, err)
+		}
+		if tag != expectedTag {
+			return nil, fmt.Errorf("%w: unexpected section %d", ErrInvalidState, tag)
+		}
+		sections[i] = data
+	}
+	if buf.Len() != 0 {
+		return nil, fmt.Errorf("%w: %d extra bytes", ErrInvalidState, buf.Len())
+	}
+	return sections, nil
+}
+
+// decodeSection decodes the data of a section that must be consumed completely
+func decodeSection(data []byte, tag uint16, decode func(buf *bytes.Buffer) error) error {
+	buf := bytes.NewBuffer(data)
+	if err := decode(buf); err != nil {
+		return fmt.Errorf("%w: section %d: %v", ErrInvalidState, tag, err)
+	}
+	if buf.Len() != 0 {
+		return fmt.Errorf("%w: section %d has %d extra bytes", ErrInvalidState, tag, buf.Len())
+	}
+	return nil
+}
+
+// encodeHierarchiesState encodes seed, proof, authValue and authPolicy of every persistent hierarchy
+func encodeHierarchiesState(t *TPM2) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, handle := range persistentHierarchies {
+		h := t.hierarchies[handle]
+		if err := packState(&buf, handle, tpmutil.U16Bytes(h.seed), tpmutil.U16Bytes(h.proof),
+			tpmutil.U16Bytes(h.authValue), h.authPolicy.Alg, tpmutil.U16Bytes(h.authPolicy.Value)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeHierarchiesState(buf *bytes.Buffer, state *persistentState) error {
+	state.hierarchies = make(map[tpmutil.Handle]*hierarchy)
+	for _, expected := range persistentHierarchies {
+		var handle tpmutil.Handle
+		var seed, proof, authValue, authPolicy tpmutil.U16Bytes
+		var authPolicyAlg tpm2.Algorithm
+		if err := tpmutil.UnpackBuf(buf, &handle, &seed, &proof, &authValue, &authPolicyAlg, &authPolicy); err != nil {
+			return err
+		}
+		if handle != expected {
+			return fmt.Errorf("unexpected hierarchy 0x%x", handle)
+		}
+		state.hierarchies[handle] = &hierarchy{
+			seed:       emptyToNil(seed),
+			proof:      emptyToNil(proof),
+			authValue:  emptyToNil(authValue),
+			authPolicy: tpm2.HashValue{Alg: authPolicyAlg, Value: emptyToNil(authPolicy)},
+		}
+	}
+	return nil
+}
+
+// encodePCRState encodes the number of PCRs and the allocation of PCR banks that is used after the next _TPM_Init
+func encodePCRState(t *TPM2) ([]byte, error) {
+	allocation := t.pendingPCRAllocation
+	if allocation == nil {
+		allocation = t.pcrAllocation()
+	}
+	pcrAllocation, err := EncodePCRSelectionWithSize(PCRSelectSize(t.pcrCount), allocation...)
+	if err != nil {
+		return nil, err
+	}
+	reconfigured := t.pcrReconfigured || t.pendingPCRAllocation != nil
+	return tpmutil.Pack(uint32(t.pcrCount), reconfigured, tpmutil.RawBytes(pcrAllocation))
+}
+
+func decodePCRState(buf *bytes.Buffer, state *persistentState) error {
+	var pcrCount uint32
+	if err := tpmutil.UnpackBuf(buf, &pcrCount, &state.pcrReconfigured); err != nil {
+		return err
+	}
+	if pcrCount < defaultPCRCount || pcrCount > maxPCRCount {
+		return fmt.Errorf("number of PCRs %d is out of range", pcrCount)
+	}
+	allocation, err := DecodePCRSelection(buf)
+	if err != nil {
+		return err
+	}
+	for _, sel := range allocation {
+		if _, ok := digestSize(sel.Hash); !ok {
+			return fmt.Errorf("unsupported PCR bank algorithm 0x%x", sel.Hash)
+		}
+		for _, pcr := range sel.PCRs {
+			if pcr >= int(pcrCount) {
+				return fmt.Errorf("PCR %d is out of range", pcr)
+			}
+		}
+	}
+	state.pcrCount = int(pcrCount)
+	state.pcrAllocation = allocation
+	return nil
+}
+
+// encodeOrderlyState encodes whether the last command was Shutdown, the state saved by Shutdown(STATE)
+// and the secrets of the null hierarchy, PCRs without saved values are encoded as empty buffers
+func encodeOrderlyState(t *TPM2) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := packState(&buf, t.shutdown, t.savedState != nil); err != nil {
+		return nil, err
+	}
+	if t.savedState == nil {
+		return buf.Bytes(), nil
+	}
+
+	hashAlgs := make([]tpm2.Algorithm, 0, len(t.savedState.pcrValues))
+	for _, hashAlg := range pcrHashAlgorithms {
+		if _, ok := t.savedState.pcrValues[hashAlg]; ok {
+			hashAlgs = append(hashAlgs, hashAlg)
+		}
+	}
+	null := t.hierarchies[tpm2.HandleNull]
+	if err := packState(&buf, tpmutil.U16Bytes(null.seed), tpmutil.U16Bytes(null.proof),
+		t.savedState.pcrUpdateCounter, uint8(len(hashAlgs))); err != nil {
+		return nil, err
+	}
+	for _, hashAlg := range hashAlgs {
+		if err := packState(&buf, hashAlg); err != nil {
+			return nil, err
+		}
+		values := t.savedState.pcrValues[hashAlg]
+		for pcr := 0; pcr < t.pcrCount; pcr++ {
+			var value []byte
+			if pcr < len(values) {
+				value = values[pcr]
+			}
+			if err := packState(&buf, tpmutil.U16Bytes(value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeOrderlyState(buf *bytes.Buffer, state *persistentState) error {
+	var hasSavedState bool
+	if err := tpmutil.UnpackBuf(buf, &state.shutdown, &hasSavedState); err != nil {
+		return err
+	}
+	if !hasSavedState {
+		return nil
+	}
+
+	var nullSeed, nullProof tpmutil.U16Bytes
+	var pcrUpdateCounter uint32
+	var bankCount uint8
+	if err := tpmutil.UnpackBuf(buf, &nullSeed, &nullProof, &pcrUpdateCounter, &bankCount); err != nil {
+		return err
+	}
+	if len(nullSeed) != primarySeedSize || len(nullProof) != primarySeedSize {
+		return fmt.Errorf("null hierarchy secrets have %d and %d bytes", len(nullSeed), len(nullProof))
+	}
+	saved := &savedState{
+		pcrValues:        make(map[tpm2.Algorithm][][]byte),
+		pcrUpdateCounter: pcrUpdateCounter,
+	}
+	for i := 0; i < int(bankCount); i++ {
+		var hashAlg tpm2.Algorithm
+		if err := tpmutil.UnpackBuf(buf, &hashAlg); err != nil {
+			return err
+		}
+		size, ok := digestSize(hashAlg)
+		if !ok {
+			return fmt.Errorf("unsupported PCR bank algorithm 0x%x", hashAlg)
+		}
+		// the PCR section precedes this one, so the number of PCRs is known
+		values := make([][]byte, state.pcrCount)
+		for pcr := range values {
+			var value tpmutil.U16Bytes
+			if err := tpmutil.UnpackBuf(buf, &value); err != nil {
+				return err
+			}
+			if len(value) != 0 && len(value) != size {
+				return fmt.Errorf("PCR %d of bank 0x%x has %d bytes", pcr, hashAlg, len(value))
+			}
+			values[pcr] = emptyToNil(value)
+		}
+		saved.pcrValues[hashAlg] = values
+	}
+	state.savedState = saved
+	state.nullHierarchy = &hierarchy{
+		seed:       nullSeed,
+		proof:      nullProof,
+		authPolicy: tpm2.HashValue{Alg: tpm2.AlgNull},
+	}
+	return nil
+}
+
+// encodeFlagsState encodes the flags that are kept in NV memory
+func encodeFlagsState(t *TPM2) ([]byte, error) {
+	return tpmutil.Pack(t.tpmEstablished)
+}
+
+func decodeFlagsState(buf *bytes.Buffer, state *persistentState) error {
+	return tpmutil.UnpackBuf(buf, &state.tpmEstablished)
+}
+
+// encodeNVState encodes the largest value of undefined counters followed by the public areas, authValues and data
+// of NV indices in ascending order of handles. Orderly counters are stored with their value in NV memory
+func encodeNVState(t *TPM2) ([]byte, error) {
+	handles := make([]tpmutil.Handle, 0, len(t.nvIndices))
+	for handle := range t.nvIndices {
+		handles = append(handles, handle)
+	}
+	sortHandles(handles)
+
+	var buf bytes.Buffer
+	if err := packState(&buf, t.maxNVCounter, uint32(len(handles))); err != nil {
+		return nil, err
+	}
+	for _, handle := range handles {
+		nv := t.nvIndices[handle]
+		public, err := tpmutil.Pack(nv.public)
+		if err != nil {
+			return nil, err
+		}
+		data := nv.data
+		if nv.isOrderlyCounter() && nv.has(tpm2.AttrWritten) {
+			data = make([]byte, nvCounterSize)
+			binary.BigEndian.PutUint64(data, nv.nvCounter)
+		}
+		if err := packState(&buf, tpmutil.U16Bytes(public), tpmutil.U16Bytes(nv.authValue), tpmutil.U16Bytes(data)); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeNVState(buf *bytes.Buffer, state *persistentState) error {
+	var count uint32
+	if err := tpmutil.UnpackBuf(buf, &state.maxNVCounter, &count); err != nil {
+		return err
+	}
+	if count > maxNVIndices {
+		return fmt.Errorf("%d NV indices exceed the limit", count)
+	}
+	for i := 0; i < int(count); i++ {
+		var publicInfo, authValue, data tpmutil.U16Bytes
+		if err := tpmutil.UnpackBuf(buf, &publicInfo, &authValue, &data); err != nil {
+			return err
+		}
+		var public tpm2.NVPublic
+		if n, err := tpmutil.Unpack(publicInfo, &public); err != nil || n != len(publicInfo) {
+			return fmt.Errorf("invalid public area of NV index %d", i)
+		}
+		if !isNVIndexHandle(public.NVIndex) || state.nvIndices[public.NVIndex] != nil {
+			return fmt.Errorf("invalid or duplicate NV index 0x%x", public.NVIndex)
+		}
+		if _, ok := digestSize(public.NameAlg); !ok {
+			return fmt.Errorf("unsupported name algorithm 0x%x of NV index 0x%x", public.NameAlg, public.NVIndex)
+		}
+		if len(data) != int(public.DataSize) {
+			return fmt.Errorf("NV index 0x%x has %d bytes of data instead of %d", public.NVIndex, len(data), public.DataSize)
+		}
+		if t := nvTypeFromAttributes(public.Attributes); (t == nvTypeCounter || t == nvTypeBits) && len(data) != nvCounterSize {
+			return fmt.Errorf("NV index 0x%x of type %d has %d bytes of data", public.NVIndex, t, len(data))
+		}
+		nv := &nvIndex{
+			public:    public,
+			authValue: emptyToNil(authValue),
+			data:      data,
+		}
+		if nv.isOrderlyCounter() && nv.has(tpm2.AttrWritten) {
+			nv.nvCounter = nv.counter()
+		}
+		state.nvIndices[public.NVIndex] = nv
+	}
+	return nil
+}
+
+// encodeClockState encodes Clock, resetCount and restartCount
+func encodeClockState(t *TPM2) ([]byte, error) {
+	return tpmutil.Pack(t.nvClock(), t.resetCount, t.restartCount)
+}
+
+func decodeClockState(buf *bytes.Buffer, state *persistentState) error {
+	return tpmutil.UnpackBuf(buf, &state.clock, &state.resetCount, &state.restartCount)
+}
+
+// encodeObjectsState encodes the public areas, sensitive areas, qualified names and hierarchies
+// of persistent objects in ascending order of handles
+func encodeObjectsState(t *TPM2) ([]byte, error) {
+	var handles []tpmutil.Handle
+	for handle := range t.objects {
+		if uint32(handle)>>handleTypeShift == handleTypePersistent {
+			handles = append(handles, handle)
+		}
+	}
+	sortHandles(handles)
+
+	var buf bytes.Buffer
+	if err := packState(&buf, uint32(len(handles))); err != nil {
+		return nil, err
+	}
+	for _, handle := range handles {
+		if err := encodeObject(&buf, handle, t.objects[handle]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeObjectsState(buf *bytes.Buffer, state *persistentState) error {
+	var count uint32
+	if err := tpmutil.UnpackBuf(buf, &count); err != nil {
+		return err
+	}
+	if count > maxPersistentObjects {
+		return fmt.Errorf("%d persistent objects exceed the limit", count)
+	}
+	for i := 0; i < int(count); i++ {
+		handle, obj, err := decodeObject(buf)
+		if err != nil {
+			return err
+		}
+		if handle < persistentFirst || handle > persistentLast || state.objects[handle] != nil {
+			return fmt.Errorf("invalid or duplicate persistent object 0x%x", handle)
+		}
+		if state.hierarchies[obj.hierarchy] == nil || obj.publicOnly() {
+			return fmt.Errorf("persistent object 0x%x of hierarchy 0x%x cannot be persistent", handle, obj.hierarchy)
+		}
+		state.objects[handle] = obj
+	}
+	return nil
+}
+
+// encodeObject encodes the handle, the public area, the sensitive area, the qualified name and the hierarchy
+// of an object, the sensitive area of an object loaded without it is empty
+func encodeObject(buf *bytes.Buffer, handle tpmutil.Handle, obj *object) error {
+	public, err := obj.public.Encode()
+	if err != nil {
+		return err
+	}
+	var sensitive []byte
+	if !obj.publicOnly() {
+		if sensitive, err = tpmutil.Pack(obj.sensitiveArea()); err != nil {
+			return err
+		}
+	}
+	return packState(buf, handle, tpmutil.U16Bytes(public), tpmutil.U16Bytes(sensitive),
+		tpmutil.U16Bytes(obj.qualifiedName), obj.hierarchy)
+}
+
+func decodeObject(buf *bytes.Buffer) (tpmutil.Handle, *object, error) {
+	var handle, hierarchy tpmutil.Handle
+	var publicArea, sensitiveArea, qualifiedName tpmutil.U16Bytes
+	if err := tpmutil.UnpackBuf(buf, &handle, &publicArea, &sensitiveArea, &qualifiedName, &hierarchy); err != nil {
+		return 0, nil, err
+	}
+	public, err := tpm2.DecodePublic(publicArea)
+	if err != nil {
+		return 0, nil, fmt.Errorf("invalid public area of object 0x%x", handle)
+	}
+	var obj *object
+	if len(sensitiveArea) == 0 {
+		obj, err = newObject(public, nil)
+	} else {
+		var sensitive tpm2.Private
+		if n, err := tpmutil.Unpack(sensitiveArea, &sensitive); err != nil || n != len(sensitiveArea) {
+			return 0, nil, fmt.Errorf("invalid sensitive area of object 0x%x", handle)
+		}
+		obj, err = restoreObject(public, sensitive, nil)
+	}
+	if err != nil {
+		return 0, nil, fmt.Errorf("object 0x%x: %v", handle, err)
+	}
+	obj.qualifiedName = qualifiedName
+	obj.hierarchy = hierarchy
+	return handle, obj, nil
+}
+
+// encodeLockoutState encodes the counter of authorization failures, the parameters of the dictionary attack
+// protection and whether lockoutAuth is blocked. The recovery intervals restart after a restart of the device
+func encodeLockoutState(t *TPM2) ([]byte, error) {
+	t.updateLockout()
+	da := &t.da
+	return tpmutil.Pack(da.failedTries, da.maxTries, da.recoveryTime, da.lockoutRecovery, da.lockoutAuthFailed)
+}
+
+func decodeLockoutState(buf *bytes.Buffer, state *persistentState) error {
+	da := &state.da
+	return tpmutil.UnpackBuf(buf, &da.failedTries, &da.maxTries, &da.recoveryTime, &da.lockoutRecovery, &da.lockoutAuthFailed)
+}
+
+// emptyToNil keeps decoded empty buffers equal to the values that were never set
+func emptyToNil(b []byte) []byte {
+	if len(b) == 0 {
+		return nil
+	}
+	return b
+}
+
+// packState appends the TPM encoding of elements to a section of the persistent state
+func packState(buf *bytes.Buffer, elts ...interface{}) error {
+	b, err := tpmutil.Pack(elts...)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
@@ -1,8 +1,10 @@
 package swtpm2
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil"
@@ -11,6 +13,9 @@ import (
 // Regular TPM 2.0 devices use 24-bit mask (3 bytes) for PCR selection.
 const sizeOfPCRSelect = 3
 
+// maxSizeOfPCRSelect is the largest accepted PCR selection bitmask, it covers all 256 PCR handles
+const maxSizeOfPCRSelect = 32
+
 // CommandHeader represents the header of a command
 type CommandHeader struct {
 	Tag  tpmutil.Tag
@@ -69,61 +74,393 @@ func (rpr *ReadPublicResponse) Encode() ([]byte, error) {
 	return tpmutil.Pack(resp)
 }
 
+// ReadPublicNVResponse represents the response of NV_ReadPublic command
+type ReadPublicNVResponse struct {
+	NVPublic tpm2.NVPublic
+	Name     []byte
+}
+
+// Encode converts ReadPublicNVResponse to a byte array
+func (rpr *ReadPublicNVResponse) Encode() ([]byte, error) {
+	public, err := tpmutil.Pack(rpr.NVPublic)
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(tpmutil.U16Bytes(public), tpmutil.U16Bytes(rpr.Name))
+}
+
+// NVCertifyResponse represents the response of NV_Certify command
+type NVCertifyResponse struct {
+	// CertifyInfo is TPMS_ATTEST that was signed
+	CertifyInfo []byte
+	Signature   tpm2.Signature
+}
+
+// Encode converts NVCertifyResponse to a byte array
+func (ncr *NVCertifyResponse) Encode() ([]byte, error) {
+	signature, err := ncr.Signature.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(tpmutil.U16Bytes(ncr.CertifyInfo), tpmutil.RawBytes(signature))
+}
+
+// PolicyAuthResponse represents the response of PolicySigned and PolicySecret commands
+type PolicyAuthResponse struct {
+	// Timeout is TPM2B_TIMEOUT that is passed to PolicyTicket with the ticket
+	Timeout      []byte
+	PolicyTicket tpm2.Ticket
+}
+
+// Encode converts PolicyAuthResponse to a byte array
+func (par *PolicyAuthResponse) Encode() ([]byte, error) {
+	return tpmutil.Pack(tpmutil.U16Bytes(par.Timeout), par.PolicyTicket)
+}
+
 type TPMPCRSelection struct {
 	Hash tpm2.Algorithm
 	Size byte
 	PCRs tpmutil.RawBytes
 }
 
+// PCRSelectSize returns sizeofSelect of a bitmask that covers a given number of PCRs,
+// the size is never less than sizeOfPCRSelect
+func PCRSelectSize(pcrCount int) int {
+	size := (pcrCount + 7) / 8
+	if size < sizeOfPCRSelect {
+		return sizeOfPCRSelect
+	}
+	return size
+}
+
 // EncodePCRSelection encodes given PCR selection
-// Copy-paste of tpm2.encodePCRSelection that is not public yet
+// All selections share the smallest bitmask that covers every selected PCR
 func EncodePCRSelection(sel ...tpm2.PCRSelection) ([]byte, error) {
-	if len(sel) == 0 {
-		return tpmutil.Pack(uint32(0))
+	pcrCount := 0
+	for _, s := range sel {
+		for _, n := range s.PCRs {
+			if n >= pcrCount {
+				pcrCount = n + 1
+			}
+		}
+	}
+	return EncodePCRSelectionWithSize(PCRSelectSize(pcrCount), sel...)
+}
+
+// EncodePCRSelectionWithSize encodes given PCR selection with a bitmask of sizeOfSelect bytes
+func EncodePCRSelectionWithSize(sizeOfSelect int, sel ...tpm2.PCRSelection) ([]byte, error) {
+	if sizeOfSelect > maxSizeOfPCRSelect {
+		return nil, fmt.Errorf("size of PCR selection %d exceeds %d", sizeOfSelect, maxSizeOfPCRSelect)
 	}
 
 	// PCR selection is a variable-size bitmask, where position of a set bit is
 	// the selected PCR index.
-	// Size of the bitmask in bytes is pre-pended. It should be at least
-	// sizeOfPCRSelect.
+	// Size of the bitmask in bytes is pre-pended.
 	//
 	// For example, selecting PCRs 3 and 9 looks like:
 	// size(3)  mask     mask     mask
 	// 00000011 00000000 00000001 00000100
-	var retBytes []byte
+	retBytes, err := tpmutil.Pack(uint32(len(sel)))
+	if err != nil {
+		return nil, err
+	}
 	for _, s := range sel {
-		if len(s.PCRs) == 0 {
-			return tpmutil.Pack(uint32(0))
+		pcrSelect, err := encodePCRSelect(sizeOfSelect, s.PCRs)
+		if err != nil {
+			return nil, err
 		}
-
 		ts := TPMPCRSelection{
 			Hash: s.Hash,
-			Size: sizeOfPCRSelect,
-			PCRs: make(tpmutil.RawBytes, sizeOfPCRSelect),
-		}
-
-		// s[i].PCRs parameter is indexes of PCRs, convert that to set bits.
-		for _, n := range s.PCRs {
-			if n >= 8*sizeOfPCRSelect {
-				return nil, fmt.Errorf("PCR index %d is out of range (exceeds maximum value %d)", n, 8*sizeOfPCRSelect-1)
-			}
-			byteNum := n / 8
-			bytePos := byte(1 << byte(n%8))
-			ts.PCRs[byteNum] |= bytePos
+			Size: byte(sizeOfSelect),
+			PCRs: pcrSelect,
 		}
 
 		tmpBytes, err := tpmutil.Pack(ts)
 		if err != nil {
 			return nil, err
 		}
-
 		retBytes = append(retBytes, tmpBytes...)
 	}
-	tmpSize, err := tpmutil.Pack(uint32(len(sel)))
+	return retBytes, nil
+}
+
+// encodePCRSelect converts indexes of PCRs to a bitmask of sizeOfSelect bytes
+func encodePCRSelect(sizeOfSelect int, pcrs []int) (tpmutil.RawBytes, error) {
+	pcrSelect := make(tpmutil.RawBytes, sizeOfSelect)
+	for _, n := range pcrs {
+		if n < 0 || n >= 8*sizeOfSelect {
+			return nil, fmt.Errorf("PCR index %d is out of range (exceeds maximum value %d)", n, 8*sizeOfSelect-1)
+		}
+		pcrSelect[n/8] |= 1 << byte(n%8)
+	}
+	return pcrSelect, nil
+}
+
+// decodePCRSelect converts a bitmask to indexes of PCRs
+func decodePCRSelect(pcrSelect []byte) []int {
+	var pcrs []int
+	for n := 0; n < 8*len(pcrSelect); n++ {
+		if pcrSelect[n/8]&(1<<byte(n%8)) != 0 {
+			pcrs = append(pcrs, n)
+		}
+	}
+	return pcrs
+}
+
+// CommandAttributes represents TPMA_CC value
+type CommandAttributes uint32
+
+// PCRProperty represents TPM_PT_PCR value, a tag of TPMS_TAGGED_PCR_SELECT
+type PCRProperty uint32
+
+// PCR properties reported by GetCapability(TPM_CAP_PCR_PROPERTIES)
+const (
+	PCRSave        PCRProperty = 0x00
+	PCRExtendL0    PCRProperty = 0x01
+	PCRResetL0     PCRProperty = 0x02
+	PCRExtendL1    PCRProperty = 0x03
+	PCRResetL1     PCRProperty = 0x04
+	PCRExtendL2    PCRProperty = 0x05
+	PCRResetL2     PCRProperty = 0x06
+	PCRExtendL3    PCRProperty = 0x07
+	PCRResetL3     PCRProperty = 0x08
+	PCRExtendL4    PCRProperty = 0x09
+	PCRResetL4     PCRProperty = 0x0A
+	PCRNoIncrement PCRProperty = 0x11
+	PCRDRTMReset   PCRProperty = 0x12
+	PCRPolicy      PCRProperty = 0x13
+	PCRAuth        PCRProperty = 0x14
+)
+
+// TaggedPCRSelect represents TPMS_TAGGED_PCR_SELECT structure
+type TaggedPCRSelect struct {
+	Tag  PCRProperty
+	PCRs []int
+}
+
+// Encode converts TaggedPCRSelect to a byte array
+func (tps *TaggedPCRSelect) Encode() ([]byte, error) {
+	pcrCount := 0
+	for _, n := range tps.PCRs {
+		if n >= pcrCount {
+			pcrCount = n + 1
+		}
+	}
+	sizeOfSelect := PCRSelectSize(pcrCount)
+	pcrSelect, err := encodePCRSelect(sizeOfSelect, tps.PCRs)
 	if err != nil {
 		return nil, err
 	}
-	retBytes = append(tmpSize, retBytes...)
+	return tpmutil.Pack(tps.Tag, byte(sizeOfSelect), pcrSelect)
+}
 
-	return retBytes, nil
+// TaggedPolicy represents TPMS_TAGGED_POLICY structure
+type TaggedPolicy struct {
+	Handle     tpmutil.Handle
+	PolicyHash tpm2.HashValue
+}
+
+// Encode converts TaggedPolicy to a byte array
+func (tp *TaggedPolicy) Encode() ([]byte, error) {
+	policyHash, err := tp.PolicyHash.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(tp.Handle, tpmutil.RawBytes(policyHash))
+}
+
+// DecodePCRSelection decodes TPML_PCR_SELECTION from the buffer
+func DecodePCRSelection(buf *bytes.Buffer) ([]tpm2.PCRSelection, error) {
+	sel, _, err := DecodePCRSelectionWithSize(buf)
+	return sel, err
+}
+
+// DecodePCRSelectionWithSize decodes TPML_PCR_SELECTION from the buffer and returns the largest sizeofSelect
+// of its selections, so a response can be encoded with the same size of bitmasks as the request
+func DecodePCRSelectionWithSize(buf *bytes.Buffer) ([]tpm2.PCRSelection, int, error) {
+	var count uint32
+	if err := tpmutil.UnpackBuf(buf, &count); err != nil {
+		return nil, 0, err
+	}
+	if int(count) > buf.Len() {
+		return nil, 0, fmt.Errorf("too many PCR selections: %d", count)
+	}
+
+	var sel []tpm2.PCRSelection
+	sizeOfSelect := 0
+	for i := uint32(0); i < count; i++ {
+		var hash tpm2.Algorithm
+		var size byte
+		if err := tpmutil.UnpackBuf(buf, &hash, &size); err != nil {
+			return nil, 0, err
+		}
+		if size > maxSizeOfPCRSelect {
+			return nil, 0, fmt.Errorf("size of PCR selection %d exceeds %d", size, maxSizeOfPCRSelect)
+		}
+		pcrSelect := make([]byte, size)
+		if _, err := io.ReadFull(buf, pcrSelect); err != nil {
+			return nil, 0, err
+		}
+		if int(size) > sizeOfSelect {
+			sizeOfSelect = int(size)
+		}
+		sel = append(sel, tpm2.PCRSelection{Hash: hash, PCRs: decodePCRSelect(pcrSelect)})
+	}
+	return sel, sizeOfSelect, nil
+}
+
+// SensitiveCreate represents TPMS_SENSITIVE_CREATE structure
+type SensitiveCreate struct {
+	UserAuth tpmutil.U16Bytes
+	Data     tpmutil.U16Bytes
+}
+
+// CreationData represents TPMS_CREATION_DATA structure
+type CreationData struct {
+	PCRSelection        []tpm2.PCRSelection
+	PCRDigest           []byte
+	Locality            byte
+	ParentNameAlg       tpm2.Algorithm
+	ParentName          []byte
+	ParentQualifiedName []byte
+	OutsideInfo         []byte
+}
+
+// Encode converts CreationData to a byte array
+func (cd *CreationData) Encode() ([]byte, error) {
+	pcrSelection, err := EncodePCRSelection(cd.PCRSelection...)
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(
+		tpmutil.RawBytes(pcrSelection),
+		tpmutil.U16Bytes(cd.PCRDigest),
+		cd.Locality,
+		cd.ParentNameAlg,
+		tpmutil.U16Bytes(cd.ParentName),
+		tpmutil.U16Bytes(cd.ParentQualifiedName),
+		tpmutil.U16Bytes(cd.OutsideInfo),
+	)
+}
+
+// CreatePrimaryResponse is a processing result of CreatePrimary command
+type CreatePrimaryResponse struct {
+	Handle         tpmutil.Handle
+	Public         tpm2.Public
+	CreationData   CreationData
+	CreationHash   []byte
+	CreationTicket tpm2.Ticket
+	Name           []byte
+}
+
+// Encode converts CreatePrimaryResponse to a byte array
+func (cpr *CreatePrimaryResponse) Encode() ([]byte, error) {
+	public, err := cpr.Public.Encode()
+	if err != nil {
+		return nil, err
+	}
+	creationData, err := cpr.CreationData.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(
+		cpr.Handle,
+		tpmutil.U16Bytes(public),
+		tpmutil.U16Bytes(creationData),
+		tpmutil.U16Bytes(cpr.CreationHash),
+		cpr.CreationTicket,
+		tpmutil.U16Bytes(cpr.Name),
+	)
+}
+
+// CreateResponse is a processing result of Create command
+type CreateResponse struct {
+	Private        []byte
+	Public         tpm2.Public
+	CreationData   CreationData
+	CreationHash   []byte
+	CreationTicket tpm2.Ticket
+}
+
+// Encode converts CreateResponse to a byte array
+func (cr *CreateResponse) Encode() ([]byte, error) {
+	public, err := cr.Public.Encode()
+	if err != nil {
+		return nil, err
+	}
+	creationData, err := cr.CreationData.Encode()
+	if err != nil {
+		return nil, err
+	}
+	return tpmutil.Pack(
+		tpmutil.U16Bytes(cr.Private),
+		tpmutil.U16Bytes(public),
+		tpmutil.U16Bytes(creationData),
+		tpmutil.U16Bytes(cr.CreationHash),
+		cr.CreationTicket,
+	)
+}
+
+// PCRReadResponse is a processing result of PCR_Read command
+type PCRReadResponse struct {
+	UpdateCounter uint32
+	PCRSelection  []tpm2.PCRSelection
+	Digests       [][]byte
+	// SizeOfSelect is the size of PCR selection bitmasks, the smallest fitting size is used when it is zero
+	SizeOfSelect int
+}
+
+// Encode converts PCRReadResponse to a byte array
+func (prr *PCRReadResponse) Encode() ([]byte, error) {
+	var pcrSelection []byte
+	var err error
+	if prr.SizeOfSelect == 0 {
+		pcrSelection, err = EncodePCRSelection(prr.PCRSelection...)
+	} else {
+		pcrSelection, err = EncodePCRSelectionWithSize(prr.SizeOfSelect, prr.PCRSelection...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := tpmutil.Pack(prr.UpdateCounter, tpmutil.RawBytes(pcrSelection), uint32(len(prr.Digests)))
+	if err != nil {
+		return nil, err
+	}
+	for _, digest := range prr.Digests {
+		encoded, err := tpmutil.Pack(tpmutil.U16Bytes(digest))
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, encoded...)
+	}
+	return b, nil
+}
+
+// EncodeDigestValues encodes TPML_DIGEST_VALUES
+func EncodeDigestValues(digests []tpm2.HashValue) ([]byte, error) {
+	b, err := tpmutil.Pack(uint32(len(digests)))
+	if err != nil {
+		return nil, err
+	}
+	for _, digest := range digests {
+		encoded, err := digest.Encode()
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, encoded...)
+	}
+	return b, nil
+}
+
+// PCRAllocateResponse is a processing result of PCR_Allocate command
+type PCRAllocateResponse struct {
+	AllocationSuccess bool
+	MaxPCR            uint32
+	SizeNeeded        uint32
+	SizeAvailable     uint32
+}
+
+// Encode converts PCRAllocateResponse to a byte array
+func (par *PCRAllocateResponse) Encode() ([]byte, error) {
+	return tpmutil.Pack(par.AllocationSuccess, par.MaxPCR, par.SizeNeeded, par.SizeAvailable)
 }
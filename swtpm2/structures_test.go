@@ -0,0 +1,93 @@
+package swtpm2_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/rihter007/go-swtpm/swtpm2"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPCRSelectionRoundTrip(t *testing.T) {
+	testCases := []tpm2.PCRSelection{
+		{Hash: tpm2.AlgSHA1, PCRs: []int{0}},
+		{Hash: tpm2.AlgSHA256, PCRs: []int{3, 9, 23}},
+		{Hash: tpm2.AlgSHA384, PCRs: []int{0, 1, 2, 3, 4, 5, 6, 7, 16}},
+	}
+
+	for _, sel := range testCases {
+		// go-tpm encodes selections with 3 bytes bitmasks
+		creationData := tpm2.CreationData{PCRSelection: sel, ParentNameAlg: tpm2.AlgNull}
+		encoded, err := creationData.EncodeCreationData()
+		require.NoError(t, err)
+		decoded, err := swtpm2.DecodePCRSelection(bytes.NewBuffer(encoded))
+		require.NoError(t, err)
+		require.Equal(t, []tpm2.PCRSelection{sel}, decoded)
+
+		encoded, err = swtpm2.EncodePCRSelection(sel)
+		require.NoError(t, err)
+		// the rest of TPMS_CREATION_DATA: pcrDigest, locality, parentNameAlg, parentName, parentQualifiedName, outsideInfo
+		encoded = append(encoded, 0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00)
+		goDecoded, err := tpm2.DecodeCreationData(encoded)
+		require.NoError(t, err)
+		require.Equal(t, sel, goDecoded.PCRSelection)
+	}
+}
+
+func TestPCRSelectionBeyond24PCRs(t *testing.T) {
+	sel := []tpm2.PCRSelection{
+		{Hash: tpm2.AlgSHA1},
+		{Hash: tpm2.AlgSHA256, PCRs: []int{0, 24, 31}},
+	}
+	encoded, err := swtpm2.EncodePCRSelection(sel...)
+	require.NoError(t, err)
+	// both selections use the 4 bytes bitmask required for PCR 31
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x04, 0x04, 0x00, 0x00, 0x00, 0x00,
+		0x00, 0x0B, 0x04, 0x01, 0x00, 0x00, 0x81,
+	}, encoded)
+
+	decoded, sizeOfSelect, err := swtpm2.DecodePCRSelectionWithSize(bytes.NewBuffer(encoded))
+	require.NoError(t, err)
+	require.Equal(t, 4, sizeOfSelect)
+	require.Equal(t, sel[1], decoded[1])
+	require.Empty(t, decoded[0].PCRs)
+
+	// the size requested by the caller is kept even if it exceeds the selected PCRs
+	encoded, err = swtpm2.EncodePCRSelectionWithSize(5, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{1}})
+	require.NoError(t, err)
+	decoded, sizeOfSelect, err = swtpm2.DecodePCRSelectionWithSize(bytes.NewBuffer(encoded))
+	require.NoError(t, err)
+	require.Equal(t, 5, sizeOfSelect)
+	require.Equal(t, []int{1}, decoded[0].PCRs)
+
+	_, err = swtpm2.EncodePCRSelectionWithSize(3, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{24}})
+	require.Error(t, err)
+	_, err = swtpm2.EncodePCRSelection(tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{256}})
+	require.Error(t, err)
+
+	tooLarge := []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x0B, 0x21}
+	tooLarge = append(tooLarge, make([]byte, 0x21)...)
+	_, err = swtpm2.DecodePCRSelection(bytes.NewBuffer(tooLarge))
+	require.Error(t, err)
+}
+
+func TestTaggedPCRSelectEncode(t *testing.T) {
+	tps := swtpm2.TaggedPCRSelect{Tag: swtpm2.PCRResetL0, PCRs: []int{16, 23}}
+	encoded, err := tps.Encode()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x02, 0x03, 0x00, 0x00, 0x81}, encoded)
+
+	tps.PCRs = append(tps.PCRs, 32)
+	encoded, err = tps.Encode()
+	require.NoError(t, err)
+	require.Equal(t, []byte{0x00, 0x00, 0x00, 0x02, 0x05, 0x00, 0x00, 0x81, 0x00, 0x01}, encoded)
+
+	var tag uint32
+	_, err = tpmutil.Unpack(encoded, &tag)
+	require.NoError(t, err)
+	require.Equal(t, uint32(swtpm2.PCRResetL0), tag)
+}
@@ -1,7 +1,9 @@
 package swtpm2
 
 import (
+	"crypto/subtle"
 	"fmt"
+	"time"
 
 	"github.com/google/go-tpm/tpm2"
 	"github.com/google/go-tpm/tpmutil"
@@ -9,33 +11,293 @@ import (
 
 // TPM2 represents a TPM2.0 device
 type TPM2 struct {
+	hierarchies map[tpmutil.Handle]*hierarchy
+	objects     map[tpmutil.Handle]*object
+	nvIndices   map[tpmutil.Handle]*nvIndex
+	sessions    map[tpmutil.Handle]*session
+	// sessionAuths are the authorizations of the command being executed by HMAC and policy sessions,
+	// password sessions have nil entries
+	sessionAuths []*sessionAuth
+	// maxNVCounter is the largest value of the counters that were undefined
+	maxNVCounter uint64
+	// ppCommands contains commands that require physical presence for platform authorization
+	ppCommands map[tpmutil.Command]bool
+	// auditCommands contains commands that are audited
+	auditCommands map[tpmutil.Command]bool
+	// pcrCount is the number of PCRs in every bank
+	pcrCount int
+	// pcrBanks are the allocated PCR banks in ascending order of hash algorithms
+	pcrBanks []*pcrBank
+	// pendingPCRAllocation is the allocation of PCR banks that takes effect after the next _TPM_Init
+	pendingPCRAllocation []tpm2.PCRSelection
+	// pcrUpdateCounter counts changes of PCRs
+	pcrUpdateCounter uint32
+	// locality is the locality of the command being executed
+	locality uint8
+
+	// started is set by a successful Startup and cleared by _TPM_Init
+	started bool
+	// shutdown is set by Shutdown and cleared when the orderly state is lost
+	shutdown bool
+	// savedState is the state preserved by Shutdown(STATE)
+	savedState *savedState
+	// pcrReconfigured is set when _TPM_Init applied a new PCR allocation
+	pcrReconfigured bool
+	// orderlyStartup is set when the last Startup was preceded by Shutdown
+	orderlyStartup bool
+	// eventSequence is the H-CRTM or D-RTM event sequence started by _TPM_Hash_Start
+	eventSequence eventSequence
+	// hcrtmStartup is set when PCR 0 was measured by H-CRTM before Startup
+	hcrtmStartup bool
+	// tpmEstablished is set by _TPM_Hash_Start
+	tpmEstablished bool
+	// clock is the value of Clock at clockStart
+	clock      uint64
+	clockStart time.Time
+	// timeStart is the moment of the last _TPM_Init
+	timeStart time.Time
+	// resetCount counts TPM Resets, restartCount counts TPM Restarts and TPM Resumes since the last TPM Reset
+	resetCount   uint32
+	restartCount uint32
+	// da is the state of the dictionary attack protection
+	da dictionaryAttack
+
+	// Platform signals
+	nvUnavailable    bool
+	physicalPresence bool
+	canceled         bool
+}
+
+// Config describes an emulated TPM2 device
+type Config struct {
+	// Seed is used to derive primary seeds, random seeds are generated when it is empty
+	Seed []byte
+	// PCRBanks lists hash algorithms of the allocated PCR banks, SHA-1 and SHA-256 banks are allocated when it is empty
+	PCRBanks []tpm2.Algorithm
+	// PCRCount is the number of PCRs in every bank, 24 PCRs are implemented when it is zero
+	PCRCount int
 }
 
-// NewTPM2 creates a new TPM2 object
+// NewTPM2 creates a new TPM2 object with random primary seeds
 func NewTPM2() *TPM2 {
-	return &TPM2{}
+	return NewTPM2FromSeed(randomBytes(primarySeedSize))
+}
+
+// NewTPM2FromSeed creates a new TPM2 object, primary seeds of the owner, endorsement and platform
+// hierarchies are derived from the given seed, so the device always produces the same primary keys
+func NewTPM2FromSeed(seed []byte) *TPM2 {
+	t, err := NewTPM2WithConfig(Config{Seed: seed})
+	if err != nil {
+		// the default configuration is always valid
+		panic(fmt.Sprintf("failed to create TPM2, err: %v", err))
+	}
+	return t
+}
+
+// NewTPM2WithConfig creates a new TPM2 object with a given configuration
+func NewTPM2WithConfig(config Config) (*TPM2, error) {
+	seed := config.Seed
+	if len(seed) == 0 {
+		seed = randomBytes(primarySeedSize)
+	}
+	hashAlgs := config.PCRBanks
+	if len(hashAlgs) == 0 {
+		hashAlgs = defaultPCRBanks
+	}
+	pcrCount := config.PCRCount
+	if pcrCount == 0 {
+		pcrCount = defaultPCRCount
+	}
+	if pcrCount < defaultPCRCount || pcrCount > maxPCRCount {
+		return nil, fmt.Errorf("number of PCRs %d is out of range [%d, %d]", pcrCount, defaultPCRCount, maxPCRCount)
+	}
+	pcrAllocation, err := defaultPCRAllocation(hashAlgs, pcrCount)
+	if err != nil {
+		return nil, err
+	}
+	return &TPM2{
+		hierarchies:   newHierarchies(seed),
+		objects:       make(map[tpmutil.Handle]*object),
+		nvIndices:     make(map[tpmutil.Handle]*nvIndex),
+		sessions:      make(map[tpmutil.Handle]*session),
+		ppCommands:    make(map[tpmutil.Command]bool),
+		auditCommands: make(map[tpmutil.Command]bool),
+		pcrCount:      pcrCount,
+		pcrBanks:      newPCRBanks(pcrAllocation, pcrCount),
+		clockStart:    time.Now(),
+		timeStart:     time.Now(),
+		da:            newDictionaryAttack(),
+	}, nil
+}
+
+// BeginCommand checks the authorization sessions of a command and decrypts its first parameter
+func (t *TPM2) BeginCommand(cmd *CommandContext) error {
+	if !t.started && cmd.Header.Cmd != tpm2.CmdStartup {
+		return tpm2.Error{Code: tpm2.RCInitialize}
+	}
+	if err := checkLocality(cmd.Locality); err != nil {
+		return err
+	}
+	t.locality = cmd.Locality
+	if t.shutdown && !preservesOrderlyState[cmd.Header.Cmd] {
+		// the state saved by Shutdown is not valid when the TPM keeps running
+		t.shutdown = false
+		t.savedState = nil
+	}
+	if err := t.checkPlatformSignals(cmd); err != nil {
+		return err
+	}
+
+	t.sessionAuths = make([]*sessionAuth, len(cmd.Sessions))
+	for i, session := range cmd.Sessions {
+		if session.Attributes&^(tpm2.AttrContinueSession|tpm2.AttrDecrypt|tpm2.AttrEcrypt) != 0 {
+			return sessionError(tpm2.RCAttributes, i+1)
+		}
+		for _, previous := range cmd.Sessions[:i] {
+			if session.Session != tpm2.HandlePasswordSession && previous.Session == session.Session {
+				return sessionError(tpm2.RCHandle, i+1)
+			}
+		}
+		if i >= len(cmd.AuthHandles) {
+			sa, err := t.cipherSession(cmd, i+1, session)
+			if err != nil {
+				return err
+			}
+			t.sessionAuths[i] = sa
+			continue
+		}
+		if session.Session != tpm2.HandlePasswordSession {
+			sa, err := t.authorizeSession(cmd, i+1, session)
+			if err != nil {
+				return err
+			}
+			t.sessionAuths[i] = sa
+			continue
+		}
+		if len(session.Nonce) > 0 {
+			return sessionError(tpm2.RCNonce, i+1)
+		}
+
+		authValue, ok := t.authValue(cmd.AuthHandles[i])
+		if !ok {
+			return handleError(tpm2.RCHandle, i+1)
+		}
+		nv := t.nvIndices[cmd.AuthHandles[i]]
+		if nv != nil {
+			if err := nv.checkAuthValue(cmd.Header.Cmd); err != nil {
+				return err
+			}
+		}
+		if obj, ok := t.objects[cmd.AuthHandles[i]]; ok {
+			if err := obj.checkAuthValue(cmd.Header.Cmd, i+1); err != nil {
+				return err
+			}
+		}
+		if err := t.checkLockout(cmd.AuthHandles[i]); err != nil {
+			return err
+		}
+		matches := subtle.ConstantTimeCompare(authValue, session.Auth) == 1
+		if nv != nil {
+			nv.authorized(matches)
+		}
+		if !matches {
+			t.authorizationFailed(cmd.AuthHandles[i])
+			return sessionError(tpm2.RCAuthFail, i+1)
+		}
+	}
+	return t.decryptParameter(cmd)
+}
+
+// EndCommand builds the authorization area of a response, the first response parameter is encrypted in place
+// when a session has the encrypt attribute
+func (t *TPM2) EndCommand(cmd *CommandContext, responseParameters []byte) ([]AuthResponse, error) {
+	for _, sa := range t.sessionAuths {
+		if sa != nil {
+			sa.session.rollNonce()
+		}
+	}
+	if err := t.encryptParameter(cmd, responseParameters); err != nil {
+		return nil, err
+	}
+
+	responses := make([]AuthResponse, len(cmd.Sessions))
+	for i, session := range cmd.Sessions {
+		if i < len(t.sessionAuths) && t.sessionAuths[i] != nil {
+			response, err := t.completeSession(cmd, session, t.sessionAuths[i], responseParameters)
+			if err != nil {
+				return nil, err
+			}
+			responses[i] = response
+			continue
+		}
+		// password sessions always respond with empty nonce and hmac and continueSession set
+		responses[i] = AuthResponse{Attributes: tpm2.AttrContinueSession}
+	}
+	t.sessionAuths = nil
+	return responses, nil
 }
 
 // ReadPublic processes ReadPublic command
 func (t *TPM2) ReadPublic(handle tpmutil.Handle) (*ReadPublicResponse, error) {
-	return nil, fmt.Errorf("not implemented")
+	obj, ok := t.objects[handle]
+	if !ok {
+		return nil, handleError(tpm2.RCHandle, 1)
+	}
+	return &ReadPublicResponse{
+		Public:        obj.public,
+		Name:          obj.name,
+		QualifiedName: obj.qualifiedName,
+	}, nil
 }
 
-// ReadPublicNV processes ReadPublicNV command
-func (t *TPM2) ReadPublicNV(index tpmutil.Handle) (*tpm2.NVPublic, error) {
-	return nil, fmt.Errorf("not implemented")
+// authValue returns the authorization value of an entity
+func (t *TPM2) authValue(handle tpmutil.Handle) ([]byte, bool) {
+	if h, ok := t.hierarchies[handle]; ok {
+		return h.authValue, true
+	}
+	if obj, ok := t.objects[handle]; ok {
+		return obj.authValue, true
+	}
+	if nv, ok := t.nvIndices[handle]; ok {
+		return nv.authValue, true
+	}
+	if handle < tpmutil.Handle(t.pcrCount) {
+		// PCRs have no authorization values
+		return nil, true
+	}
+	return nil, false
 }
 
-func (t *TPM2) GetCapabilityPCRs(count, property uint32) ([]tpm2.PCRSelection, error) {
-	return nil, fmt.Errorf("not implemented")
+// loadObject places an object into the first free transient slot and returns its handle
+func (t *TPM2) loadObject(public tpm2.Public, parentQualifiedName []byte) (tpmutil.Handle, error) {
+	obj, err := newObject(public, parentQualifiedName)
+	if err != nil {
+		return 0, err
+	}
+	obj.hierarchy = tpm2.HandleNull
+	return t.addObject(obj)
 }
 
-func (t *TPM2) StartAuthSession(tpmKey, bindKey tpmutil.Handle,
-	nonceCaller, secret []byte,
-	se tpm2.SessionType,
-	sym, hashAlg tpm2.Algorithm) (tpmutil.Handle, []byte, error) {
+// addObject places an object into the first free transient slot and returns its handle
+func (t *TPM2) addObject(obj *object) (tpmutil.Handle, error) {
+	var loaded int
+	for handle := range t.objects {
+		if handle >= transientFirst && handle <= transientLast {
+			loaded++
+		}
+	}
+	if loaded >= maxLoadedObjects {
+		return 0, tpm2.Warning{Code: tpm2.RCObjectMemory}
+	}
 
-	return tpmutil.Handle(0), nil, fmt.Errorf("not implemented")
+	handle := transientFirst
+	for ; handle <= transientLast; handle++ {
+		if _, ok := t.objects[handle]; !ok {
+			break
+		}
+	}
+	t.objects[handle] = obj
+	return handle, nil
 }
 
 // TPM2 should implement `Commands` interface
@@ -0,0 +1,2985 @@
+package swtpm2_test
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/rihter007/go-swtpm/sm3"
+	"github.com/rihter007/go-swtpm/swtpm2"
+	"github.com/stretchr/testify/require"
+)
+
+// algSM3 is TPM_ALG_SM3_256 that is missing in go-tpm
+const algSM3 tpm2.Algorithm = 0x0012
+
+// launchTPM2 serves commands for a started TPM2 device until the test is finished
+func launchTPM2(t *testing.T, tpm *swtpm2.TPM2) io.ReadWriter {
+	rw := serveTPM2(t, tpm)
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	return rw
+}
+
+// startPolicySession starts an unbound and unsalted session of a given type with SHA256 and returns nonceTPM
+func startPolicySession(t *testing.T, rw io.ReadWriter, sessionType tpm2.SessionType) (tpmutil.Handle, []byte) {
+	session, nonceTPM, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, bytes.Repeat([]byte{0x5A}, 16), nil,
+		sessionType, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	return session, nonceTPM
+}
+
+// loadExternal loads a public area and an optional sensitive area with LoadExternal
+func loadExternal(t *testing.T, rw io.ReadWriter, sensitive *tpm2.Private, public tpm2.Public,
+	hierarchy tpmutil.Handle) (tpmutil.Handle, tpmutil.ResponseCode) {
+
+	var inPrivate []byte
+	if sensitive != nil {
+		var err error
+		inPrivate, err = tpmutil.Pack(*sensitive)
+		require.NoError(t, err)
+	}
+	inPublic, err := public.Encode()
+	require.NoError(t, err)
+	resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdLoadExternal, tpmutil.U16Bytes(inPrivate),
+		tpmutil.U16Bytes(inPublic), hierarchy)
+	require.NoError(t, err)
+	var handle tpmutil.Handle
+	if code == tpmutil.RCSuccess {
+		_, err = tpmutil.Unpack(resp, &handle)
+		require.NoError(t, err)
+	}
+	return handle, code
+}
+
+// serveTPM2 serves commands for a given TPM2 device until the test is finished
+func serveTPM2(t *testing.T, tpm *swtpm2.TPM2) io.ReadWriter {
+	clientIO, serverIO := connectedTransport()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		swtpm2.NewLoopProcessCommand(tpm)(serverIO)
+	}()
+
+	t.Cleanup(func() {
+		_ = clientIO.output.Close()
+		wg.Wait()
+	})
+	return clientIO
+}
+
+func TestTPM2ReadPublic(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	public := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign: &tpm2.SigScheme{
+				Alg:  tpm2.AlgECDSA,
+				Hash: tpm2.AlgSHA256,
+			},
+			CurveID: tpm2.CurveNISTP256,
+			Point: tpm2.ECPoint{
+				XRaw: make([]byte, 32),
+				YRaw: make([]byte, 32),
+			},
+		},
+	}
+	parentQualifiedName := []byte{0x40, 0x00, 0x00, 0x01}
+
+	handle, err := swtpm2.LoadObject(tpm, public, parentQualifiedName)
+	require.NoError(t, err)
+
+	actualPublic, name, qualifiedName, err := tpm2.ReadPublic(rw, handle)
+	require.NoError(t, err)
+	require.Equal(t, public, actualPublic)
+
+	matches, err := tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: name[2:]}}.MatchesPublic(public)
+	require.NoError(t, err)
+	require.True(t, matches)
+	require.Equal(t, []byte{0x00, 0x0B}, name[:2])
+
+	expectedQualifiedName := sha256.Sum256(append(parentQualifiedName, name...))
+	require.Equal(t, append([]byte{0x00, 0x0B}, expectedQualifiedName[:]...), qualifiedName)
+
+	_, _, _, err = tpm2.ReadPublic(rw, handle+1)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+
+	_, _, _, err = tpm2.ReadPublic(rw, tpmutil.Handle(0x81000001))
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+}
+
+func TestTPM2GetCapability(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	public := tpm2.Public{
+		Type:    tpm2.AlgKeyedHash,
+		NameAlg: tpm2.AlgSHA256,
+		KeyedHashParameters: &tpm2.KeyedHashParams{
+			Alg: tpm2.AlgNull,
+		},
+	}
+	var loaded []interface{}
+	for i := 0; i < 3; i++ {
+		handle, err := swtpm2.LoadObject(tpm, public, nil)
+		require.NoError(t, err)
+		loaded = append(loaded, handle)
+	}
+
+	handles, moreData, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 10, uint32(tpm2.PersistentFirst))
+	require.NoError(t, err)
+	require.False(t, moreData)
+	require.Empty(t, handles)
+
+	handles, moreData, err = tpm2.GetCapability(rw, tpm2.CapabilityHandles, 2, uint32(tpm2.TransientFirst))
+	require.NoError(t, err)
+	require.True(t, moreData)
+	require.Equal(t, loaded[:2], handles)
+
+	handles, moreData, err = tpm2.GetCapability(rw, tpm2.CapabilityHandles, 2, uint32(loaded[2].(tpmutil.Handle)))
+	require.NoError(t, err)
+	require.False(t, moreData)
+	require.Equal(t, loaded[2:], handles)
+
+	_, _, err = tpm2.GetCapability(rw, tpm2.CapabilityHandles, 1, 0x7F000000)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCHandle, Parameter: tpm2.RC2}, err)
+
+	algs, moreData, err := tpm2.GetCapability(rw, tpm2.CapabilityAlgs, 1, uint32(tpm2.AlgSHA256))
+	require.NoError(t, err)
+	require.True(t, moreData)
+	require.Len(t, algs, 1)
+	require.Equal(t, tpm2.AlgSHA256, algs[0].(tpm2.AlgorithmDescription).ID)
+
+	properties, moreData, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 2, uint32(tpm2.Manufacturer))
+	require.NoError(t, err)
+	require.True(t, moreData)
+	require.Equal(t, []interface{}{
+		tpm2.TaggedProperty{Tag: tpm2.Manufacturer, Value: 0x53575450},
+		tpm2.TaggedProperty{Tag: tpm2.VendorString1, Value: 0x676F2D73},
+	}, properties)
+
+	properties, moreData, err = tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 1000, uint32(tpm2.HRLoaded))
+	require.NoError(t, err)
+	require.False(t, moreData)
+	// TPM_PT_HR_LOADED counts sessions, the loaded objects are reported by TPM_PT_HR_TRANSIENT_AVAIL
+	require.Equal(t, tpm2.TaggedProperty{Tag: tpm2.HRLoaded, Value: 0}, properties[0])
+	require.Equal(t, tpm2.TaggedProperty{Tag: tpm2.HRTransientAvail, Value: 13}, properties[4])
+	require.Equal(t, tpm2.AuditCounter1, properties[len(properties)-1].(tpm2.TaggedProperty).Tag)
+}
+
+func TestTPM2GetCapabilityPCRProperties(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdGetCapability,
+		tpm2.CapabilityPCRProperties, uint32(swtpm2.PCRResetL4), uint32(2))
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	// moreData, capability, count and two TPMS_TAGGED_PCR_SELECT
+	require.Equal(t, []byte{
+		0x01,
+		0x00, 0x00, 0x00, 0x07,
+		0x00, 0x00, 0x00, 0x02,
+		0x00, 0x00, 0x00, 0x0A, 0x03, 0x00, 0x00, 0x7E,
+		0x00, 0x00, 0x00, 0x11, 0x03, 0x00, 0x00, 0xE1,
+	}, []byte(resp))
+}
+
+func TestTPM2CreatePrimary(t *testing.T) {
+	seed := []byte("device seed")
+	rw := launchTPM2(t, swtpm2.NewTPM2FromSeed(seed))
+	restartedRW := launchTPM2(t, swtpm2.NewTPM2FromSeed(seed))
+
+	eccTemplate := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	}
+	rsaTemplate := tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits: 2048,
+		},
+	}
+
+	for _, template := range []tpm2.Public{eccTemplate, rsaTemplate} {
+		handle, public, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+		_, restartedPublic, err := tpm2.CreatePrimary(restartedRW, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+		require.Equal(t, public, restartedPublic)
+
+		_, endorsementPublic, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+		require.NotEqual(t, public, endorsementPublic)
+
+		readPublic, _, _, err := tpm2.ReadPublic(rw, handle)
+		require.NoError(t, err)
+		readKey, err := readPublic.Key()
+		require.NoError(t, err)
+		require.Equal(t, public, readKey)
+	}
+
+	_, nullPublic, err := tpm2.CreatePrimary(rw, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", eccTemplate)
+	require.NoError(t, err)
+	_, restartedNullPublic, err := tpm2.CreatePrimary(restartedRW, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", eccTemplate)
+	require.NoError(t, err)
+	require.NotEqual(t, nullPublic, restartedNullPublic)
+
+	_, public, creationData, creationHash, ticket, name, err := tpm2.CreatePrimaryEx(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", eccTemplate)
+	require.NoError(t, err)
+	decodedPublic, err := tpm2.DecodePublic(public)
+	require.NoError(t, err)
+	matches, err := tpm2.Name{Digest: &tpm2.HashValue{Alg: tpm2.AlgSHA256, Value: name[2:]}}.MatchesPublic(decodedPublic)
+	require.NoError(t, err)
+	require.True(t, matches)
+	expectedCreationHash := sha256.Sum256(creationData)
+	require.Equal(t, expectedCreationHash[:], creationHash)
+	require.Equal(t, tpm2.HandleOwner, ticket.Hierarchy)
+	require.Len(t, ticket.Digest, sha256.Size)
+
+	_, _, err = tpm2.CreatePrimary(rw, tpm2.HandleLockout, tpm2.PCRSelection{}, "", "", eccTemplate)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCValue, Handle: tpm2.RC1}, err)
+
+	_, _, err = tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "wrong", "", eccTemplate)
+	require.Equal(t, tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}, err)
+
+	unsupportedCurve := eccTemplate
+	unsupportedCurve.ECCParameters = &tpm2.ECCParams{
+		Symmetric: eccTemplate.ECCParameters.Symmetric,
+		CurveID:   tpm2.CurveBNP256,
+	}
+	_, _, err = tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", unsupportedCurve)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCCurve, Parameter: tpm2.RC2}, err)
+}
+
+func TestTPM2CreateLoad(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	srkTemplate := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	}
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", srkTemplate)
+	require.NoError(t, err)
+	otherSRK, _, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", srkTemplate)
+	require.NoError(t, err)
+
+	templates := []tpm2.Public{
+		{
+			Type:       tpm2.AlgECC,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.FlagSignerDefault,
+			ECCParameters: &tpm2.ECCParams{
+				Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+				CurveID: tpm2.CurveNISTP384,
+			},
+		},
+		{
+			Type:       tpm2.AlgRSA,
+			NameAlg:    tpm2.AlgSHA1,
+			Attributes: tpm2.FlagStorageDefault,
+			RSAParameters: &tpm2.RSAParams{
+				Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 256, Mode: tpm2.AlgCFB},
+				KeyBits:   2048,
+			},
+		},
+	}
+	for _, template := range templates {
+		private, public, _, _, ticket, err := tpm2.CreateKey(rw, srk, tpm2.PCRSelection{}, "", "password", template)
+		require.NoError(t, err)
+		require.Equal(t, tpm2.HandleOwner, ticket.Hierarchy)
+
+		handle, name, err := tpm2.Load(rw, srk, "", public, private)
+		require.NoError(t, err)
+
+		readPublic, readName, _, err := tpm2.ReadPublic(rw, handle)
+		require.NoError(t, err)
+		// go-tpm returns the name of a loaded object together with its size
+		require.Equal(t, name[2:], readName)
+		encodedPublic, err := readPublic.Encode()
+		require.NoError(t, err)
+		require.Equal(t, public, encodedPublic)
+
+		_, _, err = tpm2.Load(rw, otherSRK, "", public, private)
+		require.Equal(t, tpm2.ParameterError{Code: tpm2.RCIntegrity, Parameter: tpm2.RC1}, err)
+
+		tampered := append([]byte{}, private...)
+		tampered[len(tampered)-1] ^= 1
+		_, _, err = tpm2.Load(rw, srk, "", public, tampered)
+		require.Equal(t, tpm2.ParameterError{Code: tpm2.RCIntegrity, Parameter: tpm2.RC1}, err)
+
+		require.NoError(t, tpm2.FlushContext(rw, handle))
+		_, _, _, err = tpm2.ReadPublic(rw, handle)
+		require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+	}
+
+	private, public, _, _, _, err := tpm2.CreateKeyWithSensitive(rw, srk, tpm2.PCRSelection{}, "", "password", tpm2.Public{
+		Type:       tpm2.AlgKeyedHash,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagFixedTPM | tpm2.FlagFixedParent | tpm2.FlagUserWithAuth,
+	}, []byte("secret"))
+	require.NoError(t, err)
+	sealed, _, err := tpm2.Load(rw, srk, "", public, private)
+	require.NoError(t, err)
+
+	_, _, _, _, _, err = tpm2.CreateKey(rw, sealed, tpm2.PCRSelection{}, "password", "", templates[0])
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCType, Handle: tpm2.RC1}, err)
+
+	require.NoError(t, tpm2.FlushContext(rw, sealed))
+	err = tpm2.FlushContext(rw, sealed)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCHandle, Parameter: tpm2.RC1}, err)
+}
+
+func TestTPM2LoadExternal(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	public := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+			Point:   tpm2.ECPoint{XRaw: priv.X.FillBytes(make([]byte, 32)), YRaw: priv.Y.FillBytes(make([]byte, 32))},
+		},
+	}
+	sensitive := &tpm2.Private{Type: tpm2.AlgECC, AuthValue: []byte("password"), Sensitive: priv.D.FillBytes(make([]byte, 32))}
+
+	// the hierarchy is the parent of an external object
+	for _, hierarchy := range []tpmutil.Handle{tpm2.HandleNull, tpm2.HandleOwner} {
+		var private *tpm2.Private
+		if hierarchy == tpm2.HandleNull {
+			private = sensitive
+		}
+		handle, code := loadExternal(t, rw, private, public, hierarchy)
+		require.Equal(t, tpmutil.RCSuccess, code)
+		_, name, qualifiedName, err := tpm2.ReadPublic(rw, handle)
+		require.NoError(t, err)
+		parentName, err := tpmutil.Pack(hierarchy)
+		require.NoError(t, err)
+		expectedQualifiedName := sha256.Sum256(append(parentName, name...))
+		require.Equal(t, append([]byte{0x00, 0x0B}, expectedQualifiedName[:]...), qualifiedName)
+		require.NoError(t, tpm2.FlushContext(rw, handle))
+	}
+
+	// a sensitive area is loaded into the null hierarchy only
+	_, code := loadExternal(t, rw, sensitive, public, tpm2.HandleOwner)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCHierarchy, Parameter: tpm2.RC3}), code)
+	_, code = loadExternal(t, rw, nil, public, tpm2.HandleLockout)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC3}), code)
+	fixed := public
+	fixed.Attributes |= tpm2.FlagFixedTPM
+	_, code = loadExternal(t, rw, sensitive, fixed, tpm2.HandleNull)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCAttributes, Parameter: tpm2.RC2}), code)
+	_, code = loadExternal(t, rw, &tpm2.Private{Type: tpm2.AlgRSA}, public, tpm2.HandleNull)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCType, Parameter: tpm2.RC2}), code)
+}
+
+func TestTPM2ObjectRoles(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	// adminPolicy allows ObjectChangeAuth only: H(0...0 || TPM_CC_PolicyCommandCode || TPM_CC_ObjectChangeAuth)
+	h := sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x6C, 0x00, 0x00, 0x01, 0x50})
+	adminPolicy := h.Sum(nil)
+	storageTemplate := func(attributes tpm2.KeyProp) tpm2.Public {
+		return tpm2.Public{
+			Type:       tpm2.AlgECC,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attributes,
+			AuthPolicy: adminPolicy,
+			ECCParameters: &tpm2.ECCParams{
+				Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+				CurveID:   tpm2.CurveNISTP256,
+			},
+		}
+	}
+	childTemplate := storageTemplate(tpm2.FlagStorageDefault)
+	childTemplate.AuthPolicy = nil
+
+	// the authValue cannot authorize the USER role without userWithAuth
+	ek, _, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "",
+		storageTemplate(tpm2.FlagStorageDefault&^tpm2.FlagUserWithAuth|tpm2.FlagAdminWithPolicy))
+	require.NoError(t, err)
+	_, _, _, _, _, err = tpm2.CreateKey(rw, ek, tpm2.PCRSelection{}, "", "", childTemplate)
+	require.Equal(t, tpm2.Error{Code: tpm2.RCAuthUnavailable}, err)
+
+	srk, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", childTemplate)
+	require.NoError(t, err)
+	private, public, _, _, _, err := tpm2.CreateKey(rw, srk, tpm2.PCRSelection{}, "", "password",
+		storageTemplate(tpm2.FlagStorageDefault|tpm2.FlagAdminWithPolicy))
+	require.NoError(t, err)
+	key, _, err := tpm2.Load(rw, srk, "", public, private)
+	require.NoError(t, err)
+	_, _, _, _, _, err = tpm2.CreateKey(rw, key, tpm2.PCRSelection{}, "password", "", childTemplate)
+	require.NoError(t, err)
+
+	objectChangeAuth := func(auth tpm2.AuthCommand, newAuth []byte) ([]byte, tpmutil.ResponseCode) {
+		authArea, err := tpmutil.Pack(auth)
+		require.NoError(t, err)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, swtpm2.CmdObjectChangeAuth, key, srk,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.U16Bytes(newAuth))
+		require.NoError(t, err)
+		if code != tpmutil.RCSuccess {
+			return nil, code
+		}
+		var parameterSize uint32
+		var outPrivate tpmutil.U16Bytes
+		_, err = tpmutil.Unpack(resp, &parameterSize, &outPrivate)
+		require.NoError(t, err)
+		return outPrivate, code
+	}
+
+	// the ADMIN role requires a policy session with adminWithPolicy
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Auth: []byte("password")}
+	_, code := objectChangeAuth(password, []byte("new password"))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCAuthUnavailable}), code)
+	session, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyCommandCode(rw, session, swtpm2.CmdObjectChangeAuth))
+	outPrivate, code := objectChangeAuth(tpm2.AuthCommand{Session: session, Nonce: bytes.Repeat([]byte{0x5A}, 16)}, []byte("new password"))
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	changed, _, err := tpm2.Load(rw, srk, "", public, outPrivate)
+	require.NoError(t, err)
+	_, _, _, _, _, err = tpm2.CreateKey(rw, changed, tpm2.PCRSelection{}, "password", "", childTemplate)
+	require.Equal(t, tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}, err)
+	_, _, _, _, _, err = tpm2.CreateKey(rw, changed, tpm2.PCRSelection{}, "new password", "", childTemplate)
+	require.NoError(t, err)
+}
+
+func TestTPM2EvictControl(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	}
+	property := func(rw io.ReadWriter, tag tpm2.TPMProp) uint32 {
+		properties, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 1, uint32(tag))
+		require.NoError(t, err)
+		require.Equal(t, tag, properties[0].(tpm2.TaggedProperty).Tag)
+		return properties[0].(tpm2.TaggedProperty).Value
+	}
+	const persistentHandle = tpmutil.Handle(0x81000001)
+
+	key, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "password", template)
+	require.NoError(t, err)
+	_, name, _, err := tpm2.ReadPublic(rw, key)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.EvictControl(rw, "", tpm2.HandleOwner, key, persistentHandle))
+	_, persistentName, _, err := tpm2.ReadPublic(rw, persistentHandle)
+	require.NoError(t, err)
+	require.Equal(t, name, persistentName)
+	handles, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 10, uint32(tpm2.PersistentFirst))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{persistentHandle}, handles)
+	require.Equal(t, uint32(1), property(rw, tpm2.CurrentPersistent))
+	require.Equal(t, uint32(7), property(rw, tpm2.AvailPersistent))
+
+	// the owner uses the lower half of persistent handles, objects of the null hierarchy are never persistent
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVDefined}, tpm2.EvictControl(rw, "", tpm2.HandleOwner, key, persistentHandle))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCRange, Parameter: tpm2.RC1},
+		tpm2.EvictControl(rw, "", tpm2.HandleOwner, key, 0x81800000))
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHierarchy, Handle: tpm2.RC2},
+		tpm2.EvictControl(rw, "", tpm2.HandlePlatform, key, 0x81800000))
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC2},
+		tpm2.EvictControl(rw, "", tpm2.HandleOwner, persistentHandle, 0x81000002))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.FlushContext(rw, persistentHandle))
+	nullKey, _, err := tpm2.CreatePrimary(rw, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", template)
+	require.NoError(t, err)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCAttributes, Handle: tpm2.RC2},
+		tpm2.EvictControl(rw, "", tpm2.HandleOwner, nullKey, 0x81000002))
+
+	for handle := persistentHandle + 1; handle < persistentHandle+8; handle++ {
+		require.NoError(t, tpm2.EvictControl(rw, "", tpm2.HandleOwner, key, handle))
+	}
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVSpace}, tpm2.EvictControl(rw, "", tpm2.HandleOwner, key, persistentHandle+8))
+	for handle := persistentHandle + 1; handle < persistentHandle+8; handle++ {
+		require.NoError(t, tpm2.EvictControl(rw, "", tpm2.HandleOwner, handle, handle))
+	}
+
+	// persistent objects survive a restart of the device without Shutdown, transient objects do not
+	state, err := tpm.MarshalState()
+	require.NoError(t, err)
+	restarted := swtpm2.NewTPM2()
+	require.NoError(t, restarted.LoadState(state))
+	rw = serveTPM2(t, restarted)
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	_, _, _, err = tpm2.ReadPublic(rw, key)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+	_, persistentName, _, err = tpm2.ReadPublic(rw, persistentHandle)
+	require.NoError(t, err)
+	require.Equal(t, name, persistentName)
+	_, _, _, _, _, err = tpm2.CreateKey(rw, persistentHandle, tpm2.PCRSelection{}, "password", "", template)
+	require.NoError(t, err)
+
+	require.NoError(t, tpm2.EvictControl(rw, "", tpm2.HandleOwner, persistentHandle, persistentHandle))
+	_, _, _, err = tpm2.ReadPublic(rw, persistentHandle)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+	require.Equal(t, uint32(0), property(rw, tpm2.CurrentPersistent))
+}
+
+func TestTPM2PCRs(t *testing.T) {
+	tpm, err := swtpm2.NewTPM2WithConfig(swtpm2.Config{PCRBanks: []tpm2.Algorithm{tpm2.AlgSHA256, algSM3, tpm2.AlgSHA1}})
+	require.NoError(t, err)
+	rw := launchTPM2(t, tpm)
+
+	pcrs, _, err := tpm2.GetCapability(rw, tpm2.CapabilityPCRs, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, pcrs, 5)
+	for i, hashAlg := range []tpm2.Algorithm{tpm2.AlgSHA1, tpm2.AlgSHA256, tpm2.AlgSHA384, tpm2.AlgSHA512, algSM3} {
+		sel := pcrs[i].(tpm2.PCRSelection)
+		require.Equal(t, hashAlg, sel.Hash)
+		if hashAlg == tpm2.AlgSHA384 || hashAlg == tpm2.AlgSHA512 {
+			require.Empty(t, sel.PCRs)
+		} else {
+			require.Len(t, sel.PCRs, 24)
+		}
+	}
+
+	value, err := tpm2.ReadPCR(rw, 0, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, sha256.Size), value)
+	value, err = tpm2.ReadPCR(rw, 17, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{0xFF}, sha256.Size), value)
+	_, err = tpm2.ReadPCR(rw, 0, tpm2.AlgSHA384)
+	require.Error(t, err)
+
+	digest := sha256.Sum256([]byte("measurement"))
+	require.NoError(t, tpm2.PCRExtend(rw, 0, tpm2.AlgSHA256, digest[:], ""))
+	expected := sha256.Sum256(append(make([]byte, sha256.Size), digest[:]...))
+	value, err = tpm2.ReadPCR(rw, 0, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, expected[:], value)
+	value, err = tpm2.ReadPCR(rw, 0, tpm2.AlgSHA1)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, sha1.Size), value)
+
+	require.NoError(t, tpm2.PCREvent(rw, 1, []byte("event")))
+	eventDigest := sha1.Sum([]byte("event"))
+	expectedSHA1 := sha1.Sum(append(make([]byte, sha1.Size), eventDigest[:]...))
+	value, err = tpm2.ReadPCR(rw, 1, tpm2.AlgSHA1)
+	require.NoError(t, err)
+	require.Equal(t, expectedSHA1[:], value)
+	smEventDigest := sm3.Sum([]byte("event"))
+	expectedSM3 := sm3.Sum(append(make([]byte, sm3.Size), smEventDigest[:]...))
+	value, err = tpm2.ReadPCR(rw, 1, algSM3)
+	require.NoError(t, err)
+	require.Equal(t, expectedSM3[:], value)
+
+	err = tpm2.PCRExtend(rw, 21, tpm2.AlgSHA256, digest[:], "")
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCLocality}, err)
+	err = tpm2.PCRReset(rw, 0)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCLocality}, err)
+	err = tpm2.PCRReset(rw, 17)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCLocality}, err)
+
+	require.NoError(t, tpm2.PCRExtend(rw, 16, tpm2.AlgSHA256, digest[:], ""))
+	require.NoError(t, tpm2.PCRReset(rw, 16))
+	value, err = tpm2.ReadPCR(rw, 16, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, sha256.Size), value)
+}
+
+func TestTPM2PCRRead(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	readPCRs := func(sel ...tpm2.PCRSelection) (uint32, []tpm2.PCRSelection, int) {
+		selection, err := swtpm2.EncodePCRSelection(sel...)
+		require.NoError(t, err)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdPCRRead, tpmutil.RawBytes(selection))
+		require.NoError(t, err)
+		require.Equal(t, tpmutil.RCSuccess, code)
+
+		buf := bytes.NewBuffer(resp)
+		var updateCounter uint32
+		require.NoError(t, tpmutil.UnpackBuf(buf, &updateCounter))
+		selectionOut, err := swtpm2.DecodePCRSelection(buf)
+		require.NoError(t, err)
+		var count uint32
+		require.NoError(t, tpmutil.UnpackBuf(buf, &count))
+		return updateCounter, selectionOut, int(count)
+	}
+
+	all := make([]int, 24)
+	for i := range all {
+		all[i] = i
+	}
+	updateCounter, selection, count := readPCRs(
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA384, PCRs: []int{0}},
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{1, 2}},
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: all},
+	)
+	require.Zero(t, updateCounter)
+	// at most 8 digests are returned, bits of PCRs that are not read are cleared
+	require.Equal(t, []tpm2.PCRSelection{
+		{Hash: tpm2.AlgSHA384},
+		{Hash: tpm2.AlgSHA1, PCRs: []int{1, 2}},
+		{Hash: tpm2.AlgSHA256, PCRs: []int{0, 1, 2, 3, 4, 5}},
+	}, selection)
+	require.Equal(t, 8, count)
+
+	digest := make([]byte, sha256.Size)
+	require.NoError(t, tpm2.PCRExtend(rw, 0, tpm2.AlgSHA256, digest, ""))
+	require.NoError(t, tpm2.PCRExtend(rw, 23, tpm2.AlgSHA256, digest, ""))
+	updateCounter, _, _ = readPCRs(tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{0}})
+	// PCR 23 does not increment the counter
+	require.Equal(t, uint32(1), updateCounter)
+}
+
+func TestTPM2CreationPCRDigest(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	digest := sha256.Sum256([]byte("measurement"))
+	require.NoError(t, tpm2.PCRExtend(rw, 7, tpm2.AlgSHA256, digest[:], ""))
+	pcr7, err := tpm2.ReadPCR(rw, 7, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	pcr8, err := tpm2.ReadPCR(rw, 8, tpm2.AlgSHA256)
+	require.NoError(t, err)
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	sel := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7, 8}}
+	_, _, encoded, _, _, _, err := tpm2.CreatePrimaryEx(rw, tpm2.HandleOwner, sel, "", "", template)
+	require.NoError(t, err)
+	creationData, err := tpm2.DecodeCreationData(encoded)
+	require.NoError(t, err)
+	require.Equal(t, sel, creationData.PCRSelection)
+	expected := sha256.Sum256(append(pcr7, pcr8...))
+	require.Equal(t, expected[:], []byte(creationData.PCRDigest))
+}
+
+func TestTPM2ExtraPCRs(t *testing.T) {
+	tpm, err := swtpm2.NewTPM2WithConfig(swtpm2.Config{PCRCount: 32})
+	require.NoError(t, err)
+	rw := launchTPM2(t, tpm)
+
+	pcrs, _, err := tpm2.GetCapability(rw, tpm2.CapabilityPCRs, 1, 0)
+	require.NoError(t, err)
+	require.Len(t, pcrs[0].(tpm2.PCRSelection).PCRs, 32)
+
+	properties, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 2, uint32(tpm2.PCRCount))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{
+		tpm2.TaggedProperty{Tag: tpm2.PCRCount, Value: 32},
+		tpm2.TaggedProperty{Tag: tpm2.PCRSelectMin, Value: 4},
+	}, properties)
+
+	handles, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 64, 0)
+	require.NoError(t, err)
+	require.Len(t, handles, 32)
+
+	digest := sha256.Sum256([]byte("measurement"))
+	require.NoError(t, tpm2.PCRExtend(rw, 31, tpm2.AlgSHA256, digest[:], ""))
+	expected := sha256.Sum256(append(make([]byte, sha256.Size), digest[:]...))
+
+	selection, err := swtpm2.EncodePCRSelectionWithSize(5, tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{31, 32}})
+	require.NoError(t, err)
+	resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdPCRRead, tpmutil.RawBytes(selection))
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	// pcrSelectionOut keeps sizeofSelect of the request, PCR 32 is not implemented
+	buf := bytes.NewBuffer(resp[4:])
+	selectionOut, sizeOfSelect, err := swtpm2.DecodePCRSelectionWithSize(buf)
+	require.NoError(t, err)
+	require.Equal(t, 5, sizeOfSelect)
+	require.Equal(t, []tpm2.PCRSelection{{Hash: tpm2.AlgSHA256, PCRs: []int{31}}}, selectionOut)
+	var count uint32
+	var value tpmutil.U16Bytes
+	require.NoError(t, tpmutil.UnpackBuf(buf, &count, &value))
+	require.Equal(t, uint32(1), count)
+	require.Equal(t, expected[:], []byte(value))
+
+	_, err = swtpm2.NewTPM2WithConfig(swtpm2.Config{PCRCount: 16})
+	require.Error(t, err)
+}
+
+func TestTPM2PCRAllocate(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	allocate := func(authHandle tpmutil.Handle, sel ...tpm2.PCRSelection) ([]byte, tpmutil.ResponseCode) {
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession})
+		require.NoError(t, err)
+		pcrAllocation, err := swtpm2.EncodePCRSelection(sel...)
+		require.NoError(t, err)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, 0x0000012B, authHandle,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.RawBytes(pcrAllocation))
+		require.NoError(t, err)
+		return resp, code
+	}
+	allocation := func() []tpm2.PCRSelection {
+		pcrs, _, err := tpm2.GetCapability(rw, tpm2.CapabilityPCRs, 1, 0)
+		require.NoError(t, err)
+		var sel []tpm2.PCRSelection
+		for _, pcr := range pcrs {
+			if s := pcr.(tpm2.PCRSelection); len(s.PCRs) > 0 {
+				sel = append(sel, s)
+			}
+		}
+		return sel
+	}
+	all := make([]int, 24)
+	for i := range all {
+		all[i] = i
+	}
+
+	resp, code := allocate(tpm2.HandlePlatform,
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA1},
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA384, PCRs: all})
+	require.Equal(t, tpmutil.RCSuccess, code)
+	// parameterSize, allocationSuccess, maxPCR, sizeNeeded, sizeAvailable
+	require.Equal(t, []byte{
+		0x00, 0x00, 0x00, 0x0D,
+		0x01,
+		0x00, 0x00, 0x00, 0x18,
+		0x00, 0x00, 0x07, 0x80,
+		0x00, 0x00, 0x0C, 0x00,
+	}, resp[:17])
+
+	// the new allocation takes effect after _TPM_Init only
+	require.Equal(t, []tpm2.PCRSelection{{Hash: tpm2.AlgSHA1, PCRs: all}, {Hash: tpm2.AlgSHA256, PCRs: all}}, allocation())
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, []tpm2.PCRSelection{{Hash: tpm2.AlgSHA256, PCRs: all}, {Hash: tpm2.AlgSHA384, PCRs: all}}, allocation())
+	_, err := tpm2.ReadPCR(rw, 0, tpm2.AlgSHA1)
+	require.Error(t, err)
+	value, err := tpm2.ReadPCR(rw, 17, tpm2.AlgSHA384)
+	require.NoError(t, err)
+	require.Equal(t, bytes.Repeat([]byte{0xFF}, 48), value)
+
+	// all banks do not fit the PCR memory
+	resp, code = allocate(tpm2.HandlePlatform,
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: all},
+		tpm2.PCRSelection{Hash: tpm2.AlgSHA512, PCRs: all},
+		tpm2.PCRSelection{Hash: algSM3, PCRs: all})
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, byte(0x00), resp[4])
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, []tpm2.PCRSelection{{Hash: tpm2.AlgSHA256, PCRs: all}, {Hash: tpm2.AlgSHA384, PCRs: all}}, allocation())
+
+	// a partial allocation of a bank
+	_, code = allocate(tpm2.HandlePlatform, tpm2.PCRSelection{Hash: tpm2.AlgSHA384, PCRs: []int{0, 1, 2}})
+	require.Equal(t, tpmutil.RCSuccess, code)
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, []tpm2.PCRSelection{{Hash: tpm2.AlgSHA256, PCRs: all}, {Hash: tpm2.AlgSHA384, PCRs: []int{0, 1, 2}}}, allocation())
+	_, err = tpm2.ReadPCR(rw, 3, tpm2.AlgSHA384)
+	require.Error(t, err)
+
+	// TPM Resume is not possible with a new allocation
+	_, code = allocate(tpm2.HandlePlatform, tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: all})
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Startup(rw, tpm2.StartupState))
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+
+	_, code = allocate(tpm2.HandlePlatform, tpm2.PCRSelection{Hash: tpm2.AlgSHA1}, tpm2.PCRSelection{Hash: tpm2.AlgSHA256}, tpm2.PCRSelection{Hash: tpm2.AlgSHA384})
+	require.Equal(t, tpmutil.ResponseCode(0x127), code)
+	_, code = allocate(tpm2.HandleOwner, tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: all})
+	require.Equal(t, swtpm2.ResponseCode(tpm2.HandleError{Code: tpm2.RCValue, Handle: tpm2.RC1}), code)
+	_, code = allocate(tpm2.HandlePlatform, tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{24}})
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}), code)
+}
+
+func TestTPM2StartupShutdown(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := serveTPM2(t, tpm)
+
+	_, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 1, 0)
+	require.Equal(t, tpm2.Error{Code: tpm2.RCInitialize}, err)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Startup(rw, tpm2.StartupState))
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCInitialize}, tpm2.Startup(rw, tpm2.StartupClear))
+
+	orderly := func() bool {
+		properties, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 1, uint32(tpm2.TPMAStartupClear))
+		require.NoError(t, err)
+		return properties[0].(tpm2.TaggedProperty).Value&(1<<31) != 0
+	}
+	readPCR := func(pcr int) []byte {
+		value, err := tpm2.ReadPCR(rw, pcr, tpm2.AlgSHA256)
+		require.NoError(t, err)
+		return value
+	}
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	nullPrimary := func() crypto.PublicKey {
+		handle, public, err := tpm2.CreatePrimary(rw, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+		require.NoError(t, tpm2.FlushContext(rw, handle))
+		return public
+	}
+	require.False(t, orderly())
+
+	digest := make([]byte, sha256.Size)
+	require.NoError(t, tpm2.PCRExtend(rw, 0, tpm2.AlgSHA256, digest, ""))
+	require.NoError(t, tpm2.PCRExtend(rw, 16, tpm2.AlgSHA256, digest, ""))
+	pcr0, pcr16 := readPCR(0), readPCR(16)
+	nullKey := nullPrimary()
+	handle, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	require.NoError(t, err)
+
+	// TPM Resume keeps PCRs with stateSave attribute
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupState))
+	require.True(t, orderly())
+	require.Equal(t, pcr0, readPCR(0))
+	require.NotEqual(t, pcr16, readPCR(16))
+	require.Equal(t, nullKey, nullPrimary())
+	_, _, _, err = tpm2.ReadPublic(rw, handle)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+
+	// TPM Restart resets PCRs but keeps the null hierarchy
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.True(t, orderly())
+	require.Equal(t, make([]byte, sha256.Size), readPCR(0))
+	require.Equal(t, nullKey, nullPrimary())
+
+	// commands after Shutdown invalidate the saved state
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	require.NoError(t, tpm2.PCRExtend(rw, 0, tpm2.AlgSHA256, digest, ""))
+	tpm.Init()
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Startup(rw, tpm2.StartupState))
+
+	// TPM Reset changes the null hierarchy
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.False(t, orderly())
+	require.NotEqual(t, nullKey, nullPrimary())
+
+	// the platform can discard the saved state
+	nullKey = nullPrimary()
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.DiscardSavedState()
+	tpm.Init()
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Startup(rw, tpm2.StartupState))
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.NotEqual(t, nullKey, nullPrimary())
+
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupClear))
+	tpm.Init()
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Startup(rw, tpm2.StartupState))
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.True(t, orderly())
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Shutdown(rw, tpm2.StartupType(2)))
+}
+
+func TestTPM2PlatformSignals(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	// the state saved by Shutdown survives a power cycle
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.PowerOff()
+	_, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 1, 0)
+	require.Equal(t, tpm2.Error{Code: tpm2.RCInitialize}, err)
+	tpm.PowerOn()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupState))
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	tpm.SetCancel(true)
+	_, _, err = tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCCanceled}, err)
+	tpm.SetCancel(false)
+	handle, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", template)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(rw, handle))
+
+	// TPM2_PCR_Allocate needs NV memory to store the new allocation
+	authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession})
+	require.NoError(t, err)
+	pcrAllocation, err := swtpm2.EncodePCRSelection(tpm2.PCRSelection{Hash: tpm2.AlgSHA1, PCRs: []int{0}})
+	require.NoError(t, err)
+	allocate := func() tpmutil.ResponseCode {
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, 0x0000012B, tpm2.HandlePlatform,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.RawBytes(pcrAllocation))
+		require.NoError(t, err)
+		return code
+	}
+	tpm.SetNVAvailable(false)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Warning{Code: tpm2.RCNVUnavailable}), allocate())
+	tpm.SetNVAvailable(true)
+	require.Equal(t, tpmutil.RCSuccess, allocate())
+}
+
+func TestTPM2HashSequence(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := serveTPM2(t, tpm)
+
+	readPCR := func(pcr int, hashAlg tpm2.Algorithm) []byte {
+		value, err := tpm2.ReadPCR(rw, pcr, hashAlg)
+		require.NoError(t, err)
+		return value
+	}
+
+	// H-CRTM before Startup measures PCR 0 reset with locality 4
+	tpm.HashStart()
+	tpm.HashData([]byte("H-CRTM"))
+	tpm.HashData([]byte(" event"))
+	tpm.HashEnd()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+
+	eventSHA1 := sha1.Sum([]byte("H-CRTM event"))
+	initialSHA1 := make([]byte, sha1.Size)
+	initialSHA1[sha1.Size-1] = 4
+	expectedSHA1 := sha1.Sum(append(initialSHA1, eventSHA1[:]...))
+	require.Equal(t, expectedSHA1[:], readPCR(0, tpm2.AlgSHA1))
+
+	eventSHA256 := sha256.Sum256([]byte("H-CRTM event"))
+	initialSHA256 := make([]byte, sha256.Size)
+	initialSHA256[sha256.Size-1] = 4
+	expectedSHA256 := sha256.Sum256(append(initialSHA256, eventSHA256[:]...))
+	require.Equal(t, expectedSHA256[:], readPCR(0, tpm2.AlgSHA256))
+
+	// TPM Resume cannot follow H-CRTM, the measurement is kept for Startup(CLEAR)
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	tpm.HashStart()
+	tpm.HashData([]byte("H-CRTM event"))
+	tpm.HashEnd()
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCLocality}, tpm2.Startup(rw, tpm2.StartupState))
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, expectedSHA256[:], readPCR(0, tpm2.AlgSHA256))
+
+	// D-RTM after Startup resets the dynamic PCRs and measures PCR 17
+	require.Equal(t, bytes.Repeat([]byte{0xFF}, sha256.Size), readPCR(17, tpm2.AlgSHA256))
+	tpm.HashStart()
+	tpm.HashData([]byte("D-RTM event"))
+	tpm.HashEnd()
+	drtmSHA256 := sha256.Sum256([]byte("D-RTM event"))
+	expectedSHA256 = sha256.Sum256(append(make([]byte, sha256.Size), drtmSHA256[:]...))
+	require.Equal(t, expectedSHA256[:], readPCR(17, tpm2.AlgSHA256))
+	require.Equal(t, make([]byte, sha256.Size), readPCR(18, tpm2.AlgSHA256))
+
+	// data and end without a started sequence are ignored
+	tpm.HashData([]byte("ignored"))
+	tpm.HashEnd()
+	require.Equal(t, expectedSHA256[:], readPCR(17, tpm2.AlgSHA256))
+
+	// without H-CRTM PCR 0 starts from zero
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, make([]byte, sha256.Size), readPCR(0, tpm2.AlgSHA256))
+}
+
+// localityTransport executes commands of a TPM2 device synchronously at a given locality
+type localityTransport struct {
+	tpm      *swtpm2.TPM2
+	locality uint8
+	response bytes.Buffer
+}
+
+func (l *localityTransport) Write(b []byte) (int, error) {
+	resp, err := swtpm2.ProcessCommandAtLocality(bytes.NewReader(b), l.locality, l.tpm)
+	if err != nil {
+		return 0, err
+	}
+	l.response.Write(resp)
+	return len(b), nil
+}
+
+func (l *localityTransport) Read(b []byte) (int, error) {
+	return l.response.Read(b)
+}
+
+func TestTPM2Locality(t *testing.T) {
+	rw := &localityTransport{tpm: swtpm2.NewTPM2()}
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+
+	digest := make([]byte, sha256.Size)
+	errLocality := tpm2.Warning{Code: tpm2.RCLocality}
+
+	require.NoError(t, tpm2.PCRReset(rw, 16))
+	require.Equal(t, errLocality, tpm2.PCRReset(rw, 17))
+	require.Equal(t, errLocality, tpm2.PCRExtend(rw, 20, tpm2.AlgSHA256, digest, ""))
+
+	rw.locality = 1
+	require.NoError(t, tpm2.PCRExtend(rw, 20, tpm2.AlgSHA256, digest, ""))
+	require.Equal(t, errLocality, tpm2.PCRReset(rw, 20))
+
+	rw.locality = 2
+	require.NoError(t, tpm2.PCRReset(rw, 20))
+
+	// the PCRs of a dynamic root of trust are reset by _TPM_Hash_Start only
+	rw.locality = 4
+	require.NoError(t, tpm2.PCRExtend(rw, 17, tpm2.AlgSHA256, digest, ""))
+	require.Equal(t, errLocality, tpm2.PCRReset(rw, 17))
+
+	// localities between 5 and 31 are not defined
+	rw.locality = 5
+	_, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 1, 0)
+	require.Equal(t, errLocality, err)
+	rw.locality = 31
+	_, _, err = tpm2.GetCapability(rw, tpm2.CapabilityHandles, 1, 0)
+	require.Equal(t, errLocality, err)
+
+	// extended localities are not present in PCR attributes
+	rw.locality = 32
+	require.Equal(t, errLocality, tpm2.PCRExtend(rw, 16, tpm2.AlgSHA256, digest, ""))
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	for locality, expected := range map[uint8]byte{0: 0x01, 3: 0x08, 4: 0x10, 32: 32, 255: 255} {
+		rw.locality = locality
+		handle, _, creationData, _, _, _, err := tpm2.CreatePrimaryEx(rw, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+		require.NoError(t, tpm2.FlushContext(rw, handle))
+		data, err := tpm2.DecodeCreationData(creationData)
+		require.NoError(t, err)
+		require.Equal(t, expected, data.Locality)
+	}
+
+	// the TPM starts at locality 0 or 3, the startup locality is recorded in PCR 0
+	rw = &localityTransport{tpm: swtpm2.NewTPM2()}
+	for _, locality := range []uint8{1, 2, 4, 32} {
+		rw.locality = locality
+		require.Equal(t, errLocality, tpm2.Startup(rw, tpm2.StartupClear))
+	}
+	rw.locality = 3
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	pcr0, err := tpm2.ReadPCR(rw, 0, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	expected := make([]byte, sha256.Size)
+	expected[sha256.Size-1] = 3
+	require.Equal(t, expected, pcr0)
+	pcr1, err := tpm2.ReadPCR(rw, 1, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, sha256.Size), pcr1)
+}
+
+func TestTPM2TPMEstablished(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	require.False(t, tpm.TPMEstablished())
+
+	tpm.HashStart()
+	tpm.HashEnd()
+	require.True(t, tpm.TPMEstablished())
+
+	// the flag survives _TPM_Init and is reset from localities 3 and 4 only
+	tpm.Init()
+	require.True(t, tpm.TPMEstablished())
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCLocality}, tpm.ResetTPMEstablished(0))
+	require.True(t, tpm.TPMEstablished())
+	require.NoError(t, tpm.ResetTPMEstablished(3))
+	require.False(t, tpm.TPMEstablished())
+}
+
+func TestTPM2State(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+		},
+	}
+	primary := func(rw io.ReadWriter, hierarchy tpmutil.Handle) crypto.PublicKey {
+		handle, public, err := tpm2.CreatePrimary(rw, hierarchy, tpm2.PCRSelection{}, "", "", template)
+		require.NoError(t, err)
+		require.NoError(t, tpm2.FlushContext(rw, handle))
+		return public
+	}
+	restart := func() (*swtpm2.TPM2, io.ReadWriter) {
+		state, err := tpm.MarshalState()
+		require.NoError(t, err)
+		restarted := swtpm2.NewTPM2()
+		require.NoError(t, restarted.LoadState(state))
+		return restarted, serveTPM2(t, restarted)
+	}
+
+	digest := make([]byte, sha256.Size)
+	require.NoError(t, tpm2.PCRExtend(rw, 0, tpm2.AlgSHA256, digest, ""))
+	pcr0, err := tpm2.ReadPCR(rw, 0, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	ek, nullKey := primary(rw, tpm2.HandleEndorsement), primary(rw, tpm2.HandleNull)
+	tpm.HashStart()
+	tpm.HashEnd()
+
+	// primary seeds, TPM established flag and the state of Shutdown(STATE) survive a restart
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	restarted, restartedRW := restart()
+	require.True(t, restarted.TPMEstablished())
+	require.NoError(t, tpm2.Startup(restartedRW, tpm2.StartupState))
+	value, err := tpm2.ReadPCR(restartedRW, 0, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, pcr0, value)
+	require.Equal(t, ek, primary(restartedRW, tpm2.HandleEndorsement))
+	require.Equal(t, nullKey, primary(restartedRW, tpm2.HandleNull))
+
+	// the state of a running TPM allows TPM Reset only
+	require.NoError(t, tpm2.PCRExtend(rw, 0, tpm2.AlgSHA256, digest, ""))
+	restarted, restartedRW = restart()
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.Startup(restartedRW, tpm2.StartupState))
+	require.NoError(t, tpm2.Startup(restartedRW, tpm2.StartupClear))
+	require.Equal(t, ek, primary(restartedRW, tpm2.HandleEndorsement))
+	require.NotEqual(t, nullKey, primary(restartedRW, tpm2.HandleNull))
+
+	state, err := tpm.MarshalState()
+	require.NoError(t, err)
+	stateCopy := func() []byte {
+		return append([]byte(nil), state...)
+	}
+	corrupted := stateCopy()
+	corrupted[len(corrupted)/2] ^= 1
+	require.True(t, errors.Is(restarted.LoadState(corrupted), swtpm2.ErrInvalidState))
+	require.True(t, errors.Is(restarted.LoadState(state[:len(state)-1]), swtpm2.ErrInvalidState))
+	require.True(t, errors.Is(restarted.LoadState(nil), swtpm2.ErrInvalidState))
+
+	resign := func(b []byte) []byte {
+		content := b[:len(b)-sha256.Size]
+		digest := sha256.Sum256(content)
+		return append(content, digest[:]...)
+	}
+	wrongVersion := stateCopy()
+	wrongVersion[7]++
+	require.True(t, errors.Is(restarted.LoadState(resign(wrongVersion)), swtpm2.ErrInvalidState))
+	wrongMagic := stateCopy()
+	wrongMagic[0] = 'X'
+	require.True(t, errors.Is(restarted.LoadState(resign(wrongMagic)), swtpm2.ErrInvalidState))
+	// every section is required, the last one is the dictionary attack state with 17 bytes of data
+	const lockoutSectionSize = 2 + 4 + 17
+	missingSection := stateCopy()[:len(state)-sha256.Size-lockoutSectionSize]
+	require.True(t, errors.Is(restarted.LoadState(resign(append(missingSection, make([]byte, sha256.Size)...))),
+		swtpm2.ErrInvalidState))
+
+	// a failed load keeps the running TPM intact, a successful load drops its sessions
+	require.Equal(t, ek, primary(restartedRW, tpm2.HandleEndorsement))
+	session, _ := startPolicySession(t, restartedRW, tpm2.SessionHMAC)
+	require.NoError(t, restarted.LoadState(state))
+	require.NoError(t, tpm2.Startup(restartedRW, tpm2.StartupClear))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCHandle, Parameter: tpm2.RC1}, tpm2.FlushContext(restartedRW, session))
+}
+
+func TestTPM2VolatileState(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	}
+	require.NoError(t, tpm2.PCRExtend(rw, 16, tpm2.AlgSHA256, make([]byte, sha256.Size), ""))
+	pcr16, err := tpm2.ReadPCR(rw, 16, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	key, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "password", template)
+	require.NoError(t, err)
+	public, name, _, err := tpm2.ReadPublic(rw, key)
+	require.NoError(t, err)
+	external, code := loadExternal(t, rw, nil, public, tpm2.HandleOwner)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	nullKey, nullPublic, err := tpm2.CreatePrimary(rw, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", template)
+	require.NoError(t, err)
+	require.NoError(t, tpm2.FlushContext(rw, nullKey))
+	session, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyPassword(rw, session))
+	policyDigest, err := tpm2.PolicyGetDigest(rw, session)
+	require.NoError(t, err)
+
+	migrate := func(tpm *swtpm2.TPM2) *swtpm2.TPM2 {
+		persistent, err := tpm.MarshalState()
+		require.NoError(t, err)
+		volatile, err := tpm.MarshalVolatileState()
+		require.NoError(t, err)
+		migrated := swtpm2.NewTPM2()
+		require.NoError(t, migrated.LoadState(persistent))
+		require.NoError(t, migrated.LoadVolatileState(volatile))
+		return migrated
+	}
+
+	// the migrated TPM keeps running with the objects, sessions and PCR values of the source
+	migratedRW := serveTPM2(t, migrate(tpm))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCInitialize}, tpm2.Startup(migratedRW, tpm2.StartupClear))
+	value, err := tpm2.ReadPCR(migratedRW, 16, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, pcr16, value)
+	_, _, _, _, _, err = tpm2.CreateKey(migratedRW, key, tpm2.PCRSelection{}, "password", "", template)
+	require.NoError(t, err)
+	_, externalName, _, err := tpm2.ReadPublic(migratedRW, external)
+	require.NoError(t, err)
+	require.Equal(t, name, externalName)
+	_, migratedNullPublic, err := tpm2.CreatePrimary(migratedRW, tpm2.HandleNull, tpm2.PCRSelection{}, "", "", template)
+	require.NoError(t, err)
+	require.Equal(t, nullPublic, migratedNullPublic)
+	migratedDigest, err := tpm2.PolicyGetDigest(migratedRW, session)
+	require.NoError(t, err)
+	require.Equal(t, policyDigest, migratedDigest)
+
+	// a TPM waiting for Startup stays so
+	tpm.Init()
+	migratedRW = serveTPM2(t, migrate(tpm))
+	require.NoError(t, tpm2.Startup(migratedRW, tpm2.StartupClear))
+
+	volatile, err := tpm.MarshalVolatileState()
+	require.NoError(t, err)
+	persistent, err := tpm.MarshalState()
+	require.NoError(t, err)
+	require.True(t, errors.Is(tpm.LoadVolatileState(persistent), swtpm2.ErrInvalidState))
+	require.True(t, errors.Is(tpm.LoadState(volatile), swtpm2.ErrInvalidState))
+	volatile[len(volatile)/2] ^= 1
+	require.True(t, errors.Is(tpm.LoadVolatileState(volatile), swtpm2.ErrInvalidState))
+}
+
+func TestTPM2NV(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	const index = tpmutil.Handle(0x01500000)
+	define := func(authHandle tpmutil.Handle, handle tpmutil.Handle, attributes tpm2.NVAttr, dataSize uint16) error {
+		return tpm2.NVDefineSpaceEx(rw, authHandle, "index auth", tpm2.NVPublic{
+			NVIndex:    handle,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attributes,
+			DataSize:   dataSize,
+		}, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession})
+	}
+	read := func(authHandle tpmutil.Handle, auth string, size, offset uint16) ([]byte, tpmutil.ResponseCode) {
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession, Auth: []byte(auth)})
+		require.NoError(t, err)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdReadNV, authHandle, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), size, offset)
+		require.NoError(t, err)
+		if code != tpmutil.RCSuccess {
+			return nil, code
+		}
+		var parameterSize uint32
+		var data tpmutil.U16Bytes
+		_, err = tpmutil.Unpack(resp, &parameterSize, &data)
+		require.NoError(t, err)
+		return data, code
+	}
+
+	attributes := tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrAuthWrite | tpm2.AttrAuthRead | tpm2.AttrNoDA
+	require.NoError(t, define(tpm2.HandleOwner, index, attributes, 16))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVDefined}, define(tpm2.HandleOwner, index, attributes, 16))
+
+	_, code := read(tpm2.HandleOwner, "", 16, 0)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCNVUninitialized}), code)
+	require.NoError(t, tpm2.NVWrite(rw, index, index, "index auth", []byte{1, 2, 3, 4}, 4))
+	data, code := read(index, "index auth", 16, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	expected := append(append(bytes.Repeat([]byte{0xFF}, 4), 1, 2, 3, 4), bytes.Repeat([]byte{0xFF}, 8)...)
+	require.Equal(t, expected, data)
+	data, code = read(tpm2.HandleOwner, "", 2, 5)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, []byte{2, 3}, data)
+
+	_, code = read(tpm2.HandleOwner, "", 2, 15)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCNVRange}), code)
+	_, code = read(tpm2.HandlePlatform, "", 16, 0)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCNVAuthorization}), code)
+	_, code = read(index, "wrong", 16, 0)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}), code)
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVRange}, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", make([]byte, 17), 0))
+
+	// the Name reflects TPMA_NV_WRITTEN
+	public, err := tpm2.NVReadPublic(rw, index)
+	require.NoError(t, err)
+	require.Equal(t, attributes|tpm2.AttrWritten, public.Attributes)
+	resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdReadPublicNV, index)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	var nvPublic, name tpmutil.U16Bytes
+	_, err = tpmutil.Unpack(resp, &nvPublic, &name)
+	require.NoError(t, err)
+	nameDigest := sha256.Sum256(nvPublic)
+	require.Equal(t, append([]byte{0x00, 0x0B}, nameDigest[:]...), []byte(name))
+
+	handles, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 10, 0x01000000)
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{index}, handles)
+
+	// the authValue of the index is available for the operations allowed by TPMA_NV_AUTHREAD and TPMA_NV_AUTHWRITE
+	const ownerIndex = index + 1
+	require.NoError(t, define(tpm2.HandleOwner, ownerIndex, tpm2.AttrOwnerWrite|tpm2.AttrOwnerRead|tpm2.AttrWriteAll, 4))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCAuthUnavailable}, tpm2.NVWrite(rw, ownerIndex, ownerIndex, "index auth", []byte{1, 2, 3, 4}, 0))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVRange}, tpm2.NVWrite(rw, tpm2.HandleOwner, ownerIndex, "", []byte{1, 2}, 0))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, ownerIndex, "", []byte{1, 2, 3, 4}, 0))
+
+	// counters are not written with NV_Write
+	const counter = index + 2
+	require.NoError(t, define(tpm2.HandleOwner, counter, attributes|tpm2.NVAttr(1<<4), 8))
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCAttributes, Handle: tpm2.RC2}, tpm2.NVWrite(rw, tpm2.HandleOwner, counter, "", make([]byte, 8), 0))
+
+	// inconsistent attributes
+	publicInfo := tpm2.ParameterError{Code: tpm2.RCAttributes, Parameter: tpm2.RC2}
+	require.Equal(t, publicInfo, define(tpm2.HandleOwner, index+3, tpm2.AttrOwnerWrite, 4))
+	require.Equal(t, publicInfo, define(tpm2.HandleOwner, index+3, attributes|tpm2.AttrWritten, 4))
+	require.Equal(t, publicInfo, define(tpm2.HandleOwner, index+3, attributes|tpm2.AttrPlatformCreate, 4))
+	require.Equal(t, publicInfo, define(tpm2.HandlePlatform, index+3, attributes, 4))
+	require.Equal(t, publicInfo, define(tpm2.HandleOwner, index+3, attributes|tpm2.NVAttr(1<<4)|tpm2.AttrClearSTClear, 8))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCSize, Parameter: tpm2.RC2}, define(tpm2.HandleOwner, index+3, attributes|tpm2.NVAttr(1<<4), 4))
+
+	// TPMA_NV_CLEAR_STCLEAR clears TPMA_NV_WRITTEN on TPM Reset and TPM Restart but not on TPM Resume
+	const stClearIndex = index + 4
+	require.NoError(t, define(tpm2.HandleOwner, stClearIndex, attributes|tpm2.AttrClearSTClear, 4))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, stClearIndex, "", []byte{1, 2, 3, 4}, 0))
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupState))
+	public, err = tpm2.NVReadPublic(rw, stClearIndex)
+	require.NoError(t, err)
+	require.NotZero(t, public.Attributes&tpm2.AttrWritten)
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	public, err = tpm2.NVReadPublic(rw, stClearIndex)
+	require.NoError(t, err)
+	require.Zero(t, public.Attributes&tpm2.AttrWritten)
+
+	// NV indices survive a restart of the device
+	state, err := tpm.MarshalState()
+	require.NoError(t, err)
+	restarted := swtpm2.NewTPM2()
+	require.NoError(t, restarted.LoadState(state))
+	restartedRW := launchTPM2(t, restarted)
+	restoredData, err := tpm2.NVReadEx(restartedRW, index, index, "index auth", 0)
+	require.NoError(t, err)
+	require.Equal(t, expected, restoredData)
+
+	// platform indices are removed with platform authorization, TPMA_NV_POLICY_DELETE requires NV_UndefineSpaceSpecial
+	const platformIndex = index + 5
+	require.NoError(t, define(tpm2.HandlePlatform, platformIndex, attributes|tpm2.AttrPlatformCreate|tpm2.AttrPolicyDelete, 4))
+	require.NoError(t, define(tpm2.HandlePlatform, platformIndex+1, attributes|tpm2.AttrPlatformCreate, 4))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVAuthorization}, tpm2.NVUndefineSpace(rw, "", tpm2.HandleOwner, platformIndex+1))
+	require.NoError(t, tpm2.NVUndefineSpace(rw, "", tpm2.HandlePlatform, platformIndex+1))
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCAttributes, Handle: tpm2.RC2}, tpm2.NVUndefineSpace(rw, "", tpm2.HandlePlatform, platformIndex))
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	require.Equal(t, tpm2.Error{Code: tpm2.RCAuthUnavailable}, tpm2.NVUndefineSpaceSpecial(rw, platformIndex, password, password))
+
+	require.NoError(t, tpm2.NVUndefineSpace(rw, "", tpm2.HandleOwner, index))
+	_, err = tpm2.NVReadPublic(rw, index)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCHandle, Handle: tpm2.RC1}, err)
+}
+
+func TestTPM2NVPin(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	const pinPass = tpmutil.Handle(0x01500010)
+	const pinFail = pinPass + 1
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	pinAttributes := tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrAuthRead | tpm2.AttrNoDA
+	for _, pin := range []struct {
+		handle tpmutil.Handle
+		nvType tpm2.NVAttr
+	}{{pinPass, 9 << 4}, {pinFail, 8 << 4}} {
+		require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "pin", tpm2.NVPublic{
+			NVIndex:    pin.handle,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: pinAttributes | pin.nvType,
+			DataSize:   8,
+		}, password))
+		// pinCount = 0, pinLimit = 2
+		require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, pin.handle, "", []byte{0, 0, 0, 0, 0, 0, 0, 2}, 0))
+	}
+
+	// PIN Pass index counts successful authorizations
+	for i := 0; i < 2; i++ {
+		_, err := tpm2.NVReadEx(rw, pinPass, pinPass, "pin", 0)
+		require.NoError(t, err)
+	}
+	_, err := tpm2.NVReadEx(rw, pinPass, pinPass, "pin", 0)
+	require.Error(t, err)
+	data, err := tpm2.NVReadEx(rw, pinPass, tpm2.HandleOwner, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 2}, data)
+
+	// PIN Fail index counts failed authorizations
+	for i := 0; i < 2; i++ {
+		_, err := tpm2.NVReadEx(rw, pinFail, pinFail, "wrong", 0)
+		require.Error(t, err)
+	}
+	_, err = tpm2.NVReadEx(rw, pinFail, pinFail, "pin", 0)
+	require.Error(t, err)
+	data, err = tpm2.NVReadEx(rw, pinFail, tpm2.HandleOwner, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 0, 2, 0, 0, 0, 2}, data)
+
+	// PIN indices cannot be reset by the owner of their authValue
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCAttributes, Parameter: tpm2.RC2}, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "pin", tpm2.NVPublic{
+		NVIndex:    pinFail + 1,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: pinAttributes | tpm2.AttrAuthWrite | 9<<4,
+		DataSize:   8,
+	}, password))
+}
+
+func TestTPM2NVCounters(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	const counter = tpmutil.Handle(0x01500020)
+	const orderlyCounter = counter + 1
+	const bits = counter + 2
+	const extend = counter + 3
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	attributes := tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrNoDA
+	define := func(handle tpmutil.Handle, attributes tpm2.NVAttr, dataSize uint16) {
+		require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+			NVIndex:    handle,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attributes,
+			DataSize:   dataSize,
+		}, password))
+	}
+	value := func(handle tpmutil.Handle) uint64 {
+		data, err := tpm2.NVReadEx(rw, handle, tpm2.HandleOwner, "", 0)
+		require.NoError(t, err)
+		var v uint64
+		_, err = tpmutil.Unpack(data, &v)
+		require.NoError(t, err)
+		return v
+	}
+	nvCommand := func(cc tpmutil.Command, handle tpmutil.Handle, params ...interface{}) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(password)
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, cc,
+			append([]interface{}{tpm2.HandleOwner, handle, uint32(len(authArea)), tpmutil.RawBytes(authArea)}, params...)...)
+		require.NoError(t, err)
+		return code
+	}
+
+	define(counter, attributes|1<<4, 8)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, tpmutil.RCSuccess, nvCommand(tpm2.CmdIncrementNVCounter, counter))
+	}
+	require.Equal(t, uint64(3), value(counter))
+
+	// a new counter starts from the largest value of the counters
+	define(orderlyCounter, attributes|tpm2.AttrOrderly|1<<4, 8)
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(tpm2.CmdIncrementNVCounter, orderlyCounter))
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(tpm2.CmdIncrementNVCounter, orderlyCounter))
+	require.Equal(t, uint64(5), value(orderlyCounter))
+
+	// an orderly counter keeps its value in RAM over an orderly shutdown
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupClear))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, uint64(5), value(orderlyCounter))
+
+	// after an unorderly shutdown an orderly counter continues from the high-water mark
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(tpm2.CmdIncrementNVCounter, orderlyCounter))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.Equal(t, uint64(5+256), value(orderlyCounter))
+	require.Equal(t, uint64(3), value(counter))
+
+	// the value of an undefined counter is not reused
+	require.NoError(t, tpm2.NVUndefineSpace(rw, "", tpm2.HandleOwner, orderlyCounter))
+	define(orderlyCounter, attributes|1<<4, 8)
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(tpm2.CmdIncrementNVCounter, orderlyCounter))
+	require.Equal(t, uint64(5+256+1), value(orderlyCounter))
+
+	// bit fields are ORed
+	define(bits, attributes|2<<4, 8)
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(swtpm2.CmdNVSetBits, bits, uint64(1)))
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(swtpm2.CmdNVSetBits, bits, uint64(4)))
+	require.Equal(t, uint64(5), value(bits))
+
+	// extend indices are extended like PCRs
+	define(extend, attributes|4<<4, sha256.Size)
+	require.Equal(t, tpmutil.RCSuccess, nvCommand(swtpm2.CmdNVExtend, extend, tpmutil.U16Bytes("event")))
+	data, err := tpm2.NVReadEx(rw, extend, tpm2.HandleOwner, "", 0)
+	require.NoError(t, err)
+	expected := sha256.Sum256(append(make([]byte, sha256.Size), "event"...))
+	require.Equal(t, expected[:], data)
+
+	// every command accepts its own type of index only
+	wrongType := swtpm2.ResponseCode(tpm2.HandleError{Code: tpm2.RCAttributes, Handle: tpm2.RC2})
+	require.Equal(t, wrongType, nvCommand(tpm2.CmdIncrementNVCounter, bits))
+	require.Equal(t, wrongType, nvCommand(swtpm2.CmdNVSetBits, counter, uint64(1)))
+	require.Equal(t, wrongType, nvCommand(swtpm2.CmdNVExtend, bits, tpmutil.U16Bytes("event")))
+
+	// counters survive a restart of the device
+	state, err := tpm.MarshalState()
+	require.NoError(t, err)
+	restarted := swtpm2.NewTPM2()
+	require.NoError(t, restarted.LoadState(state))
+	rw = launchTPM2(t, restarted)
+	require.Equal(t, uint64(5+256+1), value(orderlyCounter))
+	require.Equal(t, uint64(5), value(bits))
+}
+
+func TestTPM2NVLocks(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	const stClear = tpmutil.Handle(0x01500030)
+	const writeDefine = stClear + 1
+	const global = stClear + 2
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	attributes := tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrNoDA
+	for handle, lock := range map[tpmutil.Handle]tpm2.NVAttr{
+		stClear:     tpm2.AttrWriteSTClear | tpm2.AttrReadSTClear,
+		writeDefine: tpm2.AttrWriteDefine,
+		global:      tpm2.AttrGlobalLock,
+	} {
+		require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+			NVIndex:    handle,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: attributes | lock,
+			DataSize:   4,
+		}, password))
+		require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, handle, "", []byte{1, 2, 3, 4}, 0))
+	}
+	locked := tpm2.Error{Code: tpm2.RCNVLocked}
+	write := func(handle tpmutil.Handle) error {
+		return tpm2.NVWrite(rw, tpm2.HandleOwner, handle, "", []byte{1, 2, 3, 4}, 0)
+	}
+
+	require.NoError(t, tpm2.NVWriteLock(rw, tpm2.HandleOwner, stClear, ""))
+	require.NoError(t, tpm2.NVWriteLock(rw, tpm2.HandleOwner, stClear, ""))
+	require.Equal(t, locked, write(stClear))
+	require.NoError(t, tpm2.NVReadLock(rw, tpm2.HandleOwner, stClear, ""))
+	_, err := tpm2.NVReadEx(rw, stClear, tpm2.HandleOwner, "", 0)
+	require.Error(t, err)
+	require.NoError(t, tpm2.NVWriteLock(rw, tpm2.HandleOwner, writeDefine, ""))
+	require.Equal(t, locked, write(writeDefine))
+
+	// an index is locked only when its attributes allow it
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCAttributes, Handle: tpm2.RC2}, tpm2.NVWriteLock(rw, tpm2.HandleOwner, global, ""))
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCAttributes, Handle: tpm2.RC2}, tpm2.NVReadLock(rw, tpm2.HandleOwner, global, ""))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCNVAuthorization}, tpm2.NVWriteLock(rw, tpm2.HandlePlatform, stClear, ""))
+
+	authArea, err := tpmutil.Pack(password)
+	require.NoError(t, err)
+	_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, swtpm2.CmdNVGlobalWriteLock, tpm2.HandleOwner,
+		uint32(len(authArea)), tpmutil.RawBytes(authArea))
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, locked, write(global))
+
+	// the authValue of an index is changed in the ADMIN role that is not available for a password
+	_, code, err = tpmutil.RunCommand(rw, tpm2.TagSessions, swtpm2.CmdNVChangeAuth, stClear,
+		uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.U16Bytes("new auth"))
+	require.NoError(t, err)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCAuthUnavailable}), code)
+
+	// TPM Resume keeps the locks, TPM Restart clears all locks except TPMA_NV_WRITEDEFINE
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupState))
+	require.Equal(t, locked, write(stClear))
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupState))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.NoError(t, write(stClear))
+	require.NoError(t, write(global))
+	_, err = tpm2.NVReadEx(rw, stClear, tpm2.HandleOwner, "", 0)
+	require.NoError(t, err)
+	require.Equal(t, locked, write(writeDefine))
+}
+
+func TestTPM2NVCertify(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	const index = tpmutil.Handle(0x01500040)
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrOwnerWrite | tpm2.AttrOwnerRead | tpm2.AttrNoDA,
+		DataSize:   8,
+	}, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", []byte("contents"), 0))
+	nvPublic, err := tpm2.NVReadPublic(rw, index)
+	require.NoError(t, err)
+	nvName, err := tpmutil.Pack(nvPublic)
+	require.NoError(t, err)
+	nvDigest := sha256.Sum256(nvName)
+
+	signer, signerPublic, err := tpm2.CreatePrimary(rw, tpm2.HandleEndorsement, tpm2.PCRSelection{}, "", "", tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSignerDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgRSASSA, Hash: tpm2.AlgSHA256},
+			KeyBits: 2048,
+		},
+	})
+	require.NoError(t, err)
+
+	certify := func(signHandle tpmutil.Handle, scheme []tpm2.Algorithm, size, offset uint16) ([]byte, []byte, tpmutil.ResponseCode) {
+		inScheme, err := tpmutil.Pack(scheme)
+		require.NoError(t, err)
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession})
+		require.NoError(t, err)
+		authArea = append(authArea, authArea...)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, swtpm2.CmdNVCertify, signHandle, tpm2.HandleOwner, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.U16Bytes("nonce"), tpmutil.RawBytes(inScheme), size, offset)
+		require.NoError(t, err)
+		if code != tpmutil.RCSuccess {
+			return nil, nil, code
+		}
+		var parameterSize uint32
+		var attest tpmutil.U16Bytes
+		n, err := tpmutil.Unpack(resp, &parameterSize, &attest)
+		require.NoError(t, err)
+		return attest, resp[n : 4+parameterSize], code
+	}
+
+	attest, signature, code := certify(signer, []tpm2.Algorithm{tpm2.AlgNull}, 4, 2)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	var magic uint32
+	var attestType tpmutil.Tag
+	var qualifiedSigner, extraData, name, contents tpmutil.U16Bytes
+	var clockInfo tpm2.ClockInfo
+	var firmwareVersion uint64
+	var offset uint16
+	_, err = tpmutil.Unpack(attest, &magic, &attestType, &qualifiedSigner, &extraData, &clockInfo, &firmwareVersion,
+		&name, &offset, &contents)
+	require.NoError(t, err)
+	require.Equal(t, uint32(0xFF544347), magic)
+	require.Equal(t, tpmutil.Tag(0x8014), attestType)
+	require.Equal(t, []byte("nonce"), []byte(extraData))
+	require.Equal(t, uint32(1), clockInfo.ResetCount)
+	require.Equal(t, append([]byte{0x00, 0x0B}, nvDigest[:]...), []byte(name))
+	require.Equal(t, uint16(2), offset)
+	require.Equal(t, []byte("nten"), []byte(contents))
+
+	sig, err := tpm2.DecodeSignature(bytes.NewBuffer(signature))
+	require.NoError(t, err)
+	require.Equal(t, tpm2.AlgRSASSA, sig.Alg)
+	attestDigest := sha256.Sum256(attest)
+	require.NoError(t, rsa.VerifyPKCS1v15(signerPublic.(*rsa.PublicKey), crypto.SHA256, attestDigest[:], sig.RSA.Signature))
+
+	// the attestation is not signed without a key
+	attest, signature, code = certify(tpm2.HandleNull, []tpm2.Algorithm{tpm2.AlgNull}, 8, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.NotEmpty(t, attest)
+	require.Equal(t, []byte{0x00, 0x10}, signature)
+
+	// the scheme of the key cannot be changed
+	_, _, code = certify(signer, []tpm2.Algorithm{tpm2.AlgRSAPSS, tpm2.AlgSHA256}, 8, 0)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCScheme, Parameter: tpm2.RC2}), code)
+	_, signature, code = certify(signer, []tpm2.Algorithm{tpm2.AlgRSASSA, tpm2.AlgSHA256}, 8, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, []byte{0x00, 0x14}, signature[:2])
+	_, _, code = certify(signer, []tpm2.Algorithm{tpm2.AlgNull}, 4, 6)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCNVRange}), code)
+}
+
+// sessionHMAC computes the HMAC of an authorization with a SHA-256 session
+func sessionHMAC(key, pHash, nonceNewer, nonceOlder []byte, attributes tpm2.SessionAttributes) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(pHash)
+	mac.Write(nonceNewer)
+	mac.Write(nonceOlder)
+	mac.Write([]byte{byte(attributes)})
+	return mac.Sum(nil)
+}
+
+func TestTPM2Sessions(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	hmacSession, nonceTPM, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonceCaller, nil,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.Handle(0x02000000), hmacSession)
+	require.Len(t, nonceTPM, 32)
+	policySession, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonceCaller, nil,
+		tpm2.SessionPolicy, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.Handle(0x03000001), policySession)
+	trialSession, _, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonceCaller, nil,
+		tpm2.SessionTrial, tpm2.AlgNull, tpm2.AlgSHA1)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.Handle(0x03000002), trialSession)
+
+	_, _, err = tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonceCaller, nil,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.Equal(t, tpm2.Warning{Code: tpm2.RCSessionMemory}, err)
+	handles, _, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 10, uint32(tpm2.HMACSessionFirst))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{hmacSession, policySession, trialSession}, handles)
+	handles, moreData, err := tpm2.GetCapability(rw, tpm2.CapabilityHandles, 1, uint32(tpm2.HMACSessionFirst)+1)
+	require.NoError(t, err)
+	require.True(t, moreData)
+	require.Equal(t, []interface{}{policySession}, handles)
+	// contexts of sessions cannot be saved
+	handles, _, err = tpm2.GetCapability(rw, tpm2.CapabilityHandles, 10, uint32(tpm2.PolicySessionFirst))
+	require.NoError(t, err)
+	require.Empty(t, handles)
+	properties, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 4, uint32(tpm2.HRLoaded))
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{
+		tpm2.TaggedProperty{Tag: tpm2.HRLoaded, Value: 3},
+		tpm2.TaggedProperty{Tag: tpm2.HRLoadedAvail, Value: 0},
+		tpm2.TaggedProperty{Tag: tpm2.HRActive, Value: 3},
+		tpm2.TaggedProperty{Tag: tpm2.HRActiveAvail, Value: 0},
+	}, properties)
+
+	require.NoError(t, tpm2.FlushContext(rw, trialSession))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCHandle, Parameter: tpm2.RC1}, tpm2.FlushContext(rw, trialSession))
+	_, _, err = tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonceCaller[:15], nil,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCSize, Parameter: tpm2.RC1}, err)
+
+	// go-tpm sends only the algorithm of TPMT_SYM_DEF
+	startAuthSession := func(symmetric ...interface{}) tpmutil.ResponseCode {
+		parameters := append([]interface{}{tpm2.HandleNull, tpm2.HandleNull, tpmutil.U16Bytes(nonceCaller), tpmutil.U16Bytes(nil),
+			tpm2.SessionHMAC}, symmetric...)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdStartAuthSession, append(parameters, tpm2.AlgSHA256)...)
+		require.NoError(t, err)
+		return code
+	}
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCSymmetric, Parameter: tpm2.RC4}),
+		startAuthSession(tpm2.AlgAES, uint16(128), tpm2.AlgOFB))
+	require.Equal(t, tpmutil.RCSuccess, startAuthSession(tpm2.AlgAES, uint16(128), tpm2.AlgCFB))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Warning{Code: tpm2.RCSessionMemory}), startAuthSession(tpm2.AlgXOR, tpm2.AlgSHA256))
+}
+
+func TestTPM2SessionAuthorization(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	const index = tpmutil.Handle(0x01500050)
+	authValue := []byte("secret")
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, string(authValue), tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrAuthRead | tpm2.AttrAuthWrite | tpm2.AttrNoDA,
+		DataSize:   8,
+	}, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}))
+	require.NoError(t, tpm2.NVWrite(rw, index, index, string(authValue), []byte("contents"), 0))
+	nvPublic, err := tpm2.NVReadPublic(rw, index)
+	require.NoError(t, err)
+	public, err := tpmutil.Pack(nvPublic)
+	require.NoError(t, err)
+	digest := sha256.Sum256(public)
+	name := append([]byte{0x00, 0x0B}, digest[:]...)
+
+	// nvRead reads the index with a session and returns the response code, the nonce of the response and its HMAC
+	nvRead := func(session tpmutil.Handle, key, nonceCaller, nonceTPM []byte, attributes tpm2.SessionAttributes) (tpmutil.ResponseCode, []byte) {
+		h := sha256.New()
+		h.Write([]byte{0x00, 0x00, 0x01, 0x4E})
+		h.Write(name)
+		h.Write(name)
+		h.Write([]byte{0x00, 0x08, 0x00, 0x00})
+		auth := tpm2.AuthCommand{
+			Session:    session,
+			Nonce:      nonceCaller,
+			Attributes: attributes,
+			Auth:       sessionHMAC(key, h.Sum(nil), nonceCaller, nonceTPM, attributes),
+		}
+		authArea, err := tpmutil.Pack(auth)
+		require.NoError(t, err)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdReadNV, index, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), uint16(8), uint16(0))
+		require.NoError(t, err)
+		if code != tpmutil.RCSuccess {
+			return code, nil
+		}
+
+		var parameterSize uint32
+		var data, nonce, hmac tpmutil.U16Bytes
+		var responseAttributes tpm2.SessionAttributes
+		_, err = tpmutil.Unpack(resp, &parameterSize, &data, &nonce, &responseAttributes, &hmac)
+		require.NoError(t, err)
+		require.Equal(t, []byte("contents"), []byte(data))
+		h = sha256.New()
+		h.Write([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x01, 0x4E})
+		h.Write(resp[4 : 4+parameterSize])
+		require.Equal(t, sessionHMAC(key, h.Sum(nil), nonce, nonceCaller, attributes), []byte(hmac))
+		return code, nonce
+	}
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	session, nonceTPM, err := tpm2.StartAuthSession(rw, tpm2.HandleNull, tpm2.HandleNull, nonceCaller, nil,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	code, _ := nvRead(session, []byte("wrong"), nonceCaller, nonceTPM, tpm2.AttrContinueSession)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}), code)
+	code, newNonceTPM := nvRead(session, authValue, nonceCaller, nonceTPM, tpm2.AttrContinueSession)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	// nonceTPM rolls with every command
+	code, _ = nvRead(session, authValue, nonceCaller, nonceTPM, tpm2.AttrContinueSession)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}), code)
+	code, newNonceTPM = nvRead(session, authValue, nonceCaller, newNonceTPM, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	code, _ = nvRead(session, authValue, nonceCaller, newNonceTPM, 0)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Warning{Code: tpm2.RCReferenceS0}), code)
+
+	// the authValue of the bind entity is a part of the session key
+	session, nonceTPM, err = tpm2.StartAuthSession(rw, tpm2.HandleNull, index, nonceCaller, nil,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	sessionKey, err := tpm2.KDFa(tpm2.AlgSHA256, authValue, "ATH", nonceTPM, nonceCaller, 256)
+	require.NoError(t, err)
+	code, _ = nvRead(session, sessionKey, nonceCaller, nonceTPM, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	// the salt is encrypted with RSA-OAEP
+	rsaKey, rsaPublic, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", tpm2.Public{
+		Type:       tpm2.AlgRSA,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		RSAParameters: &tpm2.RSAParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			KeyBits:   2048,
+		},
+	})
+	require.NoError(t, err)
+	salt := bytes.Repeat([]byte{0x33}, 32)
+	encryptedSalt, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, rsaPublic.(*rsa.PublicKey), salt, []byte("SECRET\x00"))
+	require.NoError(t, err)
+	session, nonceTPM, err = tpm2.StartAuthSession(rw, rsaKey, tpm2.HandleNull, nonceCaller, encryptedSalt,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	sessionKey, err = tpm2.KDFa(tpm2.AlgSHA256, salt, "ATH", nonceTPM, nonceCaller, 256)
+	require.NoError(t, err)
+	code, _ = nvRead(session, append(sessionKey, authValue...), nonceCaller, nonceTPM, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	// the salt of an ECC key is derived from the shared secret of ECDH
+	eccKey, eccPublic, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "", tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	})
+	require.NoError(t, err)
+	ephemeral, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	point, err := tpmutil.Pack(tpmutil.U16Bytes(ephemeral.X.FillBytes(make([]byte, 32))),
+		tpmutil.U16Bytes(ephemeral.Y.FillBytes(make([]byte, 32))))
+	require.NoError(t, err)
+	eccPub := eccPublic.(*ecdsa.PublicKey)
+	z, _ := elliptic.P256().ScalarMult(eccPub.X, eccPub.Y, ephemeral.D.Bytes())
+	salt, err = tpm2.KDFe(tpm2.AlgSHA256, z.FillBytes(make([]byte, 32)), "SECRET",
+		ephemeral.X.FillBytes(make([]byte, 32)), eccPub.X.FillBytes(make([]byte, 32)), 256)
+	require.NoError(t, err)
+	session, nonceTPM, err = tpm2.StartAuthSession(rw, eccKey, tpm2.HandleNull, nonceCaller, point,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.NoError(t, err)
+	sessionKey, err = tpm2.KDFa(tpm2.AlgSHA256, salt, "ATH", nonceTPM, nonceCaller, 256)
+	require.NoError(t, err)
+	code, _ = nvRead(session, append(sessionKey, authValue...), nonceCaller, nonceTPM, 0)
+	require.Equal(t, tpmutil.RCSuccess, code)
+
+	// the point must be on the curve of the key
+	point[len(point)-1] ^= 1
+	_, _, err = tpm2.StartAuthSession(rw, eccKey, tpm2.HandleNull, nonceCaller, point,
+		tpm2.SessionHMAC, tpm2.AlgNull, tpm2.AlgSHA256)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCECCPoint, Parameter: tpm2.RC2}, err)
+}
+
+func TestTPM2DictionaryAttack(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	template := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagStorageDefault,
+		ECCParameters: &tpm2.ECCParams{
+			Symmetric: &tpm2.SymScheme{Alg: tpm2.AlgAES, KeyBits: 128, Mode: tpm2.AlgCFB},
+			CurveID:   tpm2.CurveNISTP256,
+		},
+	}
+	noDATemplate := template
+	noDATemplate.Attributes |= tpm2.FlagNoDA
+	property := func(rw io.ReadWriter, tag tpm2.TPMProp) uint32 {
+		properties, _, err := tpm2.GetCapability(rw, tpm2.CapabilityTPMProperties, 1, uint32(tag))
+		require.NoError(t, err)
+		require.Equal(t, tag, properties[0].(tpm2.TaggedProperty).Tag)
+		return properties[0].(tpm2.TaggedProperty).Value
+	}
+	lockoutAuth := func(password string) tpm2.AuthCommand {
+		return tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession, Auth: []byte(password)}
+	}
+	// creating a child authorizes the USER role of the parent with its authValue
+	create := func(rw io.ReadWriter, parent tpmutil.Handle, password string) error {
+		_, _, _, _, _, err := tpm2.CreateKey(rw, parent, tpm2.PCRSelection{}, password, "", template)
+		return err
+	}
+	authFail := tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}
+	lockout := tpm2.Warning{Code: tpm2.RCLockout}
+
+	require.Equal(t, uint32(0), property(rw, tpm2.LockoutCounter))
+	require.Equal(t, uint32(3), property(rw, tpm2.MaxAuthFail))
+	require.Equal(t, uint32(1000), property(rw, tpm2.LockoutInterval))
+	require.Equal(t, uint32(1000), property(rw, tpm2.LockoutRecovery))
+
+	// in lockout the authValues of DA protected objects are refused, objects with noDA are still available
+	key, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "password", template)
+	require.NoError(t, err)
+	noDAKey, _, err := tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "password", noDATemplate)
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.Equal(t, authFail, create(rw, noDAKey, "wrong"))
+		require.Equal(t, authFail, create(rw, key, "wrong"))
+	}
+	require.Equal(t, uint32(3), property(rw, tpm2.LockoutCounter))
+	require.Equal(t, uint32(1<<9), property(rw, tpm2.TPMAPermanent))
+	require.Equal(t, lockout, create(rw, key, "password"))
+	require.NoError(t, create(rw, noDAKey, "password"))
+
+	require.NoError(t, tpm2.DictionaryAttackLockReset(rw, lockoutAuth("")))
+	require.Equal(t, uint32(0), property(rw, tpm2.LockoutCounter))
+	require.NoError(t, create(rw, key, "password"))
+
+	// a Startup that is not preceded by Shutdown counts as a failure and the counter survives a restart
+	require.NoError(t, tpm2.DictionaryAttackParameters(rw, lockoutAuth(""), 2, 1000, 0))
+	require.Equal(t, uint32(2), property(rw, tpm2.MaxAuthFail))
+	require.Equal(t, authFail, create(rw, key, "wrong"))
+	state, err := tpm.MarshalState()
+	require.NoError(t, err)
+	restarted := swtpm2.NewTPM2()
+	require.NoError(t, restarted.LoadState(state))
+	rw = launchTPM2(t, restarted)
+	require.Equal(t, uint32(2), property(rw, tpm2.LockoutCounter))
+	key, _, err = tpm2.CreatePrimary(rw, tpm2.HandleOwner, tpm2.PCRSelection{}, "", "password", template)
+	require.NoError(t, err)
+	require.Equal(t, lockout, create(rw, key, "password"))
+
+	// with lockoutRecovery of zero a failed authorization of lockoutAuth is recovered by TPM Reset only
+	require.Equal(t, authFail, tpm2.DictionaryAttackLockReset(rw, lockoutAuth("wrong")))
+	require.Equal(t, lockout, tpm2.DictionaryAttackLockReset(rw, lockoutAuth("")))
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupClear))
+	restarted.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	require.NoError(t, tpm2.DictionaryAttackLockReset(rw, lockoutAuth("")))
+	require.Equal(t, uint32(0), property(rw, tpm2.LockoutCounter))
+}
+
+func TestTPM2ParameterEncryption(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	const index = tpmutil.Handle(0x01500051)
+	authValue := []byte("secret")
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, string(authValue), tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrAuthRead | tpm2.AttrAuthWrite | tpm2.AttrNoDA,
+		DataSize:   8,
+	}, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}))
+	// the Name of the index changes when it is written for the first time
+	require.NoError(t, tpm2.NVWrite(rw, index, index, string(authValue), make([]byte, 8), 0))
+	nvPublic, err := tpm2.NVReadPublic(rw, index)
+	require.NoError(t, err)
+	public, err := tpmutil.Pack(nvPublic)
+	require.NoError(t, err)
+	digest := sha256.Sum256(public)
+	name := append([]byte{0x00, 0x0B}, digest[:]...)
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	// startSession starts an HMAC session with TPMT_SYM_DEF given by its fields
+	startSession := func(bind tpmutil.Handle, symmetric ...interface{}) (tpmutil.Handle, []byte) {
+		parameters := append([]interface{}{tpm2.HandleNull, bind, tpmutil.U16Bytes(nonceCaller), tpmutil.U16Bytes(nil),
+			tpm2.SessionHMAC}, symmetric...)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdStartAuthSession, append(parameters, tpm2.AlgSHA256)...)
+		require.NoError(t, err)
+		require.Equal(t, tpmutil.RCSuccess, code)
+		var session tpmutil.Handle
+		var nonceTPM tpmutil.U16Bytes
+		_, err = tpmutil.Unpack(resp, &session, &nonceTPM)
+		require.NoError(t, err)
+		return session, nonceTPM
+	}
+	// cfb encrypts or decrypts data with AES-128 in CFB mode with the key and IV from KDFa(key, "CFB", nonceNewer, nonceOlder)
+	cfb := func(key, nonceNewer, nonceOlder, data []byte, decrypt bool) []byte {
+		bits, err := tpm2.KDFa(tpm2.AlgSHA256, key, "CFB", nonceNewer, nonceOlder, 256)
+		require.NoError(t, err)
+		block, err := aes.NewCipher(bits[:16])
+		require.NoError(t, err)
+		out := make([]byte, len(data))
+		if decrypt {
+			cipher.NewCFBDecrypter(block, bits[16:]).XORKeyStream(out, data)
+		} else {
+			cipher.NewCFBEncrypter(block, bits[16:]).XORKeyStream(out, data)
+		}
+		return out
+	}
+	// nvCommand runs an NV command on the index and returns the response parameters and the response sessions
+	nvCommand := func(cc tpmutil.Command, sessions []tpm2.AuthCommand, parameters ...interface{}) ([]byte, []swtpm2.AuthResponse, tpmutil.ResponseCode) {
+		var authArea []byte
+		for _, session := range sessions {
+			b, err := tpmutil.Pack(session)
+			require.NoError(t, err)
+			authArea = append(authArea, b...)
+		}
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, cc, append([]interface{}{index, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea)}, parameters...)...)
+		require.NoError(t, err)
+		if code != tpmutil.RCSuccess {
+			return nil, nil, code
+		}
+		var parameterSize uint32
+		_, err = tpmutil.Unpack(resp, &parameterSize)
+		require.NoError(t, err)
+		buf := bytes.NewBuffer(resp[4+parameterSize:])
+		responses := make([]swtpm2.AuthResponse, len(sessions))
+		for i := range responses {
+			require.NoError(t, tpmutil.UnpackBuf(buf, &responses[i].Nonce, &responses[i].Attributes, &responses[i].Auth))
+		}
+		return resp[4 : 4+parameterSize], responses, code
+	}
+	cpHash := func(cc tpmutil.Command, parameters []byte) []byte {
+		h := sha256.New()
+		require.NoError(t, binary.Write(h, binary.BigEndian, cc))
+		h.Write(name)
+		h.Write(name)
+		h.Write(parameters)
+		return h.Sum(nil)
+	}
+	rpHash := func(cc tpmutil.Command, parameters []byte) []byte {
+		h := sha256.New()
+		require.NoError(t, binary.Write(h, binary.BigEndian, uint32(0)))
+		require.NoError(t, binary.Write(h, binary.BigEndian, cc))
+		h.Write(parameters)
+		return h.Sum(nil)
+	}
+
+	// the authorization session decrypts the data of NV_Write with the authValue of the index
+	session, nonceTPM := startSession(tpm2.HandleNull, tpm2.AlgAES, uint16(128), tpm2.AlgCFB)
+	attributes := tpm2.AttrContinueSession | tpm2.AttrDecrypt
+	parameters, err := tpmutil.Pack(tpmutil.U16Bytes(cfb(authValue, nonceCaller, nonceTPM, []byte("contents"), false)), uint16(0))
+	require.NoError(t, err)
+	_, responses, code := nvCommand(tpm2.CmdWriteNV, []tpm2.AuthCommand{{Session: session, Nonce: nonceCaller, Attributes: attributes,
+		Auth: sessionHMAC(authValue, cpHash(tpm2.CmdWriteNV, parameters), nonceCaller, nonceTPM, attributes)}},
+		tpmutil.RawBytes(parameters))
+	require.Equal(t, tpmutil.RCSuccess, code)
+	data, err := tpm2.NVReadEx(rw, index, index, string(authValue), 0)
+	require.NoError(t, err)
+	require.Equal(t, []byte("contents"), data)
+
+	// the response of NV_Read is encrypted with the new nonceTPM and HMAC covers the encrypted data
+	nonceTPM = responses[0].Nonce
+	attributes = tpm2.AttrContinueSession | tpm2.AttrEcrypt
+	parameters, err = tpmutil.Pack(uint16(8), uint16(0))
+	require.NoError(t, err)
+	response, responses, code := nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{{Session: session, Nonce: nonceCaller, Attributes: attributes,
+		Auth: sessionHMAC(authValue, cpHash(tpm2.CmdReadNV, parameters), nonceCaller, nonceTPM, attributes)}},
+		tpmutil.RawBytes(parameters))
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, sessionHMAC(authValue, rpHash(tpm2.CmdReadNV, response), responses[0].Nonce, nonceCaller, attributes),
+		[]byte(responses[0].Auth))
+	require.Equal(t, []byte("contents"), cfb(authValue, responses[0].Nonce, nonceCaller, response[2:], true))
+	nonceTPM = responses[0].Nonce
+
+	// a session that follows the authorizations encrypts with its session key,
+	// XOR uses KDFa(hashAlg, sessionKey, "XOR", nonceNewer, nonceOlder) as the mask
+	// and its command HMAC is keyed with the session key only
+	xorSession, xorNonce := startSession(index, tpm2.AlgXOR, tpm2.AlgSHA256)
+	sessionKey, err := tpm2.KDFa(tpm2.AlgSHA256, authValue, "ATH", xorNonce, nonceCaller, 256)
+	require.NoError(t, err)
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Auth: authValue}
+	attributes = tpm2.AttrEcrypt
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		{Session: xorSession, Nonce: nonceCaller, Attributes: attributes | tpm2.AttrContinueSession,
+			Auth: sessionHMAC(sessionKey, cpHash(tpm2.CmdReadNV, parameters), nonceCaller, xorNonce, attributes)}},
+		tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC2}), code)
+	response, responses, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		{Session: xorSession, Nonce: nonceCaller, Attributes: attributes,
+			Auth: sessionHMAC(sessionKey, cpHash(tpm2.CmdReadNV, parameters), nonceCaller, xorNonce, attributes)}},
+		tpmutil.RawBytes(parameters))
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, sessionHMAC(sessionKey, rpHash(tpm2.CmdReadNV, response), responses[1].Nonce, nonceCaller, attributes),
+		[]byte(responses[1].Auth))
+	mask, err := tpm2.KDFa(tpm2.AlgSHA256, sessionKey, "XOR", responses[1].Nonce, nonceCaller, 64)
+	require.NoError(t, err)
+	for i := range mask {
+		mask[i] ^= response[2+i]
+	}
+	require.Equal(t, []byte("contents"), mask)
+	// the session is flushed without continueSession
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		{Session: xorSession, Nonce: nonceCaller, Attributes: attributes}}, tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Warning{Code: tpm2.RCReferenceS0 + 1}), code)
+
+	// the first parameter of NV_Read is not a sized buffer
+	cipherAuth := func(session tpmutil.Handle, nonceTPM []byte, attributes tpm2.SessionAttributes) tpm2.AuthCommand {
+		return tpm2.AuthCommand{Session: session, Nonce: nonceCaller, Attributes: attributes,
+			Auth: sessionHMAC(nil, cpHash(tpm2.CmdReadNV, parameters), nonceCaller, nonceTPM, attributes)}
+	}
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		cipherAuth(session, nonceTPM, tpm2.AttrContinueSession|tpm2.AttrDecrypt)}, tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAttributes, Session: tpm2.RC2}), code)
+	// password sessions cannot encrypt
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{{Session: tpm2.HandlePasswordSession, Auth: authValue,
+		Attributes: tpm2.AttrEcrypt}}, tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAttributes, Session: tpm2.RC1}), code)
+	// sessions that follow the authorizations must encrypt
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		{Session: session, Nonce: nonceCaller, Attributes: tpm2.AttrContinueSession}}, tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAttributes, Session: tpm2.RC2}), code)
+	// a session without a symmetric algorithm cannot encrypt
+	plainSession, plainNonce := startSession(tpm2.HandleNull, tpm2.AlgNull)
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		cipherAuth(plainSession, plainNonce, tpm2.AttrEcrypt)}, tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCSymmetric, Session: tpm2.RC2}), code)
+	// only one session encrypts the response
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		cipherAuth(session, nonceTPM, tpm2.AttrEcrypt), cipherAuth(plainSession, plainNonce, tpm2.AttrEcrypt)},
+		tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAttributes, Session: tpm2.RC3}), code)
+	// a session appears once
+	_, _, code = nvCommand(tpm2.CmdReadNV, []tpm2.AuthCommand{password,
+		cipherAuth(session, nonceTPM, tpm2.AttrEcrypt), cipherAuth(session, nonceTPM, tpm2.AttrDecrypt)},
+		tpmutil.RawBytes(parameters))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCHandle, Session: tpm2.RC3}), code)
+}
+
+func TestTPM2PolicySessionAuthorization(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	const index = tpmutil.Handle(0x01500051)
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	for i, policy := range [][]byte{make([]byte, 32), bytes.Repeat([]byte{1}, 32)} {
+		require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+			NVIndex:    index + tpmutil.Handle(i),
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.AttrPolicyRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+			AuthPolicy: policy,
+			DataSize:   4,
+		}, password))
+		require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index+tpmutil.Handle(i), "", []byte{1, 2, 3, 4}, 0))
+	}
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	// nvRead reads an index with a new policy session of a given type, the session has no HMAC key
+	nvRead := func(handle tpmutil.Handle, sessionType tpm2.SessionType) tpmutil.ResponseCode {
+		session, _ := startPolicySession(t, rw, sessionType)
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: session, Nonce: nonceCaller})
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdReadNV, handle, handle,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), uint16(4), uint16(0))
+		require.NoError(t, err)
+		_ = tpm2.FlushContext(rw, session)
+		return code
+	}
+	// the policy digest of a new session is all zeros
+	require.Equal(t, tpmutil.RCSuccess, nvRead(index, tpm2.SessionPolicy))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyFail, Session: tpm2.RC1}), nvRead(index+1, tpm2.SessionPolicy))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAttributes, Session: tpm2.RC1}), nvRead(index, tpm2.SessionTrial))
+	// a policy cannot authorize the owner to write the index
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCAuthUnavailable}), nvRead(index, tpm2.SessionHMAC))
+}
+
+func TestTPM2PolicyPCR(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	selection := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+
+	// policyDigest of PolicyPCR is H(0...0 || TPM_CC_PolicyPCR || pcrs || H(PCR 7))
+	trial, _ := startPolicySession(t, rw, tpm2.SessionTrial)
+	require.NoError(t, tpm2.PolicyPCR(rw, trial, nil, selection))
+	pcrPolicy, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	pcrDigest := sha256.Sum256(make([]byte, 32))
+	h := sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x7F, 0x00, 0x00, 0x00, 0x01, 0x00, 0x0B, 0x03, 0x80, 0x00, 0x00})
+	h.Write(pcrDigest[:])
+	require.Equal(t, h.Sum(nil), pcrPolicy)
+	// the selection is hashed as sent, a larger sizeofSelect gives another policy
+	_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyRestart, trial)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	wideSelection := []byte{0x00, 0x00, 0x00, 0x01, 0x00, 0x0B, 0x04, 0x80, 0x00, 0x00, 0x00}
+	_, code, err = tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdPolicyPCR, trial, tpmutil.U16Bytes(nil),
+		tpmutil.RawBytes(wideSelection))
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	widePolicy, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	h = sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x7F})
+	h.Write(wideSelection)
+	h.Write(pcrDigest[:])
+	require.Equal(t, h.Sum(nil), widePolicy)
+	_, code, err = tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyRestart, trial)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.NoError(t, tpm2.PolicyPCR(rw, trial, nil, selection))
+
+	otherPolicy := bytes.Repeat([]byte{0x11}, 32)
+	branches := tpm2.TPMLDigest{Digests: []tpmutil.U16Bytes{otherPolicy, pcrPolicy}}
+	require.NoError(t, tpm2.PolicyOr(rw, trial, branches))
+	policy, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	h = sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x71})
+	h.Write(otherPolicy)
+	h.Write(pcrPolicy)
+	require.Equal(t, h.Sum(nil), policy)
+	_, code, err = tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyRestart, trial)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	policyDigest, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, 32), policyDigest)
+	require.NoError(t, tpm2.FlushContext(rw, trial))
+
+	const index = tpmutil.Handle(0x01500060)
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrPolicyRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+		AuthPolicy: policy,
+		DataSize:   4,
+	}, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", []byte{1, 2, 3, 4}, 0))
+	nvRead := func(session tpmutil.Handle) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: session, Nonce: nonceCaller, Attributes: tpm2.AttrContinueSession})
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdReadNV, index, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), uint16(4), uint16(0))
+		require.NoError(t, err)
+		return code
+	}
+
+	session, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1},
+		tpm2.PolicyPCR(rw, session, bytes.Repeat([]byte{1}, 32), selection))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.PolicyOr(rw, session, branches))
+	require.NoError(t, tpm2.PolicyPCR(rw, session, pcrDigest[:], selection))
+	require.NoError(t, tpm2.PolicyOr(rw, session, branches))
+	require.Equal(t, tpmutil.RCSuccess, nvRead(session))
+	// the policy is reset after every authorization
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyFail, Session: tpm2.RC1}), nvRead(session))
+
+	// PCRs must not change between PolicyPCR and the authorization
+	require.NoError(t, tpm2.PolicyPCR(rw, session, nil, selection))
+	require.NoError(t, tpm2.PolicyOr(rw, session, branches))
+	require.NoError(t, tpm2.PCRExtend(rw, 7, tpm2.AlgSHA256, make([]byte, 32), ""))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPCRChanged}), nvRead(session))
+	require.Equal(t, tpm2.Error{Code: tpm2.RCPCRChanged}, tpm2.PolicyPCR(rw, session, nil, selection))
+	_, code, err = tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyRestart, session)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.NoError(t, tpm2.PolicyPCR(rw, session, nil, selection))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}, tpm2.PolicyOr(rw, session, branches))
+
+	hmacSession, _ := startPolicySession(t, rw, tpm2.SessionHMAC)
+	_, err = tpm2.PolicyGetDigest(rw, hmacSession)
+	require.Equal(t, tpm2.HandleError{Code: tpm2.RCValue, Handle: tpm2.RC1}, err)
+}
+
+func TestTPM2PolicySigned(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := launchTPM2(t, tpm)
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	public := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+			Point:   tpm2.ECPoint{XRaw: priv.X.FillBytes(make([]byte, 32)), YRaw: priv.Y.FillBytes(make([]byte, 32))},
+		},
+	}
+	authObject, code := loadExternal(t, rw, nil, public, tpm2.HandleNull)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	_, name, _, err := tpm2.ReadPublic(rw, authObject)
+	require.NoError(t, err)
+
+	// signedAuth signs nonceTPM || expiration || cpHashA || policyRef
+	signedAuth := func(nonceTPM []byte, expiration int32, policyRef []byte) []byte {
+		message, err := tpmutil.Pack(tpmutil.RawBytes(nonceTPM), expiration, tpmutil.RawBytes(policyRef))
+		require.NoError(t, err)
+		digest := sha256.Sum256(message)
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest[:])
+		require.NoError(t, err)
+		signature, err := tpm2.Signature{Alg: tpm2.AlgECDSA, ECC: &tpm2.SignatureECC{HashAlg: tpm2.AlgSHA256, R: r, S: s}}.Encode()
+		require.NoError(t, err)
+		return signature
+	}
+	policyRef := []byte("policy ref")
+	h := sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x60})
+	h.Write(name)
+	step := h.Sum(nil)
+	h = sha256.New()
+	h.Write(step)
+	h.Write(policyRef)
+	expectedPolicy := h.Sum(nil)
+
+	session, nonceTPM := startPolicySession(t, rw, tpm2.SessionPolicy)
+	_, _, err = tpm2.PolicySigned(rw, authObject, session, nonceTPM, nil, policyRef, -60, signedAuth(nonceTPM, -30, policyRef))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCSignature, Parameter: tpm2.RC5}, err)
+	_, _, err = tpm2.PolicySigned(rw, authObject, session, policyRef, nil, policyRef, -60, signedAuth(policyRef, -60, policyRef))
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCNonce, Parameter: tpm2.RC1}, err)
+	timeout, ticket, err := tpm2.PolicySigned(rw, authObject, session, nonceTPM, nil, policyRef, -60, signedAuth(nonceTPM, -60, policyRef))
+	require.NoError(t, err)
+	require.Len(t, timeout, 8)
+	require.Equal(t, tpm2.TagAuthSigned, ticket.Type)
+	require.NotEmpty(t, ticket.Digest)
+	policyDigest, err := tpm2.PolicyGetDigest(rw, session)
+	require.NoError(t, err)
+	require.Equal(t, expectedPolicy, policyDigest)
+
+	// an assertion that does not expire produces no ticket
+	other, nonceTPM := startPolicySession(t, rw, tpm2.SessionPolicy)
+	otherTimeout, nullTicket, err := tpm2.PolicySigned(rw, authObject, other, nonceTPM, nil, policyRef, 0, signedAuth(nonceTPM, 0, policyRef))
+	require.NoError(t, err)
+	require.Empty(t, otherTimeout)
+	require.Equal(t, tpm2.HandleNull, nullTicket.Hierarchy)
+	require.Empty(t, nullTicket.Digest)
+	require.NoError(t, tpm2.FlushContext(rw, other))
+
+	// the signature is not checked by a trial session
+	trial, _ := startPolicySession(t, rw, tpm2.SessionTrial)
+	_, _, err = tpm2.PolicySigned(rw, authObject, trial, nil, nil, policyRef, 0, signedAuth(nil, 1, nil))
+	require.NoError(t, err)
+	policyDigest, err = tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	require.Equal(t, expectedPolicy, policyDigest)
+	require.NoError(t, tpm2.FlushContext(rw, trial))
+
+	// the ticket repeats the assertion in another session
+	policyTicket := func(session tpmutil.Handle, ticket *tpm2.Ticket) tpmutil.ResponseCode {
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyTicket, session, tpmutil.U16Bytes(timeout),
+			tpmutil.U16Bytes(nil), tpmutil.U16Bytes(policyRef), tpmutil.U16Bytes(name), *ticket)
+		require.NoError(t, err)
+		return code
+	}
+	replay, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policyTicket(replay, ticket))
+	policyDigest, err = tpm2.PolicyGetDigest(rw, replay)
+	require.NoError(t, err)
+	require.Equal(t, expectedPolicy, policyDigest)
+	forged := *ticket
+	forged.Digest = append([]byte{forged.Digest[0] ^ 1}, forged.Digest[1:]...)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCTicket, Parameter: tpm2.RC5}), policyTicket(replay, &forged))
+
+	// the timeout of a ticket is not valid after Startup
+	require.NoError(t, tpm2.Shutdown(rw, tpm2.StartupClear))
+	tpm.Init()
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+	_, code = loadExternal(t, rw, nil, public, tpm2.HandleNull)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	replay, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCTicket, Parameter: tpm2.RC5}), policyTicket(replay, ticket))
+}
+
+func TestTPM2PolicySecret(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	h := sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x51, 0x40, 0x00, 0x00, 0x01})
+	step := h.Sum(nil)
+	h = sha256.New()
+	h.Write(step)
+	policy := h.Sum(nil)
+
+	const index = tpmutil.Handle(0x01500070)
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrPolicyRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+		AuthPolicy: policy,
+		DataSize:   4,
+	}, password))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", []byte{1, 2, 3, 4}, 0))
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	nvRead := func(session tpmutil.Handle) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: session, Nonce: nonceCaller, Attributes: tpm2.AttrContinueSession})
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdReadNV, index, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), uint16(4), uint16(0))
+		require.NoError(t, err)
+		return code
+	}
+
+	session, nonceTPM := startPolicySession(t, rw, tpm2.SessionPolicy)
+	_, _, err := tpm2.PolicySecret(rw, tpm2.HandleOwner, tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Auth: []byte("wrong")},
+		session, nonceTPM, nil, nil, 0)
+	require.Equal(t, tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}, err)
+	timeout, ticket, err := tpm2.PolicySecret(rw, tpm2.HandleOwner, password, session, nonceTPM, nil, nil, 0)
+	require.NoError(t, err)
+	require.Empty(t, timeout)
+	require.Equal(t, tpm2.HandleNull, ticket.Hierarchy)
+	require.Equal(t, tpmutil.RCSuccess, nvRead(session))
+
+	// the session is bound to the parameters of another command
+	cpHash := bytes.Repeat([]byte{1}, 32)
+	_, ticket, err = tpm2.PolicySecret(rw, tpm2.HandleOwner, password, session, nil, cpHash, nil, -10)
+	require.NoError(t, err)
+	require.Equal(t, tpm2.HandleOwner, ticket.Hierarchy)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyFail, Session: tpm2.RC1}), nvRead(session))
+	_, _, err = tpm2.PolicySecret(rw, tpm2.HandleOwner, password, session, nil, bytes.Repeat([]byte{2}, 32), nil, 0)
+	require.Equal(t, tpm2.Error{Code: tpm2.RCCPHash}, err)
+	_, _, err = tpm2.PolicySecret(rw, tpm2.HandleOwner, password, session, nil, cpHash[:20], nil, 0)
+	require.Equal(t, tpm2.ParameterError{Code: tpm2.RCSize, Parameter: tpm2.RC2}, err)
+}
+
+func TestTPM2PolicyAuthorize(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	public := tpm2.Public{
+		Type:       tpm2.AlgECC,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.FlagSign | tpm2.FlagUserWithAuth,
+		ECCParameters: &tpm2.ECCParams{
+			Sign:    &tpm2.SigScheme{Alg: tpm2.AlgECDSA, Hash: tpm2.AlgSHA256},
+			CurveID: tpm2.CurveNISTP256,
+			Point:   tpm2.ECPoint{XRaw: priv.X.FillBytes(make([]byte, 32)), YRaw: priv.Y.FillBytes(make([]byte, 32))},
+		},
+	}
+	nullKey, code := loadExternal(t, rw, nil, public, tpm2.HandleNull)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	keySign, code := loadExternal(t, rw, nil, public, tpm2.HandleOwner)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	_, keyName, _, err := tpm2.ReadPublic(rw, keySign)
+	require.NoError(t, err)
+
+	verifySignature := func(keySign tpmutil.Handle, digest []byte) (tpm2.Ticket, tpmutil.ResponseCode) {
+		r, s, err := ecdsa.Sign(rand.Reader, priv, digest)
+		require.NoError(t, err)
+		signature, err := tpm2.Signature{Alg: tpm2.AlgECDSA, ECC: &tpm2.SignatureECC{HashAlg: tpm2.AlgSHA256, R: r, S: s}}.Encode()
+		require.NoError(t, err)
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdVerifySignature, keySign,
+			tpmutil.U16Bytes(digest), tpmutil.RawBytes(signature))
+		require.NoError(t, err)
+		var ticket tpm2.Ticket
+		if code == tpmutil.RCSuccess {
+			_, err = tpmutil.Unpack(resp, &ticket)
+			require.NoError(t, err)
+		}
+		return ticket, code
+	}
+	policyAuthorize := func(session tpmutil.Handle, approvedPolicy, policyRef []byte, ticket tpm2.Ticket) tpmutil.ResponseCode {
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyAuthorize, session, tpmutil.U16Bytes(approvedPolicy),
+			tpmutil.U16Bytes(policyRef), tpmutil.U16Bytes(keyName), ticket)
+		require.NoError(t, err)
+		return code
+	}
+
+	// the approved policy is PolicyPCR on PCR 7
+	selection := tpm2.PCRSelection{Hash: tpm2.AlgSHA256, PCRs: []int{7}}
+	trial, _ := startPolicySession(t, rw, tpm2.SessionTrial)
+	require.NoError(t, tpm2.PolicyPCR(rw, trial, nil, selection))
+	approvedPolicy, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	policyRef := []byte("policy ref")
+	aHash := sha256.Sum256(append(append([]byte{}, approvedPolicy...), policyRef...))
+
+	// policyDigest of PolicyAuthorize is H(H(0...0 || TPM_CC_PolicyAuthorize || keySign) || policyRef)
+	h := sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x6A})
+	h.Write(keyName)
+	step := h.Sum(nil)
+	h = sha256.New()
+	h.Write(step)
+	h.Write(policyRef)
+	authorizedPolicy := h.Sum(nil)
+
+	// a key in the null hierarchy produces no ticket
+	ticket, code := verifySignature(nullKey, aHash[:])
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, tpm2.HandleNull, ticket.Hierarchy)
+	_, code = verifySignature(keySign, make([]byte, 32))
+	require.Equal(t, tpmutil.RCSuccess, code)
+	ticket, code = verifySignature(keySign, aHash[:])
+	require.Equal(t, tpmutil.RCSuccess, code)
+	require.Equal(t, tpmutil.Tag(0x8022), ticket.Type)
+	require.Equal(t, tpm2.HandleOwner, ticket.Hierarchy)
+
+	// the trial session does not check the ticket
+	require.Equal(t, tpmutil.RCSuccess, policyAuthorize(trial, nil, policyRef, tpm2.Ticket{Type: 0x8022, Hierarchy: tpm2.HandleNull}))
+	policy, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	require.Equal(t, authorizedPolicy, policy)
+	require.NoError(t, tpm2.FlushContext(rw, trial))
+
+	session, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}),
+		policyAuthorize(session, approvedPolicy, policyRef, ticket))
+	require.NoError(t, tpm2.PolicyPCR(rw, session, nil, selection))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC4}),
+		policyAuthorize(session, approvedPolicy, []byte("other ref"), ticket))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCTag, Parameter: tpm2.RC4}),
+		policyAuthorize(session, approvedPolicy, policyRef, tpm2.Ticket{Type: tpm2.TagHashCheck, Hierarchy: tpm2.HandleOwner}))
+	require.Equal(t, tpmutil.RCSuccess, policyAuthorize(session, approvedPolicy, policyRef, ticket))
+	policy, err = tpm2.PolicyGetDigest(rw, session)
+	require.NoError(t, err)
+	require.Equal(t, authorizedPolicy, policy)
+
+	// PolicyAuthorizeNV reads the approved policy as TPMT_HA from the index, the data that follows it is ignored
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	defineIndex := func(index tpmutil.Handle, data []byte) {
+		require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+			NVIndex:    index,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.AttrOwnerRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+			DataSize:   uint16(len(data)),
+		}, password))
+		require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", data, 0))
+	}
+	const index, shortIndex = tpmutil.Handle(0x01500080), tpmutil.Handle(0x01500081)
+	defineIndex(index, append(append([]byte{0x00, 0x0B}, approvedPolicy...), 0xFF, 0xFF))
+	defineIndex(shortIndex, append([]byte{0x00, 0x0B}, approvedPolicy[:31]...))
+	resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdReadPublicNV, index)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	var nvPublic, nvName tpmutil.U16Bytes
+	_, err = tpmutil.Unpack(resp, &nvPublic, &nvName)
+	require.NoError(t, err)
+	policyAuthorizeNV := func(index, session tpmutil.Handle) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(password)
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, swtpm2.CmdPolicyAuthorizeNV, tpm2.HandleOwner, index, session,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea))
+		require.NoError(t, err)
+		return code
+	}
+	h = sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x92})
+	h.Write(nvName)
+	nvPolicy := h.Sum(nil)
+
+	nvSession, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.HandleError{Code: tpm2.RCValue, Handle: tpm2.RC2}), policyAuthorizeNV(index, nvSession))
+	require.NoError(t, tpm2.PolicyPCR(rw, nvSession, nil, selection))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.HandleError{Code: tpm2.RCSize, Handle: tpm2.RC2}), policyAuthorizeNV(shortIndex, nvSession))
+	require.Equal(t, tpmutil.RCSuccess, policyAuthorizeNV(index, nvSession))
+	policy, err = tpm2.PolicyGetDigest(rw, nvSession)
+	require.NoError(t, err)
+	require.Equal(t, nvPolicy, policy)
+}
+
+func TestTPM2PolicyNV(t *testing.T) {
+	rw := launchTPM2(t, swtpm2.NewTPM2())
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	const index = tpmutil.Handle(0x01500090)
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+		NVIndex:    index,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrOwnerRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+		DataSize:   8,
+	}, password))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", []byte{0, 0, 0, 0, 0, 0, 0x10, 0x00}, 0))
+	resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdReadPublicNV, index)
+	require.NoError(t, err)
+	require.Equal(t, tpmutil.RCSuccess, code)
+	var nvPublic, nvName tpmutil.U16Bytes
+	_, err = tpmutil.Unpack(resp, &nvPublic, &nvName)
+	require.NoError(t, err)
+
+	policyNV := func(session tpmutil.Handle, operandB []byte, offset, operation uint16) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(password)
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, swtpm2.CmdPolicyNV, tpm2.HandleOwner, index, session,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.U16Bytes(operandB), offset, operation)
+		require.NoError(t, err)
+		return code
+	}
+	policyCounterTimer := func(session tpmutil.Handle, operandB []byte, offset, operation uint16) tpmutil.ResponseCode {
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyCounterTimer, session,
+			tpmutil.U16Bytes(operandB), offset, operation)
+		require.NoError(t, err)
+		return code
+	}
+
+	// policyDigest of PolicyNV is H(0...0 || TPM_CC_PolicyNV || H(operandB || offset || operation) || nvName)
+	operandB := []byte{0x0F, 0xFF}
+	args := sha256.Sum256(append(append([]byte{}, operandB...), 0x00, 0x06, 0x00, 0x03))
+	h := sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x49})
+	h.Write(args[:])
+	h.Write(nvName)
+	nvPolicy := h.Sum(nil)
+
+	trial, _ := startPolicySession(t, rw, tpm2.SessionTrial)
+	require.Equal(t, tpmutil.RCSuccess, policyNV(trial, operandB, 6, 3))
+	policy, err := tpm2.PolicyGetDigest(rw, trial)
+	require.NoError(t, err)
+	require.Equal(t, nvPolicy, policy)
+	require.NoError(t, tpm2.FlushContext(rw, trial))
+
+	session, _ := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policyNV(session, operandB, 6, 3))
+	policy, err = tpm2.PolicyGetDigest(rw, session)
+	require.NoError(t, err)
+	require.Equal(t, nvPolicy, policy)
+	for _, c := range []struct {
+		operandB  []byte
+		offset    uint16
+		operation uint16
+		code      tpmutil.ResponseCode
+	}{
+		{[]byte{0x10, 0x00}, 6, 0, tpmutil.RCSuccess},
+		{[]byte{0x10, 0x01}, 6, 1, tpmutil.RCSuccess},
+		{[]byte{0x10, 0x00}, 6, 1, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPolicy})},
+		{[]byte{0xF0}, 6, 2, tpmutil.RCSuccess},
+		{[]byte{0xF0}, 6, 3, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPolicy})},
+		{[]byte{0x20}, 6, 4, tpmutil.RCSuccess},
+		{[]byte{0x10}, 6, 5, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPolicy})},
+		{[]byte{0x10}, 6, 6, tpmutil.RCSuccess},
+		{[]byte{0x10}, 6, 7, tpmutil.RCSuccess},
+		{[]byte{0x0F}, 6, 8, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPolicy})},
+		{[]byte{0x11}, 6, 9, tpmutil.RCSuccess},
+		{[]byte{0x10, 0x00}, 6, 10, tpmutil.RCSuccess},
+		{[]byte{0x11, 0x00}, 6, 10, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPolicy})},
+		{[]byte{0x01, 0xFF}, 6, 11, tpmutil.RCSuccess},
+		{[]byte{0x00}, 6, 12, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC3})},
+		{[]byte{0x00}, 9, 0, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC2})},
+		{[]byte{0x00, 0x00, 0x00}, 6, 0, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCSize, Parameter: tpm2.RC1})},
+	} {
+		require.Equal(t, c.code, policyNV(session, c.operandB, c.offset, c.operation), "operandB %x offset %d operation %d",
+			c.operandB, c.offset, c.operation)
+	}
+
+	// policyDigest of PolicyCounterTimer is H(0...0 || TPM_CC_PolicyCounterTimer || H(operandB || offset || operation))
+	operandB = []byte{0x00, 0x00, 0x00, 0x01}
+	args = sha256.Sum256(append(append([]byte{}, operandB...), 0x00, 0x10, 0x00, 0x00))
+	h = sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x6D})
+	h.Write(args[:])
+	timerPolicy := h.Sum(nil)
+
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policyCounterTimer(session, operandB, 16, 0))
+	policy, err = tpm2.PolicyGetDigest(rw, session)
+	require.NoError(t, err)
+	require.Equal(t, timerPolicy, policy)
+	require.Equal(t, tpmutil.RCSuccess, policyCounterTimer(session, []byte{0}, 20, 0))
+	require.Equal(t, tpmutil.RCSuccess, policyCounterTimer(session, []byte{1}, 24, 0))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCPolicy}),
+		policyCounterTimer(session, make([]byte, 8), 8, 4))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCRange, Parameter: tpm2.RC2}),
+		policyCounterTimer(session, make([]byte, 8), 20, 0))
+
+	// the session with PolicyNvWritten authorizes indices with a matching TPMA_NV_WRITTEN
+	policyNvWritten := func(session tpmutil.Handle, writtenSet byte) tpmutil.ResponseCode {
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, swtpm2.CmdPolicyNvWritten, session, writtenSet)
+		require.NoError(t, err)
+		return code
+	}
+	h = sha256.New()
+	h.Write(make([]byte, 32))
+	h.Write([]byte{0x00, 0x00, 0x01, 0x8F, 0x01})
+	writtenPolicy := h.Sum(nil)
+	const policyIndex = index + 1
+	require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "", tpm2.NVPublic{
+		NVIndex:    policyIndex,
+		NameAlg:    tpm2.AlgSHA256,
+		Attributes: tpm2.AttrPolicyWrite | tpm2.AttrPolicyRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+		AuthPolicy: writtenPolicy,
+		DataSize:   4,
+	}, password))
+	nvWrite := func(session tpmutil.Handle) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: session, Nonce: nonceCaller, Attributes: tpm2.AttrContinueSession})
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdWriteNV, policyIndex, policyIndex,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), tpmutil.U16Bytes{1, 2, 3, 4}, uint16(0))
+		require.NoError(t, err)
+		return code
+	}
+
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policyNvWritten(session, 1))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}), policyNvWritten(session, 0))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}), policyNvWritten(session, 2))
+	policy, err = tpm2.PolicyGetDigest(rw, session)
+	require.NoError(t, err)
+	require.Equal(t, writtenPolicy, policy)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyFail, Session: tpm2.RC1}), nvWrite(session))
+	require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, policyIndex, "", []byte{0, 0, 0, 0}, 0))
+	require.Equal(t, tpmutil.RCSuccess, nvWrite(session))
+}
+
+func TestTPM2PolicyCommandBinding(t *testing.T) {
+	tpm := swtpm2.NewTPM2()
+	rw := &localityTransport{tpm: tpm}
+	require.NoError(t, tpm2.Startup(rw, tpm2.StartupClear))
+
+	nonceCaller := bytes.Repeat([]byte{0x5A}, 16)
+	policy := func(session tpmutil.Handle, cc tpmutil.Command, parameters ...interface{}) tpmutil.ResponseCode {
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, cc, append([]interface{}{session}, parameters...)...)
+		require.NoError(t, err)
+		return code
+	}
+	policyDigest := func(session tpmutil.Handle) []byte {
+		digest, err := tpm2.PolicyGetDigest(rw, session)
+		require.NoError(t, err)
+		return digest
+	}
+	extend := func(digest []byte, data ...[]byte) []byte {
+		h := sha256.New()
+		h.Write(digest)
+		for _, d := range data {
+			h.Write(d)
+		}
+		return h.Sum(nil)
+	}
+
+	// the indices are read with policy sessions only, their authValue is "secret"
+	password := tpm2.AuthCommand{Session: tpm2.HandlePasswordSession, Attributes: tpm2.AttrContinueSession}
+	defineIndex := func(index tpmutil.Handle, authPolicy []byte) []byte {
+		require.NoError(t, tpm2.NVDefineSpaceEx(rw, tpm2.HandleOwner, "secret", tpm2.NVPublic{
+			NVIndex:    index,
+			NameAlg:    tpm2.AlgSHA256,
+			Attributes: tpm2.AttrPolicyRead | tpm2.AttrOwnerWrite | tpm2.AttrNoDA,
+			AuthPolicy: authPolicy,
+			DataSize:   4,
+		}, password))
+		require.NoError(t, tpm2.NVWrite(rw, tpm2.HandleOwner, index, "", []byte{1, 2, 3, 4}, 0))
+		resp, code, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdReadPublicNV, index)
+		require.NoError(t, err)
+		require.Equal(t, tpmutil.RCSuccess, code)
+		var nvPublic, name tpmutil.U16Bytes
+		_, err = tpmutil.Unpack(resp, &nvPublic, &name)
+		require.NoError(t, err)
+		return name
+	}
+	// nvRead reads an index with a policy session that is flushed afterwards
+	nvRead := func(index, session tpmutil.Handle, auth []byte) tpmutil.ResponseCode {
+		authArea, err := tpmutil.Pack(tpm2.AuthCommand{Session: session, Nonce: nonceCaller, Auth: auth})
+		require.NoError(t, err)
+		_, code, err := tpmutil.RunCommand(rw, tpm2.TagSessions, tpm2.CmdReadNV, index, index,
+			uint32(len(authArea)), tpmutil.RawBytes(authArea), uint16(4), uint16(0))
+		require.NoError(t, err)
+		_ = tpm2.FlushContext(rw, session)
+		return code
+	}
+	readCpHash := func(name []byte) []byte {
+		return extend(nil, []byte{0x00, 0x00, 0x01, 0x4E}, name, name, []byte{0x00, 0x04, 0x00, 0x00})
+	}
+	authValuePolicy := extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x6B})
+
+	// PolicyCommandCode and PolicyAuthValue require the HMAC with the authValue for NV_Read
+	commandPolicy := extend(extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x6C, 0x00, 0x00, 0x01, 0x4E}),
+		[]byte{0x00, 0x00, 0x01, 0x6B})
+	trial, _ := startPolicySession(t, rw, tpm2.SessionTrial)
+	require.NoError(t, tpm2.PolicyCommandCode(rw, trial, tpm2.CmdReadNV))
+	require.Equal(t, tpmutil.RCSuccess, policy(trial, swtpm2.CmdPolicyAuthValue))
+	require.Equal(t, commandPolicy, policyDigest(trial))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}),
+		policy(trial, tpm2.CmdPolicyCommandCode, tpm2.CmdWriteNV))
+	require.NoError(t, tpm2.FlushContext(rw, trial))
+	trial, _ = startPolicySession(t, rw, tpm2.SessionTrial)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCPolicyCC, Parameter: tpm2.RC1}),
+		policy(trial, tpm2.CmdPolicyCommandCode, tpmutil.Command(0x1FF)))
+	require.NoError(t, tpm2.FlushContext(rw, trial))
+
+	const index = tpmutil.Handle(0x015000A0)
+	name := defineIndex(index, commandPolicy)
+	session, nonceTPM := startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyCommandCode(rw, session, tpm2.CmdReadNV))
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyAuthValue))
+	require.Equal(t, tpmutil.RCSuccess, nvRead(index, session, sessionHMAC([]byte("secret"), readCpHash(name), nonceCaller, nonceTPM, 0)))
+	session, nonceTPM = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyCommandCode(rw, session, tpm2.CmdReadNV))
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyAuthValue))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}),
+		nvRead(index, session, sessionHMAC([]byte("wrong"), readCpHash(name), nonceCaller, nonceTPM, 0)))
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyCommandCode(rw, session, tpm2.CmdWriteNV))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyCC, Session: tpm2.RC1}), nvRead(index, session, nil))
+
+	// PolicyPassword has the policy of PolicyAuthValue, the authValue is sent in clear text
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyPassword(rw, session))
+	require.Equal(t, authValuePolicy, policyDigest(session))
+	name = defineIndex(index+1, authValuePolicy)
+	require.Equal(t, tpmutil.RCSuccess, nvRead(index+1, session, []byte("secret")))
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.NoError(t, tpm2.PolicyPassword(rw, session))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCAuthFail, Session: tpm2.RC1}), nvRead(index+1, session, []byte("wrong")))
+
+	// PolicyLocality narrows the localities with every assertion
+	localityPolicy := extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x6F, 0x0A})
+	defineIndex(index+2, localityPolicy)
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyLocality, byte(0x0A)))
+	require.Equal(t, localityPolicy, policyDigest(session))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Warning{Code: tpm2.RCLocality}), nvRead(index+2, session, nil))
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyLocality, byte(0x0A)))
+	rw.locality = 3
+	require.Equal(t, tpmutil.RCSuccess, nvRead(index+2, session, nil))
+	rw.locality = 0
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyLocality, byte(0x0A)))
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyLocality, byte(0x03)))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCRange, Parameter: tpm2.RC1}),
+		policy(session, swtpm2.CmdPolicyLocality, byte(0x04)))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCRange, Parameter: tpm2.RC1}),
+		policy(session, swtpm2.CmdPolicyLocality, byte(0x20)))
+	require.NoError(t, tpm2.FlushContext(rw, session))
+
+	// PolicyPhysicalPresence requires the assertion of physical presence
+	ppPolicy := extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x87})
+	defineIndex(index+3, ppPolicy)
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyPhysicalPresence))
+	require.Equal(t, ppPolicy, policyDigest(session))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPP, Session: tpm2.RC1}), nvRead(index+3, session, nil))
+	tpm.SetPhysicalPresence(true)
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyPhysicalPresence))
+	require.Equal(t, tpmutil.RCSuccess, nvRead(index+3, session, nil))
+	tpm.SetPhysicalPresence(false)
+
+	// PolicyNameHash binds the session to the Names of the handles and excludes PolicyCpHash
+	const nameIndex = index + 4
+	session, _ = startPolicySession(t, rw, tpm2.SessionTrial)
+	defineIndex(nameIndex, make([]byte, 32))
+	resp, _, err := tpmutil.RunCommand(rw, tpm2.TagNoSessions, tpm2.CmdReadPublicNV, nameIndex)
+	require.NoError(t, err)
+	var nvPublic, nvName tpmutil.U16Bytes
+	_, err = tpmutil.Unpack(resp, &nvPublic, &nvName)
+	require.NoError(t, err)
+	nameHash := extend(nil, nvName, nvName)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyNameHash, tpmutil.U16Bytes(nameHash)))
+	nameHashPolicy := extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x70}, nameHash)
+	require.Equal(t, nameHashPolicy, policyDigest(session))
+	require.NoError(t, tpm2.FlushContext(rw, session))
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyNameHash, tpmutil.U16Bytes(nameHash)))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCCPHash}),
+		policy(session, swtpm2.CmdPolicyCpHash, tpmutil.U16Bytes(readCpHash(nvName))))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCCPHash}),
+		policy(session, swtpm2.CmdPolicyNameHash, tpmutil.U16Bytes(nameHash)))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyFail, Session: tpm2.RC1}), nvRead(index+1, session, nil))
+
+	// PolicyCpHash binds the session to the parameters
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCSize, Parameter: tpm2.RC1}),
+		policy(session, swtpm2.CmdPolicyCpHash, tpmutil.U16Bytes(make([]byte, 20))))
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyCpHash, tpmutil.U16Bytes(readCpHash(nvName))))
+	require.Equal(t, extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x63}, readCpHash(nvName)), policyDigest(session))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCCPHash}),
+		policy(session, swtpm2.CmdPolicyCpHash, tpmutil.U16Bytes(readCpHash(name))))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCCPHash}),
+		policy(session, swtpm2.CmdPolicyTemplate, tpmutil.U16Bytes(make([]byte, 32))))
+	require.NoError(t, tpm2.FlushContext(rw, session))
+
+	// PolicyDuplicationSelect restricts the session to Duplicate, objectName is a part of the policy when included
+	objectName := append([]byte{0x00, 0x0B}, bytes.Repeat([]byte{1}, 32)...)
+	parentName := append([]byte{0x00, 0x0B}, bytes.Repeat([]byte{2}, 32)...)
+	session, _ = startPolicySession(t, rw, tpm2.SessionTrial)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyDuplicationSelect,
+		tpmutil.U16Bytes(objectName), tpmutil.U16Bytes(parentName), byte(1)))
+	require.Equal(t, extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x88}, objectName, parentName, []byte{1}), policyDigest(session))
+	require.NoError(t, tpm2.FlushContext(rw, session))
+	session, _ = startPolicySession(t, rw, tpm2.SessionTrial)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyDuplicationSelect,
+		tpmutil.U16Bytes(objectName), tpmutil.U16Bytes(parentName), byte(0)))
+	require.Equal(t, extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x88}, parentName, []byte{0}), policyDigest(session))
+	require.NoError(t, tpm2.FlushContext(rw, session))
+	session, _ = startPolicySession(t, rw, tpm2.SessionTrial)
+	require.NoError(t, tpm2.PolicyCommandCode(rw, session, tpm2.CmdReadNV))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.Error{Code: tpm2.RCCommandCode}), policy(session, swtpm2.CmdPolicyDuplicationSelect,
+		tpmutil.U16Bytes(objectName), tpmutil.U16Bytes(parentName), byte(0)))
+	require.NoError(t, tpm2.FlushContext(rw, session))
+
+	// PolicyTemplate allows only the creation of objects, it can be repeated with the same templateHash
+	templateHash := bytes.Repeat([]byte{3}, 32)
+	session, _ = startPolicySession(t, rw, tpm2.SessionPolicy)
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyTemplate, tpmutil.U16Bytes(templateHash)))
+	require.Equal(t, extend(make([]byte, 32), []byte{0x00, 0x00, 0x01, 0x90}, templateHash), policyDigest(session))
+	require.Equal(t, tpmutil.RCSuccess, policy(session, swtpm2.CmdPolicyTemplate, tpmutil.U16Bytes(templateHash)))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.ParameterError{Code: tpm2.RCValue, Parameter: tpm2.RC1}),
+		policy(session, swtpm2.CmdPolicyTemplate, tpmutil.U16Bytes(make([]byte, 32))))
+	require.Equal(t, swtpm2.ResponseCode(tpm2.SessionError{Code: tpm2.RCPolicyFail, Session: tpm2.RC1}), nvRead(nameIndex, session, nil))
+}
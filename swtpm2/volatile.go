@@ -0,0 +1,398 @@
+package swtpm2
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/google/go-tpm/tpm2"
+	"github.com/google/go-tpm/tpmutil"
+)
+
+// The volatile state is encoded like the persistent state with its own magic and version
+const (
+	volatileStateMagic          = "SWV2"
+	volatileStateVersion uint32 = 1
+)
+
+// Tags of the sections of the volatile state
+const (
+	volatileSectionFlags      uint16 = 1
+	volatileSectionNull       uint16 = 2
+	volatileSectionPCRs       uint16 = 3
+	volatileSectionObjects    uint16 = 4
+	volatileSectionSessions   uint16 = 5
+	volatileSectionNVCounters uint16 = 6
+)
+
+// volatileState is the decoded volatile state that is applied to TPM2 at once
+type volatileState struct {
+	started         bool
+	orderlyStartup  bool
+	hcrtmStartup    bool
+	pcrReconfigured bool
+	// time is the value of Time, selfHealStart and lockoutStart are the recovery intervals relative to it
+	time          uint64
+	selfHealStart uint64
+	lockoutStart  uint64
+	nullHierarchy *hierarchy
+	pcrBanks      []*pcrBank
+	// pcrUpdateCounter counts changes of PCRs
+	pcrUpdateCounter uint32
+	objects          map[tpmutil.Handle]*object
+	sessions         map[tpmutil.Handle]*session
+	// nvCounters are the values of orderly counters kept in RAM
+	nvCounters map[tpmutil.Handle]uint64
+}
+
+// volatileSection encodes and decodes a section of the volatile state,
+// the decoder checks the state against the persistent state of TPM2
+type volatileSection struct {
+	tag    uint16
+	encode func(t *TPM2) ([]byte, error)
+	decode func(t *TPM2, buf *bytes.Buffer, state *volatileState) error
+}
+
+// volatileSections are all sections of the volatile state in ascending order of tags, every section is required
+var volatileSections = []volatileSection{
+	{volatileSectionFlags, encodeVolatileFlags, decodeVolatileFlags},
+	{volatileSectionNull, encodeNullHierarchy, decodeNullHierarchy},
+	{volatileSectionPCRs, encodePCRValues, decodePCRValues},
+	{volatileSectionObjects, encodeTransientObjects, decodeTransientObjects},
+	{volatileSectionSessions, encodeSessions, decodeSessions},
+	{volatileSectionNVCounters, encodeNVCounters, decodeNVCounters},
+}
+
+// MarshalVolatileState encodes the state of TPM2 that is lost by _TPM_Init: whether the TPM is started,
+// PCR values, the secrets of the null hierarchy, transient objects, sessions, orderly counters and Time.
+// An H-CRTM event sequence in progress is not saved
+func (t *TPM2) MarshalVolatileState() ([]byte, error) {
+	sections := make([][]byte, len(volatileSections))
+	tags := make([]uint16, len(volatileSections))
+	for i, section := range volatileSections {
+		data, err := section.encode(t)
+		if err != nil {
+			return nil, err
+		}
+		sections[i], tags[i] = data, section.tag
+	}
+	return sealSections(volatileStateMagic, volatileStateVersion, tags, sections)
+}
+
+// LoadVolatileState replaces the volatile state of TPM2 with a state produced by MarshalVolatileState of a TPM
+// with the same persistent state, so a running TPM continues where the state was saved without Startup.
+// The persistent state is loaded first with LoadState
+func (t *TPM2) LoadVolatileState(b []byte) error {
+	tags := make([]uint16, len(volatileSections))
+	for i, section := range volatileSections {
+		tags[i] = section.tag
+	}
+	sections, err := openSections(b, volatileStateMagic, volatileStateVersion, tags)
+	if err != nil {
+		return err
+	}
+	state := &volatileState{
+		objects:    make(map[tpmutil.Handle]*object),
+		sessions:   make(map[tpmutil.Handle]*session),
+		nvCounters: make(map[tpmutil.Handle]uint64),
+	}
+	for i, section := range volatileSections {
+		if err := decodeSection(sections[i], section.tag, func(buf *bytes.Buffer) error {
+			return section.decode(t, buf, state)
+		}); err != nil {
+			return err
+		}
+	}
+
+	// the allocation of the persistent state is pending when it differs from the banks of the running TPM
+	allocation := t.pcrAllocation()
+	t.pcrBanks = state.pcrBanks
+	t.pendingPCRAllocation = nil
+	if !t.sameAllocation(allocation, t.pcrAllocation()) {
+		t.pendingPCRAllocation = allocation
+	}
+	t.pcrUpdateCounter = state.pcrUpdateCounter
+	t.pcrReconfigured = state.pcrReconfigured
+	t.hierarchies[tpm2.HandleNull] = state.nullHierarchy
+	t.flushTransientObjects()
+	for handle, obj := range state.objects {
+		t.objects[handle] = obj
+	}
+	t.sessions = state.sessions
+	t.sessionAuths = nil
+	for handle, counter := range state.nvCounters {
+		t.nvIndices[handle].setCounter(counter)
+	}
+	t.timeStart = time.Now().Add(-time.Duration(state.time) * time.Millisecond)
+	t.da.selfHealStart = state.selfHealStart
+	t.da.lockoutStart = state.lockoutStart
+	t.eventSequence = nil
+	t.hcrtmStartup = state.hcrtmStartup
+	t.orderlyStartup = state.orderlyStartup
+	t.started = state.started
+	return nil
+}
+
+// sameAllocation reports whether two allocations of PCR banks select the same PCRs
+func (t *TPM2) sameAllocation(a, b []tpm2.PCRSelection) bool {
+	size := PCRSelectSize(t.pcrCount)
+	encodedA, errA := EncodePCRSelectionWithSize(size, a...)
+	encodedB, errB := EncodePCRSelectionWithSize(size, b...)
+	return errA == nil && errB == nil && bytes.Equal(encodedA, encodedB)
+}
+
+// encodeVolatileFlags encodes the flags of the running TPM and Time
+func encodeVolatileFlags(t *TPM2) ([]byte, error) {
+	return tpmutil.Pack(t.started, t.orderlyStartup, t.hcrtmStartup, t.pcrReconfigured,
+		t.timeValue(), t.da.selfHealStart, t.da.lockoutStart)
+}
+
+func decodeVolatileFlags(_ *TPM2, buf *bytes.Buffer, state *volatileState) error {
+	return tpmutil.UnpackBuf(buf, &state.started, &state.orderlyStartup, &state.hcrtmStartup, &state.pcrReconfigured,
+		&state.time, &state.selfHealStart, &state.lockoutStart)
+}
+
+// encodeNullHierarchy encodes the secrets of the null hierarchy that are replaced by TPM Reset
+func encodeNullHierarchy(t *TPM2) ([]byte, error) {
+	null := t.hierarchies[tpm2.HandleNull]
+	return tpmutil.Pack(tpmutil.U16Bytes(null.seed), tpmutil.U16Bytes(null.proof))
+}
+
+func decodeNullHierarchy(_ *TPM2, buf *bytes.Buffer, state *volatileState) error {
+	var seed, proof tpmutil.U16Bytes
+	if err := tpmutil.UnpackBuf(buf, &seed, &proof); err != nil {
+		return err
+	}
+	if len(seed) != primarySeedSize || len(proof) != primarySeedSize {
+		return fmt.Errorf("null hierarchy secrets have %d and %d bytes", len(seed), len(proof))
+	}
+	state.nullHierarchy = &hierarchy{
+		seed:       seed,
+		proof:      proof,
+		authPolicy: tpm2.HashValue{Alg: tpm2.AlgNull},
+	}
+	return nil
+}
+
+// encodePCRValues encodes pcrUpdateCounter and the values of the allocated PCR banks,
+// PCRs that are not allocated are encoded as empty buffers
+func encodePCRValues(t *TPM2) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := packState(&buf, t.pcrUpdateCounter, uint8(len(t.pcrBanks))); err != nil {
+		return nil, err
+	}
+	for _, bank := range t.pcrBanks {
+		if err := packState(&buf, bank.hashAlg); err != nil {
+			return nil, err
+		}
+		for _, value := range bank.values {
+			if err := packState(&buf, tpmutil.U16Bytes(value)); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodePCRValues(t *TPM2, buf *bytes.Buffer, state *volatileState) error {
+	var bankCount uint8
+	if err := tpmutil.UnpackBuf(buf, &state.pcrUpdateCounter, &bankCount); err != nil {
+		return err
+	}
+	for i := 0; i < int(bankCount); i++ {
+		var hashAlg tpm2.Algorithm
+		if err := tpmutil.UnpackBuf(buf, &hashAlg); err != nil {
+			return err
+		}
+		size, ok := digestSize(hashAlg)
+		if !ok {
+			return fmt.Errorf("unsupported PCR bank algorithm 0x%x", hashAlg)
+		}
+		if i > 0 && hashAlg <= state.pcrBanks[i-1].hashAlg {
+			return fmt.Errorf("PCR bank 0x%x is out of order", hashAlg)
+		}
+		bank := &pcrBank{hashAlg: hashAlg, values: make([][]byte, t.pcrCount)}
+		for pcr := range bank.values {
+			var value tpmutil.U16Bytes
+			if err := tpmutil.UnpackBuf(buf, &value); err != nil {
+				return err
+			}
+			if len(value) != 0 && len(value) != size {
+				return fmt.Errorf("PCR %d of bank 0x%x has %d bytes", pcr, hashAlg, len(value))
+			}
+			bank.values[pcr] = emptyToNil(value)
+		}
+		state.pcrBanks = append(state.pcrBanks, bank)
+	}
+	return nil
+}
+
+// encodeTransientObjects encodes the loaded transient objects in ascending order of handles
+func encodeTransientObjects(t *TPM2) ([]byte, error) {
+	var handles []tpmutil.Handle
+	for handle := range t.objects {
+		if uint32(handle)>>handleTypeShift == handleTypeTransient {
+			handles = append(handles, handle)
+		}
+	}
+	sortHandles(handles)
+
+	var buf bytes.Buffer
+	if err := packState(&buf, uint32(len(handles))); err != nil {
+		return nil, err
+	}
+	for _, handle := range handles {
+		if err := encodeObject(&buf, handle, t.objects[handle]); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeTransientObjects(t *TPM2, buf *bytes.Buffer, state *volatileState) error {
+	var count uint32
+	if err := tpmutil.UnpackBuf(buf, &count); err != nil {
+		return err
+	}
+	if count > maxLoadedObjects {
+		return fmt.Errorf("%d transient objects exceed the limit", count)
+	}
+	for i := 0; i < int(count); i++ {
+		handle, obj, err := decodeObject(buf)
+		if err != nil {
+			return err
+		}
+		if handle < transientFirst || handle > transientLast || state.objects[handle] != nil {
+			return fmt.Errorf("invalid or duplicate transient object 0x%x", handle)
+		}
+		if _, ok := t.hierarchies[obj.hierarchy]; !ok {
+			return fmt.Errorf("transient object 0x%x belongs to unknown hierarchy 0x%x", handle, obj.hierarchy)
+		}
+		state.objects[handle] = obj
+	}
+	return nil
+}
+
+// encodeSessions encodes the loaded sessions in ascending order of handles
+func encodeSessions(t *TPM2) ([]byte, error) {
+	handles := make([]tpmutil.Handle, 0, len(t.sessions))
+	for handle := range t.sessions {
+		handles = append(handles, handle)
+	}
+	sortHandles(handles)
+
+	var buf bytes.Buffer
+	if err := packState(&buf, uint32(len(handles))); err != nil {
+		return nil, err
+	}
+	for _, handle := range handles {
+		s := t.sessions[handle]
+		if err := packState(&buf, handle, s.sessionType, s.authHash, s.symmetric.Alg, s.symmetric.KeyBits, s.symmetric.Mode,
+			tpmutil.U16Bytes(s.sessionKey), tpmutil.U16Bytes(s.nonceTPM), tpmutil.U16Bytes(s.boundEntity),
+			tpmutil.U16Bytes(s.policyDigest), s.pcrChecked, s.pcrUpdateCounter, s.startTime, s.timeout,
+			tpmutil.U16Bytes(s.cpHash), s.checkNVWritten, s.nvWrittenState, s.commandCode,
+			tpmutil.U16Bytes(s.nameHash), tpmutil.U16Bytes(s.templateHash), s.commandLocality,
+			s.isAuthValueNeeded, s.isPasswordNeeded, s.isPPRequired); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeSessions(_ *TPM2, buf *bytes.Buffer, state *volatileState) error {
+	var count uint32
+	if err := tpmutil.UnpackBuf(buf, &count); err != nil {
+		return err
+	}
+	if count > maxLoadedSessions {
+		return fmt.Errorf("%d sessions exceed the limit", count)
+	}
+	for i := 0; i < int(count); i++ {
+		var handle tpmutil.Handle
+		var sessionKey, nonceTPM, boundEntity, policyDigest, cpHash, nameHash, templateHash tpmutil.U16Bytes
+		s := &session{}
+		if err := tpmutil.UnpackBuf(buf, &handle, &s.sessionType, &s.authHash, &s.symmetric.Alg, &s.symmetric.KeyBits,
+			&s.symmetric.Mode, &sessionKey, &nonceTPM, &boundEntity, &policyDigest, &s.pcrChecked, &s.pcrUpdateCounter,
+			&s.startTime, &s.timeout, &cpHash, &s.checkNVWritten, &s.nvWrittenState, &s.commandCode, &nameHash,
+			&templateHash, &s.commandLocality, &s.isAuthValueNeeded, &s.isPasswordNeeded, &s.isPPRequired); err != nil {
+			return err
+		}
+
+		// the slot of a session is shared by the HMAC and the policy session ranges
+		first := hmacSessionFirst
+		switch s.sessionType {
+		case tpm2.SessionHMAC:
+		case tpm2.SessionPolicy, tpm2.SessionTrial:
+			first = policySessionFirst
+		default:
+			return fmt.Errorf("session 0x%x has unknown type %d", handle, s.sessionType)
+		}
+		slot := handle - first
+		if handle < first || slot >= maxLoadedSessions ||
+			state.sessions[hmacSessionFirst+slot] != nil || state.sessions[policySessionFirst+slot] != nil {
+			return fmt.Errorf("invalid or duplicate session 0x%x", handle)
+		}
+		size, ok := digestSize(s.authHash)
+		if !ok || len(nonceTPM) != size || len(policyDigest) != size {
+			return fmt.Errorf("session 0x%x has invalid hash algorithm 0x%x or digests", handle, s.authHash)
+		}
+		if !checkSessionSymmetric(s.symmetric) {
+			return fmt.Errorf("session 0x%x has invalid symmetric algorithm 0x%x", handle, s.symmetric.Alg)
+		}
+		s.sessionKey = emptyToNil(sessionKey)
+		s.nonceTPM = nonceTPM
+		s.boundEntity = emptyToNil(boundEntity)
+		s.policyDigest = policyDigest
+		s.cpHash = emptyToNil(cpHash)
+		s.nameHash = emptyToNil(nameHash)
+		s.templateHash = emptyToNil(templateHash)
+		state.sessions[handle] = s
+	}
+	return nil
+}
+
+// encodeNVCounters encodes the values of written orderly counters that are kept in RAM in ascending order of handles
+func encodeNVCounters(t *TPM2) ([]byte, error) {
+	var handles []tpmutil.Handle
+	for handle, nv := range t.nvIndices {
+		if nv.isOrderlyCounter() && nv.has(tpm2.AttrWritten) {
+			handles = append(handles, handle)
+		}
+	}
+	sortHandles(handles)
+
+	var buf bytes.Buffer
+	if err := packState(&buf, uint32(len(handles))); err != nil {
+		return nil, err
+	}
+	for _, handle := range handles {
+		if err := packState(&buf, handle, t.nvIndices[handle].counter()); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeNVCounters(t *TPM2, buf *bytes.Buffer, state *volatileState) error {
+	var count uint32
+	if err := tpmutil.UnpackBuf(buf, &count); err != nil {
+		return err
+	}
+	for i := 0; i < int(count); i++ {
+		var handle tpmutil.Handle
+		var counter uint64
+		if err := tpmutil.UnpackBuf(buf, &handle, &counter); err != nil {
+			return err
+		}
+		nv, ok := t.nvIndices[handle]
+		if !ok || !nv.isOrderlyCounter() || !nv.has(tpm2.AttrWritten) {
+			return fmt.Errorf("0x%x is not a written orderly counter", handle)
+		}
+		// the counter in RAM is never behind the value in NV memory
+		if _, ok := state.nvCounters[handle]; ok || counter < nv.nvCounter {
+			return fmt.Errorf("invalid or duplicate value of orderly counter 0x%x", handle)
+		}
+		state.nvCounters[handle] = counter
+	}
+	return nil
+}
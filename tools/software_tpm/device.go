@@ -0,0 +1,253 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/google/go-tpm/tpmutil"
+	"github.com/rihter007/go-swtpm/swtpm"
+	"github.com/rihter007/go-swtpm/swtpm2"
+	"github.com/rihter007/go-swtpm/transport"
+)
+
+// Errors of the state blobs
+var (
+	errUnknownBlob = errors.New("unknown state blob type")
+	// errSaveStateBlob is returned for a savestate blob with data, the state saved by Shutdown(STATE)
+	// is a part of the permanent blob
+	errSaveStateBlob = errors.New("the savestate blob is a part of the permanent blob")
+)
+
+// lockedDevice serializes TPM commands and platform signals that arrive from different connections
+type lockedDevice struct {
+	mu  sync.Mutex
+	tpm *swtpm2.TPM2
+	// state receives the persistent state after every change, the state is not saved when it is nil
+	state *stateFile
+	// volatile is the volatile state stored by CMD_STORE_VOLATILE or CMD_SET_STATEBLOB, it is restored
+	// by the next power-on
+	volatile []byte
+}
+
+// persist saves the persistent state of the TPM, the caller holds the lock
+func (d *lockedDevice) persist() {
+	if d.state == nil {
+		return
+	}
+	if err := d.storeState(); err != nil {
+		log.Errorf("failed to save TPM state, err: %v", err)
+	}
+}
+
+func (d *lockedDevice) storeState() error {
+	state, err := d.tpm.MarshalState()
+	if err != nil {
+		return err
+	}
+	return d.state.save(state)
+}
+
+func (d *lockedDevice) PowerOn() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.PowerOn()
+	d.restoreVolatile()
+	d.persist()
+}
+
+// restoreVolatile applies the stored volatile state once, the TPM waits for Startup when it cannot be applied.
+// The caller holds the lock
+func (d *lockedDevice) restoreVolatile() {
+	if d.volatile == nil {
+		return
+	}
+	if err := d.tpm.LoadVolatileState(d.volatile); err != nil {
+		log.Errorf("failed to restore volatile TPM state, err: %v", err)
+	}
+	d.dropVolatile()
+}
+
+// dropVolatile removes the stored volatile state, the caller holds the lock
+func (d *lockedDevice) dropVolatile() {
+	d.volatile = nil
+	if d.state == nil {
+		return
+	}
+	if err := d.state.removeVolatile(); err != nil {
+		log.Errorf("failed to remove volatile TPM state, err: %v", err)
+	}
+}
+
+func (d *lockedDevice) PowerOff() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.PowerOff()
+}
+
+func (d *lockedDevice) Init() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.Init()
+	d.persist()
+}
+
+func (d *lockedDevice) SetNVAvailable(available bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.SetNVAvailable(available)
+}
+
+func (d *lockedDevice) SetPhysicalPresence(asserted bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.SetPhysicalPresence(asserted)
+}
+
+func (d *lockedDevice) SetCancel(canceled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.SetCancel(canceled)
+}
+
+func (d *lockedDevice) HashStart() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.HashStart()
+	d.persist()
+}
+
+func (d *lockedDevice) HashData(data []byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.HashData(data)
+}
+
+func (d *lockedDevice) HashEnd() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.tpm.HashEnd()
+}
+
+func (d *lockedDevice) TPMEstablished() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.tpm.TPMEstablished()
+}
+
+func (d *lockedDevice) ResetTPMEstablished(locality uint8) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.tpm.ResetTPMEstablished(locality); err != nil {
+		return err
+	}
+	d.persist()
+	return nil
+}
+
+// StoreVolatile saves the volatile state of the running TPM for the next power-on,
+// it is written to the state directory together with the persistent state
+func (d *lockedDevice) StoreVolatile() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	volatile, err := d.tpm.MarshalVolatileState()
+	if err != nil {
+		return err
+	}
+	if d.state != nil {
+		if err := d.storeState(); err != nil {
+			return err
+		}
+		if err := d.state.saveVolatile(volatile); err != nil {
+			return err
+		}
+	}
+	d.volatile = volatile
+	return nil
+}
+
+// DeleteVolatile drops the stored volatile state and the state saved by Shutdown(STATE),
+// so the next Startup is TPM Reset
+func (d *lockedDevice) DeleteVolatile() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dropVolatile()
+	d.tpm.DiscardSavedState()
+	d.persist()
+	return nil
+}
+
+// StateBlob returns the persistent state or the volatile state of the running TPM. The state saved
+// by Shutdown(STATE) is a part of the persistent state, so the savestate blob is always empty
+func (d *lockedDevice) StateBlob(blobType swtpm.BlobType) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch blobType {
+	case swtpm.BlobPermanent:
+		return d.tpm.MarshalState()
+	case swtpm.BlobVolatile:
+		return d.tpm.MarshalVolatileState()
+	case swtpm.BlobSaveState:
+		return []byte{}, nil
+	default:
+		return nil, errUnknownBlob
+	}
+}
+
+// SetStateBlob replaces the persistent state at once or stores the volatile state for the next power-on,
+// only an empty savestate blob is accepted as in StateBlob
+func (d *lockedDevice) SetStateBlob(blobType swtpm.BlobType, blob []byte) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	switch blobType {
+	case swtpm.BlobPermanent:
+		if err := d.tpm.LoadState(blob); err != nil {
+			return err
+		}
+		d.persist()
+	case swtpm.BlobVolatile:
+		if d.state != nil {
+			if err := d.state.saveVolatile(blob); err != nil {
+				return err
+			}
+		}
+		d.volatile = blob
+	case swtpm.BlobSaveState:
+		if len(blob) != 0 {
+			return errSaveStateBlob
+		}
+	default:
+		return errUnknownBlob
+	}
+	return nil
+}
+
+func (d *lockedDevice) processCommand(command []byte, locality uint8) ([]byte, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	response, err := swtpm2.ProcessCommandAtLocality(bytes.NewBuffer(command), locality, d.tpm)
+	d.persist()
+	return response, err
+}
+
+// processConnection processes raw TPM commands of a connection at locality 0 until it fails
+func (d *lockedDevice) processConnection(c net.Conn) {
+	loop := transport.NewConnectionProcessingLoop(func(c net.Conn) error {
+		header, body, err := swtpm2.ParseCommandHeader(c)
+		if err != nil {
+			return err
+		}
+		command, err := tpmutil.Pack(header, tpmutil.RawBytes(body))
+		if err != nil {
+			return err
+		}
+		response, err := d.processCommand(command, 0)
+		if err != nil {
+			return err
+		}
+		_, err = c.Write(response)
+		return err
+	})
+	loop(c)
+}
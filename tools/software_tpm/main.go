@@ -1,17 +1,15 @@
 package main
 
 import (
-	"bytes"
 	"context"
 	"flag"
 	"fmt"
 	"github.com/rihter007/go-swtpm/swtpm2"
 	"net"
 	"os"
-	"sync"
+	"strconv"
 
 	"github.com/facebookincubator/contest/pkg/logging"
-	"github.com/rihter007/go-swtpm/mssim"
 	"github.com/rihter007/go-swtpm/transport"
 	"github.com/sirupsen/logrus"
 )
@@ -30,7 +28,14 @@ func main() {
 
 	logLevelLiteral := flag.String("log-level", "info", "Determines the log level, the valid options are: "+logLevelOptions)
 	useMssim := flag.Bool("mssim", false, "start in mssim mode")
+	useSWTPM := flag.Bool("swtpm", false, "start in swtpm mode with a data channel and a control channel")
 	port := flag.Int("port", 2321, "Port to start listening commands at")
+	unixPath := flag.String("unix", "", "Path of a unix domain socket to listen commands at instead of the TCP port, "+
+		"in mssim mode platform commands are received at the path with \".plat\" suffix, "+
+		"in swtpm mode the control channel is at the path with \".ctrl\" suffix")
+	unixMode := flag.String("unix-mode", "0600", "Octal permissions of unix domain sockets")
+	stateDir := flag.String("state-dir", "", "Directory to keep the TPM state in across restarts, "+
+		"the TPM state is lost on exit when it is empty")
 	flag.Parse()
 
 	logLevel, err := logrus.ParseLevel(*logLevelLiteral)
@@ -40,69 +45,73 @@ func main() {
 	logrus.SetOutput(os.Stdout)
 	logrus.SetLevel(logLevel)
 
-	tpmDevice := swtpm2.NewTPM2()
+	device := &lockedDevice{tpm: swtpm2.NewTPM2()}
+	if *stateDir != "" {
+		device.tpm, device.state, err = openStateFile(*stateDir)
+		if err != nil {
+			log.Panic(err)
+		}
+		if device.volatile, err = device.state.loadVolatile(); err != nil {
+			log.Panic(err)
+		}
+	}
 	transportLogger := logging.GetLogger("transport")
 
-	if *useMssim {
-		if err := launchMSSIMServer(*port, *port+1, tpmDevice, transportLogger); err != nil {
+	if *useMssim && *useSWTPM {
+		log.Panicf("mssim and swtpm modes cannot be used together")
+	}
+
+	// platform commands of mssim and the control channel of swtpm are received at the next port
+	commandServer, controlServer := tcpServer(*port, transportLogger), tcpServer(*port+1, transportLogger)
+	if *unixPath != "" {
+		mode, err := strconv.ParseUint(*unixMode, 8, 32)
+		if err != nil {
+			log.Panicf("invalid unix socket permissions %q: %v", *unixMode, err)
+		}
+		controlSuffix := ".plat"
+		if *useSWTPM {
+			controlSuffix = ".ctrl"
+		}
+		commandServer = unixServer(*unixPath, os.FileMode(mode), transportLogger)
+		controlServer = unixServer(*unixPath+controlSuffix, os.FileMode(mode), transportLogger)
+	}
+
+	switch {
+	case *useMssim:
+		if err := launchMSSIMServer(commandServer, controlServer, device); err != nil {
 			log.Errorf("faield to launch server: %v", err)
 		}
-	} else {
-		loop := swtpm2.NewLoopProcessCommand(tpmDevice)
-		connectionLoop := func(c net.Conn) {
-			loop(c)
+	case *useSWTPM:
+		if err := launchSWTPMServer(commandServer, controlServer, device); err != nil {
+			log.Errorf("failed to launch server: %v", err)
 		}
-		if err := transport.ServeTCP(context.Background(), *port, connectionLoop, transportLogger); err != nil {
-			log.Errorf("failed during serving commands on TCP transport, err: %v", err)
+	default:
+		if err := commandServer.serve(context.Background(), device.processConnection); err != nil {
+			log.Errorf("failed during serving commands on %s, err: %v", commandServer.name, err)
 		}
 	}
 }
 
-func launchMSSIMServer(commandPort, platformPort int, commands swtpm2.Commands, transportLogger *logrus.Entry) error {
-	log.Infof("launch in mssim mode, command port: %d, platform port %d", commandPort, platformPort)
-
-	var wg sync.WaitGroup
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-
-		loop := transport.NewConnectionProcessingLoop(func(c net.Conn) error {
-			return mssim.DummyPlatformProcessor(c, nil)
-		})
-		if err := transport.ServeTCP(context.Background(), platformPort, loop, transportLogger); err != nil {
-			log.Errorf("failed during serving mssim platform commands on TCP transport, err: %v", err)
-		}
-	}()
-
-	// launch commands processor
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		processor := func(c net.Conn) error {
-			request, err := mssim.ParseRequest(c)
-			if err != nil {
-				return err
-			}
-
-			commandResponse, err := swtpm2.ProcessCommand(bytes.NewBuffer(request.InternalCommand), commands)
-			if err != nil {
-				return fmt.Errorf("failed to process TPM command, err: %v", err)
-			}
+// server accepts connections on a single endpoint until the context is canceled
+type server struct {
+	name  string
+	serve func(ctx context.Context, handleConnection func(c net.Conn)) error
+}
 
-			mssimResponse, err := mssim.CreateResponse(mssim.RCSuccess, commandResponse)
-			if err != nil {
-				return fmt.Errorf("failed creating response frame, err: %v", err)
-			}
-			bytesWritten, err := c.Write(mssimResponse)
-			log.Infof("command processed, response bytes written: %d", bytesWritten)
-			return err
-		}
+func tcpServer(port int, transportLogger *logrus.Entry) server {
+	return server{
+		name: fmt.Sprintf("TCP port %d", port),
+		serve: func(ctx context.Context, handleConnection func(c net.Conn)) error {
+			return transport.ServeTCP(ctx, port, handleConnection, transportLogger)
+		},
+	}
+}
 
-		loop := transport.NewConnectionProcessingLoop(processor)
-		if err := transport.ServeTCP(context.Background(), commandPort, loop, transportLogger); err != nil {
-			log.Errorf("failed during serving mssim commands on TCP transport, err: %v", err)
-		}
-	}()
-	wg.Wait()
-	return nil
+func unixServer(path string, mode os.FileMode, transportLogger *logrus.Entry) server {
+	return server{
+		name: fmt.Sprintf("unix socket %s", path),
+		serve: func(ctx context.Context, handleConnection func(c net.Conn)) error {
+			return transport.ServeUnixWithMode(ctx, path, mode, handleConnection, transportLogger)
+		},
+	}
 }
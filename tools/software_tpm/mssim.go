@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/rihter007/go-swtpm/mssim"
+	"github.com/rihter007/go-swtpm/transport"
+)
+
+func launchMSSIMServer(commandServer, platformServer server, device *lockedDevice) error {
+	log.Infof("launch in mssim mode, commands on %s, platform commands on %s", commandServer.name, platformServer.name)
+
+	// TPM_STOP stops both servers
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		loop := transport.NewConnectionProcessingLoop(func(c net.Conn) error {
+			err := mssim.PlatformProcessor(c, device, nil)
+			if errors.Is(err, mssim.ErrStop) {
+				log.Infof("stop requested on the platform channel")
+				stop()
+			}
+			return err
+		})
+		connectionLoop := func(c net.Conn) {
+			loop(c)
+			_ = c.Close()
+		}
+		if err := platformServer.serve(ctx, connectionLoop); err != nil {
+			log.Errorf("failed during serving mssim platform commands on %s, err: %v", platformServer.name, err)
+		}
+	}()
+
+	// launch commands processor
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		processor := func(c net.Conn) error {
+			request, err := mssim.ParseRequest(c)
+			if err != nil {
+				return err
+			}
+
+			switch request.Command {
+			case mssim.TpmSessionEnd:
+				return mssim.ErrSessionEnd
+			case mssim.TpmSignalHashStart:
+				device.HashStart()
+				return binary.Write(c, binary.BigEndian, mssim.RCSuccess)
+			case mssim.TpmSignalHashData:
+				device.HashData(request.HashData)
+				return binary.Write(c, binary.BigEndian, mssim.RCSuccess)
+			case mssim.TpmSignalHashEnd:
+				device.HashEnd()
+				return binary.Write(c, binary.BigEndian, mssim.RCSuccess)
+			}
+
+			commandResponse, err := device.processCommand(request.InternalCommand, request.Locality)
+			if err != nil {
+				return fmt.Errorf("failed to process TPM command, err: %v", err)
+			}
+
+			mssimResponse, err := mssim.CreateResponse(mssim.RCSuccess, commandResponse)
+			if err != nil {
+				return fmt.Errorf("failed creating response frame, err: %v", err)
+			}
+			bytesWritten, err := c.Write(mssimResponse)
+			log.Infof("command processed, response bytes written: %d", bytesWritten)
+			return err
+		}
+
+		loop := transport.NewConnectionProcessingLoop(processor)
+		if err := commandServer.serve(ctx, loop); err != nil {
+			log.Errorf("failed during serving mssim commands on %s, err: %v", commandServer.name, err)
+		}
+	}()
+	wg.Wait()
+	return nil
+}
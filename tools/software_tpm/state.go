@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/rihter007/go-swtpm/swtpm2"
+)
+
+// Names of the files in the state directory
+const (
+	// stateFileName is the file with the persistent state of the TPM
+	stateFileName = "tpm2-state"
+	// volatileFileName is the file with the volatile state stored for the next power-on
+	volatileFileName = "tpm2-volatile-state"
+)
+
+// stateFile keeps the persistent state of the TPM on disk
+type stateFile struct {
+	path         string
+	volatilePath string
+	// stored is the content of the file, it is not rewritten while the state does not change
+	stored []byte
+}
+
+// openStateFile loads the TPM from the state directory, a new TPM is created and saved when there is no state yet
+func openStateFile(dir string) (*swtpm2.TPM2, *stateFile, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, nil, fmt.Errorf("failed to create state directory %s, err: %v", dir, err)
+	}
+	f := &stateFile{path: filepath.Join(dir, stateFileName), volatilePath: filepath.Join(dir, volatileFileName)}
+
+	tpm := swtpm2.NewTPM2()
+	state, err := ioutil.ReadFile(f.path)
+	switch {
+	case os.IsNotExist(err):
+		log.Infof("no TPM state at %s, a new TPM is created", f.path)
+		if state, err = tpm.MarshalState(); err != nil {
+			return nil, nil, err
+		}
+		if err := f.save(state); err != nil {
+			return nil, nil, err
+		}
+	case err != nil:
+		return nil, nil, fmt.Errorf("failed to read TPM state, err: %v", err)
+	default:
+		if err := tpm.LoadState(state); err != nil {
+			return nil, nil, fmt.Errorf("failed to load TPM state from %s, err: %w", f.path, err)
+		}
+		f.stored = state
+		log.Infof("TPM state is loaded from %s", f.path)
+	}
+	return tpm, f, nil
+}
+
+// save writes the state unless it is already on disk
+func (f *stateFile) save(state []byte) error {
+	if bytes.Equal(state, f.stored) {
+		return nil
+	}
+	if err := writeFileAtomic(f.path, state, 0600); err != nil {
+		return err
+	}
+	f.stored = state
+	return nil
+}
+
+// loadVolatile reads the stored volatile state, it is nil when there is none
+func (f *stateFile) loadVolatile() ([]byte, error) {
+	volatile, err := ioutil.ReadFile(f.volatilePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volatile TPM state, err: %v", err)
+	}
+	log.Infof("volatile TPM state is loaded from %s, it is restored by the next power-on", f.volatilePath)
+	return volatile, nil
+}
+
+// saveVolatile writes the volatile state that is restored by the next power-on
+func (f *stateFile) saveVolatile(volatile []byte) error {
+	return writeFileAtomic(f.volatilePath, volatile, 0600)
+}
+
+// removeVolatile removes the stored volatile state
+func (f *stateFile) removeVolatile() error {
+	if err := os.Remove(f.volatilePath); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// writeFileAtomic replaces a file with new content, the file has either the old or the new content after a crash
+func writeFileAtomic(path string, data []byte, perm os.FileMode) (err error) {
+	dir := filepath.Dir(path)
+	tmp, err := ioutil.TempFile(dir, filepath.Base(path)+".tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file, err: %v", err)
+	}
+	defer func() {
+		if err != nil {
+			_ = tmp.Close()
+			_ = os.Remove(tmp.Name())
+		}
+	}()
+
+	if err = tmp.Chmod(perm); err != nil {
+		return err
+	}
+	if _, err = tmp.Write(data); err != nil {
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+
+	// the rename is durable once the directory is synced
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = d.Close()
+	}()
+	return d.Sync()
+}
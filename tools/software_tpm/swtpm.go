@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/rihter007/go-swtpm/swtpm"
+	"github.com/rihter007/go-swtpm/transport"
+)
+
+func launchSWTPMServer(dataServer, ctrlServer server, device *lockedDevice) error {
+	log.Infof("launch in swtpm mode, data channel on %s, control channel on %s", dataServer.name, ctrlServer.name)
+
+	// CMD_SHUTDOWN stops both servers
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	var control *swtpm.Control
+	dataLoop := func(c net.Conn) {
+		transport.NewConnectionProcessingLoop(func(c net.Conn) error {
+			return control.ProcessData(c, device.processCommand)
+		})(c)
+		_ = c.Close()
+	}
+	control = swtpm.NewControl(device, dataLoop)
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		loop := transport.NewConnectionProcessingLoop(func(c net.Conn) error {
+			err := control.ProcessControl(c, nil)
+			if errors.Is(err, swtpm.ErrShutdown) {
+				log.Infof("shutdown requested on the control channel")
+				stop()
+			}
+			return err
+		})
+		connectionLoop := func(c net.Conn) {
+			loop(c)
+			_ = c.Close()
+		}
+		if err := ctrlServer.serve(ctx, connectionLoop); err != nil {
+			log.Errorf("failed during serving swtpm control commands on %s, err: %v", ctrlServer.name, err)
+		}
+	}()
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		if err := dataServer.serve(ctx, dataLoop); err != nil {
+			log.Errorf("failed during serving swtpm commands on %s, err: %v", dataServer.name, err)
+		}
+	}()
+	wg.Wait()
+	return nil
+}
@@ -0,0 +1,41 @@
+package transport
+
+import (
+	"context"
+	"net"
+
+	"github.com/rihter007/logruswrap"
+)
+
+// serve accepts connections until the context is canceled, the listener is closed on return
+func serve(ctx context.Context, listener net.Listener, address string, handleConnection func(c net.Conn), l logruswrap.PrintfLogger) error {
+	log := logruswrap.WrapPrintfLogger(l)
+	internalCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	go func() {
+		<-internalCtx.Done()
+
+		log.Debugf("close listener for %s", address)
+		if err := listener.Close(); err != nil {
+			log.Errorf("failed close listener, err: %v", err)
+		}
+	}()
+
+	log.Infof("listening on %s", address)
+	for {
+		c, err := listener.Accept()
+		if internalCtx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			log.Errorf("obtained an error during accept: %v on address %s", err, address)
+			continue
+		}
+		log.Debugf("connected from %s on address %s", c.RemoteAddr().String(), address)
+		go func(conn net.Conn) {
+			handleConnection(conn)
+			log.Infof("handling of %s finished", c.RemoteAddr().String())
+		}(c)
+	}
+}
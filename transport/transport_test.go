@@ -4,6 +4,8 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"os"
+	"path/filepath"
 	"sync"
 	"testing"
 	"time"
@@ -52,3 +54,59 @@ func TestTcpTransport(t *testing.T) {
 
 	require.NoError(t, serverTCPError)
 }
+
+func TestUnixTransport(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "tpm.sock")
+
+	// a socket left by a previous process is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var wg sync.WaitGroup
+	connectedEvent := make(chan struct{})
+
+	wg.Add(1)
+	var serverUnixError error
+	go func() {
+		defer wg.Done()
+		serverUnixError = transport.ServeUnixWithMode(ctx, path, 0660, func(c net.Conn) {
+			close(connectedEvent)
+		}, nil)
+	}()
+
+	require.Eventually(t, func() bool {
+		info, err := os.Stat(path)
+		return err == nil && info.Mode().Perm() == 0660
+	}, time.Second, 10*time.Millisecond)
+
+	c, err := net.Dial("unix", path)
+	require.NoError(t, err)
+	require.NotNil(t, c)
+	defer func() {
+		require.NoError(t, c.Close())
+	}()
+
+	var obtainedConnection bool
+	select {
+	case <-connectedEvent:
+		obtainedConnection = true
+	case <-time.After(time.Second):
+	}
+	require.True(t, obtainedConnection)
+
+	cancel()
+	wg.Wait()
+
+	require.NoError(t, serverUnixError)
+	_, err = os.Stat(path)
+	require.True(t, os.IsNotExist(err))
+
+	// other files are not replaced
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	require.Error(t, transport.ServeUnix(context.Background(), path, func(c net.Conn) {}, nil))
+}
@@ -0,0 +1,59 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/rihter007/logruswrap"
+)
+
+// DefaultUnixSocketMode allows only the owner of the process to connect to a socket
+const DefaultUnixSocketMode os.FileMode = 0600
+
+// ServeUnix launches software TPM on a unix domain socket with DefaultUnixSocketMode permissions
+func ServeUnix(ctx context.Context, path string, handleConnection func(c net.Conn), l logruswrap.PrintfLogger) error {
+	return ServeUnixWithMode(ctx, path, DefaultUnixSocketMode, handleConnection, l)
+}
+
+// ServeUnixWithMode launches software TPM on a unix domain socket with given permissions,
+// a stale socket file is replaced and the socket file is removed when serving is finished
+func ServeUnixWithMode(ctx context.Context, path string, mode os.FileMode, handleConnection func(c net.Conn), l logruswrap.PrintfLogger) error {
+	if handleConnection == nil {
+		panic("handleConnection should not be nil")
+	}
+	if err := removeStaleSocket(path); err != nil {
+		return err
+	}
+
+	lc := net.ListenConfig{}
+	listener, err := lc.Listen(ctx, "unix", path)
+	if err != nil {
+		return fmt.Errorf("failed to start listening on %s, err: %v", path, err)
+	}
+	// the socket file is removed by the listener on close
+	if err := os.Chmod(path, mode); err != nil {
+		_ = listener.Close()
+		return fmt.Errorf("failed to change permissions of %s, err: %v", path, err)
+	}
+	return serve(ctx, listener, path, handleConnection, l)
+}
+
+// removeStaleSocket removes a socket file that was left by a previous process, other files are not touched
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check %s, err: %v", path, err)
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("%s exists and is not a socket", path)
+	}
+	if err := os.Remove(path); err != nil {
+		return fmt.Errorf("failed to remove stale socket %s, err: %v", path, err)
+	}
+	return nil
+}